@@ -17,14 +17,21 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
+
+	"github.com/google/git-pull-request-mirror/auth"
+	"github.com/google/git-pull-request-mirror/store"
 )
 
 // Code for the web control panel
@@ -34,27 +41,145 @@ const (
 	idRepoName = "repoName"
 	// idRepoToken is the id used in an http form for a github API key
 	idRepoToken = "repoToken"
+	// idHookEvents is the id used in an http form for the events that a
+	// repository's web hook delivers
+	idHookEvents = "hookEvents"
+	// idPullRequestState is the id used in an http form for the state of the
+	// pull requests that are mirrored
+	idPullRequestState = "prState"
+	// idImportWindow is the id used in an http form for the number of days of
+	// pull requests that are mirrored when a repository is initialized
+	idImportWindow = "importWindow"
+	// idOrgName is the id used in an http form for a GitHub organization (or
+	// user)
+	idOrgName = "orgName"
+
+	// defaultPageSize and maxPageSize bound the number of repos listed on
+	// each page of the configuration page.
+	defaultPageSize = 50
+	maxPageSize     = 500
 )
 
+// repoStatuses are the statuses that the repo list can be filtered by.
+var repoStatuses = []string{
+	statusValidating,
+	statusHooksInitializing,
+	statusInitializing,
+	statusReady,
+	statusError,
+	statusPaused,
+}
+
 var configTemplate = template.Must(template.ParseFiles("index.html"))
 
+var errorsTemplate = template.Must(template.ParseFiles("errors.html"))
+
 // renderRepo represents a single repository to be rendered on the page
 type renderRepo struct {
-	Name       string
-	Status     string
-	ErrorCause string
+	Name        string
+	Status      string
+	ErrorCause  string
+	ErrorCount  int
+	LastSynced  string
+	PRCount     int
+	StatusCount int
+	Events      string
+
+	// ImportWindowDays is 0 unless only the recently updated pull requests
+	// were imported.
+	ImportWindowDays int
+
+	// HookUnverified is set if the repo's web hook was pinged, but the ping
+	// was never delivered.
+	HookUnverified bool
+
+	// RateReset is empty if the API quota is unknown.
+	RateRemaining int
+	RateReset     string
 }
 
 // renderConfig is the top-level struct passed to rendering
 type renderConfig struct {
 	Repos []renderRepo
+
+	// Status is the status that the repos are filtered by, if any, and
+	// Statuses are all of the statuses that they can be filtered by.
+	Status   string
+	Statuses []string
+
+	// NextPage is the URL of the next page of repos, or empty if this is
+	// the last page.
+	NextPage template.URL
+
+	// HookEvents are the events that a repo's web hook can be configured
+	// to deliver.
+	HookEvents []string
+
+	// OrgDefaults are the organizations that have a default token. The
+	// tokens themselves are never rendered.
+	OrgDefaults []string
+}
+
+// listOptions are the query parameters that select which repos are listed on
+// the configuration page.
+type listOptions struct {
+	// Page is the datastore cursor of the page, or empty for the first one.
+	Page   string
+	Limit  int
+	Status string
+}
+
+// parseListOptions reads the "page", "limit", and "status" query parameters.
+func parseListOptions(query url.Values) (listOptions, error) {
+	opts := listOptions{
+		Page:   query.Get("page"),
+		Limit:  defaultPageSize,
+		Status: query.Get("status"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return opts, fmt.Errorf("The limit must be a number between 1 and %d", maxPageSize)
+		}
+		opts.Limit = n
+	}
+	if opts.Status != "" {
+		valid := false
+		for _, status := range repoStatuses {
+			valid = valid || opts.Status == status
+		}
+		if !valid {
+			return opts, fmt.Errorf("Unknown status %q", opts.Status)
+		}
+	}
+	return opts, nil
+}
+
+// query returns the query string that selects the page at the given cursor,
+// keeping the rest of the options.
+func (opts listOptions) query(page string) string {
+	q := url.Values{}
+	q.Set("page", page)
+	if opts.Limit != defaultPageSize {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Status != "" {
+		q.Set("status", opts.Status)
+	}
+	return q.Encode()
 }
 
 // configHandler renders a configuration page
 func configHandler(w http.ResponseWriter, req *http.Request) {
 	ctx := appengine.NewContext(req)
 
-	repos, err := getAllRepoData(appengine.NewContext(req))
+	opts, err := parseListOptions(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repos, nextPage, err := getRepoDataPage(ctx, opts.Status, opts.Limit, opts.Page)
 
 	if err != nil {
 		log.Errorf(ctx, "Error fetching repos: %s", err.Error())
@@ -62,19 +187,112 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	conf := renderConfig{}
+	conf := renderConfig{
+		Status:     opts.Status,
+		Statuses:   repoStatuses,
+		HookEvents: store.DefaultHookEvents,
+	}
+	if nextPage != "" {
+		conf.NextPage = template.URL("/?" + opts.query(nextPage))
+	}
 
+	orgDefaults, err := getAllOrgDefaults(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Error fetching organization defaults: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, defaults := range orgDefaults {
+		conf.OrgDefaults = append(conf.OrgDefaults, defaults.Org)
+	}
+
+	now := time.Now()
 	for _, repo := range repos {
 		conf.Repos = append(conf.Repos, renderRepo{
-			Name:       fmt.Sprintf("%s/%s", repo.User, repo.Repo),
-			Status:     repo.Status,
-			ErrorCause: repo.ErrorCause,
+			Name:        fmt.Sprintf("%s/%s", repo.User, repo.Repo),
+			Status:      repo.Status,
+			ErrorCause:  repo.ErrorCause,
+			ErrorCount:  len(repo.ErrorHistory()),
+			LastSynced:  formatSyncAge(now, repo.LastSyncedAt),
+			PRCount:     repo.LastPRCount,
+			StatusCount: repo.LastStatusCount,
+			Events:      strings.Join(repo.SubscribedEvents()[1:], ", "),
+
+			ImportWindowDays: repo.ImportWindowDays,
+			HookUnverified:   repo.HookUnverified(now),
 		})
+		if !repo.RateReset.IsZero() {
+			r := &conf.Repos[len(conf.Repos)-1]
+			r.RateRemaining = repo.RateRemaining
+			r.RateReset = repo.RateReset.Format(time.RFC3339)
+		}
 	}
 
 	configTemplate.Execute(w, &conf)
 }
 
+// renderErrors is passed to the rendering of a single repository's error
+// history.
+type renderErrors struct {
+	Name   string
+	Errors []renderError
+}
+
+// renderError represents a single error in a repository's history.
+type renderError struct {
+	Time  string
+	Cause string
+}
+
+// errorsHandler renders the error history of the repository named by the
+// repoName query parameter.
+func errorsHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	fullRepoName := req.URL.Query().Get(idRepoName)
+	splitName := strings.Split(fullRepoName, "/")
+	if len(splitName) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid repository name (can't split on '/'): %s", fullRepoName), http.StatusBadRequest)
+		return
+	}
+
+	repo, err := getRepoData(ctx, splitName[0], splitName[1])
+	if err != nil {
+		log.Errorf(ctx, "Error fetching repo %s: %s", fullRepoName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := renderErrors{Name: fullRepoName}
+	for _, e := range repo.ErrorHistory() {
+		page.Errors = append(page.Errors, renderError{
+			Time:  e.Time.Format(time.RFC3339),
+			Cause: e.Cause,
+		})
+	}
+
+	errorsTemplate.Execute(w, &page)
+}
+
+// formatSyncAge describes how long ago the given sync time was, e.g. "5m ago",
+// or returns the empty string if the repo has never been synced.
+func formatSyncAge(now, syncedAt time.Time) string {
+	if syncedAt.IsZero() {
+		return ""
+	}
+	age := now.Sub(syncedAt)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age/time.Minute))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(age/(24*time.Hour)))
+	}
+}
+
 // addHandler handles POSTs to the /add endpoint
 func addHandler(w http.ResponseWriter, req *http.Request) {
 	defer http.Redirect(w, req, "/", http.StatusSeeOther)
@@ -97,11 +315,8 @@ func addHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// An empty token means that the organization's default token is used.
 	repoToken := req.PostForm.Get(idRepoToken)
-	if repoToken == "" {
-		log.Errorf(ctx, "No repoToken for /add endpoint: %v", req.PostForm)
-		return
-	}
 
 	splitName := strings.Split(repoName, "/")
 	if len(splitName) != 2 {
@@ -109,10 +324,40 @@ func addHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	events := req.PostForm[idHookEvents]
+	if len(events) > 0 {
+		if err := store.CheckHookEvents(events); err != nil {
+			log.Errorf(ctx, "Invalid web hook events for %s: %s", repoName, err.Error())
+			return
+		}
+	}
+
+	prState := req.PostForm.Get(idPullRequestState)
+	switch prState {
+	case "", "open", "closed", "all":
+	default:
+		log.Errorf(ctx, "Invalid pull request state for %s: %q", repoName, prState)
+		return
+	}
+
+	var importWindowDays int
+	if window := req.PostForm.Get(idImportWindow); window != "" {
+		importWindowDays, err = strconv.Atoi(window)
+		if err != nil || importWindowDays < 0 {
+			log.Errorf(ctx, "Invalid import window for %s: %q", repoName, window)
+			return
+		}
+	}
+
 	log.Infof(ctx, "Adding repository %s", repoName)
 
-	err = initRepoData(ctx, splitName[0], splitName[1], repoToken)
+	err = initRepoData(ctx, splitName[0], splitName[1], repoToken, events, prState, importWindowDays)
 
+	var existsErr *repoExistsError
+	if errors.As(err, &existsErr) {
+		log.Errorf(ctx, "Couldn't store repository %s: %s; use \"Update token\" to change its token", repoName, err.Error())
+		return
+	}
 	if err != nil {
 		log.Errorf(ctx, "Couldn't store repository %s: %s", repoName, err.Error())
 		return
@@ -121,6 +366,38 @@ func addHandler(w http.ResponseWriter, req *http.Request) {
 	validate(ctx, splitName[0], splitName[1])
 }
 
+// validateHandler handles POSTs to the /validate endpoint, which checks that a
+// token can be used to mirror a repository without starting to mirror it.
+func validateHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /validate endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't parse form for /validate endpoint: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	repoName := req.PostForm.Get(idRepoName)
+	repoToken := req.PostForm.Get(idRepoToken)
+	splitName := strings.Split(repoName, "/")
+	if len(splitName) != 2 || repoToken == "" {
+		http.Error(w, "A repository name of the form user/repo and an access token are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := checkToken(ctx, repoToken, splitName[0], splitName[1]); err != nil {
+		log.Infof(ctx, "Token check for %s failed: %s", repoName, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "The token can be used to mirror %s", repoName)
+}
+
 // deleteHandler handles POSTS to the /delete endpoint
 func deleteHandler(w http.ResponseWriter, req *http.Request) {
 	defer http.Redirect(w, req, "/", http.StatusSeeOther)
@@ -152,6 +429,262 @@ func deleteHandler(w http.ResponseWriter, req *http.Request) {
 	deactivate(ctx, splitName[0], splitName[1])
 }
 
+// resyncHandler handles POSTs to the /resync endpoint
+func resyncHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		log.Errorf(ctx, "Incorrect method for /resync endpoint: %s", req.Method)
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		log.Errorf(ctx, "Couldn't parse form for /resync endpoint: %s", err.Error())
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	fullRepoName := req.PostForm.Get(idRepoName)
+	if fullRepoName == "" {
+		log.Errorf(ctx, "No repoName for /resync endpoint: %v", req.PostForm)
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	splitName := strings.Split(fullRepoName, "/")
+	if len(splitName) != 2 {
+		log.Errorf(ctx, "Invalid repository name (can't split on '/'): %s", fullRepoName)
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	started, err := transitionRepoStatus(ctx, splitName[0], splitName[1], statusReady, statusInitializing)
+	if err != nil {
+		log.Errorf(ctx, "Couldn't start resync of %s: %s", fullRepoName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		http.Error(w, fmt.Sprintf("Repository %s can only be resynced once it is %q; please wait for the current operation to finish.",
+			fullRepoName, statusReady), http.StatusConflict)
+		return
+	}
+
+	log.Infof(ctx, "Resyncing repository %s", fullRepoName)
+	resync(ctx, splitName[0], splitName[1])
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// pauseHandler handles POSTs to the /pause endpoint, which stops mirroring a
+// repo until it is resumed, while keeping its web hook and its data.
+func pauseHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /pause endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fullRepoName := req.PostForm.Get(idRepoName)
+	splitName := strings.Split(fullRepoName, "/")
+	if len(splitName) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid repository name (can't split on '/'): %s", fullRepoName), http.StatusBadRequest)
+		return
+	}
+
+	paused, err := transitionRepoStatus(ctx, splitName[0], splitName[1], statusReady, statusPaused)
+	if err != nil {
+		log.Errorf(ctx, "Couldn't pause %s: %s", fullRepoName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !paused {
+		http.Error(w, fmt.Sprintf("Repository %s can only be paused once it is %q; please wait for the current operation to finish.",
+			fullRepoName, statusReady), http.StatusConflict)
+		return
+	}
+
+	log.Infof(ctx, "Paused repository %s", fullRepoName)
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// resumeHandler handles POSTs to the /resume endpoint, which resumes mirroring
+// a paused repo, starting with a resync to catch up on what was missed.
+func resumeHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /resume endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fullRepoName := req.PostForm.Get(idRepoName)
+	splitName := strings.Split(fullRepoName, "/")
+	if len(splitName) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid repository name (can't split on '/'): %s", fullRepoName), http.StatusBadRequest)
+		return
+	}
+
+	resumed, err := transitionRepoStatus(ctx, splitName[0], splitName[1], statusPaused, statusInitializing)
+	if err != nil {
+		log.Errorf(ctx, "Couldn't resume %s: %s", fullRepoName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !resumed {
+		http.Error(w, fmt.Sprintf("Repository %s is not %q.", fullRepoName, statusPaused), http.StatusConflict)
+		return
+	}
+
+	// The resync moves the repo back to ready once it has caught up.
+	log.Infof(ctx, "Resuming repository %s", fullRepoName)
+	resync(ctx, splitName[0], splitName[1])
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// rotateSecretHandler handles POSTs to the /rotateSecret endpoint
+func rotateSecretHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /rotateSecret endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fullRepoName := req.PostForm.Get(idRepoName)
+	splitName := strings.Split(fullRepoName, "/")
+	if len(splitName) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid repository name (can't split on '/'): %s", fullRepoName), http.StatusBadRequest)
+		return
+	}
+
+	if err := rotateHookSecret(ctx, splitName[0], splitName[1]); err != nil {
+		log.Errorf(ctx, "Couldn't rotate the secret of %s: %s", fullRepoName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// orgDefaultsHandler handles POSTs to the /orgDefaults endpoint, which sets the
+// default token of an organization, or clears it if the token is empty.
+func orgDefaultsHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /orgDefaults endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orgName := req.PostForm.Get(idOrgName)
+	if orgName == "" || strings.Contains(orgName, "/") {
+		http.Error(w, fmt.Sprintf("Invalid organization name: %q", orgName), http.StatusBadRequest)
+		return
+	}
+
+	if err := setOrgDefaultToken(ctx, orgName, req.PostForm.Get(idRepoToken)); err != nil {
+		log.Errorf(ctx, "Couldn't update the default token of %s: %s", orgName, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// updateTokenHandler handles POSTs to the /updateToken endpoint, which replaces
+// the token of a repo that is already being mirrored.
+func updateTokenHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /updateToken endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repoName := req.PostForm.Get(idRepoName)
+	repoToken := req.PostForm.Get(idRepoToken)
+	splitName := strings.Split(repoName, "/")
+	if len(splitName) != 2 || repoToken == "" {
+		http.Error(w, "A repository name of the form user/repo and an access token are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := updateRepoToken(ctx, splitName[0], splitName[1], repoToken); err != nil {
+		log.Errorf(ctx, "Couldn't update the token of %s: %s", repoName, err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// updateEventsHandler handles POSTs to the /updateEvents endpoint, which changes
+// the events that the web hook of a repo that is already being mirrored delivers.
+func updateEventsHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+
+	if req.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Incorrect method for /updateEvents endpoint: %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repoName := req.PostForm.Get(idRepoName)
+	splitName := strings.Split(repoName, "/")
+	if len(splitName) != 2 {
+		http.Error(w, fmt.Sprintf("Invalid repository name (can't split on '/'): %s", repoName), http.StatusBadRequest)
+		return
+	}
+
+	if err := updateHookEvents(ctx, splitName[0], splitName[1], req.PostForm[idHookEvents]); err != nil {
+		log.Errorf(ctx, "Couldn't update the web hook events of %s: %s", repoName, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// healthzHandler reports whether the service is able to reach the datastore.
+// It does not require a login, so that it can be used by uptime checks.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := appengine.NewContext(req)
+	if err := pingStorage(ctx); err != nil {
+		log.Errorf(ctx, "Health check failed: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
 func restartOperationsHandler(w http.ResponseWriter, req *http.Request) {
 	ctx := appengine.NewContext(req)
 	restartAbandonedOperations(ctx)
@@ -186,11 +719,26 @@ func enforceLoginHandler(next http.Handler) http.Handler {
 func setupHandlers() {
 	http.Handle("/add", enforceLoginHandler(http.HandlerFunc(addHandler)))
 	http.Handle("/delete", enforceLoginHandler(http.HandlerFunc(deleteHandler)))
+	http.Handle("/validate", enforceLoginHandler(http.HandlerFunc(validateHandler)))
+	http.Handle("/resync", enforceLoginHandler(http.HandlerFunc(resyncHandler)))
+	http.Handle("/pause", enforceLoginHandler(http.HandlerFunc(pauseHandler)))
+	http.Handle("/resume", enforceLoginHandler(http.HandlerFunc(resumeHandler)))
+	http.Handle("/errors", enforceLoginHandler(http.HandlerFunc(errorsHandler)))
+	http.Handle("/rotateSecret", enforceLoginHandler(http.HandlerFunc(rotateSecretHandler)))
+	http.Handle("/updateToken", enforceLoginHandler(http.HandlerFunc(updateTokenHandler)))
+	http.Handle("/orgDefaults", enforceLoginHandler(http.HandlerFunc(orgDefaultsHandler)))
+	http.Handle("/updateEvents", enforceLoginHandler(http.HandlerFunc(updateEventsHandler)))
 	http.Handle("/restartOperations", http.HandlerFunc(restartOperationsHandler))
+	http.Handle("/healthz", http.HandlerFunc(healthzHandler))
 	http.Handle("/", enforceLoginHandler(http.HandlerFunc(configHandler)))
 }
 
 func main() {
+	timeout, err := auth.RequestTimeoutFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	auth.RequestTimeout = timeout
 	setupHandlers()
 	appengine.Main()
 }
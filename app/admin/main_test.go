@@ -0,0 +1,73 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFormatSyncAge(t *testing.T) {
+	now := time.Date(2016, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		syncedAt time.Time
+		expected string
+	}{
+		{time.Time{}, ""},
+		{now.Add(-10 * time.Second), "just now"},
+		{now.Add(-5 * time.Minute), "5m ago"},
+		{now.Add(-3*time.Hour - 20*time.Minute), "3h ago"},
+		{now.Add(-50 * time.Hour), "2d ago"},
+	} {
+		if got := formatSyncAge(now, tc.syncedAt); got != tc.expected {
+			t.Errorf("formatSyncAge(%v) = %q; expected %q", tc.syncedAt, got, tc.expected)
+		}
+	}
+}
+
+func TestParseListOptions(t *testing.T) {
+	opts, err := parseListOptions(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts != (listOptions{Limit: defaultPageSize}) {
+		t.Errorf("Unexpected default options %+v", opts)
+	}
+
+	opts, err = parseListOptions(url.Values{"page": {"abc"}, "limit": {"10"}, "status": {statusError}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts != (listOptions{Page: "abc", Limit: 10, Status: statusError}) {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	if q := opts.query("def"); q != "limit=10&page=def&status=Error" {
+		t.Errorf("Unexpected query for the next page %q", q)
+	}
+
+	for _, invalid := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"many"}},
+		{"limit": {"100000"}},
+		{"status": {"Broken"}},
+	} {
+		if _, err := parseListOptions(invalid); err == nil {
+			t.Errorf("Expected an error for %v", invalid)
+		}
+	}
+}
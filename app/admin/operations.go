@@ -22,36 +22,46 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/git-pull-request-mirror/auth"
+	"github.com/google/git-pull-request-mirror/githubops"
+	"github.com/google/git-pull-request-mirror/oplog"
+	"github.com/google/git-pull-request-mirror/store"
 	"github.com/google/go-github/github"
-	"golang.org/x/oauth2"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
 )
 
 const (
-	maxRetries   = 200
-	scopesHeader = "X-OAuth-Scopes"
-	secretSize   = 64
+	maxRetries = 200
+	secretSize = 64
+
+	// webhookBaseURLEnv names the environment variable that overrides the
+	// base URL of the hooks service.
+	webhookBaseURLEnv = "MIRROR_WEBHOOK_BASE_URL"
 
 	githubEventHeader     = "X-Github-Event"
 	githubSignatureHeader = "X-Hub-Signature"
 
-	eventPing         = "ping"
-	eventStatus       = "status"
-	eventPullRequest  = "pull_request"
-	eventDiffComment  = "pull_request_review_comment"
-	eventIssueComment = "issue_comment"
+	eventPing = "ping"
 )
 
 var errTooManyRetries = errors.New("Too many retries!")
 
-// retry reduces github api-retrying boilerplate for when we run out of requests.
-// It will call the given function until it succeeds or errors out, or until it
-// has retried more than $maxRetries times.
+// githubClients holds the GitHub clients of the repos, so the operations on a
+// repo share one client until its token is updated.
+var githubClients auth.ClientCache
+
+// retry reduces github api-retrying boilerplate for when we run out of requests,
+// or a request times out. It will call the given function until it succeeds or
+// errors out, or until it has retried more than $maxRetries times.
 // Use like so:
 //
 //	var zen string
@@ -74,6 +84,12 @@ func retry(ctx context.Context, f func() (*github.Response, error)) error {
 			time.Sleep(waitDuration)
 			continue
 		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+			// The request stalled, e.g. on a dropped connection.
+			log.Infof(ctx, "Request to github timed out (%v); retrying", err)
+			continue
+		}
 		if err != nil {
 			// Error unrelated to timeout
 			return err
@@ -85,6 +101,14 @@ func retry(ctx context.Context, f func() (*github.Response, error)) error {
 	return errTooManyRetries
 }
 
+// isNotFound reports whether the given error is a 404 response from GitHub.
+func isNotFound(err error) bool {
+	var errResp *github.ErrorResponse
+	return errors.As(err, &errResp) &&
+		errResp.Response != nil &&
+		errResp.Response.StatusCode == http.StatusNotFound
+}
+
 // Each repository goes through the following lifecycle states:
 //
 //   [validating]
@@ -110,9 +134,10 @@ func retry(ctx context.Context, f func() (*github.Response, error)) error {
 
 // validate ensures that the repo is accessible
 func validate(ctx context.Context, user, repo string) {
-	log.Infof(ctx, "Validating repo %s/%s", user, repo)
+	logger := newOpLogger(ctx, "validate", user, repo)
+	logger.Infof("start", "Validating repo")
 
-	errorf := makeErrorf(ctx, user, repo)
+	errorf := makeErrorf(ctx, logger, user, repo)
 
 	repoData, err := getRepoData(ctx, user, repo)
 	if err != nil {
@@ -120,143 +145,132 @@ func validate(ctx context.Context, user, repo string) {
 		return
 	}
 
-	httpClient := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: repoData.Token},
-	))
+	sizeKB, err := checkToken(ctx, repoData.Token, user, repo)
+	if err != nil {
+		errorf("%s", err.Error())
+		return
+	}
 
-	githubClient := github.NewClient(httpClient)
+	logger.Done()
 
-	var resp *github.Response
-	err = retry(ctx, func() (*github.Response, error) {
-		// APIMeta will always succeed and will tell us what scopes
-		// we have.
-		_, resp, err = githubClient.APIMeta(ctx)
-		return resp, err
+	err = modifyRepoData(ctx, user, repo, func(item *repoStorageData) {
+		item.Status = statusHooksInitializing
+		item.SizeKB = sizeKB
 	})
 
 	if err != nil {
-		errorf("Can't validate repo %s/%s: %s", user, repo, err.Error())
-		return
+		errorf("Can't change repo status: %s", err.Error())
 	}
 
-	scopesHeader := resp.Header["X-Oauth-Scopes"]
+	createHooks(ctx, user, repo)
+}
 
-	if len(scopesHeader) == 0 {
-		// No scopes means that a token has access to all *public* repositories.
-		// It's simplest to just require private access.
-		errorf("Invalid token, missing scopes: `repo`, `write:repo_hook`")
-		return
+// updateRepoToken replaces the token of a tracked repo, and then validates it
+// again, keeping the repo's web hook and the notes mirrored so far.
+func updateRepoToken(ctx context.Context, user, repo, token string) error {
+	updated := false
+	err := modifyRepoData(ctx, user, repo, func(item *repoStorageData) {
+		updated = item.UpdateToken(token)
+	})
+	if err != nil {
+		return fmt.Errorf("can't update the token: %v", err)
 	}
-
-	// The token has scopes.
-	// Let's make sure it has all the ones we need enabled.
-	// Note that strictly speaking, we need the repo, public_repo,
-	// write:repo_hook, and repo:status scopes, but repo and
-	// write:repo_hook subsume the others.
-
-	// Necessary because github makes things comma-delimited instead
-	// of semicolon-delimited for some reason.
-	scopes := strings.Split(scopesHeader[0], ", ")
-
-	var hasRepo bool
-	var hasWriteRepoHook bool
-	for _, scope := range scopes {
-		switch scope {
-		case "repo":
-			hasRepo = true
-		case "admin:repo_hook":
-			hasWriteRepoHook = true
-		case "write:repo_hook":
-			hasWriteRepoHook = true
-		}
+	if !updated {
+		return fmt.Errorf("the token of %s/%s can only be updated once it is %q or %q; please wait for the current operation to finish",
+			user, repo, statusReady, statusError)
 	}
 
-	if !hasRepo || !hasWriteRepoHook {
-		var missingScopes string
-		if !hasRepo && !hasWriteRepoHook {
-			missingScopes = "repo, write:repo_hook"
-		} else if !hasRepo {
-			missingScopes = "repo"
-		} else {
-			missingScopes = "write:repo_hook"
-		}
-		errorf("Invalid token for %s/%s, missing scopes: %s... had: %v",
-			user,
-			repo,
-			missingScopes,
-			scopes)
-		return
-	}
+	log.Infof(ctx, "Updated the token of repo %s/%s", user, repo)
+	validate(ctx, user, repo)
+	return nil
+}
 
-	log.Infof(ctx, "Validated repo %s/%s", user, repo)
+// checkToken makes sure that the given token can be used to mirror the repo,
+// without changing anything either on GitHub or in the datastore, and returns
+// the size of the repo in kilobytes.
+func checkToken(ctx context.Context, token, user, repo string) (int, error) {
+	githubClient, err := auth.NewClient(ctx, token)
+	if err != nil {
+		return 0, err
+	}
 
+	var ghRepo *github.Repository
 	err = retry(ctx, func() (resp *github.Response, err error) {
-		_, resp, err = githubClient.Repositories.Get(ctx, user, repo)
+		ghRepo, resp, err = githubClient.Repositories.Get(ctx, user, repo)
 		return
 	})
 
+	if isNotFound(err) {
+		// GitHub also responds with a 404 for private repositories that the
+		// token can't see, so we can't tell those two cases apart.
+		return 0, fmt.Errorf("Repository %s/%s not found or token lacks access", user, repo)
+	}
 	if err != nil {
-		errorf("Can't validate repo %s/%s: %s", user, repo, err.Error())
+		return 0, fmt.Errorf("Can't validate repo %s/%s: %s", user, repo, err.Error())
 	}
 
-	err = modifyRepoData(ctx, user, repo, func(item *repoStorageData) {
-		item.Status = statusHooksInitializing
+	var resp *github.Response
+	err = retry(ctx, func() (*github.Response, error) {
+		// APIMeta will always succeed and will tell us what scopes
+		// we have.
+		_, resp, err = githubClient.APIMeta(ctx)
+		return resp, err
 	})
 
 	if err != nil {
-		errorf("Can't change repo status: %s", err.Error())
+		return 0, fmt.Errorf("Can't validate repo %s/%s: %s", user, repo, err.Error())
 	}
 
-	createHooks(ctx, user, repo)
+	retrier := func(request func() (*github.Response, error)) error {
+		return retry(ctx, request)
+	}
+	if err := githubops.CheckAccess(ctx, resp, githubClient.Repositories, retrier, user, repo); err != nil {
+		return 0, fmt.Errorf("Invalid token for %s/%s, %s", user, repo, err.Error())
+	}
+	return ghRepo.GetSize(), nil
 }
 
 // hook sets up webhooks for a given repository
 func createHooks(ctx context.Context, userName, repoName string) {
-	errorf := makeErrorf(ctx, userName, repoName)
+	logger := newOpLogger(ctx, "createHooks", userName, repoName)
+	errorf := makeErrorf(ctx, logger, userName, repoName)
 	repoData, err := getRepoData(ctx, userName, repoName)
 	if err != nil {
 		errorf("Can't load repo to hook: %s", err.Error())
 		return
 	}
 
-	client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: repoData.Token},
-	)))
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
 
 	active := true
 
-	secret := make([]byte, secretSize)
-	_, err = rand.Read(secret)
+	secretHex, err := newHookSecret()
 	if err != nil {
 		errorf("Can't create secret key: %s", err.Error())
 		return
 	}
-	secretHex := hex.EncodeToString(secret)
-
-	// TODO allow non-appspot urls?
-	url := fmt.Sprintf("https://github-mirror-dot-%s.appspot.com/hook/%s/%s", appengine.AppID(ctx), userName, repoName)
-
-	log.Infof(ctx, "Creating hook for %s/%s: url `%s`", userName, repoName, url)
 
-	var hook *github.Hook
-	err = retry(ctx, func() (resp *github.Response, err error) {
-		hook, resp, err = client.Repositories.CreateHook(ctx, userName, repoName, &github.Hook{
-			Events: []string{
-				eventPing,
-				eventStatus,
-				eventPullRequest,
-				eventDiffComment,
-				eventIssueComment,
-			},
-			Active: &active,
-			Config: map[string]interface{}{
-				"url":          url,
-				"content_type": "json",
-				"secret":       secretHex,
-				"insecure_ssl": false,
-			},
-		})
+	url, err := makeHookURL(os.Getenv(webhookBaseURLEnv), appengine.AppID(ctx), userName, repoName)
+	if err != nil {
+		errorf("Can't build hook URL: %s", err.Error())
 		return
+	}
+
+	logger.Infof("create", "Creating hook: url `%s`", url)
+
+	hook, created, err := upsertHook(ctx, client.Repositories, userName, repoName, &github.Hook{
+		Events: repoData.SubscribedEvents(),
+		Active: &active,
+		Config: map[string]interface{}{
+			"url":          url,
+			"content_type": "json",
+			"secret":       secretHex,
+			"insecure_ssl": false,
+		},
 	})
 	if err != nil {
 		errorf("Can't create hook: %s", err.Error())
@@ -268,11 +282,14 @@ func createHooks(ctx context.Context, userName, repoName string) {
 		return
 	}
 
-	log.Infof(ctx, "Hook creation for %s/%s successful", userName, repoName)
+	logger.Infof("created", "Hook creation successful")
 
 	err = modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
 		item.HookSecret = secretHex
 		item.HookID = *hook.ID
+		item.HookHealthy = true
+		item.HookCheckedAt = time.Now()
+		item.HookPingRequestedAt = time.Now()
 	})
 
 	if err != nil {
@@ -280,12 +297,241 @@ func createHooks(ctx context.Context, userName, repoName string) {
 		return
 	}
 
-	log.Infof(ctx, "Repo waiting for hook ping: %s/%s", userName, repoName)
+	if err := requestHookPing(ctx, client.Repositories, userName, repoName, *hook.ID, created); err != nil {
+		errorf("Can't ping hook: %s", err.Error())
+		return
+	}
+
+	logger.Infof("ping", "Repo waiting for hook ping")
+	logger.Done()
+}
+
+// requestHookPing makes GitHub deliver a "ping" event to the given web hook,
+// which confirms that the hook reaches the hooks service.
+//
+// GitHub only sends the "ping" event on its own when a hook is first created,
+// so it is only explicitly requested for a reused hook; pinging a new hook too
+// would have the repo initialized twice.
+func requestHookPing(ctx context.Context, hooks hooksService, userName, repoName string, hookID int64, created bool) error {
+	if created {
+		return nil
+	}
+	return retry(ctx, func() (*github.Response, error) {
+		return hooks.PingHook(ctx, userName, repoName, hookID)
+	})
+}
+
+// newHookSecret returns a random, hex-encoded secret for signing web hooks.
+func newHookSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// rotateHookSecret replaces the secret of a repository's web hook with a fresh
+// one, both on GitHub and in the datastore.
+//
+// The new secret is stored first, and the previous one is still accepted by the
+// hooks service for a grace period, so that no deliveries are rejected while
+// the change takes effect on GitHub. If the secret can't be changed on GitHub,
+// then the stored secret is reverted.
+func rotateHookSecret(ctx context.Context, userName, repoName string) error {
+	repoData, err := getRepoData(ctx, userName, repoName)
+	if err != nil {
+		return fmt.Errorf("can't load repo: %v", err)
+	}
+	if repoData.HookID == 0 {
+		return fmt.Errorf("%s/%s has no web hook", userName, repoName)
+	}
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		return fmt.Errorf("can't create the GitHub client: %v", err)
+	}
+
+	secretHex, err := newHookSecret()
+	if err != nil {
+		return fmt.Errorf("can't create secret key: %v", err)
+	}
+
+	err = modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+		item.RotateHookSecret(secretHex, time.Now())
+	})
+	if err != nil {
+		return fmt.Errorf("can't store the new secret: %v", err)
+	}
+
+	if err := setHookSecret(ctx, client.Repositories, userName, repoName, repoData.HookID, secretHex); err != nil {
+		revertErr := modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+			if item.HookSecret == secretHex {
+				item.RevertHookSecret()
+			}
+		})
+		if revertErr != nil {
+			log.Errorf(ctx, "Can't revert the secret of %s/%s: %s", userName, repoName, revertErr.Error())
+		}
+		return fmt.Errorf("can't set the new secret on GitHub: %v", err)
+	}
+
+	log.Infof(ctx, "Rotated the web hook secret of %s/%s", userName, repoName)
+	return nil
+}
+
+// setHookSecret changes the secret of the given web hook, leaving the rest of its
+// configuration as is.
+func setHookSecret(ctx context.Context, hooks hooksService, userName, repoName string, hookID int64, secret string) error {
+	var hook *github.Hook
+	err := retry(ctx, func() (resp *github.Response, err error) {
+		hook, resp, err = hooks.GetHook(ctx, userName, repoName, hookID)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	// GitHub replaces the whole configuration of an edited hook.
+	config := make(map[string]interface{})
+	for key, value := range hook.Config {
+		config[key] = value
+	}
+	config["secret"] = secret
+	return retry(ctx, func() (resp *github.Response, err error) {
+		_, resp, err = hooks.EditHook(ctx, userName, repoName, hookID, &github.Hook{Config: config})
+		return
+	})
+}
+
+// updateHookEvents changes the GitHub events that a tracked repo's web hook
+// delivers, editing the existing hook in place.
+func updateHookEvents(ctx context.Context, userName, repoName string, events []string) error {
+	if err := store.CheckHookEvents(events); err != nil {
+		return err
+	}
+
+	var repoData repoStorageData
+	err := modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+		item.HookEvents = events
+		repoData = *item
+	})
+	if err != nil {
+		return fmt.Errorf("can't store the web hook events: %v", err)
+	}
+	if repoData.HookID == 0 {
+		// The events are used once the hook is created.
+		return nil
+	}
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		return fmt.Errorf("can't create the GitHub client: %v", err)
+	}
+	if err := setHookEvents(ctx, client.Repositories, userName, repoName, repoData.HookID, repoData.SubscribedEvents()); err != nil {
+		return fmt.Errorf("can't set the web hook events on GitHub: %v", err)
+	}
+
+	log.Infof(ctx, "Updated the web hook events of %s/%s to %v", userName, repoName, events)
+	return nil
+}
+
+// setHookEvents replaces the events that the given web hook delivers, leaving
+// the rest of its configuration as is.
+func setHookEvents(ctx context.Context, hooks hooksService, userName, repoName string, hookID int64, events []string) error {
+	return retry(ctx, func() (resp *github.Response, err error) {
+		_, resp, err = hooks.EditHook(ctx, userName, repoName, hookID, &github.Hook{Events: events})
+		return
+	})
+}
+
+// makeHookURL returns the URL that GitHub should deliver web hooks for the
+// given repository to.
+//
+// The base URL defaults to the hooks service of the given App Engine app, but
+// can be overridden for deployments that are served from another domain.
+func makeHookURL(baseURL, appID, userName, repoName string) (string, error) {
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("https://github-mirror-dot-%s.appspot.com", appID)
+	}
+	parsed, err := neturl.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return "", fmt.Errorf("web hook base URL must be an absolute https URL: %q", baseURL)
+	}
+	return fmt.Sprintf("%s/hook/%s/%s", strings.TrimRight(baseURL, "/"), userName, repoName), nil
+}
+
+// hooksService can be stubbed out in testing; satisfied by github.Client.Repositories
+type hooksService interface {
+	GetHook(ctx context.Context, owner, repo string, id int64) (*github.Hook, *github.Response, error)
+	ListHooks(ctx context.Context, owner, repo string, opt *github.ListOptions) ([]*github.Hook, *github.Response, error)
+	CreateHook(ctx context.Context, owner, repo string, hook *github.Hook) (*github.Hook, *github.Response, error)
+	EditHook(ctx context.Context, owner, repo string, id int64, hook *github.Hook) (*github.Hook, *github.Response, error)
+	PingHook(ctx context.Context, owner, repo string, id int64) (*github.Response, error)
+}
+
+// findExistingHook returns the repository's webhook that delivers to the given url,
+// or nil if there is no such hook.
+func findExistingHook(ctx context.Context, hooks hooksService, userName, repoName, url string) (*github.Hook, error) {
+	listOpts := &github.ListOptions{PerPage: 100}
+	for {
+		var page []*github.Hook
+		var resp *github.Response
+		err := retry(ctx, func() (*github.Response, error) {
+			var err error
+			page, resp, err = hooks.ListHooks(ctx, userName, repoName, listOpts)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, hook := range page {
+			if hookURL, ok := hook.Config["url"].(string); ok && hookURL == url {
+				return hook, nil
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			return nil, nil
+		}
+		listOpts.Page = resp.NextPage
+	}
+}
+
+// upsertHook creates the given webhook, or, if a hook delivering to the same url
+// already exists (e.g. from an earlier, abandoned attempt), updates that hook in
+// place so that it uses the new secret. This keeps hook creation indempotent.
+//
+// The returned bool reports whether a new hook was created.
+func upsertHook(ctx context.Context, hooks hooksService, userName, repoName string, hook *github.Hook) (*github.Hook, bool, error) {
+	url, _ := hook.Config["url"].(string)
+	existing, err := findExistingHook(ctx, hooks, userName, repoName, url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var result *github.Hook
+	if existing != nil && existing.ID != nil {
+		err = retry(ctx, func() (resp *github.Response, err error) {
+			result, resp, err = hooks.EditHook(ctx, userName, repoName, *existing.ID, hook)
+			return
+		})
+	} else {
+		err = retry(ctx, func() (resp *github.Response, err error) {
+			result, resp, err = hooks.CreateHook(ctx, userName, repoName, hook)
+			return
+		})
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return result, existing == nil, nil
 }
 
 // deactivate deletes webhooks and forgets data for a given repository
 func deactivate(ctx context.Context, userName, repoName string) {
-	errorf := makeErrorf(ctx, userName, repoName)
+	errorf := makeErrorf(ctx, newOpLogger(ctx, "deactivate", userName, repoName), userName, repoName)
 
 	repoData, err := getRepoData(ctx, userName, repoName)
 	if err != nil {
@@ -293,9 +539,11 @@ func deactivate(ctx context.Context, userName, repoName string) {
 		return
 	}
 
-	client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: repoData.Token},
-	)))
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
 
 	log.Infof(ctx, "Deleting hook for repository %s/%s", userName, repoName)
 	err = retry(ctx, func() (resp *github.Response, err error) {
@@ -317,9 +565,48 @@ func deactivate(ctx context.Context, userName, repoName string) {
 	}
 }
 
+// resync re-mirrors all of the data for a repository that is already set up.
+//
+// As with the initial mirroring, the work is done by the hooks service, which
+// we trigger by pinging the repository's existing web hook. The caller is
+// expected to have already moved the repo into the initializing state.
+func resync(ctx context.Context, userName, repoName string) {
+	errorf := makeErrorf(ctx, newOpLogger(ctx, "resync", userName, repoName), userName, repoName)
+
+	repoData, err := getRepoData(ctx, userName, repoName)
+	if err != nil {
+		errorf("Can't load repo to resync: %s", err.Error())
+		return
+	}
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
+
+	err = modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+		item.HookPingRequestedAt = time.Now()
+	})
+	if err != nil {
+		errorf("Can't record the hook ping: %s", err.Error())
+		return
+	}
+
+	err = requestHookPing(ctx, client.Repositories, userName, repoName, repoData.HookID, false)
+	if err != nil {
+		errorf("Can't ping hook: %s", err.Error())
+		return
+	}
+
+	log.Infof(ctx, "Repo waiting for hook ping: %s/%s", userName, repoName)
+}
+
 // restartAbandonedOperations runs when the web server starts.
 // It goes through the repos in the data store and checks their statuses.
-// If they're validating or initializing, those processes will restart.
+// If they're validating, or have been initializing for too long without any
+// progress, those processes will restart, and if they're ready, we check that
+// their web hooks still exist. Paused repos are left alone.
 // If they actually finished validating / initializing but didn't write
 // to the store that's fine, since all operations are indempotent; we
 // can redo it.
@@ -342,13 +629,17 @@ func restartAbandonedOperations(ctx context.Context) {
 			switch repo.Status {
 			case statusReady:
 				log.Infof(ctx, "Repo ready: %s/%s", repo.User, repo.Repo)
+				checkHook(ctx, repo)
 			case statusError:
 				log.Infof(ctx, "Repo errored out: %s/%s", repo.User, repo.Repo)
+			case statusPaused:
+				log.Infof(ctx, "Repo paused: %s/%s", repo.User, repo.Repo)
 			case statusValidating:
 				log.Infof(ctx, "Repo requires validation: %s/%s", repo.User, repo.Repo)
 				validate(ctx, repo.User, repo.Repo)
 			case statusInitializing:
 				log.Infof(ctx, "Repo requires initialization: %s/%s", repo.User, repo.Repo)
+				restartInitialization(ctx, repo.User, repo.Repo)
 			case statusHooksInitializing:
 				log.Infof(ctx, "Repo requires hook initialization: %s/%s", repo.User, repo.Repo)
 				createHooks(ctx, repo.User, repo.Repo)
@@ -361,11 +652,140 @@ func restartAbandonedOperations(ctx context.Context) {
 	wg.Wait()
 }
 
-// makeErrorf returns a utility function that logs a given error and then sets the repo's error information to that error
-func makeErrorf(ctx context.Context, userName, repoName string) func(string, ...interface{}) {
+// checkHook verifies that the web hook for a ready repo still exists.
+//
+// If the hook was deleted on GitHub, then the repo would silently stop being
+// updated, so we send it back through hook initialization to recreate it.
+func checkHook(ctx context.Context, repoData repoStorageData) {
+	userName, repoName := repoData.User, repoData.Repo
+	errorf := makeErrorf(ctx, newOpLogger(ctx, "checkHook", userName, repoName), userName, repoName)
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
+
+	exists, err := hookExists(ctx, client.Repositories, userName, repoName, repoData.HookID)
+	if err != nil {
+		// This could just be a transient failure, so leave the repo as is.
+		log.Errorf(ctx, "Can't check the hook for %s/%s: %s", userName, repoName, err.Error())
+		return
+	}
+
+	err = modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+		item.HookHealthy = exists
+		item.HookCheckedAt = time.Now()
+	})
+	if err != nil {
+		log.Errorf(ctx, "Can't record the hook status for %s/%s: %s", userName, repoName, err.Error())
+	}
+	if exists {
+		return
+	}
+
+	log.Infof(ctx, "Hook for %s/%s was deleted; recreating it", userName, repoName)
+	restarted, err := transitionRepoStatus(ctx, userName, repoName, statusReady, statusHooksInitializing)
+	if err != nil {
+		errorf("Can't change repo status: %s", err.Error())
+		return
+	}
+	if !restarted {
+		log.Infof(ctx, "Repo %s/%s is no longer ready; not recreating its hook", userName, repoName)
+		return
+	}
+	createHooks(ctx, userName, repoName)
+}
+
+// hookExists reports whether the web hook with the given ID still exists.
+func hookExists(ctx context.Context, hooks hooksService, userName, repoName string, hookID int64) (bool, error) {
+	err := retry(ctx, func() (resp *github.Response, err error) {
+		_, resp, err = hooks.GetHook(ctx, userName, repoName, hookID)
+		return
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// restartInitialization recovers a repo whose initial mirroring was abandoned.
+//
+// The mirroring itself is performed by the hooks service when it receives the
+// web hook "ping", so we request that ping again from the repo's existing hook,
+// keeping its secret. A repo whose mirroring has recorded a heartbeat, or been
+// requested, within store.InitializationStaleTimeout may still be mirrored by
+// the hooks service, so it is left alone, as is a repo that has since moved on.
+// The check and the recording of the new ping are transactional, so only one
+// caller restarts the repo.
+func restartInitialization(ctx context.Context, userName, repoName string) {
+	errorf := makeErrorf(ctx, newOpLogger(ctx, "restartInitialization", userName, repoName), userName, repoName)
+
+	now := time.Now()
+	restarted := false
+	var repoData repoStorageData
+	err := modifyRepoData(ctx, userName, repoName, func(item *repoStorageData) {
+		restarted = item.Status == statusInitializing && item.InitializationStale(now)
+		if restarted {
+			item.HookPingRequestedAt = now
+		}
+		repoData = *item
+	})
+	if err != nil {
+		errorf("Can't record the hook ping: %s", err.Error())
+		return
+	}
+	if !restarted {
+		log.Infof(ctx, "Repo %s/%s is no longer initializing, or may still be; not restarting", userName, repoName)
+		return
+	}
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
+
+	err = requestHookPing(ctx, client.Repositories, userName, repoName, repoData.HookID, false)
+	if isNotFound(err) {
+		// The hook was deleted, so it has to be created again.
+		log.Infof(ctx, "Hook for %s/%s was deleted; recreating it", userName, repoName)
+		recreate, err := transitionRepoStatus(ctx, userName, repoName, statusInitializing, statusHooksInitializing)
+		if err != nil {
+			errorf("Can't change repo status: %s", err.Error())
+			return
+		}
+		if recreate {
+			createHooks(ctx, userName, repoName)
+		}
+		return
+	}
+	if err != nil {
+		errorf("Can't ping hook: %s", err.Error())
+		return
+	}
+
+	log.Infof(ctx, "Repo waiting for hook ping: %s/%s", userName, repoName)
+}
+
+// newOpLogger returns the logger for the given operation on a repo, which logs
+// JSON objects rather than text if oplog.StructuredEnv is set.
+func newOpLogger(ctx context.Context, operation, userName, repoName string) *oplog.Logger {
+	structured := os.Getenv(oplog.StructuredEnv) == "true"
+	return oplog.New(userName, repoName, operation, structured, func(severity oplog.Severity, line string) {
+		if severity == oplog.Error {
+			log.Errorf(ctx, "%s", line)
+		} else {
+			log.Infof(ctx, "%s", line)
+		}
+	})
+}
+
+// makeErrorf returns a utility function that logs a given error with the given logger and then sets the repo's error information to that error
+func makeErrorf(ctx context.Context, logger *oplog.Logger, userName, repoName string) func(string, ...interface{}) {
 	return func(format string, params ...interface{}) {
 		errText := fmt.Sprintf(format, params...)
-		log.Errorf(ctx, "%s/%s: %s", userName, repoName, errText)
+		logger.Errorf("%s", errText)
 		err := setRepoError(ctx, userName, repoName, errText)
 		if err != nil {
 			log.Errorf(ctx, "Can't set repo error status for %s/%s: %s",
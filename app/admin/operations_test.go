@@ -0,0 +1,271 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+var okResponse = github.Response{
+	Response: &http.Response{
+		StatusCode: http.StatusOK,
+	},
+	Rate: github.Rate{
+		Remaining: 1,
+	},
+}
+
+type hooksServiceStub struct {
+	Hooks   []*github.Hook
+	Created []*github.Hook
+	Edited  map[int64]*github.Hook
+	Pinged  []int64
+}
+
+func (s *hooksServiceStub) ListHooks(ctx context.Context, owner, repo string, opt *github.ListOptions) ([]*github.Hook, *github.Response, error) {
+	resp := okResponse
+	return s.Hooks, &resp, nil
+}
+
+func (s *hooksServiceStub) CreateHook(ctx context.Context, owner, repo string, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	id := int64(len(s.Hooks) + 1)
+	created := *hook
+	created.ID = &id
+	s.Hooks = append(s.Hooks, &created)
+	s.Created = append(s.Created, &created)
+	resp := okResponse
+	return &created, &resp, nil
+}
+
+func (s *hooksServiceStub) EditHook(ctx context.Context, owner, repo string, id int64, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	if s.Edited == nil {
+		s.Edited = make(map[int64]*github.Hook)
+	}
+	edited := *hook
+	edited.ID = &id
+	s.Edited[id] = &edited
+	resp := okResponse
+	return &edited, &resp, nil
+}
+
+func (s *hooksServiceStub) PingHook(ctx context.Context, owner, repo string, id int64) (*github.Response, error) {
+	s.Pinged = append(s.Pinged, id)
+	resp := okResponse
+	return &resp, nil
+}
+
+func (s *hooksServiceStub) GetHook(ctx context.Context, owner, repo string, id int64) (*github.Hook, *github.Response, error) {
+	for _, hook := range s.Hooks {
+		if hook.GetID() == id {
+			resp := okResponse
+			return hook, &resp, nil
+		}
+	}
+	resp := okResponse
+	resp.Response = &http.Response{StatusCode: http.StatusNotFound}
+	return nil, &resp, &github.ErrorResponse{Response: resp.Response, Message: "Not Found"}
+}
+
+func buildTestHook(url, secret string) *github.Hook {
+	return &github.Hook{
+		Events: []string{eventPing},
+		Config: map[string]interface{}{
+			"url":          url,
+			"content_type": "json",
+			"secret":       secret,
+		},
+	}
+}
+
+func TestUpsertHookCreatesNewHook(t *testing.T) {
+	stub := &hooksServiceStub{}
+	hook, created, err := upsertHook(context.Background(), stub, "user", "repo", buildTestHook("https://example.com/hook/user/repo", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("New hook was not reported as created")
+	}
+	if len(stub.Created) != 1 || len(stub.Edited) != 0 {
+		t.Fatalf("Expected exactly one hook creation; created %v, edited %v", stub.Created, stub.Edited)
+	}
+	if hook.ID == nil || *hook.ID != *stub.Created[0].ID {
+		t.Errorf("Unexpected hook returned: %v", hook)
+	}
+}
+
+func TestUpsertHookReusesExistingHook(t *testing.T) {
+	url := "https://example.com/hook/user/repo"
+	otherID := int64(7)
+	existingID := int64(42)
+	stub := &hooksServiceStub{
+		Hooks: []*github.Hook{
+			&github.Hook{
+				ID:     &otherID,
+				Config: map[string]interface{}{"url": "https://ci.example.com/hook"},
+			},
+			&github.Hook{
+				ID:     &existingID,
+				Config: map[string]interface{}{"url": url},
+			},
+		},
+	}
+	hook, created, err := upsertHook(context.Background(), stub, "user", "repo", buildTestHook(url, "new-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("Reused hook was reported as created")
+	}
+	if len(stub.Created) != 0 {
+		t.Fatalf("Unexpected duplicate hook creation: %v", stub.Created)
+	}
+	edited, ok := stub.Edited[existingID]
+	if !ok || len(stub.Edited) != 1 {
+		t.Fatalf("Expected the existing hook to be edited; edited %v", stub.Edited)
+	}
+	if edited.Config["secret"] != "new-secret" {
+		t.Errorf("Existing hook's secret was not reset: %v", edited.Config)
+	}
+	if hook.ID == nil || *hook.ID != existingID {
+		t.Errorf("Expected the existing hook ID to be reused; got %v", hook)
+	}
+}
+
+func TestRequestHookPing(t *testing.T) {
+	stub := &hooksServiceStub{}
+	if err := requestHookPing(context.Background(), stub, "user", "repo", 7, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.Pinged) != 0 {
+		t.Errorf("Expected GitHub to be left to ping a new hook, got pings %v", stub.Pinged)
+	}
+
+	if err := requestHookPing(context.Background(), stub, "user", "repo", 7, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stub.Pinged, []int64{7}) {
+		t.Errorf("Expected a reused hook to be pinged, got pings %v", stub.Pinged)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	notFound := &github.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Message:  "Not Found",
+	}
+	if !isNotFound(notFound) || !isNotFound(fmt.Errorf("wrapped: %w", notFound)) {
+		t.Error("Expected a 404 response to be reported as not found")
+	}
+	forbidden := &github.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusForbidden},
+	}
+	if isNotFound(forbidden) || isNotFound(errTooManyRetries) || isNotFound(nil) {
+		t.Error("Expected only 404 responses to be reported as not found")
+	}
+}
+
+func TestMakeHookURL(t *testing.T) {
+	for _, tc := range []struct {
+		baseURL  string
+		expected string
+	}{
+		{"", "https://github-mirror-dot-my-app.appspot.com/hook/user/repo"},
+		{"https://mirror.example.com", "https://mirror.example.com/hook/user/repo"},
+		{"https://example.com/mirror/", "https://example.com/mirror/hook/user/repo"},
+	} {
+		url, err := makeHookURL(tc.baseURL, "my-app", "user", "repo")
+		if err != nil {
+			t.Errorf("Unexpected error for base URL %q: %v", tc.baseURL, err)
+		} else if url != tc.expected {
+			t.Errorf("Unexpected hook URL %q for base URL %q; expected %q", url, tc.baseURL, tc.expected)
+		}
+	}
+	for _, baseURL := range []string{"http://mirror.example.com", "mirror.example.com", "https://"} {
+		if _, err := makeHookURL(baseURL, "my-app", "user", "repo"); err == nil {
+			t.Errorf("Expected an error for base URL %q", baseURL)
+		}
+	}
+}
+
+func TestHookExists(t *testing.T) {
+	hookID := int64(42)
+	stub := &hooksServiceStub{
+		Hooks: []*github.Hook{
+			&github.Hook{ID: &hookID},
+		},
+	}
+	if exists, err := hookExists(context.Background(), stub, "user", "repo", hookID); err != nil || !exists {
+		t.Errorf("Expected hook %d to exist; got %v, %v", hookID, exists, err)
+	}
+	if exists, err := hookExists(context.Background(), stub, "user", "repo", 7); err != nil || exists {
+		t.Errorf("Expected a deleted hook to be reported as missing; got %v, %v", exists, err)
+	}
+}
+
+func TestSetHookSecret(t *testing.T) {
+	hook := buildTestHook("https://example.com/hook/user/repo", "old secret")
+	id := int64(7)
+	hook.ID = &id
+	stub := &hooksServiceStub{Hooks: []*github.Hook{hook}}
+
+	if err := setHookSecret(context.Background(), stub, "user", "repo", id, "new secret"); err != nil {
+		t.Fatal(err)
+	}
+	edited := stub.Edited[id]
+	if edited == nil {
+		t.Fatal("Expected the hook to be edited")
+	}
+	if edited.Config["secret"] != "new secret" || edited.Config["url"] != hook.Config["url"] || edited.Config["content_type"] != "json" {
+		t.Errorf("Expected only the secret to change, got %v", edited.Config)
+	}
+	if hook.Config["secret"] != "old secret" {
+		t.Error("Expected the original hook configuration not to be modified")
+	}
+
+	if err := setHookSecret(context.Background(), stub, "user", "repo", id+1, "new secret"); !isNotFound(err) {
+		t.Errorf("Expected a missing hook to be reported, got %v", err)
+	}
+}
+
+func TestSetHookEvents(t *testing.T) {
+	hook := buildTestHook("https://example.com/hook/user/repo", "secret")
+	id := int64(7)
+	hook.ID = &id
+	stub := &hooksServiceStub{Hooks: []*github.Hook{hook}}
+
+	events := []string{eventPing, "status"}
+	if err := setHookEvents(context.Background(), stub, "user", "repo", id, events); err != nil {
+		t.Fatal(err)
+	}
+	edited := stub.Edited[id]
+	if edited == nil {
+		t.Fatal("Expected the hook to be edited")
+	}
+	if !reflect.DeepEqual(edited.Events, events) || edited.Config != nil {
+		t.Errorf("Expected only the events to change, got %+v", edited)
+	}
+	if len(stub.Created) != 0 {
+		t.Errorf("Expected the hook not to be recreated, got %v", stub.Created)
+	}
+}
@@ -22,20 +22,16 @@ package main
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/google/git-pull-request-mirror/store"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 )
 
-type repoStorageData struct {
-	User       string
-	Repo       string
-	Token      string // TODO(jhgilles): add another layer of encryption here?
-	HookID     int64
-	HookSecret string
-	Status     string
-	ErrorCause string
-}
+// repoStorageData is shared with the hooks service, and the command-line tools,
+// through the store package.
+type repoStorageData = store.Repo
 
 type repoExistsError struct {
 	User string
@@ -49,17 +45,21 @@ func (e *repoExistsError) Error() string {
 	)
 }
 
-const (
-	repoKind  = "repo"
-	emptyKind = "empty"
-
-	storageReposPath = "repos"
+type orgDefaultsData = store.OrgDefaults
 
-	statusValidating        = "Validating"         // Verifying repo w/ github
-	statusInitializing      = "Initializing"       // Performing initial pull-all
-	statusHooksInitializing = "Hooks Initializing" // Setting up hooks
-	statusReady             = "Ready"              // Ready and waiting for hooks
-	statusError             = "Error"              // Hit an unrecoverable error
+const (
+	repoKind        = store.RepoKind
+	orgDefaultsKind = store.OrgDefaultsKind
+	emptyKind       = store.EmptyKind
+
+	storageReposPath = store.ReposPath
+
+	statusValidating        = store.StatusValidating
+	statusInitializing      = store.StatusInitializing
+	statusHooksInitializing = store.StatusHooksInitializing
+	statusReady             = store.StatusReady
+	statusError             = store.StatusError
+	statusPaused            = store.StatusPaused
 )
 
 func initStorage(ctx context.Context) error {
@@ -73,12 +73,32 @@ func initStorage(ctx context.Context) error {
 
 // initRepoData is called to declare a new active repository in the
 // datastore. It should run after the repo has been verified to work.
-func initRepoData(ctx context.Context, user, repo, token string) error {
+//
+// The repo's web hook delivers the given events, or the default ones if there
+// are none, and the pull requests in the given state are mirrored, or only those
+// updated within the last importWindowDays days, if that is positive. If the
+// token is empty, then the default token of the repo's organization is used.
+func initRepoData(ctx context.Context, user, repo, token string, events []string, prState string, importWindowDays int) error {
+	var defaults *orgDefaultsData
+	if token == "" {
+		var err error
+		if defaults, err = getOrgDefaults(ctx, user); err != nil {
+			return err
+		}
+	}
+	token, err := store.ResolveToken(token, defaults)
+	if err != nil {
+		return err
+	}
+
 	item := repoStorageData{
-		User:   user,
-		Repo:   repo,
-		Token:  token,
-		Status: statusValidating,
+		User:             user,
+		Repo:             repo,
+		Token:            token,
+		Status:           statusValidating,
+		HookEvents:       events,
+		PullRequestState: prState,
+		ImportWindowDays: importWindowDays,
 	}
 	key := makeRepoKey(ctx, user, repo)
 	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
@@ -119,11 +139,25 @@ func modifyRepoData(ctx context.Context, user, repo string, f func(*repoStorageD
 	}, &datastore.TransactionOptions{})
 }
 
-// setRepoError sets a repo to statusErrpr with the given cause
+// transitionRepoStatus transactionally moves a repo from the given status to
+// a new one. If the repo is not in the expected status, nothing is modified
+// and false is returned.
+func transitionRepoStatus(ctx context.Context, user, repo, from, to string) (bool, error) {
+	transitioned := false
+	err := modifyRepoData(ctx, user, repo, func(item *repoStorageData) {
+		transitioned = item.Status == from
+		if transitioned {
+			item.Status = to
+		}
+	})
+	return transitioned, err
+}
+
+// setRepoError sets a repo to statusError with the given cause, and records
+// it in the repo's error history.
 func setRepoError(ctx context.Context, user, repo, errorCause string) error {
 	return modifyRepoData(ctx, user, repo, func(item *repoStorageData) {
-		item.Status = statusError
-		item.ErrorCause = errorCause
+		item.RecordError(time.Now(), errorCause)
 	})
 }
 
@@ -161,6 +195,97 @@ func getAllRepoData(ctx context.Context) ([]repoStorageData, error) {
 	return result, nil
 }
 
+// getRepoDataPage returns up to limit repos, starting at the given cursor (or
+// at the first repo, if it is empty), along with the cursor for the next page.
+// The returned cursor is empty if there are no more repos.
+//
+// If status is non-empty, only the repos with that status are returned.
+func getRepoDataPage(ctx context.Context, status string, limit int, cursor string) ([]repoStorageData, string, error) {
+	q := datastore.NewQuery(repoKind).Ancestor(makeReposRootKey(ctx))
+	if status != "" {
+		q = q.Filter("Status =", status)
+	}
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(start)
+	}
+
+	// Read one repo past the end of the page, to find out whether there is
+	// a next page.
+	it := q.Limit(limit + 1).Run(ctx)
+	result := []repoStorageData{}
+	var next datastore.Cursor
+	for {
+		if len(result) == limit {
+			c, err := it.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			next = c
+		}
+		var current repoStorageData
+		_, err := it.Next(&current)
+		if err == datastore.Done {
+			return result, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(result) == limit {
+			return result, next.String(), nil
+		}
+		result = append(result, current)
+	}
+}
+
+// getOrgDefaults returns the defaults of the given organization, or nil if it
+// has none.
+func getOrgDefaults(ctx context.Context, org string) (*orgDefaultsData, error) {
+	var defaults orgDefaultsData
+	err := datastore.Get(ctx, makeOrgDefaultsKey(ctx, org), &defaults)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &defaults, nil
+}
+
+// setOrgDefaultToken sets the default token of the given organization, or
+// removes its defaults if the token is empty. The repos that already inherited
+// the previous token keep it.
+func setOrgDefaultToken(ctx context.Context, org, token string) error {
+	key := makeOrgDefaultsKey(ctx, org)
+	if token == "" {
+		return datastore.Delete(ctx, key)
+	}
+	_, err := datastore.Put(ctx, key, &orgDefaultsData{Org: org, Token: token})
+	return err
+}
+
+// getAllOrgDefaults returns the defaults of all of the organizations that have
+// them.
+func getAllOrgDefaults(ctx context.Context) ([]orgDefaultsData, error) {
+	q := datastore.NewQuery(orgDefaultsKind).Ancestor(makeReposRootKey(ctx))
+	result := []orgDefaultsData{}
+	if _, err := q.GetAll(ctx, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// pingStorage checks that the datastore can be reached, using a query that is
+// as cheap as possible.
+func pingStorage(ctx context.Context) error {
+	q := datastore.NewQuery(repoKind).Ancestor(makeReposRootKey(ctx)).KeysOnly().Limit(1)
+	_, err := q.GetAll(ctx, nil)
+	return err
+}
+
 func makeReposRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(
 		ctx,
@@ -180,3 +305,13 @@ func makeRepoKey(ctx context.Context, user, repo string) *datastore.Key {
 		makeReposRootKey(ctx),
 	)
 }
+
+func makeOrgDefaultsKey(ctx context.Context, org string) *datastore.Key {
+	return datastore.NewKey(
+		ctx,
+		orgDefaultsKind,
+		org,
+		0,
+		makeReposRootKey(ctx),
+	)
+}
@@ -18,66 +18,541 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-pull-request-mirror/auth"
+	"github.com/google/git-pull-request-mirror/mirror"
 	"golang.org/x/net/context"
 )
 
 const (
-	remoteName      = "origin"
-	notesRefPattern = "refs/notes/devtools/*"
-	fetchSpec       = "+refs/pull/*:refs/pull/*"
-	retryAttempts   = 10
+	remoteName    = "origin"
+	pushName      = "notes"
+	fetchSpec     = "+refs/pull/*:refs/pull/*"
+	retryAttempts = 10
+
+	// initialRetryBackoff is how long to wait before the first retry of a
+	// failed git command; the wait doubles after each subsequent failure.
+	initialRetryBackoff = time.Second
+
+	// initialSyncBackoff and maxSyncBackoff bound how long to wait before
+	// pulling the notes again after pushing them failed, e.g. because
+	// someone else pushed in between.
+	initialSyncBackoff = 250 * time.Millisecond
+	maxSyncBackoff     = 8 * time.Second
+
+	// cloneFilterEnv names the environment variable that, if set, holds
+	// the object filter used to make partial clones of every repository,
+	// e.g. "blob:none".
+	cloneFilterEnv = "MIRROR_CLONE_FILTER"
+
+	// partialCloneThresholdEnv names the environment variable that, if set,
+	// holds the size in megabytes from which repositories are partially
+	// cloned when no filter is configured, or a negative number to always
+	// clone them in full.
+	partialCloneThresholdEnv = "MIRROR_PARTIAL_CLONE_THRESHOLD_MB"
+
+	// defaultPartialCloneThresholdMB is the size from which repositories are
+	// partially cloned if no threshold is configured.
+	defaultPartialCloneThresholdMB = 1024
+
+	// partialCloneFilter is the object filter used for the partial clones of
+	// large repositories. The mirror reads commits and notes, but never the
+	// contents of the files, so none of the other blobs are needed.
+	partialCloneFilter = "blob:none"
+
+	// notesRefPatternEnv names the environment variable that, if set, holds
+	// the pattern of the notes refs that are pulled and pushed. It has to
+	// cover all of the refs that the mirror writes to; see
+	// mirror.CheckNotesRefPattern.
+	notesRefPatternEnv = "MIRROR_NOTES_REF_PATTERN"
+
+	// logFormatEnv names the environment variable that, if set to "json",
+	// makes each mirrored item be logged as a line of JSON.
+	logFormatEnv = "MIRROR_LOG_FORMAT"
+
+	// reactionsEnv names the environment variable that, if set to "true",
+	// makes a summary of the reactions to each comment be mirrored with it.
+	reactionsEnv = "MIRROR_REACTIONS"
+
+	// expandReferencesEnv names the environment variable that, if set to
+	// "true", makes the issue references in pull request bodies be expanded.
+	expandReferencesEnv = "MIRROR_EXPAND_REFERENCES"
+
+	// markNonDefaultTargetsEnv names the environment variable that, if set to
+	// "true", makes the reviews of pull requests that target a branch other
+	// than the default one name that branch in their descriptions.
+	markNonDefaultTargetsEnv = "MIRROR_MARK_NON_DEFAULT_TARGETS"
+
+	// skipDraftsEnv names the environment variable that, if set to "true",
+	// makes draft pull requests be left out of the mirror.
+	skipDraftsEnv = "MIRROR_SKIP_DRAFTS"
+
+	// mergeableEnv names the environment variable that, if set to "true",
+	// makes whether each pull request can be merged be mirrored as a CI report.
+	mergeableEnv = "MIRROR_MERGEABLE"
+
+	// closedByEnv names the environment variable that, if set to "true",
+	// makes who closed each pull request without merging it be mirrored.
+	closedByEnv = "MIRROR_CLOSED_BY"
+
+	// ghostAuthorEnv names the environment variable that, if set, holds the
+	// author recorded on comments by deleted GitHub accounts.
+	ghostAuthorEnv = "MIRROR_GHOST_AUTHOR"
+
+	// contextAliasesEnv names the environment variable that, if set, holds
+	// the aliases applied to the contexts of commit statuses; see
+	// mirror.ParseContextAliases.
+	contextAliasesEnv = "MIRROR_CONTEXT_ALIASES"
+
+	// metricsEnv names the environment variable that, if set, names the
+	// backend that metrics are exported to; only "prometheus" is supported,
+	// which serves them at /metrics.
+	metricsEnv = "MIRROR_METRICS"
+
+	// gitUserNameEnv and gitUserEmailEnv name the environment variables that,
+	// if set, hold the git identity recorded on the notes commits.
+	gitUserNameEnv  = "MIRROR_GIT_USER_NAME"
+	gitUserEmailEnv = "MIRROR_GIT_USER_EMAIL"
+
+	// defaultGitUserName is the git user name used if none is configured.
+	defaultGitUserName = "Github Mirror"
+
+	// pushRemoteURLEnv names the environment variable that, if set, holds
+	// the URL of the remote that the notes are pushed to instead of GitHub,
+	// with "{owner}" and "{repo}" standing for the GitHub repository, e.g.
+	// "https://gitlab.example.com/mirrors/{owner}/{repo}.git".
+	pushRemoteURLEnv = "MIRROR_PUSH_REMOTE_URL"
+
+	// pushRemoteUserEnv and pushRemoteTokenEnv name the environment
+	// variables that, if set, hold the credentials for the push remote.
+	pushRemoteUserEnv  = "MIRROR_PUSH_REMOTE_USER"
+	pushRemoteTokenEnv = "MIRROR_PUSH_REMOTE_TOKEN"
 )
 
-// Clone creates a local copy of the repository accessible at
-// github.com/user/repo with token, in a system temp directory.
-func clone(c context.Context, repoOwner, repoName, token string) (repository.Repo, error) {
+// pushRemote is the git remote that the notes are pulled from and pushed to,
+// when that is not the GitHub repository that everything else is read from.
+//
+// The zero value means that the notes live in the GitHub repository.
+type pushRemote struct {
+	urlTemplate string
+	user        string
+	token       string
+}
+
+// configuredPushRemote returns the remote to push the notes to.
+func configuredPushRemote() (pushRemote, error) {
+	p := pushRemote{
+		urlTemplate: os.Getenv(pushRemoteURLEnv),
+		user:        os.Getenv(pushRemoteUserEnv),
+		token:       os.Getenv(pushRemoteTokenEnv),
+	}
+	if p.urlTemplate == "" {
+		if p.user != "" || p.token != "" {
+			return pushRemote{}, fmt.Errorf("credentials are set, but no push remote URL")
+		}
+		return p, nil
+	}
+	if _, err := p.url("owner", "repo"); err != nil {
+		return pushRemote{}, err
+	}
+	return p, nil
+}
+
+// name returns the name of the git remote that the notes are pulled from and
+// pushed to.
+func (p pushRemote) name() string {
+	if p.urlTemplate == "" {
+		return remoteName
+	}
+	return pushName
+}
+
+// url returns the URL of the push remote for the given GitHub repository,
+// including its credentials.
+func (p pushRemote) url(repoOwner, repo string) (string, error) {
+	parsed, err := neturl.Parse(strings.NewReplacer(
+		"{owner}", neturl.PathEscape(repoOwner),
+		"{repo}", neturl.PathEscape(repo)).Replace(p.urlTemplate))
+	if err != nil {
+		return "", fmt.Errorf("invalid push remote URL: %v", err)
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "ssh") || parsed.Host == "" {
+		return "", fmt.Errorf("push remote URL must be an absolute https or ssh URL: %q", p.urlTemplate)
+	}
+	switch {
+	case p.user != "" && p.token != "":
+		parsed.User = neturl.UserPassword(p.user, p.token)
+	case p.user != "":
+		parsed.User = neturl.User(p.user)
+	case p.token != "":
+		parsed.User = neturl.User(p.token)
+	}
+	return parsed.String(), nil
+}
+
+// cloneOptions select whether each repository is cloned in full or partially.
+type cloneOptions struct {
+	// filter, if set, is the object filter used for every clone.
+	filter string
+	// thresholdKB is the size from which repositories are partially cloned
+	// if filter isn't set; if negative, then they are always cloned in full.
+	thresholdKB int
+}
+
+// configuredCloneOptions returns the options for cloning repositories.
+func configuredCloneOptions() (cloneOptions, error) {
+	opts := cloneOptions{
+		filter:      os.Getenv(cloneFilterEnv),
+		thresholdKB: defaultPartialCloneThresholdMB * 1024,
+	}
+	if threshold := os.Getenv(partialCloneThresholdEnv); threshold != "" {
+		mb, err := strconv.Atoi(threshold)
+		if err != nil {
+			return cloneOptions{}, fmt.Errorf("not a number of megabytes: %q", threshold)
+		}
+		opts.thresholdKB = mb * 1024
+	}
+	return opts, nil
+}
+
+// filterFor returns the object filter to clone a repository of the given size
+// in kilobytes with, or "" for a full clone. The size of a repository is
+// recorded when it is validated, so repositories that were added before that
+// have an unknown size of 0. Those are partially cloned too, since the mirror
+// never reads the contents of files, whereas cloning a huge repository in full
+// may not fit in the time or disk space available.
+func (o cloneOptions) filterFor(sizeKB int) string {
+	if o.filter != "" {
+		return o.filter
+	}
+	if o.thresholdKB < 0 || (sizeKB > 0 && sizeKB < o.thresholdKB) {
+		return ""
+	}
+	return partialCloneFilter
+}
+
+// gitIdentity is the git user name and email address that the notes commits
+// are authored and committed by.
+type gitIdentity struct {
+	name  string
+	email string
+}
+
+// configuredGitIdentity returns the git identity to use for the notes commits.
+//
+// The name defaults to "Github Mirror", and the email address to that of the
+// app's default service account.
+func configuredGitIdentity() (gitIdentity, error) {
+	name, email := os.Getenv(gitUserNameEnv), os.Getenv(gitUserEmailEnv)
+	configured := name != "" || email != ""
+	if name == "" {
+		name = defaultGitUserName
+	}
+	if email == "" {
+		email = os.Getenv("GOOGLE_CLOUD_PROJECT") + "@appspot.gserviceaccount.com"
+	}
+	if configured {
+		if err := mirror.CheckGitIdentity(name, email); err != nil {
+			return gitIdentity{}, err
+		}
+	}
+	return gitIdentity{name: name, email: email}, nil
+}
+
+// configuredNotesRefPattern returns the pattern of the notes refs to pull and
+// push, which defaults to all of the git-appraise notes refs.
+func configuredNotesRefPattern() (string, error) {
+	pattern := os.Getenv(notesRefPatternEnv)
+	if pattern == "" {
+		return mirror.DefaultNotesRefPattern, nil
+	}
+	if err := mirror.CheckNotesRefPattern(pattern); err != nil {
+		return "", err
+	}
+	return pattern, nil
+}
+
+// Clone creates a bare local copy of the repository accessible at
+// github.com/user/repo with token, in a system temp directory, including the
+// git-notes matching notesRefPattern, and configured to commit as identity. If
+// filter is non-empty, then the copy is a partial clone; see gitClone.
+//
+// If the notes are pushed to a separate remote, then that remote is added to the
+// clone, and the notes are pulled from it rather than from GitHub.
+//
+// The returned cleanup function removes the temporary directory, and must be
+// called once the caller is done with the repository. If cloning fails, then
+// the directory is removed before returning.
+func clone(ctx context.Context, repoOwner, repoName, token, filter, notesRefPattern string, identity gitIdentity, push pushRemote) (*repository.GitRepo, func(), error) {
 	dir, err := ioutil.TempDir("", fmt.Sprintf("%s-%s", repoOwner, repoName))
 	if err != nil {
-		return nil, fmt.Errorf("failure creating the temporary directory for cloning: %v", err)
+		return nil, nil, fmt.Errorf("failure creating the temporary directory for cloning: %v", err)
 	}
-	cloneCmd := exec.Command("git", "clone", makeRemoteURL(token, repoOwner, repoName), dir)
-	if out, err := cloneCmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failure issuing the clone command, %v: %q", err, out)
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove the temporary clone %s: %v", dir, err)
+		}
+	}
+	repo, err := cloneInto(ctx, dir, repoOwner, repoName, token, filter, notesRefPattern, identity, push)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return repo, cleanup, nil
+}
+
+// cloneInto populates dir with a clone of github.com/user/repo; see clone.
+func cloneInto(ctx context.Context, dir, repoOwner, repoName, token, filter, notesRefPattern string, identity gitIdentity, push pushRemote) (*repository.GitRepo, error) {
+	if err := gitClone(ctx, makeRemoteURL(token, repoOwner, repoName), dir, filter, os.Getenv(auth.CABundleEnv)); err != nil {
+		return nil, err
 	}
 	repo, err := repository.NewGitRepo(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failure loading the cloned repository: %v", err)
 	}
-	if err := repo.PullNotes(remoteName, notesRefPattern); err != nil {
-		return nil, fmt.Errorf("failure pulling the git-notes: %v", err)
+	if out, err := runGitCommand(ctx, dir, "config", "--local", "--add", "user.name", identity.name); err != nil {
+		return nil, fmt.Errorf("failure configuring the local git user: %v, %q", err, out)
+	}
+	if out, err := runGitCommand(ctx, dir, "config", "--local", "--add", "user.email", identity.email); err != nil {
+		return nil, fmt.Errorf("failure configuring the local get user email address: %v, %q", err, out)
 	}
-	fetchCmd := exec.Command("git", "fetch", "origin", fetchSpec)
-	fetchCmd.Dir = dir
-	if _, err := fetchCmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failure fetching pull requests from the remote: %v", err)
+	if push.name() != remoteName {
+		pushURL, err := push.url(repoOwner, repoName)
+		if err != nil {
+			return nil, err
+		}
+		if out, err := runGitCommand(ctx, dir, "remote", "add", push.name(), pushURL); err != nil {
+			return nil, fmt.Errorf("failure adding the push remote: %v: %q", err, out)
+		}
 	}
-	configUserCmd := exec.Command("git", "config", "--local", "--add", "user.name", "Github Mirror")
-	configUserCmd.Dir = dir
-	if _, err := configUserCmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failure configuring the local git user: %v", err)
+	if err := pullNotes(ctx, dir, push.name(), notesRefPattern); err != nil {
+		return nil, fmt.Errorf("failure pulling the git-notes: %v", err)
 	}
-	userEmail := os.Getenv("GOOGLE_CLOUD_PROJECT") + "@appspot.gserviceaccount.com"
-	configEmailCmd := exec.Command("git", "config", "--local", "--add", "user.email", userEmail)
-	configEmailCmd.Dir = dir
-	if out, err := configEmailCmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failure configuring the local get user email address: %v, %q", err, out)
+	if out, err := runGitWithRetries(ctx, dir, "fetch", "origin", fetchSpec); err != nil {
+		return nil, fmt.Errorf("failure fetching pull requests from the remote: %v: %q", err, out)
 	}
 	return repo, nil
 }
 
-func syncNotes(repo repository.Repo) error {
+// gitClone makes a bare clone of the given remote in dir.
+//
+// The mirror only ever reads commits and reads and writes notes, none of which
+// need a working tree, so checking out the files would only waste time and disk
+// space.
+//
+// If filter is non-empty, then a partial clone is made using that filter (e.g.
+// "blob:none"), which saves time and disk space for repositories with large
+// histories. Unlike a shallow clone, a partial clone still includes every commit,
+// so the commits in a review and their merge base can still be computed, and any
+// objects that are filtered out are fetched on demand.
+//
+// If caPath is non-empty, then the clone is configured to trust the CA bundle at
+// that path when talking to the remote, including when the notes are pushed.
+func gitClone(ctx context.Context, remoteURL, dir, filter, caPath string) error {
+	args := []string{"clone", "--bare"}
+	if filter != "" {
+		args = append(args, "--filter="+filter)
+	}
+	if caPath != "" {
+		args = append(args, "--config", "http.sslCAInfo="+caPath)
+	}
+	args = append(args, remoteURL, dir)
+	if out, err := runGitWithRetries(ctx, "", args...); err != nil {
+		return fmt.Errorf("failure issuing the clone command, %v: %q", err, out)
+	}
+	return nil
+}
+
+// runGitCommand runs a git command in dir, returning its combined output. The
+// command is killed if ctx is cancelled before it finishes, e.g. because a
+// fetch hangs on the network.
+func runGitCommand(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return out, ctxErr
+	}
+	return out, err
+}
+
+// runGitWithRetries runs a git command that talks to the remote, retrying with
+// an exponential backoff if it fails for what may be a transient reason, until
+// ctx is cancelled.
+func runGitWithRetries(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	backoff := initialRetryBackoff
+	var out []byte
 	var err error
 	for attempt := 0; attempt < retryAttempts; attempt++ {
-		err = repo.PullNotes(remoteName, notesRefPattern)
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return out, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		out, err = runGitCommand(ctx, dir, args...)
+		if err == nil || ctx.Err() != nil || !isRetryableGitFailure(out) {
+			return out, err
+		}
+	}
+	return out, err
+}
+
+// nonRetryableGitFailures are fragments of the error messages git prints when a
+// remote rejects our credentials or can't find the repository, which no amount
+// of retrying will fix.
+var nonRetryableGitFailures = []string{
+	"Authentication failed",
+	"could not read Username",
+	"Repository not found",
+	"repository not found",
+	"The requested URL returned error: 401",
+	"The requested URL returned error: 403",
+	"The requested URL returned error: 404",
+	"does not appear to be a git repository",
+	"couldn't find remote ref",
+}
+
+// isRetryableGitFailure reports whether the given output of a failed git command
+// may have been caused by a transient problem, such as a dropped connection or
+// a server error.
+func isRetryableGitFailure(out []byte) bool {
+	for _, failure := range nonRetryableGitFailures {
+		if strings.Contains(string(out), failure) {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteNotesRef returns the local ref that the given notes ref of the given
+// remote is fetched into, as git-appraise names them.
+func remoteNotesRef(remote, notesRef string) string {
+	return "refs/notes/" + remote + "/" + strings.TrimPrefix(notesRef, "refs/notes/")
+}
+
+// notesRefMatches reports whether the given ref matches the given pattern of
+// notes refs, in which a single "*" matches any sequence of characters.
+func notesRefMatches(pattern, ref string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return ref == pattern
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(ref) >= len(prefix)+len(suffix) && strings.HasPrefix(ref, prefix) && strings.HasSuffix(ref, suffix)
+}
+
+// pullNotes fetches the notes refs matching notesRefPattern from the given
+// remote of the repository in dir, and merges each of them into the local
+// notes, as repository.Repo's PullNotes does, but stops if ctx is cancelled.
+//
+// The notes are fetched in full even into a partial clone, whose remote would
+// otherwise leave out their blobs too, and then have each note fetched on its
+// own as it is read.
+func pullNotes(ctx context.Context, dir, remote, notesRefPattern string) error {
+	remotePattern := remoteNotesRef(remote, notesRefPattern)
+	if out, err := runGitWithRetries(ctx, dir, "fetch", "--no-filter", remote, "+"+notesRefPattern+":"+remotePattern); err != nil {
+		return fmt.Errorf("failure fetching the notes: %v: %q", err, out)
+	}
+	out, err := runGitCommand(ctx, dir, "for-each-ref", "--format=%(refname)", "refs/notes/"+remote)
+	if err != nil {
+		return fmt.Errorf("failure listing the fetched notes: %v: %q", err, out)
+	}
+	for _, ref := range strings.Fields(string(out)) {
+		if !notesRefMatches(remotePattern, ref) {
+			continue
+		}
+		localRef := "refs/notes/" + strings.TrimPrefix(ref, "refs/notes/"+remote+"/")
+		if out, err := runGitCommand(ctx, dir, "notes", "--ref", localRef, "merge", ref, "-s", "cat_sort_uniq"); err != nil {
+			return fmt.Errorf("failure merging the notes in %s: %v: %q", ref, err, out)
+		}
+	}
+	return nil
+}
+
+// repoLocks serializes work on each repository within this process.
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// syncLocks makes concurrent syncs of the same repository take turns pushing
+// their notes, rather than repeatedly rejecting each other's pushes. Syncs on
+// other instances of the service are still only reconciled by retrying.
+var syncLocks = &repoLocks{locks: make(map[string]chan struct{})}
+
+// lock waits until no one else holds the lock for the given repository, and
+// then takes it, returning the function that releases it. It gives up if ctx
+// is cancelled first.
+func (l *repoLocks) lock(ctx context.Context, repoOwner, repoName string) (func(), error) {
+	key := repoOwner + "/" + repoName
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[key] = lock
+	}
+	l.mu.Unlock()
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// syncBackoff returns how long to wait before pulling and pushing the notes
+// again after the given number of failed attempts. The wait doubles after each
+// failure, and a random jitter keeps concurrent syncs from retrying in step.
+func syncBackoff(failures int) time.Duration {
+	backoff := initialSyncBackoff << uint(failures-1)
+	if backoff > maxSyncBackoff || backoff <= 0 {
+		backoff = maxSyncBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// syncNotes merges in the notes on the given remote, and then pushes the result
+// back to it, retrying after a backoff if someone else pushed in between, until
+// ctx is cancelled. Syncs of the same repository by this process are
+// serialized.
+func syncNotes(ctx context.Context, repo *repository.GitRepo, repoOwner, repoName, remote, notesRefPattern string) error {
+	unlock, err := syncLocks.lock(ctx, repoOwner, repoName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(syncBackoff(attempt)):
+			}
+		}
+		err = pullNotes(ctx, repo.Path, remote, notesRefPattern)
 		if err == nil {
-			err = repo.PushNotes(remoteName, notesRefPattern)
+			var out []byte
+			out, err = runGitCommand(ctx, repo.Path, "push", remote, notesRefPattern+":"+notesRefPattern)
 			if err == nil {
-				return err
+				return nil
 			}
+			err = fmt.Errorf("failure pushing the notes: %v: %q", err, out)
+		}
+		if ctx.Err() != nil {
+			return err
 		}
 	}
 	return err
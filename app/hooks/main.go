@@ -16,43 +16,96 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-pull-request-mirror/auth"
+	"github.com/google/git-pull-request-mirror/metrics"
+	"github.com/google/git-pull-request-mirror/metrics/prometheus"
 	"github.com/google/git-pull-request-mirror/mirror"
+	"github.com/google/git-pull-request-mirror/oplog"
 	"github.com/google/go-github/github"
-	"golang.org/x/oauth2"
 	"google.golang.org/appengine"
 
 	"cloud.google.com/go/compute/metadata"
 )
 
 const (
-	githubEventHeader     = "X-Github-Event"
-	githubSignatureHeader = "X-Hub-Signature"
-
-	eventPing         = "ping"
-	eventStatus       = "status"
-	eventPullRequest  = "pull_request"
-	eventDiffComment  = "pull_request_review_comment"
-	eventIssueComment = "issue_comment"
+	githubEventHeader        = "X-Github-Event"
+	githubSignatureHeader    = "X-Hub-Signature"
+	githubSignature256Header = "X-Hub-Signature-256"
+
+	formContentType = "application/x-www-form-urlencoded"
+
+	// lowRateLimitThreshold is the number of remaining API requests below
+	// which a sync only reads the data that is essential to it.
+	lowRateLimitThreshold = 500
+
+	// syncTimeout bounds how long reading from GitHub may take, which is long
+	// enough to wait out one reset of the API rate limit.
+	syncTimeout = 90 * time.Minute
+
+	// cloneTimeout bounds how long cloning the repository may take, after
+	// which any git command that is still running is killed.
+	cloneTimeout = 15 * time.Minute
+
+	// checkpointInterval is the number of pull requests that an initial
+	// import reads, writes, and pushes before recording its progress.
+	checkpointInterval = 100
+
+	// metricsCountTimeout bounds how long counting the repos may take when
+	// the metrics are scraped.
+	metricsCountTimeout = 10 * time.Second
+
+	eventPing          = "ping"
+	eventStatus        = "status"
+	eventPullRequest   = "pull_request"
+	eventDiffComment   = "pull_request_review_comment"
+	eventIssueComment  = "issue_comment"
+	eventCommitComment = "commit_comment"
 )
 
-// makeErrorf returns a utility function that logs a given error and then sets the repo's error information to that error
-func makeErrorf(ctx context.Context, c *datastore.Client, userName, repoName string) func(string, ...interface{}) {
+// structuredLogs is whether the operations on repos are logged as JSON objects,
+// which Cloud Logging reads as structured payloads, rather than as text.
+var structuredLogs bool
+
+// newOpLogger returns the logger for the given operation on a repo.
+func newOpLogger(operation, userName, repoName string) *oplog.Logger {
+	return oplog.New(userName, repoName, operation, structuredLogs, func(severity oplog.Severity, line string) {
+		if structuredLogs {
+			// The standard logger's timestamp prefix would keep the
+			// line from being parsed as JSON.
+			fmt.Fprintln(os.Stderr, line)
+		} else {
+			log.Print(line)
+		}
+	})
+}
+
+// makeErrorf returns a utility function that logs a given error with the given logger and then sets the repo's error information to that error
+func makeErrorf(ctx context.Context, c *datastore.Client, logger *oplog.Logger, userName, repoName string) func(string, ...interface{}) {
 	return func(format string, params ...interface{}) {
 		errText := fmt.Sprintf(format, params...)
-		log.Printf("%s/%s: %s", userName, repoName, errText)
+		logger.Errorf("%s", errText)
+		metrics.SyncError()
 		err := setRepoError(ctx, c, userName, repoName, errText)
 		if err != nil {
 			log.Printf("Can't set repo error status for %s/%s: %s",
@@ -65,87 +118,191 @@ func makeErrorf(ctx context.Context, c *datastore.Client, userName, repoName str
 }
 
 // initialize performs initial reading and commiting for the repository
-func initialize(ctx context.Context, c *datastore.Client, userName, repoName string) {
-	errorf := makeErrorf(ctx, c, userName, repoName)
+//
+// If resume is set, as for the initial import of the repository (or a restart of
+// it), then the import resumes after the last pull request whose review an
+// interrupted one pushed, and records its own progress as it goes. Otherwise,
+// e.g. for the syncs that web hooks trigger, every pull request is read, and
+// the progress and status of any import that is still in progress are left
+// alone.
+func initialize(ctx context.Context, c *datastore.Client, userName, repoName string, resume bool) {
+	metrics.SyncStarted()
+	logger := newOpLogger("initialize", userName, repoName)
+	errorf := makeErrorf(ctx, c, logger, userName, repoName)
 	repoData, err := getRepoData(ctx, c, userName, repoName)
 	if err != nil {
 		errorf("Can't load repo to initialize: %s", err.Error())
 		return
 	}
 
-	repo, err := clone(ctx, userName, repoName, repoData.Token)
+	// The admin service restarts imports that show no sign of life, so this
+	// one records that it is running, and then its progress.
+	startAfter := 0
+	if resume {
+		startAfter = repoData.LastCompletedPR
+		err = modifyRepoData(ctx, c, userName, repoName, func(item *repoStorageData) {
+			item.InitializeHeartbeat = time.Now()
+		})
+		if err != nil {
+			log.Printf("Can't record the start of initializing %s/%s: %s", userName, repoName, err.Error())
+		}
+	}
+
+	cloneCtx, cancelClone := context.WithTimeout(ctx, cloneTimeout)
+	repo, cleanup, err := clone(cloneCtx, userName, repoName, repoData.Token, cloneConfig.filterFor(repoData.SizeKB), notesRefPattern, notesIdentity, notesRemote)
+	cancelClone()
 	if err != nil {
 		errorf("Can't clone repo: %v", err)
 		return
 	}
+	defer cleanup()
 
-	client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: repoData.Token},
-	)))
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		errorf("Can't create the GitHub client: %s", err.Error())
+		return
+	}
+
+	// Commit statuses are also mirrored as they change by the "status" hook,
+	// so when we are low on API quota we only read the pull requests.
+	skipStatuses := false
+	if rate, err := coreRateLimit(ctx, client); err != nil {
+		logger.Infof("rateLimit", "Can't read the API rate limit: %s", err.Error())
+	} else if rate.Remaining < lowRateLimitThreshold {
+		logger.Infof("rateLimit", "Warning: only %d GitHub API requests remain until %v; skipping commit statuses",
+			rate.Remaining, rate.Reset.Time)
+		skipStatuses = true
+	}
 
 	errChan := make(chan error, 1000)
 	nErrors := 0
 	go func() {
 		for err := range errChan {
+			var convErr *mirror.ConversionError
+			if errors.As(err, &convErr) {
+				// A single item we can't convert shouldn't mark the whole repo as broken.
+				logger.Infof("import", "skipping: %s", err.Error())
+				continue
+			}
 			errorf(err.Error())
 			nErrors++
 		}
 	}()
 
-	reviews, err := mirror.GetAllPullRequests(repo, userName, repoName, client, errChan)
-	if err != nil {
-		errorf("Can't get PRs: %s", err.Error())
-		return
+	logChan := make(chan string, 1000)
+	go func() {
+		for msg := range logChan {
+			log.Printf(msg)
+		}
+	}()
+	defer close(logChan)
+
+	if startAfter > 0 {
+		logger.Infof("import", "Resuming the import after PR #%d", startAfter)
 	}
 
-	statuses, err := mirror.GetAllStatuses(userName, repoName, client, errChan)
+	var since time.Time
+	if repoData.ImportWindowDays > 0 {
+		since = time.Now().AddDate(0, 0, -repoData.ImportWindowDays)
+		logger.Infof("import", "Only importing the PRs updated since %s", since.Format(time.RFC3339))
+	}
+
+	// Don't let a sync that is stuck waiting on the API rate limit run forever.
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	// The reviews are pushed, and the import's progress recorded, after every
+	// batch of pull requests, so that an import which is interrupted (e.g. by a
+	// request deadline) can later resume where it left off.
+	nReviews := 0
+	err = mirror.ImportPullRequests(syncCtx, repo, userName, repoName, repoData.PullRequestState, since, startAfter, checkpointInterval, mirror.NewPullRequestsService(client), client.Issues, errChan, nil, func(reviews []review.Review, lastPR int) error {
+		if err := mirror.WriteNewReviews(reviews, repo, logChan, mirrorOptions); err != nil {
+			var writeErr *mirror.WriteError
+			if !errors.As(err, &writeErr) {
+				return err
+			}
+			// The other reviews were still written, so the import goes
+			// on, and the failures are reported like those to read PRs.
+			for _, failure := range writeErr.Failures {
+				errChan <- failure
+			}
+		}
+		if err := syncNotes(ctx, repo, userName, repoName, notesRemote.name(), notesRefPattern); err != nil {
+			return fmt.Errorf("error pushing the reviews of PRs up to #%d: %v", lastPR, err)
+		}
+		nReviews += len(reviews)
+		if !resume {
+			return nil
+		}
+		return modifyRepoData(ctx, c, userName, repoName, func(item *repoStorageData) {
+			item.LastCompletedPR = lastPR
+			item.InitializeHeartbeat = time.Now()
+		})
+	}, mirrorOptions)
 	if err != nil {
-		errorf("Can't get statuses: %s", err.Error())
+		errorf("Can't import PRs: %s", err.Error())
 		return
 	}
+
+	var statuses map[string][]ci.Report
+	if !skipStatuses {
+		statuses, err = mirror.GetAllStatuses(syncCtx, userName, repoName, client.Git, client.Repositories, client.PullRequests, nil, errChan, nil, mirrorOptions)
+		if err != nil {
+			errorf("Can't get statuses: %s", err.Error())
+			return
+		}
+	}
 	close(errChan)
 
 	nStatuses := len(statuses)
-	nReviews := len(reviews)
-	logChan := make(chan string, 1000)
-	go func() {
-		for msg := range logChan {
-			log.Printf(msg)
+	logger.Infof("commit", "Done reading! Read %d statuses, %d PRs; committing...", nStatuses, nReviews)
+	if err := mirror.WriteNewReports(statuses, repo, logChan, mirrorOptions); err != nil {
+		var writeErr *mirror.WriteError
+		if !errors.As(err, &writeErr) {
+			errorf(err.Error())
+			return
+		}
+		// The other reports were still written, so they are still pushed.
+		for _, failure := range writeErr.Failures {
+			errorf(failure.Error())
 		}
-	}()
-	log.Printf("Done reading! Read %d statuses, %d PRs", nStatuses, nReviews)
-	log.Printf("Committing...\n")
-	if err := mirror.WriteNewReports(statuses, repo, logChan); err != nil {
-		errorf(err.Error())
-		return
 	}
-	if err := mirror.WriteNewReviews(reviews, repo, logChan); err != nil {
-		errorf(err.Error())
+	err = syncNotes(ctx, repo, userName, repoName, notesRemote.name(), notesRefPattern)
+	if err != nil {
+		errorf("Error pushing initialization changes: %s", err.Error())
 		return
 	}
-	close(logChan)
-	err = syncNotes(repo)
+	logger.Infof("push", "Success initializing")
+
+	rate, err := coreRateLimit(ctx, client)
 	if err != nil {
-		errorf("Error pushing initialization changes for %s/%s: %s",
-			userName,
-			repoName,
-			err.Error())
-		return
+		log.Printf("Can't read the API rate limit for %s/%s: %s", userName, repoName, err.Error())
 	}
-	log.Printf("Success initializing %s/%s", userName, repoName)
 
 	err = modifyRepoData(ctx, c, userName, repoName, func(item *repoStorageData) {
-		item.Status = statusReady
-		item.ErrorCause = ""
+		// An import that is still in progress is left to finish, and the
+		// repo stays paused if it was paused while initializing.
+		importing := !resume && item.Status == statusInitializing
+		if !importing {
+			if item.Status != statusPaused {
+				item.Status = statusReady
+			}
+			item.ErrorCause = ""
+			item.LastCompletedPR = 0
+		}
+		item.LastSyncedAt = time.Now()
+		item.LastPRCount = nReviews
+		item.LastStatusCount = nStatuses
+		if rate != nil {
+			item.RateRemaining = rate.Remaining
+			item.RateReset = rate.Reset.Time
+		}
 	})
 
 	if err != nil {
-		errorf("Can't change repo status for %s/%s: %s",
-			userName,
-			repoName,
-			err.Error(),
-		)
+		errorf("Can't change repo status: %s", err.Error())
+		return
 	}
+	logger.Done()
 }
 
 // All webhooks are sent a "ping" event on creation
@@ -163,6 +320,7 @@ func pingHook(ctx context.Context, c *datastore.Client, userName, repoName strin
 
 	err = modifyRepoData(ctx, c, userName, repoName, func(item *repoStorageData) {
 		item.Status = statusInitializing
+		item.HookVerified = time.Now()
 	})
 
 	if err != nil {
@@ -170,27 +328,272 @@ func pingHook(ctx context.Context, c *datastore.Client, userName, repoName strin
 	}
 
 	// Pass off to initialization
-	initialize(ctx, c, userName, repoName)
+	initialize(ctx, c, userName, repoName, true)
 }
 
-type hookHandler struct {
-	projectID string
+// coreRateLimit returns the client's current quota for the core GitHub API.
+//
+// Reading the rate limit does not count against the quota.
+func coreRateLimit(ctx context.Context, client *github.Client) (*github.Rate, error) {
+	limits, _, err := client.RateLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limits.Core == nil {
+		return nil, errors.New("no core API rate limit returned")
+	}
+	return limits.Core, nil
 }
 
-func (h *hookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
+// statusEventReports converts the payload of a "status" event into the CI
+// report for the single commit it describes.
+func statusEventReports(content []byte) (map[string][]ci.Report, error) {
+	var event github.StatusEvent
+	if err := json.Unmarshal(content, &event); err != nil {
+		return nil, err
+	}
+	if event.SHA == nil {
+		return nil, errors.New("status event has no commit SHA")
+	}
 
-	sigHex := req.Header.Get(githubSignatureHeader)
-	if !strings.HasPrefix(sigHex, "sha1=") || strings.TrimPrefix(sigHex, "sha1=") == "" {
-		log.Printf("Hook hit with no signature")
-		http.Error(w, "Webhook requires "+githubSignatureHeader+" header", http.StatusBadRequest)
+	status := &github.RepoStatus{
+		ID:          event.ID,
+		State:       event.State,
+		TargetURL:   event.TargetURL,
+		Description: event.Description,
+		Context:     event.Context,
+	}
+	if event.CreatedAt != nil {
+		status.CreatedAt = &event.CreatedAt.Time
+	}
+	if event.UpdatedAt != nil {
+		status.UpdatedAt = &event.UpdatedAt.Time
+	}
+	report, err := mirror.ConvertStatus(status, mirrorOptions)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]ci.Report{
+		*event.SHA: []ci.Report{*report},
+	}, nil
+}
+
+// handleStatusEvent mirrors just the commit status described by a "status"
+// event, rather than re-reading the statuses for the entire repository.
+func handleStatusEvent(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, content []byte) {
+	reports, err := statusEventReports(content)
+	if err != nil {
+		log.Printf("Can't parse payload for status hook: %s, %s", err.Error(), content)
+		return
+	}
+
+	mirrorChanges(ctx, c, userName, repoName, repoData, "status", func(repo repository.Repo, logChan chan<- string) error {
+		return mirror.WriteNewReports(reports, repo, logChan, mirrorOptions)
+	})
+}
+
+// pullRequestEventPullRequest returns the pull request described by a
+// "pull_request" event, and whether the event only changed its labels, which
+// are recorded in its review request, so that its comments need not be read.
+func pullRequestEventPullRequest(content []byte) (pr *github.PullRequest, labelsOnly bool, err error) {
+	event, err := mirror.UnmarshalPullRequestEvent(content)
+	if err != nil {
+		return nil, false, err
+	}
+	if event.PullRequest == nil || event.PullRequest.Number == nil {
+		return nil, false, errors.New("pull request event has no pull request")
+	}
+	switch event.GetAction() {
+	case "labeled", "unlabeled":
+		return event.PullRequest, true, nil
+	}
+	return event.PullRequest, false, nil
+}
+
+// handlePullRequestEvent mirrors just the pull request that a "pull_request"
+// event is about, rather than re-reading every pull request in the repository.
+func handlePullRequestEvent(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, content []byte) {
+	pr, labelsOnly, err := pullRequestEventPullRequest(content)
+	if err != nil {
+		log.Printf("Can't parse payload for pull request hook: %s, %s", err.Error(), content)
+		return
+	}
+	if labelsOnly {
+		mirrorChanges(ctx, c, userName, repoName, repoData, fmt.Sprintf("labels of pull request #%d", *pr.Number), func(repo repository.Repo, logChan chan<- string) error {
+			return mirror.SyncReviewRequest(pr, repo, logChan, mirrorOptions)
+		})
+		return
+	}
+
+	client, err := githubClients.Client(userName, repoName, repoData.Token)
+	if err != nil {
+		log.Printf("Can't create the GitHub client for %s/%s: %s", userName, repoName, err.Error())
+		return
+	}
+	mirrorChanges(ctx, c, userName, repoName, repoData, fmt.Sprintf("pull request #%d", *pr.Number), func(repo repository.Repo, logChan chan<- string) error {
+		syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+		defer cancel()
+		return mirror.SyncPullRequest(syncCtx, pr, repo, userName, repoName, mirror.NewPullRequestsService(client), client.Issues, logChan, mirrorOptions)
+	})
+}
+
+// mirrorChanges clones the repository, writes the changes from a single event
+// to it using the given function, and then pushes the resulting notes back.
+func mirrorChanges(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, what string, write func(repo repository.Repo, logChan chan<- string) error) {
+	metrics.SyncStarted()
+	errorf := makeErrorf(ctx, c, newOpLogger("sync", userName, repoName), userName, repoName)
+
+	repo, cleanup, err := clone(ctx, userName, repoName, repoData.Token, cloneConfig.filterFor(repoData.SizeKB), notesRefPattern, notesIdentity, notesRemote)
+	if err != nil {
+		errorf("Can't clone repo: %v", err)
+		return
+	}
+	defer cleanup()
+
+	logChan := make(chan string, 1000)
+	go func() {
+		for msg := range logChan {
+			log.Printf(msg)
+		}
+	}()
+	err = write(repo, logChan)
+	close(logChan)
+	var writeErr *mirror.WriteError
+	if errors.As(err, &writeErr) {
+		// The items that were written are still pushed.
+		errorf(err.Error())
+	} else if err != nil {
+		errorf(err.Error())
+		return
+	}
+	if err := syncNotes(ctx, repo, userName, repoName, notesRemote.name(), notesRefPattern); err != nil {
+		errorf("Error pushing %s changes for %s/%s: %s",
+			what,
+			userName,
+			repoName,
+			err.Error())
 		return
 	}
+	if err == nil {
+		log.Printf("Success mirroring %s for %s/%s", what, userName, repoName)
+	}
 
-	sig, err := hex.DecodeString(strings.TrimPrefix(sigHex, "sha1="))
+	err = modifyRepoData(ctx, c, userName, repoName, func(item *repoStorageData) {
+		item.LastSyncedAt = time.Now()
+	})
 	if err != nil {
-		log.Printf("Hook can't decode hex signature `%s`: %s", sigHex, err.Error())
-		http.Error(w, "Can't decode signature", http.StatusBadRequest)
+		log.Printf("Can't record sync time for %s/%s: %s", userName, repoName, err.Error())
+	}
+}
+
+// verifySignatureWithAny checks that the given body was signed with any of the
+// given secrets, which allows for the hook's secret being rotated.
+func verifySignatureWithAny(header http.Header, secrets []string, body []byte) error {
+	var err error
+	for _, secret := range secrets {
+		if err = verifySignature(header, []byte(secret), body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifySignature checks that the given body was signed with the hook's secret.
+//
+// GitHub signs each delivery with both HMAC-SHA256 and the legacy HMAC-SHA1,
+// so the stronger signature is used whenever it is present.
+func verifySignature(header http.Header, secret, body []byte) error {
+	hashFunc, prefix, sigHeader := sha256.New, "sha256=", header.Get(githubSignature256Header)
+	if sigHeader == "" {
+		hashFunc, prefix, sigHeader = sha1.New, "sha1=", header.Get(githubSignatureHeader)
+	}
+	if !strings.HasPrefix(sigHeader, prefix) || strings.TrimPrefix(sigHeader, prefix) == "" {
+		return fmt.Errorf("malformed signature `%s`", sigHeader)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(sigHeader, prefix))
+	if err != nil {
+		return fmt.Errorf("can't decode hex signature `%s`: %v", sigHeader, err)
+	}
+
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(body)
+	expectedSig := mac.Sum(nil)
+	if !hmac.Equal(expectedSig, sig) {
+		return fmt.Errorf("'%x' vs. '%x'", expectedSig, sig)
+	}
+	return nil
+}
+
+// decodePayload returns the JSON payload of a hook delivery.
+//
+// Hooks are created with the "json" content type, but they can be reconfigured
+// to use the "form" content type, in which case the JSON is sent in the
+// "payload" form field.
+func decodePayload(contentType string, body []byte) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != formContentType {
+		return body, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	payload := form.Get("payload")
+	if payload == "" {
+		return nil, errors.New("form-encoded delivery has no payload field")
+	}
+	return []byte(payload), nil
+}
+
+type hookHandler struct {
+	// secrets caches the repos' hook secrets, to check the deliveries'
+	// signatures with.
+	secrets *secretCache
+
+	// dispatch starts mirroring the changes described by a delivery in the
+	// background; it must not block.
+	dispatch func(handler eventHandler, userName, repoName string, content []byte)
+}
+
+// newHookHandler returns the handler of the web hook deliveries, which uses the
+// given datastore client.
+func newHookHandler(c *datastore.Client) *hookHandler {
+	load := func(ctx context.Context, user, repo string) (repoStorageData, error) {
+		return getRepoData(ctx, c, user, repo)
+	}
+	return &hookHandler{
+		secrets: newSecretCache(load),
+		dispatch: func(handler eventHandler, userName, repoName string, content []byte) {
+			go func() {
+				ctx, done := context.WithCancel(context.Background())
+				defer done()
+
+				// The cached data may be stale, and mirroring needs the
+				// current token and status.
+				repo, err := getRepoData(ctx, c, userName, repoName)
+				if err != nil {
+					log.Printf("Hook can't retrieve repo %s/%s: %s", userName, repoName, err.Error())
+					return
+				}
+				if repo.Status == statusPaused {
+					log.Printf("Ignoring event for paused repo %s/%s", userName, repoName)
+					return
+				}
+				handler(ctx, c, userName, repoName, repo, content)
+			}()
+		},
+	}
+}
+
+// ServeHTTP checks the signature of a web hook delivery, and then responds to it
+// straight away, as GitHub gives up on deliveries that take more than a few
+// seconds. The changes are mirrored in the background.
+func (h *hookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Header.Get(githubSignature256Header) == "" && req.Header.Get(githubSignatureHeader) == "" {
+		log.Printf("Hook hit with no signature")
+		http.Error(w, "Webhook requires "+githubSignature256Header+" or "+githubSignatureHeader+" header", http.StatusBadRequest)
 		return
 	}
 
@@ -218,51 +621,221 @@ func (h *hookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	userName := pathParts[2]
 	repoName := pathParts[3]
 
-	c, err := datastore.NewClient(ctx, h.projectID)
+	repo, err := h.secrets.get(ctx, userName, repoName, false)
 	if err != nil {
-		log.Printf("Hook cannot connect to the datastore: %v", err)
-		http.Error(w, "Cannot connect to the datastore", http.StatusInternalServerError)
+		log.Printf("Hook can't retrieve repo: %s", err.Error())
+		http.Error(w, "Can't retrieve repo information", http.StatusInternalServerError)
 		return
 	}
 
-	repo, err := getRepoData(ctx, c, userName, repoName)
+	// The signature covers the raw request body, so it has to be checked
+	// before the payload is decoded.
+	if err := verifySignatureWithAny(req.Header, repo.HookSecrets(time.Now()), content); err != nil {
+		// The secret may have been rotated since it was cached.
+		repo, err = h.secrets.refreshSecrets(ctx, userName, repoName)
+		if err == nil {
+			err = verifySignatureWithAny(req.Header, repo.HookSecrets(time.Now()), content)
+		}
+		if err != nil {
+			log.Printf("Hook hit with invalid signature: %s", err.Error())
+			http.Error(w, "Invalid signature", http.StatusBadRequest)
+			return
+		}
+	}
+
+	content, err = decodePayload(req.Header.Get("Content-Type"), content)
 	if err != nil {
-		log.Printf("Hook can't retrieve repo: %s", err.Error())
-		http.Error(w, "Can't retrieve repo information", http.StatusInternalServerError)
+		log.Printf("Hook can't decode payload: %s", err.Error())
+		http.Error(w, "Can't decode payload", http.StatusBadRequest)
 		return
 	}
 
-	mac := hmac.New(sha1.New, []byte(repo.HookSecret))
-	mac.Write(content)
-	expectedSig := mac.Sum(nil)
-	if !bytes.Equal(expectedSig, sig) {
-		log.Printf("Hook hit with invalid signature; '%x' vs. '%x'", expectedSig, sig)
-		http.Error(w, "Invalid signature", http.StatusBadRequest)
+	handler := dispatchEvent(event, content)
+	if handler == nil {
+		log.Printf("Ignoring irrelevant %q event for %s/%s", event, userName, repoName)
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	go func() {
-		ctx, done := context.WithCancel(context.Background())
-		defer done()
-
-		if event == eventPing {
-			pingHook(ctx, c, userName, repoName, repo, content)
+	if repo.Status == statusPaused {
+		// The repo may have been resumed since it was cached, in which case
+		// this is likely the ping that makes it catch up.
+		repo, err = h.secrets.get(ctx, userName, repoName, true)
+		if err == nil && repo.Status == statusPaused {
+			log.Printf("Ignoring %q event for paused repo %s/%s", event, userName, repoName)
+			w.WriteHeader(http.StatusOK)
 			return
 		}
-		initialize(ctx, c, userName, repoName)
-	}()
+	}
+
+	h.dispatch(handler, userName, repoName, content)
 	w.WriteHeader(http.StatusOK)
 }
 
+// eventHandler mirrors the changes described by a single web hook event.
+type eventHandler func(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, content []byte)
+
+// eventHandlers maps each of the events that hooks are subscribed to onto its
+// handler.
+var eventHandlers = map[string]eventHandler{
+	eventPing:          pingHook,
+	eventStatus:        handleStatusEvent,
+	eventPullRequest:   handlePullRequestEvent,
+	eventDiffComment:   handleCommentEvent,
+	eventIssueComment:  handleCommentEvent,
+	eventCommitComment: handleCommitCommentEvent,
+}
+
+// dispatchEvent returns the handler for the given event, or nil if the event
+// doesn't affect anything that is mirrored.
+func dispatchEvent(event string, content []byte) eventHandler {
+	if event == eventIssueComment && !issueCommentOnPullRequest(content) {
+		// Comments on plain issues trigger the same event as comments on
+		// pull requests.
+		return nil
+	}
+	return eventHandlers[event]
+}
+
+// issueCommentOnPullRequest reports whether the payload of an "issue_comment"
+// event is for a comment on a pull request, rather than on a plain issue.
+func issueCommentOnPullRequest(content []byte) bool {
+	var payload struct {
+		Issue struct {
+			PullRequest *json.RawMessage `json:"pull_request"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		// Err on the side of mirroring.
+		return true
+	}
+	return payload.Issue.PullRequest != nil
+}
+
+// handleCommentEvent handles the events for new or edited comments, by
+// re-reading everything, even if an import of the repo was interrupted part way
+// through.
+func handleCommentEvent(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, content []byte) {
+	initialize(ctx, c, userName, repoName, false)
+}
+
+// handleCommitCommentEvent mirrors the comment on a commit, outside of any pull
+// request, that a "commit_comment" event is about.
+func handleCommitCommentEvent(ctx context.Context, c *datastore.Client, userName, repoName string, repoData repoStorageData, content []byte) {
+	commitComment, err := mirror.ConvertCommitCommentEvent(content, mirrorOptions)
+	if err != nil {
+		log.Printf("Can't parse payload for commit comment hook: %s, %s", err.Error(), content)
+		return
+	}
+
+	mirrorChanges(ctx, c, userName, repoName, repoData, "commit comment", func(repo repository.Repo, logChan chan<- string) error {
+		return mirror.WriteNewCommitComment(*commitComment, repo, logChan, mirrorOptions)
+	})
+}
+
+// prometheusMetrics makes the mirror's metrics be recorded for Prometheus, and
+// returns the handler that they are scraped from.
+func prometheusMetrics(projectID string) (http.Handler, error) {
+	c, err := datastore.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to the datastore: %v", err)
+	}
+	recorder, err := prometheus.NewRecorder(func() (map[string]int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsCountTimeout)
+		defer cancel()
+		return countReposByStatus(ctx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.SetRecorder(recorder)
+	return recorder.Handler(), nil
+}
+
+// githubClients holds the GitHub clients of the repos, so the syncs of a repo
+// share one client until its token is updated.
+var githubClients auth.ClientCache
+
+// notesRefPattern is the pattern of the notes refs that are pulled and pushed.
+var notesRefPattern string
+
+// notesIdentity is the git identity that the notes commits are made with.
+var notesIdentity gitIdentity
+
+// notesRemote is the remote that the notes are pushed to.
+var notesRemote pushRemote
+
+// cloneConfig selects whether repositories are cloned in full or partially.
+var cloneConfig cloneOptions
+
+// mirrorOptions control how the data read from GitHub is mirrored.
+var mirrorOptions mirror.Options
+
 func main() {
 	projectID, err := metadata.ProjectID()
 	if err != nil {
 		log.Fatalf("Failed to read the project ID from the metadata server: %v", err)
 	}
 
-	http.Handle("/hook/", &hookHandler{
-		projectID: projectID,
-	})
+	notesRefPattern, err = configuredNotesRefPattern()
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", notesRefPatternEnv, err)
+	}
+
+	notesIdentity, err = configuredGitIdentity()
+	if err != nil {
+		log.Fatalf("Invalid %s or %s: %v", gitUserNameEnv, gitUserEmailEnv, err)
+	}
+
+	notesRemote, err = configuredPushRemote()
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", pushRemoteURLEnv, err)
+	}
+
+	cloneConfig, err = configuredCloneOptions()
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", partialCloneThresholdEnv, err)
+	}
+
+	if format := os.Getenv(logFormatEnv); format != "" {
+		if mirrorOptions.LogFormat, err = mirror.ParseLogFormat(format); err != nil {
+			log.Fatalf("Invalid %s: %v", logFormatEnv, err)
+		}
+	}
+	mirrorOptions.MirrorReactions = os.Getenv(reactionsEnv) == "true"
+	mirrorOptions.ExpandReferences = os.Getenv(expandReferencesEnv) == "true"
+	mirrorOptions.MarkNonDefaultTargets = os.Getenv(markNonDefaultTargetsEnv) == "true"
+	mirrorOptions.SkipDrafts = os.Getenv(skipDraftsEnv) == "true"
+	mirrorOptions.MirrorMergeable = os.Getenv(mergeableEnv) == "true"
+	mirrorOptions.MirrorClosedBy = os.Getenv(closedByEnv) == "true"
+	structuredLogs = os.Getenv(oplog.StructuredEnv) == "true"
+	mirrorOptions.GhostAuthor = os.Getenv(ghostAuthorEnv)
+	if aliases := os.Getenv(contextAliasesEnv); aliases != "" {
+		if mirrorOptions.ContextAliases, err = mirror.ParseContextAliases(aliases); err != nil {
+			log.Fatalf("Invalid %s: %v", contextAliasesEnv, err)
+		}
+	}
+	if auth.RequestTimeout, err = auth.RequestTimeoutFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := datastore.NewClient(context.Background(), projectID)
+	if err != nil {
+		log.Fatalf("Can't connect to the datastore: %v", err)
+	}
+	http.Handle("/hook/", newHookHandler(c))
+
+	switch backend := os.Getenv(metricsEnv); backend {
+	case "":
+	case "prometheus":
+		handler, err := prometheusMetrics(projectID)
+		if err != nil {
+			log.Fatalf("Can't set up the Prometheus metrics: %v", err)
+		}
+		http.Handle("/metrics", handler)
+	default:
+		log.Fatalf("Invalid %s: unknown metrics backend %q", metricsEnv, backend)
+	}
 
 	appengine.Main()
 }
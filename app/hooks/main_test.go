@@ -0,0 +1,348 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/review/ci"
+)
+
+const statusEventPayload = `{
+  "id": 214015194,
+  "sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e",
+  "name": "octocat/Hello-World",
+  "target_url": "https://ci.example.com/build/42",
+  "context": "ci/example",
+  "description": "The build succeeded!",
+  "state": "success",
+  "created_at": "2020-05-14T21:41:15Z",
+  "updated_at": "2020-05-14T21:45:02Z"
+}`
+
+func TestStatusEventReports(t *testing.T) {
+	reports, err := statusEventReports([]byte(statusEventPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitReports := reports["6dcb09b5b57875f334f61aebed695e2e4193db5e"]
+	if len(reports) != 1 || len(commitReports) != 1 {
+		t.Fatalf("Expected a single report for the event's commit, got %v", reports)
+	}
+	report := commitReports[0]
+	if report.Status != ci.StatusSuccess || report.Agent != "ci/example" ||
+		report.URL != "https://ci.example.com/build/42" {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func TestStatusEventReportsRequiresSHA(t *testing.T) {
+	if _, err := statusEventReports([]byte(`{"state": "success"}`)); err == nil {
+		t.Error("Expected an error for a status event with no commit")
+	}
+}
+
+const pingEventPayload = `{"zen": "Keep it logically awesome.", "hook_id": 42}`
+
+func sign(hashFunc func() hash.Hash, secret, body []byte) string {
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestFormEncodedPing(t *testing.T) {
+	secret := []byte("hook secret")
+	body := []byte(url.Values{"payload": {pingEventPayload}}.Encode())
+	header := http.Header{}
+	header.Set("Content-Type", formContentType)
+	header.Set(githubSignatureHeader, "sha1="+sign(sha1.New, secret, body))
+	header.Set(githubSignature256Header, "sha256="+sign(sha256.New, secret, body))
+
+	if err := verifySignature(header, secret, body); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := decodePayload(header.Get("Content-Type"), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != pingEventPayload {
+		t.Errorf("Unexpected payload %q", payload)
+	}
+}
+
+func TestJSONPayloadIsUnchanged(t *testing.T) {
+	payload, err := decodePayload("application/json", []byte(pingEventPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != pingEventPayload {
+		t.Errorf("Unexpected payload %q", payload)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("hook secret")
+	body := []byte(pingEventPayload)
+
+	sha1Only := http.Header{}
+	sha1Only.Set(githubSignatureHeader, "sha1="+sign(sha1.New, secret, body))
+	if err := verifySignature(sha1Only, secret, body); err != nil {
+		t.Errorf("Expected a valid SHA1 signature to be accepted: %v", err)
+	}
+
+	wrongSecret := http.Header{}
+	wrongSecret.Set(githubSignature256Header, "sha256="+sign(sha256.New, []byte("other"), body))
+	wrongSecret.Set(githubSignatureHeader, "sha1="+sign(sha1.New, secret, body))
+	if err := verifySignature(wrongSecret, secret, body); err == nil {
+		t.Error("Expected an invalid SHA256 signature to be rejected")
+	}
+}
+
+func TestVerifySignatureWithRotatedSecret(t *testing.T) {
+	body := []byte(pingEventPayload)
+	header := http.Header{}
+	header.Set(githubSignature256Header, "sha256="+sign(sha256.New, []byte("old secret"), body))
+
+	if err := verifySignatureWithAny(header, []string{"new secret", "old secret"}, body); err != nil {
+		t.Errorf("Expected a delivery signed with the previous secret to be accepted: %v", err)
+	}
+	if err := verifySignatureWithAny(header, []string{"new secret"}, body); err == nil {
+		t.Error("Expected a delivery signed with an expired secret to be rejected")
+	}
+}
+
+func buildPullRequestEvent(action string) []byte {
+	return []byte(`{
+  "action": "` + action + `",
+  "number": 7,
+  "pull_request": {
+    "number": 7,
+    "state": "closed",
+    "title": "Bug fixes.",
+    "user": {"login": "helpful_contributor"},
+    "head": {"ref": "bug-fixes", "sha": "6dcb09b5b57875f334f61aebed695e2e4193db5e"},
+    "base": {"ref": "master", "sha": "f7a3c0b0f5d0b8b1d0e0e0c6a3b6b3b7b6e0e0c6"}
+  },
+  "label": {"name": "needs-review"}
+}`)
+}
+
+func TestPullRequestEventPullRequest(t *testing.T) {
+	for _, action := range []string{"closed", "opened", "edited", "synchronize"} {
+		pr, labelsOnly, err := pullRequestEventPullRequest(buildPullRequestEvent(action))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pr == nil || pr.GetNumber() != 7 || labelsOnly {
+			t.Errorf("Expected the %q action to update pull request #7, got %v", action, pr)
+		}
+	}
+}
+
+func TestPullRequestEventUpdatesLabels(t *testing.T) {
+	for _, action := range []string{"labeled", "unlabeled"} {
+		pr, labelsOnly, err := pullRequestEventPullRequest(buildPullRequestEvent(action))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pr == nil || pr.GetNumber() != 7 || !labelsOnly {
+			t.Errorf("Expected the %q action to update the labels of pull request #7, got %v", action, pr)
+		}
+	}
+}
+
+func buildIssueCommentEvent(issue string) []byte {
+	return []byte(`{
+  "action": "created",
+  "issue": ` + issue + `,
+  "comment": {"body": "LGTM", "user": {"login": "helpful_contributor"}}
+}`)
+}
+
+func TestIssueCommentOnPlainIssueIsIgnored(t *testing.T) {
+	content := buildIssueCommentEvent(`{"number": 3, "title": "Crash on startup"}`)
+	if issueCommentOnPullRequest(content) {
+		t.Error("Expected a comment on a plain issue not to be on a pull request")
+	}
+	if handler := dispatchEvent(eventIssueComment, content); handler != nil {
+		t.Error("Expected a comment on a plain issue not to trigger a sync")
+	}
+}
+
+func TestIssueCommentOnPullRequestIsDispatched(t *testing.T) {
+	content := buildIssueCommentEvent(`{"number": 7, "pull_request": {"url": "https://api.github.com/repos/user/repo/pulls/7"}}`)
+	if !issueCommentOnPullRequest(content) {
+		t.Error("Expected a comment on a pull request to be recognized")
+	}
+	if handler := dispatchEvent(eventIssueComment, content); handler == nil {
+		t.Error("Expected a comment on a pull request to trigger a sync")
+	}
+}
+
+func TestCommitCommentIsDispatched(t *testing.T) {
+	if handler := dispatchEvent(eventCommitComment, []byte(`{}`)); handler == nil {
+		t.Error("Expected a commit comment to be mirrored")
+	}
+}
+
+func TestUnknownEventsAreIgnored(t *testing.T) {
+	if handler := dispatchEvent("watch", []byte(`{}`)); handler != nil {
+		t.Error("Expected an unsubscribed event to be ignored")
+	}
+}
+
+func TestHookHandlerRespondsBeforeMirroring(t *testing.T) {
+	loads := 0
+	secret := "hook secret"
+	handler := &hookHandler{
+		secrets: newSecretCache(func(ctx context.Context, user, repo string) (repoStorageData, error) {
+			loads++
+			return repoStorageData{User: user, Repo: repo, HookSecret: secret}, nil
+		}),
+	}
+	dispatched := make(chan string, 10)
+	handler.dispatch = func(h eventHandler, userName, repoName string, content []byte) {
+		dispatched <- userName + "/" + repoName
+	}
+
+	deliver := func() int {
+		body := []byte(pingEventPayload)
+		req := httptest.NewRequest("POST", "/hook/user/repo", bytes.NewReader(body))
+		req.Header.Set(githubEventHeader, eventPing)
+		req.Header.Set(githubSignature256Header, "sha256="+sign(sha256.New, []byte(secret), body))
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rec, req)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the delivery to be answered quickly; took %v", elapsed)
+		}
+		return rec.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := deliver(); code != http.StatusOK {
+			t.Fatalf("Unexpected response %d", code)
+		}
+		if repo := <-dispatched; repo != "user/repo" {
+			t.Errorf("Unexpected repo dispatched: %q", repo)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected the repo's secret to be cached; loaded it %d times", loads)
+	}
+
+	// A rotated secret is picked up without waiting for the cache to expire.
+	secret = "rotated secret"
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("Unexpected response %d for a delivery signed with a rotated secret", code)
+	}
+	if loads != 2 {
+		t.Errorf("Expected the repo to be reloaded once its secret was rotated; loaded it %d times", loads)
+	}
+}
+
+func TestHookHandlerLimitsRefreshes(t *testing.T) {
+	loads := 0
+	handler := &hookHandler{
+		secrets: newSecretCache(func(ctx context.Context, user, repo string) (repoStorageData, error) {
+			loads++
+			return repoStorageData{User: user, Repo: repo, HookSecret: "hook secret"}, nil
+		}),
+		dispatch: func(h eventHandler, userName, repoName string, content []byte) {
+			t.Error("Expected a delivery with a bad signature not to be dispatched")
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		body := []byte(pingEventPayload)
+		req := httptest.NewRequest("POST", "/hook/user/repo", bytes.NewReader(body))
+		req.Header.Set(githubEventHeader, eventPing)
+		req.Header.Set(githubSignature256Header, "sha256="+sign(sha256.New, []byte("wrong secret"), body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected a delivery with a bad signature to be rejected, got %d", rec.Code)
+		}
+	}
+	// The repo is loaded once, and then refreshed once for the first bad
+	// signature, but not for the next ones.
+	if loads != 2 {
+		t.Errorf("Expected the repo to be loaded twice; loaded it %d times", loads)
+	}
+
+	// Once the refresh interval has passed, the repo may be refreshed again.
+	entry := handler.secrets.entries["user/repo"]
+	entry.refreshed = entry.refreshed.Add(-secretRefreshInterval)
+	handler.secrets.entries["user/repo"] = entry
+	if _, err := handler.secrets.refreshSecrets(context.Background(), "user", "repo"); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 3 {
+		t.Errorf("Expected the repo to be refreshed after the interval; loaded it %d times", loads)
+	}
+}
+
+func TestHookHandlerIgnoresPausedRepos(t *testing.T) {
+	secret := "hook secret"
+	status := statusPaused
+	handler := &hookHandler{
+		secrets: newSecretCache(func(ctx context.Context, user, repo string) (repoStorageData, error) {
+			return repoStorageData{User: user, Repo: repo, HookSecret: secret, Status: status}, nil
+		}),
+	}
+	dispatched := 0
+	handler.dispatch = func(h eventHandler, userName, repoName string, content []byte) {
+		dispatched++
+	}
+
+	deliver := func() int {
+		body := []byte(pingEventPayload)
+		req := httptest.NewRequest("POST", "/hook/user/repo", bytes.NewReader(body))
+		req.Header.Set(githubEventHeader, eventPing)
+		req.Header.Set(githubSignature256Header, "sha256="+sign(sha256.New, []byte(secret), body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("Expected the delivery for a paused repo to be acknowledged, got %d", code)
+	}
+	if dispatched != 0 {
+		t.Errorf("Expected nothing to be mirrored for a paused repo; dispatched %d deliveries", dispatched)
+	}
+
+	// Resuming the repo pings its hook, which must not be ignored just
+	// because the paused status is still cached.
+	status = statusInitializing
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("Unexpected response %d", code)
+	}
+	if dispatched != 1 {
+		t.Errorf("Expected the delivery for a resumed repo to be dispatched; dispatched %d deliveries", dispatched)
+	}
+}
@@ -18,83 +18,140 @@ package main
 
 // Storage for persistent repository metadata: what they are, what their keys
 // are, etc.
-// Uses standarad datastore client library.
+// Uses standarad datastore client library, via the store package.
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/google/git-pull-request-mirror/store"
 	"golang.org/x/net/context"
 )
 
-type repoStorageData struct {
-	User       string
-	Repo       string
-	Token      string // TODO(jhgilles): add another layer of encryption here?
-	HookID     int
-	HookSecret string
-	Status     string
-	ErrorCause string
-}
+type repoStorageData = store.Repo
 
 const (
-	repoKind  = "repo"
-	emptyKind = "empty"
+	statusValidating        = store.StatusValidating
+	statusInitializing      = store.StatusInitializing
+	statusHooksInitializing = store.StatusHooksInitializing
+	statusReady             = store.StatusReady
+	statusError             = store.StatusError
+	statusPaused            = store.StatusPaused
+)
 
-	storageReposPath = "repos"
+// secretCacheTTL is how long the hook secrets of a repo are cached for.
+const secretCacheTTL = time.Minute
 
-	statusValidating        = "Validating"         // Verifying repo w/ github
-	statusInitializing      = "Initializing"       // Performing initial pull-all
-	statusHooksInitializing = "Hooks Initializing" // Setting up hooks
-	statusReady             = "Ready"              // Ready and waiting for hooks
-	statusError             = "Error"              // Hit an unrecoverable error
-)
+// secretRefreshInterval is how often the data of a repo may be read again
+// because a delivery's signature didn't match the cached secrets; see
+// refreshSecrets.
+const secretRefreshInterval = 5 * time.Second
+
+// repoLoader reads the data of a single repo; getRepoData is one.
+type repoLoader func(ctx context.Context, user, repo string) (repoStorageData, error)
+
+// secretCache caches the data of the repos that web hooks are delivered for, so
+// that the signature of a delivery can usually be checked without a datastore
+// round-trip.
+//
+// App Engine's memcache isn't available in the flexible environment, so the
+// cache is kept in memory, and each instance of the service has its own.
+type secretCache struct {
+	load repoLoader
+
+	mu      sync.Mutex
+	entries map[string]cachedRepo
+}
+
+// cachedRepo is an entry of a secretCache.
+type cachedRepo struct {
+	repo    repoStorageData
+	fetched time.Time
+
+	// refreshed is when the entry was last read again by refreshSecrets.
+	refreshed time.Time
+}
+
+func newSecretCache(load repoLoader) *secretCache {
+	return &secretCache{
+		load:    load,
+		entries: make(map[string]cachedRepo),
+	}
+}
 
-// setRepoError sets a repo to statusErrpr with the given cause
+// get returns the data of the given repo, which is read from the datastore if it
+// isn't cached, if it was cached more than secretCacheTTL ago, or if refresh is
+// set, e.g. because the repo's cached status is out of date.
+func (s *secretCache) get(ctx context.Context, user, repo string, refresh bool) (repoStorageData, error) {
+	entry, ok := s.entry(user, repo)
+	if ok && !refresh && time.Since(entry.fetched) < secretCacheTTL {
+		return entry.repo, nil
+	}
+	return s.reload(ctx, user, repo, entry.refreshed)
+}
+
+// refreshSecrets returns the data of the given repo, read again from the
+// datastore because its cached secrets didn't match those of a delivery, e.g.
+// because they were rotated. Anyone can send a delivery with a bad signature,
+// though, so the data is only read again once every secretRefreshInterval for
+// each repo; otherwise, it is returned as for get.
+func (s *secretCache) refreshSecrets(ctx context.Context, user, repo string) (repoStorageData, error) {
+	now := time.Now()
+	if entry, ok := s.entry(user, repo); ok && now.Sub(entry.refreshed) < secretRefreshInterval {
+		return s.get(ctx, user, repo, false)
+	}
+	return s.reload(ctx, user, repo, now)
+}
+
+// entry returns the cache entry of the given repo, if there is one.
+func (s *secretCache) entry(user, repo string) (cachedRepo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[user+"/"+repo]
+	return entry, ok
+}
+
+// reload reads the data of the given repo from the datastore, and caches it as
+// last refreshed at the given time.
+func (s *secretCache) reload(ctx context.Context, user, repo string, refreshed time.Time) (repoStorageData, error) {
+	now := time.Now()
+	data, err := s.load(ctx, user, repo)
+	if err != nil {
+		return repoStorageData{}, err
+	}
+	s.mu.Lock()
+	s.entries[user+"/"+repo] = cachedRepo{repo: data, fetched: now, refreshed: refreshed}
+	s.mu.Unlock()
+	return data, nil
+}
+
+// setRepoError sets a repo to statusError with the given cause, and records
+// it in the repo's error history.
 func setRepoError(ctx context.Context, c *datastore.Client, user, repo, errorCause string) error {
 	return modifyRepoData(ctx, c, user, repo, func(item *repoStorageData) {
-		item.Status = statusError
-		item.ErrorCause = errorCause
+		item.RecordError(time.Now(), errorCause)
 	})
 }
 
 func modifyRepoData(ctx context.Context, c *datastore.Client, user, repo string, f func(*repoStorageData)) error {
-	_, err := c.RunInTransaction(ctx, func(txn *datastore.Transaction) error {
-		key := makeRepoKey(user, repo)
-
-		var item repoStorageData
-		if err := c.Get(ctx, key, &item); err != nil {
-			return err
-		}
-
-		f(&item)
-		if _, err := c.Put(ctx, key, &item); err != nil {
-			return err
-		}
-		return nil
-	})
-	return err
+	return store.ModifyRepo(ctx, c, user, repo, f)
 }
 
 // getRepoData returns the data for a single repo
-func getRepoData(ctx context.Context, c *datastore.Client, user, repo string) (result repoStorageData, err error) {
-	key := makeRepoKey(user, repo)
-	err = c.Get(ctx, key, &result)
-	return result, err
-}
-
-func makeReposRootKey() *datastore.Key {
-	return datastore.NameKey(
-		emptyKind,
-		storageReposPath,
-		nil,
-	)
+func getRepoData(ctx context.Context, c *datastore.Client, user, repo string) (repoStorageData, error) {
+	return store.GetRepo(ctx, c, user, repo)
 }
 
-func makeRepoKey(user, repo string) *datastore.Key {
-	return datastore.NameKey(
-		repoKind,
-		fmt.Sprintf("%s/%s", user, repo),
-		makeReposRootKey(),
-	)
+// countReposByStatus returns the number of repos in each status.
+func countReposByStatus(ctx context.Context, c *datastore.Client) (map[string]int, error) {
+	repos, err := store.ListRepos(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, repo := range repos {
+		counts[repo.Status]++
+	}
+	return counts, nil
 }
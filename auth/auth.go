@@ -24,8 +24,15 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -37,35 +44,232 @@ const (
 Note that the 'public_repo' scope is needed for public repositories,
 And the 'repo' scope is needed for private repositories.
 `
+
+	// CABundleEnv names the environment variable that, if set, holds the path
+	// of a PEM file of CA certificates to trust in addition to the system ones,
+	// e.g. for a GitHub Enterprise instance whose certificate was issued by a
+	// private CA.
+	CABundleEnv = "MIRROR_CA_BUNDLE"
+
+	// RequestTimeoutEnv names the environment variable that, if set, holds
+	// the RequestTimeout of the services, as a duration such as "45s".
+	RequestTimeoutEnv = "MIRROR_REQUEST_TIMEOUT"
+
+	// DefaultRequestTimeout is the default of RequestTimeout.
+	DefaultRequestTimeout = 30 * time.Second
 )
 
+// RequestTimeout bounds how long each request to the GitHub API made by the
+// clients built here may take, including reading the response body, so that a
+// stalled connection can't hang a sync. Zero means no timeout. It is meant to be
+// set once, before any client is built.
+var RequestTimeout = DefaultRequestTimeout
+
+// RequestTimeoutFromEnv returns the request timeout set by RequestTimeoutEnv,
+// or DefaultRequestTimeout if it isn't set.
+func RequestTimeoutFromEnv() (time.Duration, error) {
+	timeout := os.Getenv(RequestTimeoutEnv)
+	if timeout == "" {
+		return DefaultRequestTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q; must be a duration such as \"45s\", or 0 for no timeout", RequestTimeoutEnv, timeout)
+	}
+	return d, nil
+}
+
 // UnauthenticatedClient builds a github client that uses http.Client's default
 // HTTP transport.
 // The client will be insecure and extremely rate-limited; non-authenticated
 // users are limited to 60 requests / hour.
 func UnauthenticatedClient() *github.Client {
-	return github.NewClient(nil)
+	return github.NewClient(&http.Client{Timeout: RequestTimeout})
 }
 
-// TokenClient takes an oauth token and returns an authenticated github client.
-// The client is guaranteed to work.
-func TokenClient(token string) *github.Client {
-	httpClient := oauth2.NewClient(
-		oauth2.NoContext,
-		oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: token},
-		),
-	)
+// NewClient takes an oauth token and returns an authenticated github client,
+// which trusts the CA bundle named by CABundleEnv, if any.
+//
+// Unlike NewTokenClient, this does not check that the token works.
+func NewClient(ctx context.Context, token string) (*github.Client, error) {
+	httpClient, err := clientWithCABundle(ctx, token, os.Getenv(CABundleEnv))
+	if err != nil {
+		return nil, err
+	}
+	return github.NewClient(httpClient), nil
+}
+
+// NewTokenClient takes an oauth token and returns an authenticated github
+// client, after checking that the token works.
+//
+// The client trusts the CA bundle named by CABundleEnv, if any.
+func NewTokenClient(token string) (*github.Client, error) {
+	return newTokenClient(token, os.Getenv(CABundleEnv), nil)
+}
+
+// newTokenClient is NewTokenClient, trusting the CA bundle at caPath, and
+// optionally talking to the GitHub API at the given base URL instead of the
+// default.
+func newTokenClient(token, caPath string, baseURL *url.URL) (*github.Client, error) {
+	httpClient, err := clientWithCABundle(oauth2.NoContext, token, caPath)
+	if err != nil {
+		return nil, err
+	}
 
 	githubClient := github.NewClient(httpClient)
+	if baseURL != nil {
+		githubClient.BaseURL = baseURL
+	}
+
+	if _, _, err := githubClient.Users.Get(context.TODO(), ""); err != nil {
+		return nil, fmt.Errorf("token error: %v", err)
+	}
 
-	_, _, err := githubClient.Users.Get(context.TODO(), "")
+	return githubClient, nil
+}
 
+// TokenClient takes an oauth token and returns an authenticated github client.
+// The client is guaranteed to work: if the token doesn't, then this prints
+// TokenHelp and exits the process, so it is only meant for command-line tools.
+func TokenClient(token string) *github.Client {
+	githubClient, err := NewTokenClient(token)
 	if err != nil {
-		fmt.Println("Token error: ", err)
-		fmt.Println(TokenHelp)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprint(os.Stderr, TokenHelp)
 		os.Exit(1)
 	}
-
 	return githubClient
 }
+
+// Transport returns an HTTP transport that trusts the CA certificates in the
+// PEM file at caPath, in addition to the system ones.
+//
+// The transport sends its requests through the proxy named by the HTTPS_PROXY
+// or HTTP_PROXY environment variables, if any, unless the host is excluded by
+// NO_PROXY.
+func Transport(caPath string) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if caPath == "" {
+		return transport, nil
+	}
+	pem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in the CA bundle %q", caPath)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// proxyConfigured reports whether a proxy is set in the environment.
+func proxyConfigured() bool {
+	for _, v := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if os.Getenv(v) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// clientWithCABundle returns an HTTP client that authenticates with the given
+// oauth token, and trusts the CA certificates in the PEM file at caPath.
+//
+// If caPath is empty and no proxy is configured, then the client uses the
+// transport that oauth2 would pick for ctx, which on App Engine is URL Fetch.
+func clientWithCABundle(ctx context.Context, token, caPath string) (*http.Client, error) {
+	if caPath != "" || proxyConfigured() {
+		transport, err := Transport(caPath)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	))
+	// The oauth2 transport wraps the base client's transport, but not its
+	// timeout, so that has to be set on the outer client.
+	client.Timeout = RequestTimeout
+	return client, nil
+}
+
+// ClientCache holds one GitHub client per repository, so that the operations
+// on a repository share the client's connections instead of each setting up
+// their own. The zero value is an empty cache, and it is safe for concurrent
+// use.
+//
+// The cached clients trust the CA bundle named by CABundleEnv, if any, like the
+// ones returned by NewClient.
+type ClientCache struct {
+	mu      sync.Mutex
+	clients map[string]cachedClient
+}
+
+type cachedClient struct {
+	token  string
+	client *github.Client
+}
+
+// Client returns the client for the given repository, creating it if there is
+// none yet or if the cached one was created with a different token.
+//
+// Unlike NewClient, the client is not tied to the context of the operation
+// that created it: each request is sent with the transport that oauth2 would
+// pick for the request's own context, which on App Engine is URL Fetch.
+func (c *ClientCache) Client(userName, repoName, token string) (*github.Client, error) {
+	key := userName + "/" + repoName
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.clients[key]; ok && cached.token == token {
+		return cached.client, nil
+	}
+	client, err := newSharedClient(token, os.Getenv(CABundleEnv))
+	if err != nil {
+		return nil, err
+	}
+	if c.clients == nil {
+		c.clients = make(map[string]cachedClient)
+	}
+	c.clients[key] = cachedClient{token: token, client: client}
+	return client, nil
+}
+
+// newSharedClient returns a github client that authenticates with the given
+// oauth token, trusts the CA certificates in the PEM file at caPath, and can be
+// used from any context.
+func newSharedClient(token, caPath string) (*github.Client, error) {
+	var base http.RoundTripper = contextTransport{}
+	if caPath != "" || proxyConfigured() {
+		transport, err := Transport(caPath)
+		if err != nil {
+			return nil, err
+		}
+		base = transport
+	}
+	return github.NewClient(&http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+			Base:   base,
+		},
+		Timeout: RequestTimeout,
+	}), nil
+}
+
+// contextTransport sends each request through the HTTP client that oauth2
+// would use for the request's context.
+type contextTransport struct{}
+
+func (contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := oauth2.NewClient(req.Context(), nil).Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+func TestNewTokenClientRejectsBadToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer good-token" {
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"login": "user"}`))
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTokenClient("bad-token", "", baseURL); err == nil {
+		t.Error("Expected an error for a bad token")
+	}
+	if client, err := newTokenClient("good-token", "", baseURL); err != nil || client == nil {
+		t.Errorf("Expected a client for a good token; got %v, %v", client, err)
+	}
+}
+
+func TestNewTokenClientWithCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"login": "user"}`))
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTokenClient("good-token", "", baseURL); err == nil {
+		t.Error("Expected the server's certificate not to be trusted without the CA bundle")
+	}
+	if client, err := newTokenClient("good-token", caPath, baseURL); err != nil || client == nil {
+		t.Errorf("Expected a client trusting the CA bundle; got %v, %v", client, err)
+	}
+	if _, err := newTokenClient("good-token", filepath.Join(dir, "missing.pem"), baseURL); err == nil {
+		t.Error("Expected an error for a missing CA bundle")
+	}
+}
+
+func TestTransportUsesProxyFromEnvironment(t *testing.T) {
+	transport, err := Transport("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok || httpTransport.Proxy == nil {
+		t.Fatalf("Expected a transport that reads the proxy from the environment, got %+v", transport)
+	}
+	if transport == http.DefaultTransport {
+		t.Error("Expected a copy of the default transport, rather than the shared one")
+	}
+}
+
+func TestClientCacheReusesClientUntilTokenChanges(t *testing.T) {
+	var cache ClientCache
+	first, err := cache.Client("user", "repo", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := cache.Client("user", "repo", "token"); err != nil || again != first {
+		t.Errorf("Expected the cached client, got %p, %v", again, err)
+	}
+	if other, err := cache.Client("user", "other-repo", "token"); err != nil || other == first {
+		t.Errorf("Expected a separate client for another repo, got %p, %v", other, err)
+	}
+	updated, err := cache.Client("user", "repo", "new-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated == first {
+		t.Error("Expected a new client after the token changed")
+	}
+	if again, err := cache.Client("user", "repo", "new-token"); err != nil || again != updated {
+		t.Errorf("Expected the client for the new token to be cached, got %p, %v", again, err)
+	}
+}
+
+func TestClientCacheConcurrentUse(t *testing.T) {
+	var cache ClientCache
+	var wg sync.WaitGroup
+	clients := make([]*github.Client, 10)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := cache.Client("user", "repo", "token")
+			if err != nil {
+				t.Error(err)
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+	for _, client := range clients[1:] {
+		if client != clients[0] {
+			t.Fatalf("Expected all goroutines to share one client, got %p and %p", clients[0], client)
+		}
+	}
+}
+
+func TestCachedClientUsesRequestContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"login": "user"}`))
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cache ClientCache
+	client, err := cache.Client("user", "repo", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = baseURL
+
+	// The HTTP client in the context stands in for URL Fetch on App Engine.
+	used := false
+	httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		used = true
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	if _, _, err := client.Users.Get(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !used {
+		t.Error("Expected the request to go through the HTTP client of its context")
+	}
+}
+
+func TestClientsTimeOutStalledRequests(t *testing.T) {
+	defer func(timeout time.Duration) { RequestTimeout = timeout }(RequestTimeout)
+	RequestTimeout = 50 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := newSharedClient("token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient, err := clientWithCABundle(context.Background(), "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, client := range map[string]*github.Client{
+		"shared":  shared,
+		"context": github.NewClient(httpClient),
+	} {
+		client.BaseURL = baseURL
+		start := time.Now()
+		_, _, err := client.Users.Get(context.Background(), "")
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("Expected the %s client to time out, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("The %s client took %v to time out", name, elapsed)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
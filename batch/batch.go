@@ -17,15 +17,35 @@ limitations under the License.
 // Package batch is the source for a command-line tool to pull all of the data
 // from a Github repository and write it into a local clone of that repository.
 //
-// You need to clone the repository yourself (including the "refs/pull/*" refs)
-// before running the tool.
+// You need to clone the repository yourself (including the "refs/pull/*" refs,
+// and every branch a pull request may target) before running the tool.
 //
 // Example Usage:
 //    git clone https://github.com/google/git-appraise git-appraise/
 //    cd git-appraise
+//    git fetch origin '+refs/heads/*:refs/remotes/origin/*'
 //    git fetch origin '+refs/pull/*:refs/pull/*'
 //    ~/bin/github-mirror --target google/git-appraise --local ./ -auth-token <YOUR_AUTH_TOKEN>
 //
+// To mirror several repositories in one run, pass a comma-separated list of them
+// to "-target", along with a "-local-base" directory. Each repository is then
+// mirrored into "<local-base>/<user>/<repo>", which is cloned if it is missing:
+//    ~/bin/github-mirror --target google/git-appraise,google/git-pull-request-mirror --local-base ~/mirrors -auth-token <YOUR_AUTH_TOKEN>
+//
+// To check that the notes are up to date without writing anything, e.g. in CI,
+// pass "-verify". It lists the items that differ between GitHub and the local
+// notes, and exits with a nonzero status if there are any.
+//
+// To write all of the reviews, comments, and CI reports that have been mirrored
+// into a local repository to a single JSON file, without reading anything from
+// GitHub, pass "-export":
+//    ~/bin/github-mirror --local ./ -export reviews.json
+//
+// To remove the duplicate items from the notes of a local repository, e.g. after
+// the notes history was rewritten, again without reading anything from GitHub,
+// pass "-repair":
+//    ~/bin/github-mirror --local ./ -notes-ref 'refs/notes/devtools/*' -repair
+//
 // Note that the "-auth-token" flag is optional, but highly recommended. Without it
 // your API requests will be throttled to 60 per hour.
 
@@ -33,24 +53,91 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/git-appraise/repository"
 	"github.com/google/go-github/github"
 
 	"github.com/google/git-pull-request-mirror/auth"
+	"github.com/google/git-pull-request-mirror/githubops"
 	"github.com/google/git-pull-request-mirror/mirror"
 )
 
-var remoteRepository = flag.String("target", "", "Github repository to read data from")
+// notesRemote is the remote that notes are pulled from and pushed to.
+const notesRemote = "origin"
+
+var remoteRepository = flag.String("target", "", "Github repository to read data from, or a comma-separated list of them")
 var localRepositoryDir = flag.String("local", ".", "Local repository to write notes to")
+var localBase = flag.String("local-base", "", "If set, use (or clone) the local repository at `<local-base>/<user>/<repo>' for each target, instead of -local")
 var token = flag.String("auth-token", "", "Github OAuth token with either the `repo' or `public_repo' scopes: https://github.com/settings/tokens")
 var quiet = flag.Bool("quiet", false, "Don't log information to stdout")
+var logLevel = flag.String("log-level", "info", "Detail of the log output: `error' for just the errors, `info' for progress as well, or `debug' for every item that is converted or skipped too; -quiet silences all of them")
+var verbose = flag.Bool("v", false, "Same as -log-level=debug")
+var statusRefs = flag.String("status-refs", "", "Comma-separated glob patterns of the refs whose commit statuses are mirrored; defaults to pull request heads and the default branch")
+var pullRequest = flag.Int("pr", 0, "If set, only mirror the pull request with this number")
+var prState = flag.String("state", mirror.AllPullRequests, "State of the pull requests to mirror: `open', `closed', or `all'")
+var importWindow = flag.String("import-window", "", "If set, only mirror the pull requests updated within this window, as a number of days (e.g. `90d') or a duration (e.g. `36h')")
+var prune = flag.Duration("prune", 0, "If set, remove the reviews of pull requests that were closed longer ago than this (e.g. 8760h), and stop mirroring those pull requests; off by default")
+var notesRef = flag.String("notes-ref", "", "If set, pull the git-notes matching this pattern (e.g. `refs/notes/devtools/*') from origin before mirroring, and push them back afterwards; the pattern has to cover all of the git-appraise notes refs under refs/notes/devtools")
+var outputFormat = flag.String("output-format", "text", "Format of the final summary: `text' or `json'")
+var logFormat = flag.String("log-format", "text", "Format of the log line for each mirrored item: `text' or `json'")
+var reactions = flag.Bool("reactions", false, "Append a summary of the thumbs up and thumbs down reactions to each mirrored comment")
+var expandReferences = flag.Bool("expand-references", false, "Append the URL of each issue or pull request referenced in a pull request's body, e.g. `#123', to the mirrored description, and list the users it mentions, e.g. `@user', after it")
+var markNonDefaultTargets = flag.Bool("mark-non-default-targets", false, "Name the target branch, e.g. `Target: release-2.3 (non-default)', in the description of each pull request that targets a branch other than the repository's default one")
+var skipDrafts = flag.Bool("skip-drafts", false, "Leave draft pull requests out of the mirror, rather than mirroring them with a `Draft: true' line in their descriptions")
+var mergeable = flag.Bool("mergeable", false, "With -pr, also mirror whether the pull request can be merged without conflicts, as a CI report by `github/mergeable' on its head commit")
+var closedBy = flag.Bool("closed-by", false, "Add a comment recording who closed each pull request without merging it; this needs an additional API request for each such pull request")
+var ghostAuthor = flag.String("ghost-author", mirror.DefaultGhostAuthor, "Author recorded on the comments of deleted GitHub accounts")
+var contextAliases = flag.String("context-aliases", "", "Comma-separated `pattern=agent' pairs; the commit statuses whose contexts match a pattern (a regexp) are mirrored with that agent, e.g. `(ci|continuous-integration)/build=build'. Only commas outside of a pattern's groups, character classes, and repetitions separate the pairs; escape any others as `\\,'")
+var gitUserName = flag.String("git-user-name", "", "If set, the git user name that the notes commits are made by; requires -git-user-email")
+var gitUserEmail = flag.String("git-user-email", "", "If set, the git user email address that the notes commits are made by; requires -git-user-name")
+var proxy = flag.String("proxy", "", "If set, the URL of the proxy to reach GitHub through, for both API requests and git commands; overrides the HTTPS_PROXY and HTTP_PROXY environment variables")
+var verify = flag.Bool("verify", false, "Don't write anything; instead, report the items that differ between GitHub and the local notes, and exit with a nonzero status if there are any")
+var exportPath = flag.String("export", "", "If set, don't mirror anything; instead, write all of the reviews, comments, and CI reports in the local repository (-local) to this JSON file")
+var repair = flag.Bool("repair", false, "Don't mirror anything; instead, remove the duplicate review requests, comments, and CI reports from the notes of the local repository (-local), e.g. after the notes history was rewritten. With -notes-ref, the notes are pulled before and pushed after")
+var requestTimeout = flag.Duration("request-timeout", auth.DefaultRequestTimeout, "Timeout of each request to the GitHub API, after which it is retried; 0 disables it")
+var cloneTimeout = flag.Duration("clone-timeout", 10*time.Minute, "Timeout of each git command that the tool runs, e.g. to clone a repository into -local-base, or to pull or push the notes")
+var progressInterval = flag.Int("progress-interval", 50, "Print a progress line after reading every N items; 0 disables progress output")
+
+// Levels of detail of the log output, as selected by -log-level.
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+// parseLogLevel parses the name of a level of detail of the log output.
+func parseLogLevel(name string) (int, error) {
+	switch name {
+	case "error":
+		return levelError, nil
+	case "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q; must be `error', `info', or `debug'", name)
+}
+
+// importSince is the earliest update of the pull requests that are mirrored, as
+// set by -import-window, or zero if there is no limit.
+var importSince time.Time
+
+// mirrorOptions control how the data read from GitHub is mirrored; they are set
+// from the flags in main.
+var mirrorOptions mirror.Options
 
 func usage(errorMessage string) {
 	fmt.Fprintln(os.Stderr, errorMessage)
@@ -58,95 +145,606 @@ func usage(errorMessage string) {
 	os.Exit(1)
 }
 
-func main() {
-	flag.Parse()
-	splitTarget := strings.Split(*remoteRepository, "/")
-	if len(splitTarget) != 2 {
-		usage("Target repository is required, in the format `user/repo'")
+// progressPrinter returns a progress callback that logs every *progressInterval
+// items, as well as once all of the items have been read.
+func progressPrinter(l *log.Logger, items string) mirror.ProgressFunc {
+	if *progressInterval <= 0 {
+		return nil
+	}
+	return func(done, total int) {
+		if done%*progressInterval == 0 || done == total {
+			l.Printf("Fetched %d/%d %s", done, total, items)
+		}
+	}
+}
+
+// summary is the result of mirroring one repository, as printed in the "json"
+// output format, with one line per repository.
+type summary struct {
+	Repository    string   `json:"repository"`
+	Error         string   `json:"error,omitempty"`
+	StatusesRead  int      `json:"statusesRead"`
+	ReviewsRead   int      `json:"reviewsRead"`
+	NotesWritten  int      `json:"notesWritten"`
+	ReviewsPruned int      `json:"reviewsPruned"`
+	Errors        int      `json:"errors"`
+	Skipped       int      `json:"skipped"`
+	ErrorMessages []string `json:"errorMessages"`
+	// Drift is only set by "-verify".
+	Drift *mirror.Drift `json:"drift,omitempty"`
+}
+
+// countingRepo wraps a repository to count the notes written to it.
+type countingRepo struct {
+	repository.Repo
+	notesWritten int
+}
+
+func (r *countingRepo) AppendNote(notesRef, revision string, note repository.Note) error {
+	if err := r.Repo.AppendNote(notesRef, revision, note); err != nil {
+		return err
+	}
+	// Multiple notes can be appended at once, one per line.
+	r.notesWritten += len(strings.Split(string(note), "\n"))
+	return nil
+}
+
+// describeDrift describes an item reported by "-verify".
+func describeDrift(item mirror.ItemEvent) string {
+	desc := fmt.Sprintf("%s on %s", item.Type, item.Commit)
+	if item.ReviewRef != "" {
+		desc += fmt.Sprintf(" (%s)", item.ReviewRef)
+	}
+	if item.Author != "" {
+		desc += fmt.Sprintf(" by %s", item.Author)
 	}
-	userName := splitTarget[0]
-	repoName := splitTarget[1]
+	if item.Timestamp != "" {
+		desc += fmt.Sprintf(" at %s", item.Timestamp)
+	}
+	return desc
+}
+
+// exportNotes writes everything mirrored into the local repository to the given
+// JSON file.
+func exportNotes(dir, path string) error {
+	local, err := repository.NewGitRepo(dir)
+	if err != nil {
+		return fmt.Errorf("couldn't open local repository %s: %v", dir, err)
+	}
+	bundle, err := mirror.Export(local)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
 
-	localDirInfo, err := os.Stat(*localRepositoryDir)
+// repairNotes removes the duplicate items from the notes of the local repository
+// in dir, and returns the number of notes that were removed.
+func repairNotes(ctx context.Context, dir string) (int, error) {
+	local, err := repository.NewGitRepo(dir)
 	if err != nil {
-		log.Fatal(err)
+		return 0, fmt.Errorf("couldn't open local repository %s: %v", dir, err)
+	}
+	if err := pullNotes(ctx, local, dir); err != nil {
+		return 0, err
+	}
+	removed, err := mirror.RepairNotes(local, notesRemover(ctx, dir))
+	if err != nil {
+		return removed, err
+	}
+	return removed, pushNotes(ctx, dir)
+}
+
+// runGit runs git with the given arguments in dir, and returns its combined
+// output. The command is killed if it takes longer than -clone-timeout, as may
+// happen when cloning a huge repository.
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, *cloneTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("git %s timed out after %v; clone the repository beforehand, or increase -clone-timeout", args[0], *cloneTimeout)
+	}
+	return out, err
+}
+
+// pullNotes fetches the notes from origin, if requested, and merges them into
+// the local ones, as repository.Repo.PullNotes does.
+func pullNotes(ctx context.Context, local repository.Repo, dir string) error {
+	if *notesRef == "" {
+		return nil
+	}
+	remotePattern := "refs/notes/" + notesRemote + "/" + strings.TrimPrefix(*notesRef, "refs/notes/")
+	if out, err := runGit(ctx, dir, "fetch", notesRemote, "+"+*notesRef+":"+remotePattern); err != nil {
+		return fmt.Errorf("error pulling notes: %v: %q", err, out)
+	}
+	if err := local.MergeNotes(notesRemote, *notesRef); err != nil {
+		return fmt.Errorf("error merging notes: %v", err)
+	}
+	return nil
+}
+
+// pushNotes pushes the mirrored notes back to origin, if requested.
+func pushNotes(ctx context.Context, dir string) error {
+	if *notesRef == "" {
+		return nil
+	}
+	if out, err := runGit(ctx, dir, "push", notesRemote, *notesRef+":"+*notesRef); err != nil {
+		return fmt.Errorf("error pushing notes: %v: %q", err, out)
+	}
+	return nil
+}
+
+// notesRemover returns a mirror.NotesRemover for the repository in dir.
+func notesRemover(ctx context.Context, dir string) mirror.NotesRemover {
+	return func(notesRef, revision string) error {
+		if out, err := runGit(ctx, dir, "notes", "--ref", notesRef, "remove", "--ignore-missing", revision); err != nil {
+			return fmt.Errorf("failure removing the notes for %s: %v: %q", revision, err, out)
+		}
+		return nil
+	}
+}
+
+// useGitIdentity makes the git commands that the tool runs, including the ones
+// that write notes, author and commit as the given name and email address
+// rather than the user configured in each local repository.
+func useGitIdentity(name, email string) {
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		os.Setenv(v, name)
+	}
+	for _, v := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		os.Setenv(v, email)
+	}
+}
+
+// useProxy makes both the GitHub API requests and the git commands that the
+// tool runs go through the proxy at proxyURL.
+//
+// The proxy is set in the environment, which the API clients read on their
+// first request, and which the git commands inherit. Git only reads the
+// lowercase form of some of these variables, so both forms are set.
+func useProxy(proxyURL string) error {
+	if _, err := url.Parse(proxyURL); err != nil {
+		return fmt.Errorf("invalid proxy URL %q: %v", proxyURL, err)
+	}
+	for _, v := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		os.Setenv(v, proxyURL)
+	}
+	return nil
+}
+
+// target is a GitHub repository to mirror, along with its local clone.
+type target struct {
+	userName string
+	repoName string
+	localDir string
+}
+
+func (t target) String() string {
+	return t.userName + "/" + t.repoName
+}
+
+// parseTargets parses the "-target" and "-local-base" flags.
+func parseTargets() ([]target, error) {
+	var targets []target
+	for _, name := range strings.Split(*remoteRepository, ",") {
+		splitName := strings.Split(strings.TrimSpace(name), "/")
+		if len(splitName) != 2 || splitName[0] == "" || splitName[1] == "" {
+			return nil, errors.New("Target repository is required, in the format `user/repo'")
+		}
+		t := target{userName: splitName[0], repoName: splitName[1], localDir: *localRepositoryDir}
+		if *localBase != "" {
+			t.localDir = filepath.Join(*localBase, t.userName, t.repoName)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) > 1 && *localBase == "" {
+		return nil, errors.New("A local base directory (-local-base) is required to mirror multiple repositories")
+	}
+	return targets, nil
+}
+
+// openLocal opens the local clone of the given target. When using a local base
+// directory, the clone is created if it doesn't exist yet.
+func openLocal(ctx context.Context, t target) (repository.Repo, error) {
+	if _, err := os.Stat(t.localDir); os.IsNotExist(err) && *localBase != "" {
+		if err := cloneTarget(ctx, t); err != nil {
+			return nil, err
+		}
+	}
+	localDirInfo, err := os.Stat(t.localDir)
+	if err != nil {
+		return nil, err
 	}
 	if !localDirInfo.IsDir() {
-		usage("Local repository must be a directory")
+		return nil, fmt.Errorf("local repository %s must be a directory", t.localDir)
 	}
+	local, err := repository.NewGitRepo(t.localDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open local repository %s: %v; make sure you clone the remote repository locally first", t.localDir, err)
+	}
+	return local, nil
+}
 
-	local, err := repository.NewGitRepo(*localRepositoryDir)
+// cloneTarget clones the given target into its local directory, including the
+// refs of its pull requests.
+func cloneTarget(ctx context.Context, t target) error {
+	if err := os.MkdirAll(filepath.Dir(t.localDir), 0755); err != nil {
+		return err
+	}
+	args := []string{"clone"}
+	if caPath := os.Getenv(auth.CABundleEnv); caPath != "" {
+		args = append(args, "--config", "http.sslCAInfo="+caPath)
+	}
+	args = append(args, fmt.Sprintf("https://github.com/%s/%s", t.userName, t.repoName), t.localDir)
+	if out, err := runGit(ctx, "", args...); err != nil {
+		return fmt.Errorf("failure cloning %s: %v: %q", t, err, out)
+	}
+	if out, err := runGit(ctx, t.localDir, "fetch", notesRemote, "+refs/pull/*:refs/pull/*"); err != nil {
+		return fmt.Errorf("failure fetching the pull requests of %s: %v: %q", t, err, out)
+	}
+	return nil
+}
+
+// warnAboutScopes warns about each of the targets that the token's scopes don't
+// allow reading, before anything is mirrored, as GitHub otherwise fails the
+// requests for a private repository with an opaque 404 partway through.
+//
+// Tokens that don't report their scopes, such as fine-grained ones, are not
+// checked.
+func warnAboutScopes(ctx context.Context, client *github.Client, targets []target) {
+	// APIMeta will always succeed and will tell us what scopes we have.
+	_, resp, err := client.APIMeta(ctx)
 	if err != nil {
-		log.Fatal("Couldn't open local repository: ", err.Error(), "\n",
-			"Make sure you clone the remote repository locally first!")
+		log.Printf("Warning: can't read the scopes of the token: %v", err)
+		return
+	}
+	if !githubops.HasScopes(resp) {
+		return
+	}
+	for _, t := range targets {
+		var visibility string
+		remote, _, err := client.Repositories.Get(ctx, t.userName, t.repoName)
+		var errResp *github.ErrorResponse
+		switch {
+		case err == nil && remote.GetPrivate():
+			visibility = "private"
+		case err == nil:
+			visibility = "public"
+		case errors.As(err, &errResp) && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound:
+			// GitHub responds as if the private repositories that the
+			// token can't read didn't exist.
+			visibility = "either missing or private"
+		default:
+			// The error is reported when the target is mirrored.
+			continue
+		}
+		if missing := githubops.MissingReadScopes(resp, visibility != "public"); len(missing) > 0 {
+			log.Printf("Warning: %s is %s, so the token needs the %s scope to read it, but it only has: %s",
+				t, visibility, strings.Join(missing, ", "), resp.Header.Get(githubops.ScopesHeader))
+		}
 	}
+}
 
-	tokenAuth := *token != ""
-	if !tokenAuth {
-		fmt.Fprintln(os.Stderr, "Not using authentication. Note that this will be EXTREMELY SLOW;")
-		fmt.Fprintln(os.Stderr, "you get 60 requests to the github API per hour.")
-		fmt.Fprint(os.Stderr, auth.TokenHelp)
+// syncPullRequest mirrors just the pull request selected by the "-pr" flag.
+func syncPullRequest(ctx context.Context, l *log.Logger, local repository.Repo, t target, client *github.Client) error {
+	logChan := make(chan string, 1000)
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		for msg := range logChan {
+			l.Println(msg)
+		}
+	}()
+	err := mirror.SyncSinglePullRequest(ctx, *pullRequest, local, t.userName, t.repoName, mirror.NewPullRequestsService(client), client.Issues, logChan, mirrorOptions)
+	close(logChan)
+	<-logsDone
+	if err != nil {
+		return fmt.Errorf("error mirroring pull request #%d: %v", *pullRequest, err)
 	}
+	if err := pushNotes(ctx, t.localDir); err != nil {
+		return err
+	}
+	l.Printf("Done! Mirrored pull request #%d", *pullRequest)
+	return nil
+}
 
-	var client *github.Client
-	if tokenAuth {
-		client = auth.TokenClient(*token)
-	} else {
-		client = auth.UnauthenticatedClient()
+// mirrorRepository mirrors everything from a single GitHub repository into its
+// local clone.
+//
+// Errors for individual items are counted in the returned summary, while
+// errors that stop the repository from being mirrored at all are returned.
+func mirrorRepository(ctx context.Context, l *log.Logger, client *github.Client, t target, result *summary) error {
+	local, err := openLocal(ctx, t)
+	if err != nil {
+		return err
 	}
 
-	_, _, err = client.Repositories.Get(context.TODO(), userName, repoName)
+	if err := pullNotes(ctx, local, t.localDir); err != nil {
+		return err
+	}
+
+	if *pullRequest != 0 {
+		return syncPullRequest(ctx, l, local, t, client)
+	}
+
+	remote, _, err := client.Repositories.Get(ctx, t.userName, t.repoName)
 	if err != nil {
-		log.Fatal("Error fetching repository info: ", err.Error())
+		return fmt.Errorf("error fetching repository info: %v", err)
+	}
+
+	refPatterns := []string{"refs/pull/*/head", "refs/heads/" + remote.GetDefaultBranch()}
+	if *statusRefs != "" {
+		refPatterns = strings.Split(*statusRefs, ",")
+	}
+	refFilter, err := mirror.MatchRefs(refPatterns...)
+	if err != nil {
+		return err
 	}
 
 	errOutput := make(chan error, 1000)
-	nErrors := 0
+	errorsDone := make(chan struct{})
 	go func() {
+		defer close(errorsDone)
 		for err := range errOutput {
 			if !*quiet {
 				log.Println(err)
 			}
-			nErrors++
+			result.ErrorMessages = append(result.ErrorMessages, err.Error())
+			var convErr *mirror.ConversionError
+			if errors.As(err, &convErr) {
+				result.Skipped++
+			} else {
+				result.Errors++
+			}
 		}
 	}()
-	statuses, err := mirror.GetAllStatuses(userName, repoName, client, errOutput)
+	statuses, err := mirror.GetAllStatuses(ctx, t.userName, t.repoName, client.Git, client.Repositories, client.PullRequests, refFilter, errOutput, progressPrinter(l, "commit statuses"), mirrorOptions)
 	if err != nil {
-		log.Fatal("Error reading statuses: ", err.Error())
+		close(errOutput)
+		<-errorsDone
+		return fmt.Errorf("error reading statuses: %v", err)
 	}
-	reviews, err := mirror.GetAllPullRequests(local, userName, repoName, client, errOutput)
+	reviews, err := mirror.GetAllPullRequests(ctx, local, t.userName, t.repoName, *prState, importSince, 0, mirror.NewPullRequestsService(client), client.Issues, errOutput, progressPrinter(l, "PRs"), mirrorOptions)
+	close(errOutput)
+	<-errorsDone
 	if err != nil {
-		log.Fatal("Error reading pull requests: ", err.Error())
+		return fmt.Errorf("error reading pull requests: %v", err)
 	}
-	close(errOutput)
 
-	nStatuses := len(statuses)
-	nReviews := len(reviews)
-	var l *log.Logger
-	if *quiet {
-		l = log.New(ioutil.Discard, "", 0)
-	} else {
-		l = log.New(os.Stdout, "", 0)
-	}
+	result.StatusesRead = len(statuses)
+	result.ReviewsRead = len(reviews)
 	logChan := make(chan string, 1000)
+	logsDone := make(chan struct{})
 	go func() {
+		defer close(logsDone)
 		for msg := range logChan {
 			l.Println(msg)
 		}
 	}()
 
-	l.Printf("Done reading! Read %d statuses, %d PRs", nStatuses, nReviews)
+	l.Printf("Done reading %s! Read %d statuses, %d PRs", t, result.StatusesRead, result.ReviewsRead)
+	if *verify {
+		close(logChan)
+		<-logsDone
+		result.Drift = mirror.DiffNotes(statuses, reviews, local)
+		for _, item := range result.Drift.Missing {
+			l.Printf("Missing %s", describeDrift(item))
+		}
+		for _, item := range result.Drift.Extra {
+			l.Printf("Extra %s", describeDrift(item))
+		}
+		return nil
+	}
 	l.Printf("Committing...\n")
-	if err := mirror.WriteNewReports(statuses, local, logChan); err != nil {
-		log.Fatal(err)
+	counter := &countingRepo{Repo: local}
+	reportsErr := mirror.WriteNewReports(statuses, counter, logChan, mirrorOptions)
+	reviewsErr := mirror.WriteNewReviews(reviews, counter, logChan, mirrorOptions)
+	close(logChan)
+	<-logsDone
+	result.NotesWritten = counter.notesWritten
+	for _, err := range []error{reportsErr, reviewsErr} {
+		// Items that could not be written are counted as errors, but the
+		// others were still written, and so are still pushed.
+		var writeErr *mirror.WriteError
+		if errors.As(err, &writeErr) {
+			for _, failure := range writeErr.Failures {
+				if !*quiet {
+					log.Println(failure)
+				}
+				result.ErrorMessages = append(result.ErrorMessages, failure.Error())
+				result.Errors++
+			}
+		} else if err != nil {
+			return err
+		}
 	}
-	if err := mirror.WriteNewReviews(reviews, local, logChan); err != nil {
-		log.Fatal(err)
+
+	if *prune > 0 {
+		prs, err := mirror.ListPullRequests(ctx, t.userName, t.repoName, mirror.NewPullRequestsService(client))
+		if err != nil {
+			return fmt.Errorf("error reading pull requests to prune: %v", err)
+		}
+		pruned, err := mirror.PruneResolvedReviews(local, prs, *prune, notesRemover(ctx, t.localDir))
+		if err != nil {
+			return err
+		}
+		result.ReviewsPruned = len(pruned)
+		l.Printf("Pruned %d reviews of closed pull requests", result.ReviewsPruned)
+	}
+	return pushNotes(ctx, t.localDir)
+}
+
+func main() {
+	flag.Parse()
+	if *outputFormat != "text" && *outputFormat != "json" {
+		usage("Output format must be either `text' or `json'")
+	}
+	itemLogFormat, err := mirror.ParseLogFormat(*logFormat)
+	if err != nil {
+		usage(err.Error())
+	}
+	mirrorOptions.LogFormat = itemLogFormat
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		usage(err.Error())
+	}
+	if *verbose {
+		level = levelDebug
+	}
+	mirrorOptions.MirrorReactions = *reactions
+	mirrorOptions.ExpandReferences = *expandReferences
+	mirrorOptions.MarkNonDefaultTargets = *markNonDefaultTargets
+	mirrorOptions.SkipDrafts = *skipDrafts
+	mirrorOptions.MirrorMergeable = *mergeable
+	mirrorOptions.MirrorClosedBy = *closedBy
+	mirrorOptions.GhostAuthor = *ghostAuthor
+	if *prune > 0 {
+		// Don't mirror the reviews that are about to be pruned again.
+		mirrorOptions.ClosedBefore = time.Now().Add(-*prune)
+	}
+	if *contextAliases != "" {
+		if mirrorOptions.ContextAliases, err = mirror.ParseContextAliases(*contextAliases); err != nil {
+			usage(err.Error())
+		}
+	}
+	if *exportPath != "" {
+		if err := exportNotes(*localRepositoryDir, *exportPath); err != nil {
+			log.Fatalf("Error exporting %s: %v", *localRepositoryDir, err)
+		}
+		return
+	}
+	if *notesRef != "" {
+		if err := mirror.CheckNotesRefPattern(*notesRef); err != nil {
+			usage(err.Error())
+		}
+	}
+	if *gitUserName != "" || *gitUserEmail != "" {
+		if err := mirror.CheckGitIdentity(*gitUserName, *gitUserEmail); err != nil {
+			usage(err.Error())
+		}
+		useGitIdentity(*gitUserName, *gitUserEmail)
+	}
+	if *proxy != "" {
+		if err := useProxy(*proxy); err != nil {
+			usage(err.Error())
+		}
+	}
+
+	if *repair {
+		removed, err := repairNotes(context.Background(), *localRepositoryDir)
+		if err != nil {
+			log.Fatalf("Error repairing the notes of %s: %v", *localRepositoryDir, err)
+		}
+		if !*quiet {
+			fmt.Printf("Removed %d duplicate notes from %s\n", removed, *localRepositoryDir)
+		}
+		return
 	}
-	close(logChan)
 
-	l.Printf("Done! Hit %d errors", nErrors)
-	if nErrors > 0 {
+	targets, err := parseTargets()
+	if err != nil {
+		usage(err.Error())
+	}
+	if err := mirror.CheckPullRequestState(*prState); err != nil {
+		usage(err.Error())
+	}
+	window, err := mirror.ParseImportWindow(*importWindow)
+	if err != nil {
+		usage(err.Error())
+	}
+	if window > 0 {
+		importSince = time.Now().Add(-window)
+	}
+	if *verify && (*pullRequest != 0 || *prState != mirror.AllPullRequests || window > 0) {
+		usage("-verify checks every pull request, so it cannot be combined with -pr, -state, or -import-window")
+	}
+	if *pullRequest != 0 && len(targets) != 1 {
+		usage("A single target repository is required to mirror a single pull request")
+	}
+	if *mergeable && *pullRequest == 0 {
+		usage("-mergeable is only known when mirroring a single pull request, so it requires -pr")
+	}
+	if *statusRefs != "" {
+		if _, err := mirror.MatchRefs(strings.Split(*statusRefs, ",")...); err != nil {
+			usage(err.Error())
+		}
+	}
+
+	if *requestTimeout < 0 {
+		usage("-request-timeout must not be negative")
+	}
+	auth.RequestTimeout = *requestTimeout
+	tokenAuth := *token != ""
+	if !tokenAuth {
+		fmt.Fprintln(os.Stderr, "Not using authentication. Note that this will be EXTREMELY SLOW;")
+		fmt.Fprintln(os.Stderr, "you get 60 requests to the github API per hour.")
+		fmt.Fprint(os.Stderr, auth.TokenHelp)
+	}
+
+	// A single client is shared by all of the target repositories.
+	var client *github.Client
+	if tokenAuth {
+		client = auth.TokenClient(*token)
+	} else {
+		client = auth.UnauthenticatedClient()
+	}
+	ctx := context.Background()
+	if tokenAuth {
+		warnAboutScopes(ctx, client, targets)
+	}
+
+	var l *log.Logger
+	if *quiet || level < levelInfo {
+		l = log.New(ioutil.Discard, "", 0)
+	} else if *outputFormat == "json" {
+		// Keep stdout free for the JSON summary.
+		l = log.New(os.Stderr, "", 0)
+	} else {
+		l = log.New(os.Stdout, "", 0)
+	}
+	if !*quiet && level >= levelDebug {
+		mirrorOptions.Debugf = l.Printf
+	}
+
+	failed := false
+	for _, t := range targets {
+		result := summary{Repository: t.String(), ErrorMessages: []string{}}
+		if err := mirrorRepository(ctx, l, client, t, &result); err != nil {
+			// Keep going, so that one broken repository doesn't hold up the others.
+			log.Printf("Error mirroring %s: %v", t, err)
+			result.Error = err.Error()
+			failed = true
+		}
+		if result.Errors > 0 || result.Skipped > 0 {
+			failed = true
+		}
+		if result.Drift != nil && !result.Drift.Empty() {
+			failed = true
+		}
+		if *pullRequest != 0 && result.Error == "" {
+			continue
+		}
+
+		if *outputFormat == "json" {
+			if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+				log.Fatal(err)
+			}
+		} else if result.Drift != nil {
+			l.Printf("Done verifying %s! Found %d missing and %d extra items. Hit %d errors, skipped %d items that could not be converted",
+				t, len(result.Drift.Missing), len(result.Drift.Extra), result.Errors, result.Skipped)
+		} else {
+			l.Printf("Done with %s! Wrote %d notes. Hit %d errors, skipped %d items that could not be converted",
+				t, result.NotesWritten, result.Errors, result.Skipped)
+		}
+	}
+	if failed {
 		os.Exit(1)
 	}
 }
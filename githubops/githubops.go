@@ -0,0 +1,180 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package githubops holds the checks of GitHub access tokens that are shared by
+// the tools and services that mirror a repository.
+package githubops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// ScopesHeader is the response header in which GitHub lists the scopes of a
+// classic OAuth token.
+const ScopesHeader = "X-OAuth-Scopes"
+
+// HasScopes reports whether the given response lists the scopes of the token
+// used to make the request.
+//
+// GitHub App installation tokens and fine-grained personal access tokens don't
+// report any scopes, so their capabilities must be probed instead.
+func HasScopes(resp *github.Response) bool {
+	return resp.Header.Get(ScopesHeader) != ""
+}
+
+// Scopes returns the scopes listed in the X-OAuth-Scopes header of the given
+// response.
+func Scopes(resp *github.Response) []string {
+	// Necessary because github makes things comma-delimited instead
+	// of semicolon-delimited for some reason.
+	return strings.Split(resp.Header.Get(ScopesHeader), ", ")
+}
+
+// MissingScopes returns the scopes that the mirror needs, but that are missing
+// from the X-OAuth-Scopes header of the given response.
+func MissingScopes(resp *github.Response) (missing []string) {
+	// Note that strictly speaking, we need the repo, public_repo,
+	// write:repo_hook, and repo:status scopes, but repo and
+	// write:repo_hook subsume the others.
+	var hasRepo bool
+	var hasWriteRepoHook bool
+	for _, scope := range Scopes(resp) {
+		switch scope {
+		case "repo":
+			hasRepo = true
+		case "admin:repo_hook":
+			hasWriteRepoHook = true
+		case "write:repo_hook":
+			hasWriteRepoHook = true
+		}
+	}
+
+	if !hasRepo {
+		missing = append(missing, "repo")
+	}
+	if !hasWriteRepoHook {
+		missing = append(missing, "write:repo_hook")
+	}
+	return missing
+}
+
+// MissingReadScopes returns the scopes that are needed to read a repository
+// with the given visibility, but that are missing from the X-OAuth-Scopes
+// header of the given response: repo for a private repository, and either repo
+// or public_repo for a public one.
+func MissingReadScopes(resp *github.Response, private bool) []string {
+	for _, scope := range Scopes(resp) {
+		if scope == "repo" || (scope == "public_repo" && !private) {
+			return nil
+		}
+	}
+	if private {
+		return []string{"repo"}
+	}
+	return []string{"public_repo"}
+}
+
+// Retrier calls the given request until it succeeds, fails for a reason other
+// than the API rate limit, or the retries are exhausted.
+type Retrier func(request func() (*github.Response, error)) error
+
+// HookLister is the subset of github.Client.Repositories used to check for
+// access to a repository's web hooks.
+type HookLister interface {
+	ListHooks(ctx context.Context, owner, repo string, opt *github.ListOptions) ([]*github.Hook, *github.Response, error)
+}
+
+// CapabilityProber is the subset of github.Client.Repositories used to probe
+// what a token is allowed to do.
+type CapabilityProber interface {
+	HookLister
+	Get(ctx context.Context, owner, repo string) (*github.Repository, *github.Response, error)
+}
+
+// CheckAccess checks that the token used to make the request that resp is the
+// response to can do everything that the mirror needs for the given repository,
+// without changing anything.
+//
+// Tokens that report their scopes must have the ones that the mirror needs, and
+// the token's user must still be an admin of the repository, as only admins can
+// create web hooks; the others are probed as described in ProbeCapabilities.
+func CheckAccess(ctx context.Context, resp *github.Response, repos CapabilityProber, retry Retrier, userName, repoName string) error {
+	if !HasScopes(resp) {
+		return ProbeCapabilities(ctx, repos, retry, userName, repoName)
+	}
+	if missing := MissingScopes(resp); len(missing) > 0 {
+		return fmt.Errorf("missing scopes: %s... had: %s",
+			strings.Join(missing, ", "),
+			resp.Header.Get(ScopesHeader))
+	}
+	return ProbeHookAdmin(ctx, repos, retry, userName, repoName)
+}
+
+// ProbeHookAdmin checks that the token can manage the repository's web hooks,
+// by listing them.
+//
+// Having the write:repo_hook scope isn't enough for that on its own, as the
+// token's user must also be an admin of the repository; GitHub responds to
+// anyone else as if the hooks didn't exist.
+func ProbeHookAdmin(ctx context.Context, hooks HookLister, retry Retrier, userName, repoName string) error {
+	err := retry(func() (resp *github.Response, err error) {
+		_, resp, err = hooks.ListHooks(ctx, userName, repoName, nil)
+		return
+	})
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil &&
+		(errResp.Response.StatusCode == http.StatusNotFound || errResp.Response.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("token user lacks admin access to create webhooks on %s/%s", userName, repoName)
+	}
+	if err != nil {
+		return fmt.Errorf("can't manage web hooks: %v", err)
+	}
+	return nil
+}
+
+// ProbeCapabilities checks that a token which doesn't report its scopes can
+// still do everything that the mirror needs, without changing anything:
+//
+//   - Listing the repository's hooks checks for access to its web hooks, i.e.
+//     the write:repo_hook scope or the "Webhooks" permission. This is the
+//     closest check that doesn't create a hook.
+//   - The "push" permission reported for the repository is needed to push the
+//     mirrored notes, i.e. the repo scope or the "Contents" write permission.
+//     Reading pull requests and statuses only requires read access, which
+//     pushing implies.
+func ProbeCapabilities(ctx context.Context, repos CapabilityProber, retry Retrier, userName, repoName string) error {
+	if err := ProbeHookAdmin(ctx, repos, retry, userName, repoName); err != nil {
+		return err
+	}
+	var repository *github.Repository
+	err := retry(func() (resp *github.Response, err error) {
+		repository, resp, err = repos.Get(ctx, userName, repoName)
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("can't read the repository: %v", err)
+	}
+	if repository.Permissions == nil || !(*repository.Permissions)["push"] {
+		return errors.New("can't push to the repository")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package githubops
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestMissingScopes(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		missing []string
+	}{
+		{"repo, write:repo_hook", nil},
+		{"admin:repo_hook, repo, user", nil},
+		{"public_repo, admin:repo_hook", []string{"repo"}},
+		{"repo", []string{"write:repo_hook"}},
+		{"gist", []string{"repo", "write:repo_hook"}},
+	} {
+		resp := &github.Response{Response: &http.Response{Header: http.Header{}}}
+		resp.Header.Set(ScopesHeader, tc.header)
+		if !HasScopes(resp) {
+			t.Errorf("Expected scopes to be reported for %q", tc.header)
+		}
+		if missing := MissingScopes(resp); !reflect.DeepEqual(missing, tc.missing) {
+			t.Errorf("Unexpected missing scopes %v for %q; expected %v", missing, tc.header, tc.missing)
+		}
+	}
+	if HasScopes(&github.Response{Response: &http.Response{Header: http.Header{}}}) {
+		t.Error("Expected no scopes to be reported without the header")
+	}
+}
+
+func TestMissingReadScopes(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		private bool
+		missing []string
+	}{
+		{"repo, write:repo_hook", true, nil},
+		{"repo", false, nil},
+		{"public_repo", false, nil},
+		{"public_repo, write:repo_hook", true, []string{"repo"}},
+		{"gist", false, []string{"public_repo"}},
+	} {
+		resp := &github.Response{Response: &http.Response{Header: http.Header{}}}
+		resp.Header.Set(ScopesHeader, tc.header)
+		if missing := MissingReadScopes(resp, tc.private); !reflect.DeepEqual(missing, tc.missing) {
+			t.Errorf("Unexpected missing scopes %v for %q (private: %v); expected %v", missing, tc.header, tc.private, tc.missing)
+		}
+	}
+}
+
+type capabilityProberStub struct {
+	Repository *github.Repository
+	// HooksStatus, if set, is the HTTP status that listing the hooks fails with.
+	HooksStatus int
+}
+
+func (s *capabilityProberStub) Get(ctx context.Context, owner, repo string) (*github.Repository, *github.Response, error) {
+	return s.Repository, &github.Response{}, nil
+}
+
+func (s *capabilityProberStub) ListHooks(ctx context.Context, owner, repo string, opt *github.ListOptions) ([]*github.Hook, *github.Response, error) {
+	if s.HooksStatus != 0 {
+		httpResp := &http.Response{StatusCode: s.HooksStatus}
+		return nil, &github.Response{Response: httpResp}, &github.ErrorResponse{Response: httpResp}
+	}
+	return nil, &github.Response{}, nil
+}
+
+func noRetries(request func() (*github.Response, error)) error {
+	_, err := request()
+	return err
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	canPush := &map[string]bool{"pull": true, "push": true}
+	readOnly := &map[string]bool{"pull": true, "push": false}
+
+	stub := &capabilityProberStub{Repository: &github.Repository{Permissions: canPush}}
+	if err := ProbeCapabilities(context.Background(), stub, noRetries, "user", "repo"); err != nil {
+		t.Errorf("Expected a token that can push to be accepted; got %v", err)
+	}
+
+	stub = &capabilityProberStub{Repository: &github.Repository{Permissions: readOnly}}
+	if err := ProbeCapabilities(context.Background(), stub, noRetries, "user", "repo"); err == nil {
+		t.Error("Expected a read-only token to be rejected")
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	scoped := &github.Response{Response: &http.Response{Header: http.Header{}}}
+	scoped.Header.Set(ScopesHeader, "repo, admin:repo_hook")
+	canPush := &map[string]bool{"pull": true, "push": true}
+
+	admin := &capabilityProberStub{Repository: &github.Repository{Permissions: canPush}}
+	if err := CheckAccess(context.Background(), scoped, admin, noRetries, "user", "repo"); err != nil {
+		t.Errorf("Expected an admin's token with the needed scopes to be accepted; got %v", err)
+	}
+
+	// A collaborator who can push, but isn't an admin, can't list the hooks
+	// even with the right scopes.
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		collaborator := &capabilityProberStub{Repository: &github.Repository{Permissions: canPush}, HooksStatus: status}
+		err := CheckAccess(context.Background(), scoped, collaborator, noRetries, "user", "repo")
+		if err == nil || !strings.Contains(err.Error(), "lacks admin access to create webhooks on user/repo") {
+			t.Errorf("Expected a non-admin's token to be rejected for lacking admin access; got %v", err)
+		}
+	}
+
+	unscoped := &github.Response{Response: &http.Response{Header: http.Header{}}}
+	unscoped.Header.Set(ScopesHeader, "public_repo")
+	if err := CheckAccess(context.Background(), unscoped, admin, noRetries, "user", "repo"); err == nil || !strings.Contains(err.Error(), "missing scopes") {
+		t.Errorf("Expected a token without the needed scopes to be rejected; got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/google/git-appraise v0.0.0-20200404013623-45703e83847b
 	github.com/google/go-github v17.0.0+incompatible
 	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/appengine v1.6.6
@@ -0,0 +1,368 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil provides a fake GitHub API server, so that the mirror can be
+// tested end to end, from fetching through converting to writing, through a
+// real GitHub client.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// rateLimit is the number of API requests that the fake reports an hour.
+	rateLimit = 5000
+	// defaultPageSize is the number of items per page when a request doesn't
+	// ask for a page size, as for the real API.
+	defaultPageSize = 30
+)
+
+// FakeGitHub is an HTTP server that serves a single repository's pull requests,
+// their comments and reviews, and its refs and commit statuses, the way the
+// GitHub API does: paginated, with "Link" headers, and with rate limit headers.
+//
+// Its data is set up with the Add methods, which may be called at any time.
+type FakeGitHub struct {
+	// PageSize, if positive, caps the number of items in each page, so that
+	// pagination can be exercised with only a few items.
+	PageSize int
+
+	owner, repo string
+	server      *httptest.Server
+
+	mu            sync.Mutex
+	pullRequests  []*github.PullRequest
+	drafts        map[int]bool
+	issueComments map[int][]*github.IssueComment
+	diffComments  map[int][]*github.PullRequestComment
+	reviews       map[int][]*github.PullRequestReview
+	refs          []*github.Reference
+	statuses      map[string][]*github.RepoStatus
+	throttled     int
+	remaining     int
+	requests      []string
+}
+
+// NewFakeGitHub starts a fake GitHub API server for the repository owner/repo.
+// It must be closed when it is no longer needed.
+func NewFakeGitHub(owner, repo string) *FakeGitHub {
+	f := &FakeGitHub{
+		owner:         owner,
+		repo:          repo,
+		drafts:        make(map[int]bool),
+		issueComments: make(map[int][]*github.IssueComment),
+		diffComments:  make(map[int][]*github.PullRequestComment),
+		reviews:       make(map[int][]*github.PullRequestReview),
+		statuses:      make(map[string][]*github.RepoStatus),
+		remaining:     rateLimit,
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Close shuts the server down.
+func (f *FakeGitHub) Close() {
+	f.server.Close()
+}
+
+// URL returns the base URL of the fake API, with a trailing slash.
+func (f *FakeGitHub) URL() string {
+	return f.server.URL + "/"
+}
+
+// Client returns a GitHub client that talks to the fake.
+func (f *FakeGitHub) Client() *github.Client {
+	client := github.NewClient(f.server.Client())
+	baseURL, err := url.Parse(f.URL())
+	if err != nil {
+		panic(err)
+	}
+	client.BaseURL = baseURL
+	return client
+}
+
+// AddPullRequest adds a pull request, which must have a number.
+func (f *FakeGitHub) AddPullRequest(pr *github.PullRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pullRequests = append(f.pullRequests, pr)
+}
+
+// MarkDraft makes the pull request with the given number be reported as a
+// draft, in the "draft" field that go-github doesn't know about.
+func (f *FakeGitHub) MarkDraft(number int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drafts[number] = true
+}
+
+// AddIssueComment adds a comment to the pull request with the given number.
+func (f *FakeGitHub) AddIssueComment(number int, c *github.IssueComment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.issueComments[number] = append(f.issueComments[number], c)
+}
+
+// AddDiffComment adds a comment on the diff of the pull request with the given
+// number.
+func (f *FakeGitHub) AddDiffComment(number int, c *github.PullRequestComment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.diffComments[number] = append(f.diffComments[number], c)
+}
+
+// AddReview adds a review of the pull request with the given number.
+func (f *FakeGitHub) AddReview(number int, r *github.PullRequestReview) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reviews[number] = append(f.reviews[number], r)
+}
+
+// AddRef adds a ref, e.g. "refs/heads/master", that points to the given commit.
+func (f *FakeGitHub) AddRef(ref, sha string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	commit := "commit"
+	f.refs = append(f.refs, &github.Reference{
+		Ref:    &ref,
+		Object: &github.GitObject{Type: &commit, SHA: &sha},
+	})
+}
+
+// AddStatus adds a status of the given commit.
+func (f *FakeGitHub) AddStatus(sha string, status *github.RepoStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[sha] = append(f.statuses[sha], status)
+}
+
+// Throttle makes the next n requests fail as if the API rate limit had been
+// used up, with the limit resetting right away.
+func (f *FakeGitHub) Throttle(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttled = n
+}
+
+// Requests returns the path and query of every request served so far,
+// including those that were throttled.
+func (f *FakeGitHub) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *FakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+
+	if f.throttled > 0 {
+		f.throttled--
+		f.writeRateLimit(w, 0, time.Now())
+		writeJSON(w, http.StatusForbidden, map[string]string{
+			"message":           "API rate limit exceeded for user.",
+			"documentation_url": "https://developer.github.com/v3/#rate-limiting",
+		})
+		return
+	}
+	if f.remaining > 0 {
+		f.remaining--
+	}
+	f.writeRateLimit(w, f.remaining, time.Now().Add(time.Hour))
+
+	if r.Method != http.MethodGet {
+		writeNotFound(w)
+		return
+	}
+	prefix := fmt.Sprintf("/repos/%s/%s/", f.owner, f.repo)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeNotFound(w)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "pulls":
+		f.servePage(w, r, f.listPullRequests(r.URL.Query()))
+	case len(parts) == 2 && parts[0] == "pulls":
+		f.servePullRequest(w, parts[1])
+	case len(parts) == 3 && parts[0] == "pulls" && parts[2] == "comments":
+		f.serveByNumber(w, r, parts[1], func(n int) interface{} { return f.diffComments[n] })
+	case len(parts) == 3 && parts[0] == "pulls" && parts[2] == "reviews":
+		f.serveByNumber(w, r, parts[1], func(n int) interface{} { return f.reviews[n] })
+	case len(parts) == 3 && parts[0] == "issues" && parts[2] == "comments":
+		f.serveByNumber(w, r, parts[1], func(n int) interface{} { return f.issueComments[n] })
+	case len(parts) == 2 && parts[0] == "git" && parts[1] == "refs":
+		f.servePage(w, r, f.refs)
+	case len(parts) >= 3 && parts[0] == "commits" && parts[len(parts)-1] == "statuses":
+		sha := strings.Join(parts[1:len(parts)-1], "/")
+		f.servePage(w, r, f.statuses[sha])
+	default:
+		writeNotFound(w)
+	}
+}
+
+// pullRequest is a pull request as served by the fake, along with whether it is
+// a draft.
+type pullRequest struct {
+	*github.PullRequest
+	Draft bool `json:"draft"`
+}
+
+// listPullRequests returns the pull requests matching the given query, in the
+// order that it asks for.
+func (f *FakeGitHub) listPullRequests(query url.Values) []pullRequest {
+	state := query.Get("state")
+	if state == "" {
+		state = "open"
+	}
+	var prs []*github.PullRequest
+	for _, pr := range f.pullRequests {
+		if state == "all" || pr.GetState() == state {
+			prs = append(prs, pr)
+		}
+	}
+	// As with the API, the newest pull requests are listed first by default.
+	less := func(i, j int) bool { return prs[i].GetNumber() < prs[j].GetNumber() }
+	if query.Get("sort") == "updated" {
+		less = func(i, j int) bool { return prs[i].GetUpdatedAt().Before(prs[j].GetUpdatedAt()) }
+	}
+	if query.Get("direction") == "asc" {
+		sort.SliceStable(prs, less)
+	} else {
+		sort.SliceStable(prs, func(i, j int) bool { return less(j, i) })
+	}
+	result := make([]pullRequest, 0, len(prs))
+	for _, pr := range prs {
+		result = append(result, pullRequest{pr, f.drafts[pr.GetNumber()]})
+	}
+	return result
+}
+
+func (f *FakeGitHub) servePullRequest(w http.ResponseWriter, number string) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		writeNotFound(w)
+		return
+	}
+	for _, pr := range f.pullRequests {
+		if pr.GetNumber() == n {
+			writeJSON(w, http.StatusOK, pullRequest{pr, f.drafts[n]})
+			return
+		}
+	}
+	writeNotFound(w)
+}
+
+func (f *FakeGitHub) serveByNumber(w http.ResponseWriter, r *http.Request, number string, items func(n int) interface{}) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		writeNotFound(w)
+		return
+	}
+	f.servePage(w, r, items(n))
+}
+
+// servePage writes the page of the given slice of items that the request asks
+// for, along with the "Link" header pointing to the other pages.
+func (f *FakeGitHub) servePage(w http.ResponseWriter, r *http.Request, items interface{}) {
+	all, err := json.Marshal(items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(all, &elements); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPageSize
+	}
+	if f.PageSize > 0 && f.PageSize < perPage {
+		perPage = f.PageSize
+	}
+	lastPage := (len(elements) + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	var links []string
+	link := func(rel string, n int) {
+		query.Set("page", strconv.Itoa(n))
+		u := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: query.Encode()}
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.String(), rel))
+	}
+	if page > 1 {
+		link("first", 1)
+		link("prev", page-1)
+	}
+	if page < lastPage {
+		link("next", page+1)
+		link("last", lastPage)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+	if start > len(elements) {
+		start = len(elements)
+	}
+	if end > len(elements) {
+		end = len(elements)
+	}
+	writeJSON(w, http.StatusOK, append([]json.RawMessage{}, elements[start:end]...))
+}
+
+func (f *FakeGitHub) writeRateLimit(w http.ResponseWriter, remaining int, reset time.Time) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]string{
+		"message":           "Not Found",
+		"documentation_url": "https://developer.github.com/v3",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package list is the source for a command-line tool that lists the
+// repositories tracked by the GitHub mirror App Engine services, along with
+// their status.
+//
+// It reads the same Cloud Datastore as the services, using the application
+// default credentials.
+//
+// Example Usage:
+//    gcloud auth application-default login
+//    ~/bin/github-mirror-list -project <YOUR_PROJECT_ID>
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/google/git-pull-request-mirror/store"
+)
+
+var projectID = flag.String("project", "", "ID of the Google Cloud project that the mirror is deployed to")
+
+func main() {
+	flag.Parse()
+	if *projectID == "" {
+		fmt.Fprintln(os.Stderr, "The project ID is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	c, err := datastore.NewClient(ctx, *projectID)
+	if err != nil {
+		log.Fatal("Can't connect to the datastore: ", err.Error())
+	}
+	defer c.Close()
+
+	repos, err := store.ListRepos(ctx, c)
+	if err != nil {
+		log.Fatal("Can't read the tracked repositories: ", err.Error())
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tSTATUS\tLAST SYNCED\tRECENT ERRORS\tERROR")
+	for _, repo := range repos {
+		lastSynced := "never"
+		if !repo.LastSyncedAt.IsZero() {
+			lastSynced = repo.LastSyncedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\t%d\t%s\n", repo.User, repo.Repo, repo.Status, lastSynced, len(repo.ErrorHistory()), repo.ErrorCause)
+	}
+	w.Flush()
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics instruments the work done by the mirror, independently of the
+// monitoring backend that the measurements are exported to.
+//
+// The instrumented code reports each measurement through the functions of this
+// package, which pass it on to the Recorder set with SetRecorder. Until one is
+// set, the measurements are discarded.
+package metrics
+
+import "time"
+
+// Recorder receives the measurements of the mirror's work, and exports them to
+// a monitoring backend. Its methods may be called concurrently.
+type Recorder interface {
+	// SyncStarted is called whenever mirroring a repo starts, be it for a
+	// full sync or for the changes from a single web hook event.
+	SyncStarted()
+	// SyncError is called for each error hit while mirroring a repo.
+	SyncError()
+	// APICall is called for each request sent to the GitHub API, including
+	// each retry of a failed one.
+	APICall()
+	// RateLimitSleep is called whenever requests to the GitHub API are put on
+	// hold because of its rate limit, with how long they are put on hold for.
+	RateLimitSleep(d time.Duration)
+	// NotesWritten is called with the number of notes written to a repo at
+	// once.
+	NotesWritten(count int)
+}
+
+// nopRecorder discards all of the measurements.
+type nopRecorder struct{}
+
+func (nopRecorder) SyncStarted()                   {}
+func (nopRecorder) SyncError()                     {}
+func (nopRecorder) APICall()                       {}
+func (nopRecorder) RateLimitSleep(d time.Duration) {}
+func (nopRecorder) NotesWritten(count int)         {}
+
+var recorder Recorder = nopRecorder{}
+
+// SetRecorder sets the Recorder that all measurements are passed on to.
+//
+// It is not safe to call this concurrently with any of the other functions of
+// this package, so it should be called once at startup.
+func SetRecorder(r Recorder) {
+	if r == nil {
+		r = nopRecorder{}
+	}
+	recorder = r
+}
+
+// SyncStarted records that mirroring a repo has started.
+func SyncStarted() {
+	recorder.SyncStarted()
+}
+
+// SyncError records an error hit while mirroring a repo.
+func SyncError() {
+	recorder.SyncError()
+}
+
+// APICall records a request sent to the GitHub API.
+func APICall() {
+	recorder.APICall()
+}
+
+// RateLimitSleep records that requests to the GitHub API were put on hold for
+// the given duration because of its rate limit.
+func RateLimitSleep(d time.Duration) {
+	recorder.RateLimitSleep(d)
+}
+
+// NotesWritten records that the given number of notes were written.
+func NotesWritten(count int) {
+	recorder.NotesWritten(count)
+}
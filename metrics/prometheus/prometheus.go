@@ -0,0 +1,157 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package prometheus exports the mirror's metrics in the Prometheus format.
+package prometheus
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RepoCounter returns the number of tracked repos in each status.
+type RepoCounter func() (map[string]int, error)
+
+// Recorder is a metrics.Recorder that keeps the measurements in a Prometheus
+// registry, to be scraped from its Handler.
+type Recorder struct {
+	registry *prom.Registry
+
+	syncs           prom.Counter
+	syncErrors      prom.Counter
+	apiCalls        prom.Counter
+	rateLimitSleeps prom.Counter
+	rateLimitSleep  prom.Counter
+	notesWritten    prom.Counter
+}
+
+// NewRecorder returns a Recorder with a registry of all of the mirror's metrics,
+// along with the standard metrics of the Go runtime and the process.
+//
+// If countRepos is non-nil, then it is called on each scrape to report the
+// number of repos in each status.
+func NewRecorder(countRepos RepoCounter) (*Recorder, error) {
+	r := &Recorder{
+		registry: prom.NewRegistry(),
+		syncs: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_syncs_total",
+			Help: "Number of times that mirroring a repo was started.",
+		}),
+		syncErrors: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_sync_errors_total",
+			Help: "Number of errors hit while mirroring repos.",
+		}),
+		apiCalls: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_github_api_calls_total",
+			Help: "Number of requests sent to the GitHub API, including retries.",
+		}),
+		rateLimitSleeps: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_rate_limit_sleeps_total",
+			Help: "Number of times that requests were put on hold because of the GitHub API rate limit.",
+		}),
+		rateLimitSleep: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_rate_limit_sleep_seconds_total",
+			Help: "Time that requests were put on hold for because of the GitHub API rate limit.",
+		}),
+		notesWritten: prom.NewCounter(prom.CounterOpts{
+			Name: "mirror_notes_written_total",
+			Help: "Number of git notes written.",
+		}),
+	}
+	collectors := []prom.Collector{
+		r.syncs,
+		r.syncErrors,
+		r.apiCalls,
+		r.rateLimitSleeps,
+		r.rateLimitSleep,
+		r.notesWritten,
+		prom.NewGoCollector(),
+		prom.NewProcessCollector(prom.ProcessCollectorOpts{}),
+	}
+	if countRepos != nil {
+		collectors = append(collectors, &repoCollector{
+			desc: prom.NewDesc("mirror_repos",
+				"Number of tracked repos in each status.",
+				[]string{"status"}, nil),
+			countRepos: countRepos,
+		})
+	}
+	for _, c := range collectors {
+		if err := r.registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Handler returns the HTTP handler that serves the metrics to scrapers.
+func (r *Recorder) Handler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// SyncStarted implements metrics.Recorder.
+func (r *Recorder) SyncStarted() {
+	r.syncs.Inc()
+}
+
+// SyncError implements metrics.Recorder.
+func (r *Recorder) SyncError() {
+	r.syncErrors.Inc()
+}
+
+// APICall implements metrics.Recorder.
+func (r *Recorder) APICall() {
+	r.apiCalls.Inc()
+}
+
+// RateLimitSleep implements metrics.Recorder.
+func (r *Recorder) RateLimitSleep(d time.Duration) {
+	r.rateLimitSleeps.Inc()
+	if d > 0 {
+		r.rateLimitSleep.Add(d.Seconds())
+	}
+}
+
+// NotesWritten implements metrics.Recorder.
+func (r *Recorder) NotesWritten(count int) {
+	r.notesWritten.Add(float64(count))
+}
+
+// repoCollector reports the number of repos in each status, as of each scrape.
+type repoCollector struct {
+	desc       *prom.Desc
+	countRepos RepoCounter
+}
+
+func (c *repoCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.desc
+}
+
+func (c *repoCollector) Collect(ch chan<- prom.Metric) {
+	counts, err := c.countRepos()
+	if err != nil {
+		log.Printf("Can't count the repos for the metrics: %v", err)
+		ch <- prom.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for status, count := range counts {
+		ch <- prom.MustNewConstMetric(c.desc, prom.GaugeValue, float64(count), status)
+	}
+}
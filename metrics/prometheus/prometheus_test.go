@@ -0,0 +1,72 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/git-pull-request-mirror/metrics"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder, err := NewRecorder(func() (map[string]int, error) {
+		return map[string]int{"Ready": 3, "Error": 1}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.SetRecorder(recorder)
+	defer metrics.SetRecorder(nil)
+
+	metrics.SyncStarted()
+	metrics.SyncStarted()
+	metrics.SyncError()
+	metrics.APICall()
+	metrics.RateLimitSleep(90 * time.Second)
+	metrics.NotesWritten(4)
+	metrics.NotesWritten(3)
+
+	server := httptest.NewServer(recorder.Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"mirror_syncs_total 2\n",
+		"mirror_sync_errors_total 1\n",
+		"mirror_github_api_calls_total 1\n",
+		"mirror_rate_limit_sleeps_total 1\n",
+		"mirror_rate_limit_sleep_seconds_total 90\n",
+		"mirror_notes_written_total 7\n",
+		`mirror_repos{status="Ready"} 3` + "\n",
+		`mirror_repos{status="Error"} 1` + "\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %q in the scraped metrics:\n%s", expected, body)
+		}
+	}
+}
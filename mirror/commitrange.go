@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	github "github.com/google/go-github/github"
+)
+
+// CommitRangeResolver answers the questions about the history of a repository
+// that are needed to find the commits of a pull request.
+//
+// A local clone of the repository, i.e. any repository.Repo, resolves them using
+// git, and an APICommitRangeResolver resolves them using the GitHub API, so that
+// reviews can be converted without a clone at the cost of more API requests.
+type CommitRangeResolver interface {
+	// VerifyCommit returns an error if the given commit is not known.
+	VerifyCommit(hash string) error
+	// ResolveRefCommit returns the commit that the given ref points to.
+	ResolveRefCommit(ref string) (string, error)
+	// ListCommitsBetween returns the commits that are reachable from to,
+	// but not from from, oldest first.
+	ListCommitsBetween(from, to string) ([]string, error)
+	// MergeBase returns the best common ancestor of the given commits.
+	MergeBase(a, b string) (string, error)
+}
+
+// CommitsService is satisfied by github.Client.Repositories
+type CommitsService interface {
+	GetCommitSHA1(ctx context.Context, owner, repo, ref, lastSHA string) (string, *github.Response, error)
+	CompareCommits(ctx context.Context, owner, repo string, base, head string) (*github.CommitsComparison, *github.Response, error)
+}
+
+// APICommitRangeResolver is a CommitRangeResolver that reads the history of a
+// remote repository through the GitHub API.
+type APICommitRangeResolver struct {
+	// ctx is kept so that the resolver can satisfy the same interface as a
+	// local clone, whose methods don't take one.
+	ctx         context.Context
+	remoteUser  string
+	remoteRepo  string
+	repoService CommitsService
+}
+
+// NewAPICommitRangeResolver returns a resolver for the given remote repository,
+// which makes its requests with the given context.
+func NewAPICommitRangeResolver(ctx context.Context, remoteUser, remoteRepo string, repoService CommitsService) *APICommitRangeResolver {
+	return &APICommitRangeResolver{
+		ctx:         ctx,
+		remoteUser:  remoteUser,
+		remoteRepo:  remoteRepo,
+		repoService: repoService,
+	}
+}
+
+// VerifyCommit returns an error if the given commit is not in the remote repository.
+func (r *APICommitRangeResolver) VerifyCommit(hash string) error {
+	_, err := r.resolve(hash)
+	return err
+}
+
+// ResolveRefCommit returns the commit that the given ref of the remote
+// repository points to.
+func (r *APICommitRangeResolver) ResolveRefCommit(ref string) (string, error) {
+	return r.resolve(strings.TrimPrefix(ref, "refs/heads/"))
+}
+
+func (r *APICommitRangeResolver) resolve(ref string) (string, error) {
+	var sha string
+	err := executeRequest(r.ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		sha, resp, err = r.repoService.GetCommitSHA1(r.ctx, r.remoteUser, r.remoteRepo, ref, "")
+		return resp, err
+	})
+	return sha, err
+}
+
+// ListCommitsBetween returns the commits that are reachable from to, but not
+// from from, oldest first.
+//
+// GitHub only lists up to 250 commits in a comparison, so an error is returned
+// if there are more than that.
+func (r *APICommitRangeResolver) ListCommitsBetween(from, to string) ([]string, error) {
+	comparison, err := r.compare(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if total := comparison.GetTotalCommits(); total > len(comparison.Commits) {
+		return nil, fmt.Errorf("only %d of the %d commits between %.12s and %.12s were listed",
+			len(comparison.Commits), total, from, to)
+	}
+	var commits []string
+	for _, commit := range comparison.Commits {
+		commits = append(commits, commit.GetSHA())
+	}
+	return commits, nil
+}
+
+// MergeBase returns the best common ancestor of the given commits.
+func (r *APICommitRangeResolver) MergeBase(a, b string) (string, error) {
+	comparison, err := r.compare(a, b)
+	if err != nil {
+		return "", err
+	}
+	if comparison.MergeBaseCommit == nil || comparison.MergeBaseCommit.SHA == nil {
+		return "", fmt.Errorf("%.12s and %.12s have no merge base", a, b)
+	}
+	return *comparison.MergeBaseCommit.SHA, nil
+}
+
+func (r *APICommitRangeResolver) compare(base, head string) (*github.CommitsComparison, error) {
+	var comparison *github.CommitsComparison
+	err := executeRequest(r.ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		comparison, resp, err = r.repoService.CompareCommits(r.ctx, r.remoteUser, r.remoteRepo, base, head)
+		return resp, err
+	})
+	return comparison, err
+}
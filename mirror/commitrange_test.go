@@ -0,0 +1,106 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/git-appraise/repository"
+	github "github.com/google/go-github/github"
+)
+
+// commitsServiceStub answers requests for the history of a remote repository
+// from a local one.
+type commitsServiceStub struct {
+	Repo repository.Repo
+	// MaxCommits, if non-zero, is the number of commits listed in each
+	// comparison.
+	MaxCommits int
+}
+
+func (s *commitsServiceStub) GetCommitSHA1(ctx context.Context, owner, repo, ref, lastSHA string) (string, *github.Response, error) {
+	resp := emptyListResponse
+	if err := s.Repo.VerifyCommit(ref); err == nil {
+		return ref, &resp, nil
+	}
+	sha, err := s.Repo.ResolveRefCommit("refs/heads/" + ref)
+	if err != nil {
+		resp.Response = &http.Response{StatusCode: http.StatusNotFound}
+		return "", &resp, errors.New("not found")
+	}
+	return sha, &resp, nil
+}
+
+func (s *commitsServiceStub) CompareCommits(ctx context.Context, owner, repo string, base, head string) (*github.CommitsComparison, *github.Response, error) {
+	resp := emptyListResponse
+	commits, err := s.Repo.ListCommitsBetween(base, head)
+	if err != nil {
+		return nil, &resp, err
+	}
+	mergeBase, err := s.Repo.MergeBase(base, head)
+	if err != nil {
+		return nil, &resp, err
+	}
+	total := len(commits)
+	if s.MaxCommits != 0 && len(commits) > s.MaxCommits {
+		commits = commits[:s.MaxCommits]
+	}
+	comparison := &github.CommitsComparison{
+		MergeBaseCommit: &github.RepositoryCommit{SHA: &mergeBase},
+		TotalCommits:    &total,
+	}
+	for i := range commits {
+		comparison.Commits = append(comparison.Commits, github.RepositoryCommit{SHA: &commits[i]})
+	}
+	return comparison, &resp, nil
+}
+
+func TestCommitRangeResolvers(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	resolvers := map[string]CommitRangeResolver{
+		"local": testRepo,
+		"api":   NewAPICommitRangeResolver(context.Background(), repoOwner, repoName, &commitsServiceStub{Repo: testRepo}),
+	}
+	for name, resolver := range resolvers {
+		r, err := ConvertPullRequestToReviewWithResolver(pr, nil, nil, nil, testRepo, resolver, Options{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if r.Revision != repository.TestCommitG || r.Request.BaseCommit != repository.TestCommitE {
+			t.Errorf("%s: unexpected revision %q and base commit %q", name, r.Revision, r.Request.BaseCommit)
+		}
+	}
+}
+
+func TestAPICommitRangeResolverTruncatedComparison(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	resolver := NewAPICommitRangeResolver(context.Background(), repoOwner, repoName, &commitsServiceStub{Repo: testRepo, MaxCommits: 1})
+	commits, err := testRepo.ListCommitsBetween(repository.TestCommitA, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) < 2 {
+		t.Fatalf("Expected a range of several commits, got %v", commits)
+	}
+	if _, err := resolver.ListCommitsBetween(repository.TestCommitA, repository.TestCommitG); err == nil {
+		t.Error("Expected an error when not all of the commits are listed")
+	}
+}
@@ -19,7 +19,9 @@ package mirror
 import (
 	"errors"
 	"fmt"
+	"log"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -43,13 +45,165 @@ var (
 	ErrInsufficientInfo = errors.New("insufficient data for meaningful conversion")
 )
 
+// OutdatedMarker is prepended to the description of a diff comment whose
+// position no longer exists in the pull request's current diff, as the lines
+// it refers to may have since changed or moved.
+const OutdatedMarker = "[Outdated]\n\n"
+
+// commentAuthor returns the login of the given comment author, or the ghost
+// author if the account was deleted.
+func (o Options) commentAuthor(user *github.User) string {
+	login := user.GetLogin()
+	if login == "" || login == "ghost" {
+		return o.ghostAuthor()
+	}
+	return login
+}
+
+// reactionsTrailerPattern matches the trailer written by reactionsTrailer at the
+// end of a comment's description.
+var reactionsTrailerPattern = regexp.MustCompile("\n\nReactions: \\+[0-9]+/-[0-9]+$")
+
+// reactionsTrailer returns a trailer summarizing the given reactions to append
+// to a comment's description, if MirrorReactions is set.
+func (o Options) reactionsTrailer(reactions *github.Reactions) string {
+	if !o.MirrorReactions {
+		return ""
+	}
+	up, down := reactions.GetPlusOne(), reactions.GetMinusOne()
+	if up == 0 && down == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\nReactions: +%d/-%d", up, down)
+}
+
+// stripReactionsTrailer removes the trailer written by reactionsTrailer, if any,
+// from the given comment description.
+func stripReactionsTrailer(description string) string {
+	return reactionsTrailerPattern.ReplaceAllString(description, "")
+}
+
+// referencePattern matches a reference to an issue or pull request, either in
+// the same repository (e.g. "#123") or in another one (e.g. "owner/repo#123").
+var referencePattern = regexp.MustCompile(`(^|[\s(\[{,;:])(?:([\w.-]+)/([\w.-]+))?#([0-9]+)\b`)
+
+// expandReferences appends the URL of every issue or pull request referenced in
+// body, as if it were in github.com/owner/repo, e.g. "#123" is expanded to
+// "#123 (https://github.com/owner/repo/issues/123)".
+//
+// Mentions of users, e.g. "@user", are left as they are; see mentions.
+func expandReferences(body, owner, repo string) string {
+	return referencePattern.ReplaceAllStringFunc(body, func(match string) string {
+		groups := referencePattern.FindStringSubmatch(match)
+		refOwner, refRepo, number := groups[2], groups[3], groups[4]
+		if refOwner == "" {
+			refOwner, refRepo = owner, repo
+		}
+		return fmt.Sprintf("%s (https://github.com/%s/%s/issues/%s)", match, refOwner, refRepo, number)
+	})
+}
+
+// mentionPattern matches a mention of a user (e.g. "@user") or of a team (e.g.
+// "@org/team"), but not the host of an email address.
+var mentionPattern = regexp.MustCompile(`(^|[^\w@/.-])@([A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:/\w(?:[\w-]*\w)?)?)`)
+
+// mentions returns the users and teams mentioned in body, e.g. "@user", in the
+// order they are first mentioned, without duplicates.
+func mentions(body string) []string {
+	var mentioned []string
+	seen := make(map[string]bool)
+	for _, groups := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		if name := groups[2]; !seen[name] {
+			seen[name] = true
+			mentioned = append(mentioned, "@"+name)
+		}
+	}
+	return mentioned
+}
+
 // ConvertTime converts a Time instance into the serialized string used in the git-appraise JSON formats.
 func ConvertTime(t time.Time) string {
 	return fmt.Sprintf("%10d", t.Unix())
 }
 
+// ContextAlias maps the contexts of the commit statuses that match Pattern to
+// a single canonical Agent, for CI systems that have reported the same build
+// under different contexts over time.
+type ContextAlias struct {
+	Pattern *regexp.Regexp
+	Agent   string
+}
+
+// ParseContextAliases parses a comma-separated list of context aliases, each of
+// the form "<pattern>=<agent>", e.g. "ci/build|continuous-integration/build=build".
+// The patterns use the regexp syntax, and must match a whole context.
+//
+// Only the commas outside of the groups, character classes, and repetitions of
+// the patterns separate the aliases, so e.g. "ci-[0-9]{1,3}=ci" is a single
+// alias. A comma that the pattern itself has to match outside of those can be
+// escaped as "\,", as usual in a regexp.
+func ParseContextAliases(spec string) ([]ContextAlias, error) {
+	var aliases []ContextAlias
+	for _, entry := range splitContextAliases(spec) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid context alias %q; must be of the form <pattern>=<agent>", entry)
+		}
+		pattern, err := regexp.Compile("^(?:" + entry[:i] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid context alias pattern %q: %v", entry[:i], err)
+		}
+		aliases = append(aliases, ContextAlias{Pattern: pattern, Agent: entry[i+1:]})
+	}
+	return aliases, nil
+}
+
+// splitContextAliases splits the given list of context aliases at the commas
+// that separate them, as described for ParseContextAliases.
+func splitContextAliases(spec string) []string {
+	var entries []string
+	start, depth, inClass := 0, 0, false
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; {
+		case c == '\\':
+			// Skip the escaped character.
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			if strings.HasPrefix(spec[i+1:], "]") || strings.HasPrefix(spec[i+1:], "^]") {
+				// A leading ']' is part of the class rather than its end.
+				i += strings.Index(spec[i:], "]")
+			}
+		case c == '(' || c == '{':
+			depth++
+		case (c == ')' || c == '}') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			entries = append(entries, spec[start:i])
+			start = i + 1
+		}
+	}
+	return append(entries, spec[start:])
+}
+
+// normalizeContext returns the agent that the given status context is mirrored
+// as, according to ContextAliases.
+func (o Options) normalizeContext(context string) string {
+	for _, alias := range o.ContextAliases {
+		if alias.Pattern.MatchString(context) {
+			return alias.Agent
+		}
+	}
+	return context
+}
+
 // ConvertStatus converts a commit status fetched from the GitHub API into a CI report.
-func ConvertStatus(repoStatus *github.RepoStatus) (*ci.Report, error) {
+//
+// The status's context is used as the report's agent, after applying the
+// ContextAliases of opts.
+func ConvertStatus(repoStatus *github.RepoStatus, opts Options) (*ci.Report, error) {
 	result := ci.Report{}
 	if repoStatus.UpdatedAt != nil {
 		result.Timestamp = ConvertTime(*repoStatus.UpdatedAt)
@@ -74,14 +228,43 @@ func ConvertStatus(repoStatus *github.RepoStatus) (*ci.Report, error) {
 	}
 
 	if repoStatus.Context != nil {
-		result.Agent = *repoStatus.Context
+		result.Agent = opts.normalizeContext(*repoStatus.Context)
 	}
 	return &result, nil
 }
 
+// MergeableAgent is the agent of the CI reports made by ConvertMergeable.
+const MergeableAgent = "github/mergeable"
+
+// ConvertMergeable converts whether a pull request can be merged into a CI
+// report, timestamped with the given time, that succeeds if the pull request
+// can be merged and fails if it has conflicts.
+//
+// GitHub computes whether a pull request can be merged in the background, and
+// only reports it when reading that single pull request, so ErrInsufficientInfo
+// is returned if it is not known.
+func ConvertMergeable(pr *github.PullRequest, at time.Time) (*ci.Report, error) {
+	if pr.Mergeable == nil || pr.GetHead().GetSHA() == "" {
+		return nil, ErrInsufficientInfo
+	}
+	status := ci.StatusFailure
+	if *pr.Mergeable {
+		status = ci.StatusSuccess
+	}
+	return &ci.Report{
+		Timestamp: ConvertTime(at),
+		URL:       pr.GetHTMLURL(),
+		Status:    status,
+		Agent:     MergeableAgent,
+	}, nil
+}
+
 // ConvertPullRequest converts a pull request fetched from the GitHub API into a review request.
-func ConvertPullRequest(pr *github.PullRequest) (*request.Request, error) {
-	if pr.Number == nil || pr.User.Login == nil ||
+//
+// The head repository of a pull request is not needed, as it is nil for pull
+// requests from forks that have since been deleted.
+func ConvertPullRequest(pr *github.PullRequest, opts Options) (*request.Request, error) {
+	if pr.Number == nil || pr.User == nil || pr.User.Login == nil ||
 		pr.Base == nil || pr.Base.Ref == nil || pr.Base.SHA == nil ||
 		(pr.CreatedAt == nil && pr.UpdatedAt == nil) {
 		return nil, ErrInsufficientInfo
@@ -106,81 +289,366 @@ func ConvertPullRequest(pr *github.PullRequest) (*request.Request, error) {
 		description = *pr.Title
 	}
 	if pr.Body != nil && *pr.Body != "" {
-		description += "\n\n" + *pr.Body
+		body := *pr.Body
+		if opts.ExpandReferences && pr.Base.Repo != nil {
+			body = expandReferences(body, pr.Base.Repo.GetOwner().GetLogin(), pr.Base.Repo.GetName())
+		}
+		description += "\n\n" + body
+		if mentioned := mentions(body); opts.ExpandReferences && len(mentioned) > 0 {
+			// Mentions don't notify anyone away from GitHub, so they
+			// are listed where they are easy to spot.
+			description += "\n\nMentions: " + strings.Join(mentioned, ", ")
+		}
 	}
+	if isForkPullRequest(pr) {
+		description += fmt.Sprintf("\n\nFrom fork: %s:%s", repoFullName(pr.Head.Repo), pr.Head.GetRef())
+	}
+	if IsDraft(pr) {
+		// This is kept out of the trailer, which RequestsOverlap ignores,
+		// so that the review is updated once the pull request is ready.
+		description += "\n\nDraft: true"
+	}
+	description += opts.pullRequestTrailer(pr)
 
 	r := request.Request{
 		Timestamp:   timestamp,
 		ReviewRef:   fmt.Sprintf("refs/pull/%d/head", *pr.Number),
 		TargetRef:   targetRef,
 		Requester:   *pr.User.Login,
+		Reviewers:   requestedReviewers(pr),
 		Description: description,
 	}
 	return &r, nil
 }
 
-// ConvertIssueComment converts a comment on the issue associated with a pull request into a git-appraise review comment.
-func ConvertIssueComment(issueComment *github.IssueComment) (*comment.Comment, error) {
-	if issueComment.User == nil || issueComment.User.Login == nil || issueComment.Body == nil ||
-		(issueComment.UpdatedAt == nil && issueComment.CreatedAt == nil) {
-		return nil, ErrInsufficientInfo
+// draftMergeableState is the mergeable state that GitHub reports for draft
+// pull requests.
+const draftMergeableState = "draft"
+
+// IsDraft reports whether the given pull request is a draft.
+//
+// The version of go-github in use predates draft pull requests, so this relies
+// on the "draft" mergeable state, which UnmarshalPullRequestEvent, and the
+// service returned by NewPullRequestsService, set from the "draft" field of the
+// pull requests they read. Pull requests read through go-github's own service
+// are only reported as drafts when GitHub has computed their mergeable state,
+// which it never does for the listed ones.
+func IsDraft(pr *github.PullRequest) bool {
+	return pr.GetMergeableState() == draftMergeableState
+}
+
+// pullRequestTrailerPattern matches the trailer written by pullRequestTrailer at
+// the end of a review request's description.
+var pullRequestTrailerPattern = regexp.MustCompile("\n\nPR: #[0-9]+(\nURL: [^\n]+)?(\nTarget: [^\n]+)?(\nLabels: ([^\n]+))?$")
+
+// pullRequestTrailer returns a trailer to append to the description of a review
+// request, recording the number and URL of the pull request it mirrors, and, if
+// MarkNonDefaultTargets is set, the branch it targets if that is not the default
+// one, and the labels of the pull request, if it has any, e.g.:
+//
+//	PR: #1234
+//	URL: https://github.com/user/repo/pull/1234
+//	Target: release-2.3 (non-default)
+//	Labels: bug, needs-review
+func (o Options) pullRequestTrailer(pr *github.PullRequest) string {
+	trailer := fmt.Sprintf("\n\nPR: #%d", pr.GetNumber())
+	if url := pr.GetHTMLURL(); url != "" {
+		trailer += "\nURL: " + url
+	}
+	if target := nonDefaultTarget(pr); o.MarkNonDefaultTargets && target != "" {
+		trailer += "\nTarget: " + target + " (non-default)"
+	}
+	if labels := pullRequestLabels(pr); len(labels) > 0 {
+		trailer += "\nLabels: " + strings.Join(labels, ", ")
+	}
+	return trailer
+}
+
+// pullRequestLabels returns the sorted names of the labels of the given pull
+// request.
+func pullRequestLabels(pr *github.PullRequest) []string {
+	var labels []string
+	for _, label := range pr.Labels {
+		if name := label.GetName(); name != "" {
+			labels = append(labels, name)
+		}
 	}
+	sort.Strings(labels)
+	return labels
+}
 
-	var timestamp string
-	if issueComment.UpdatedAt != nil {
-		timestamp = ConvertTime(*issueComment.UpdatedAt)
+// requestLabels returns the labels recorded in the trailer of the given review
+// request, as written by pullRequestTrailer, or the empty string if it has none.
+func requestLabels(r request.Request) string {
+	if groups := pullRequestTrailerPattern.FindStringSubmatch(r.Description); groups != nil {
+		return groups[4]
 	}
-	if issueComment.CreatedAt != nil {
-		timestamp = ConvertTime(*issueComment.CreatedAt)
+	return ""
+}
+
+// nonDefaultTarget returns the name of the branch that the given pull request
+// targets, or the empty string if that is its repository's default branch, or
+// if the default branch is unknown.
+func nonDefaultTarget(pr *github.PullRequest) string {
+	defaultBranch := pr.GetBase().GetRepo().GetDefaultBranch()
+	target := strings.TrimPrefix(pr.GetBase().GetRef(), "refs/heads/")
+	if defaultBranch == "" || target == defaultBranch {
+		return ""
+	}
+	return target
+}
+
+// stripPullRequestTrailer removes the trailer written by pullRequestTrailer, if
+// any, from the given review request description.
+func stripPullRequestTrailer(description string) string {
+	return pullRequestTrailerPattern.ReplaceAllString(description, "")
+}
+
+// requestedReviewers returns the logins of the users asked to review the given
+// pull request.
+//
+// Note that GitHub drops a user from this list once they have submitted a review.
+func requestedReviewers(pr *github.PullRequest) []string {
+	var reviewers []string
+	for _, user := range pr.RequestedReviewers {
+		if login := user.GetLogin(); login != "" {
+			reviewers = append(reviewers, login)
+		}
+	}
+	return reviewers
+}
+
+// commentTimestamp returns the timestamp of a comment with the given creation
+// and update times, at least one of which must be set: the time it was last
+// updated if known, or else the time it was created.
+func commentTimestamp(createdAt, updatedAt *time.Time) string {
+	if updatedAt != nil {
+		return ConvertTime(*updatedAt)
+	}
+	return ConvertTime(*createdAt)
+}
+
+// ConvertIssueComment converts a comment on the issue associated with a pull request into a git-appraise review comment.
+//
+// Comments by deleted accounts are attributed to Options.GhostAuthor.
+func ConvertIssueComment(issueComment *github.IssueComment, opts Options) (*comment.Comment, error) {
+	if issueComment.Body == nil || (issueComment.UpdatedAt == nil && issueComment.CreatedAt == nil) {
+		return nil, ErrInsufficientInfo
 	}
 
+	timestamp := commentTimestamp(issueComment.CreatedAt, issueComment.UpdatedAt)
+
 	c := comment.Comment{
 		Timestamp:   timestamp,
-		Author:      *issueComment.User.Login,
-		Description: *issueComment.Body,
+		Author:      opts.commentAuthor(issueComment.User),
+		Description: *issueComment.Body + opts.reactionsTrailer(issueComment.Reactions),
 	}
 	return &c, nil
 }
 
 // ConvertDiffComment converts a comment on the diff associated with a pull request into a git-appraise review comment.
-func ConvertDiffComment(diffComment *github.PullRequestComment) (*comment.Comment, error) {
-	if diffComment.User == nil || diffComment.User.Login == nil || diffComment.Body == nil ||
+//
+// Comments by deleted accounts are attributed to Options.GhostAuthor. Comments
+// without a diff hunk, and outdated comments whose hunk can't be parsed, are left
+// on the file as a whole rather than on a line.
+func ConvertDiffComment(diffComment *github.PullRequestComment, opts Options) (*comment.Comment, error) {
+	if diffComment.Body == nil ||
 		(diffComment.UpdatedAt == nil && diffComment.CreatedAt == nil) ||
 		diffComment.OriginalCommitID == nil {
 		return nil, ErrInsufficientInfo
 	}
 
-	var timestamp string
-	if diffComment.UpdatedAt != nil {
-		timestamp = ConvertTime(*diffComment.UpdatedAt)
-	}
-	if diffComment.CreatedAt != nil {
-		timestamp = ConvertTime(*diffComment.CreatedAt)
+	timestamp := commentTimestamp(diffComment.CreatedAt, diffComment.UpdatedAt)
+
+	description := *diffComment.Body
+	if diffComment.Position == nil {
+		// GitHub only reports the comment's position within the current
+		// diff, so it has none if the comment is outdated.
+		description = OutdatedMarker + description
 	}
+	description += opts.reactionsTrailer(diffComment.Reactions)
 
 	c := comment.Comment{
 		Timestamp:   timestamp,
-		Author:      *diffComment.User.Login,
-		Description: *diffComment.Body,
+		Author:      opts.commentAuthor(diffComment.User),
+		Description: description,
 		Location: &comment.Location{
 			Commit: *diffComment.OriginalCommitID,
 		},
 	}
 	if diffComment.Path != nil {
 		c.Location.Path = *diffComment.Path
-		if diffComment.DiffHunk != nil {
+		if diffComment.GetDiffHunk() != "" {
 			startLine, err := commentStartLine(diffComment)
-			if err != nil {
+			switch {
+			case err == nil:
+				c.Location.Range = &comment.Range{
+					StartLine: startLine,
+				}
+			case diffComment.Position != nil:
 				return nil, err
 			}
-			c.Location.Range = &comment.Range{
-				StartLine: startLine,
-			}
+			// GitHub may return a stale hunk for an outdated comment, in
+			// which case the comment is left on the file as a whole.
 		}
 	}
 	return &c, nil
 }
 
+// ConvertCommitComment converts a comment on a commit, made outside of any pull
+// request, into a git-appraise review comment on that commit, and on the
+// commented file if there is one.
+//
+// GitHub only reports the position of such a comment within the commit's diff,
+// without the diff hunk needed to map it onto a line, so the comment is left on
+// the file as a whole. Comments by deleted accounts are attributed to
+// Options.GhostAuthor.
+func ConvertCommitComment(commitComment *github.RepositoryComment, opts Options) (*comment.Comment, error) {
+	if commitComment.Body == nil ||
+		(commitComment.UpdatedAt == nil && commitComment.CreatedAt == nil) ||
+		commitComment.GetCommitID() == "" {
+		return nil, ErrInsufficientInfo
+	}
+
+	c := comment.Comment{
+		Timestamp:   commentTimestamp(commitComment.CreatedAt, commitComment.UpdatedAt),
+		Author:      opts.commentAuthor(commitComment.User),
+		Description: *commitComment.Body + opts.reactionsTrailer(commitComment.Reactions),
+		Location: &comment.Location{
+			Commit: *commitComment.CommitID,
+			Path:   commitComment.GetPath(),
+		},
+	}
+	return &c, nil
+}
+
+// States of a pull request review, as reported by the GitHub API.
+const (
+	reviewStateApproved         = "APPROVED"
+	reviewStateChangesRequested = "CHANGES_REQUESTED"
+	reviewStatePending          = "PENDING"
+)
+
+// ConvertPullRequestReview converts a review submitted on a pull request into a
+// git-appraise review comment, which carries the review's summary and verdict.
+//
+// Approving a pull request is mirrored as a resolved comment, and requesting
+// changes to it as an unresolved one. Reviews by deleted accounts are attributed
+// to Options.GhostAuthor.
+func ConvertPullRequestReview(prReview *github.PullRequestReview, opts Options) (*comment.Comment, error) {
+	if prReview.SubmittedAt == nil || prReview.CommitID == nil {
+		return nil, ErrInsufficientInfo
+	}
+
+	c := comment.Comment{
+		Timestamp:   ConvertTime(*prReview.SubmittedAt),
+		Author:      opts.commentAuthor(prReview.User),
+		Description: prReview.GetBody(),
+		Location: &comment.Location{
+			Commit: *prReview.CommitID,
+		},
+	}
+	switch prReview.GetState() {
+	case reviewStateApproved:
+		resolved := true
+		c.Resolved = &resolved
+	case reviewStateChangesRequested:
+		resolved := false
+		c.Resolved = &resolved
+	}
+	return &c, nil
+}
+
+// hasReviewSummary reports whether the given pull request review has anything
+// to mirror besides its diff comments, i.e. a body or a verdict.
+//
+// Pending reviews have not been submitted yet, so they are never mirrored.
+func hasReviewSummary(prReview *github.PullRequestReview) bool {
+	switch prReview.GetState() {
+	case reviewStatePending:
+		return false
+	case reviewStateApproved, reviewStateChangesRequested:
+		return true
+	}
+	return prReview.GetBody() != ""
+}
+
+// pullRequestMergeComment returns a review comment recording who merged the
+// given pull request, and when, or nil if it has not been merged.
+//
+// Only pull requests fetched individually (or received in webhook payloads)
+// say who merged them; those listed from the API don't, and so get no comment.
+func pullRequestMergeComment(pr *github.PullRequest, opts Options) *comment.Comment {
+	if pr.MergedBy == nil || pr.MergedAt == nil {
+		return nil
+	}
+	author := opts.commentAuthor(pr.MergedBy)
+	return &comment.Comment{
+		Timestamp:   ConvertTime(*pr.MergedAt),
+		Author:      author,
+		Description: fmt.Sprintf("Merged by %s", author),
+	}
+}
+
+// closedWithoutMerging reports whether the given pull request was closed without
+// being merged.
+func closedWithoutMerging(pr *github.PullRequest) bool {
+	return pr.GetState() == "closed" && pr.MergedAt == nil && !pr.GetMerged()
+}
+
+// pullRequestCloseComment returns a review comment recording who closed the
+// given pull request without merging it, and when, according to the last of
+// the given issue events that closed it, or nil if it was merged or none of the
+// events closed it.
+func pullRequestCloseComment(pr *github.PullRequest, events []*github.IssueEvent, opts Options) *comment.Comment {
+	if !closedWithoutMerging(pr) {
+		return nil
+	}
+	var closed *github.IssueEvent
+	for _, event := range events {
+		if event.GetEvent() == "closed" && event.CreatedAt != nil {
+			closed = event
+		}
+	}
+	if closed == nil {
+		return nil
+	}
+	author := opts.commentAuthor(closed.Actor)
+	return &comment.Comment{
+		Timestamp:   ConvertTime(*closed.CreatedAt),
+		Author:      author,
+		Description: fmt.Sprintf("Closed by %s", author),
+	}
+}
+
+// Suggestions returns the replacement text of each suggested change in the body
+// of a GitHub diff comment.
+//
+// GitHub represents a suggested change as a fenced code block with the
+// "suggestion" info string, whose contents replace the commented-on lines.
+// The comment body itself is mirrored verbatim, so this can be used to recover
+// the suggested changes from a mirrored comment's description.
+func Suggestions(body string) []string {
+	var suggestions []string
+	var current []string
+	inSuggestion := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case !inSuggestion && trimmed == "```suggestion":
+			inSuggestion = true
+			current = nil
+		case inSuggestion && trimmed == "```":
+			inSuggestion = false
+			suggestions = append(suggestions, strings.Join(current, "\n"))
+		case inSuggestion:
+			current = append(current, line)
+		}
+	}
+	return suggestions
+}
+
 // ConvertPullRequestToReview converts a pull request from the GitHub API into a git-appraise review.
 //
 // Since the GitHub API returns pull request data in three different places (the PullRequest
@@ -189,64 +657,187 @@ func ConvertDiffComment(diffComment *github.PullRequestComment) (*comment.Commen
 //
 // This method requires a local clone of the repository in order to compute the locations of
 // the different commits in the review.
-func ConvertPullRequestToReview(pr *github.PullRequest, issueComments []*github.IssueComment, diffComments []*github.PullRequestComment, repo repository.Repo) (*review.Review, error) {
-	request, err := ConvertPullRequest(pr)
+func ConvertPullRequestToReview(pr *github.PullRequest, issueComments []*github.IssueComment, diffComments []*github.PullRequestComment, prReviews []*github.PullRequestReview, repo repository.Repo, opts Options) (*review.Review, error) {
+	return ConvertPullRequestToReviewWithResolver(pr, issueComments, diffComments, prReviews, repo, repo, opts)
+}
+
+// ConvertPullRequestToReviewWithResolver is ConvertPullRequestToReview, but
+// finds the commits of the pull request using the given resolver, rather than
+// the local clone.
+func ConvertPullRequestToReviewWithResolver(pr *github.PullRequest, issueComments []*github.IssueComment, diffComments []*github.PullRequestComment, prReviews []*github.PullRequestReview, repo repository.Repo, resolver CommitRangeResolver, opts Options) (*review.Review, error) {
+	request, err := ConvertPullRequest(pr, opts)
 	if err != nil {
 		return nil, err
 	}
-	revision, err := computeReviewStartingCommit(pr, repo)
+	revision, err := computeReviewStartingCommit(pr, resolver)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failure computing the first commit in the review: %w", err)
 	}
-	mergeBase, err := repo.MergeBase(request.TargetRef, revision)
+	mergeBase, err := reviewMergeBase(pr, request.TargetRef, revision, resolver)
 	if err != nil {
 		return nil, err
 	}
-	if mergeBase != revision {
+	if mergeBase != "" && mergeBase != revision {
 		request.BaseCommit = mergeBase
 	}
 
 	var comments []review.CommentThread
 	for _, issueComment := range issueComments {
-		c, err := ConvertIssueComment(issueComment)
+		c, err := ConvertIssueComment(issueComment, opts)
+		if err != nil {
+			return nil, err
+		}
+		thread, err := buildCommentThread(c, issueComment.CreatedAt, issueComment.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, *thread)
+	}
+	// The hashes of the comments mirroring each review and diff comment, by
+	// their GitHub IDs, so that diff comments can be threaded under them.
+	reviewHashes := make(map[int64]string)
+	for _, prReview := range prReviews {
+		if !hasReviewSummary(prReview) {
+			continue
+		}
+		c, err := ConvertPullRequestReview(prReview, opts)
 		if err != nil {
 			return nil, err
 		}
-		hash, err := c.Hash()
+		thread, err := buildCommentThread(c, prReview.SubmittedAt, prReview.SubmittedAt)
 		if err != nil {
 			return nil, err
 		}
-		comments = append(comments, review.CommentThread{
-			Hash:    hash,
-			Comment: *c,
-		})
+		if prReview.ID != nil {
+			reviewHashes[*prReview.ID] = thread.Hash
+		}
+		comments = append(comments, *thread)
 	}
+	diffCommentHashes := make(map[int64]string)
 	for _, diffComment := range diffComments {
-		c, err := ConvertDiffComment(diffComment)
+		c, err := ConvertDiffComment(diffComment, opts)
 		if err != nil {
 			return nil, err
 		}
-		hash, err := c.Hash()
+		// Replies are threaded under the comment they reply to, and
+		// everything else under the review that it was submitted with.
+		if diffComment.InReplyTo != nil {
+			c.Parent = diffCommentHashes[*diffComment.InReplyTo]
+		} else if diffComment.PullRequestReviewID != nil {
+			c.Parent = reviewHashes[*diffComment.PullRequestReviewID]
+		}
+		thread, err := buildCommentThread(c, diffComment.CreatedAt, diffComment.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
-		comments = append(comments, review.CommentThread{
-			Hash:    hash,
-			Comment: *c,
-		})
+		if diffComment.ID != nil {
+			diffCommentHashes[*diffComment.ID] = thread.Hash
+		}
+		comments = append(comments, *thread)
+	}
+	if c := pullRequestMergeComment(pr, opts); c != nil {
+		thread, err := buildCommentThread(c, pr.MergedAt, pr.MergedAt)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, *thread)
 	}
 	r := review.Review{
 		Summary: &review.Summary{
 			Repo:     repo,
 			Revision: revision,
 			Request:  *request,
-			Comments: comments,
+			Comments: dedupeCommentThreads(comments),
 		},
 	}
 
 	return &r, nil
 }
 
+// reviewMergeBase returns the merge base of the review's starting commit and its
+// target ref, or the empty string if it can't be computed.
+//
+// The target branch of a pull request is often deleted once the pull request is
+// merged, leaving its ref dangling. In that case, the pull request's base commit
+// (which was the tip of the target branch) is used instead, if it is available.
+func reviewMergeBase(pr *github.PullRequest, targetRef, revision string, repo CommitRangeResolver) (string, error) {
+	target := targetRef
+	if _, err := repo.ResolveRefCommit(targetRef); err != nil {
+		if err := repo.VerifyCommit(*pr.Base.SHA); err != nil {
+			log.Printf("Warning: neither the target ref %s nor the base commit %.12s of pull request #%d is in the local clone; not recording its base commit",
+				targetRef, *pr.Base.SHA, prNumber(pr))
+			return "", nil
+		}
+		log.Printf("Warning: the target ref %s of pull request #%d is not in the local clone; using its base commit %.12s instead",
+			targetRef, prNumber(pr), *pr.Base.SHA)
+		target = *pr.Base.SHA
+	}
+	return repo.MergeBase(target, revision)
+}
+
+// dedupeCommentThreads drops the comment threads that duplicate another one, as
+// GitHub sometimes returns a comment left on the "Files changed" tab in both the
+// issue comments and the diff comments of a pull request.
+//
+// Threads are duplicates if their comments overlap, as for CommentsOverlap, and
+// have the same timestamp, so that the same text repeated later on by the same
+// author (e.g. "PTAL") is kept. A review-level comment also duplicates a
+// file-level or line-level one with the same author and description, in which
+// case the more specific one is kept; otherwise the first one is.
+func dedupeCommentThreads(threads []review.CommentThread) []review.CommentThread {
+	var result []review.CommentThread
+	for i, thread := range threads {
+		duplicate := false
+		for j, other := range threads {
+			if i == j || thread.Comment.Timestamp != other.Comment.Timestamp {
+				continue
+			}
+			if j < i && CommentsOverlap(other.Comment, thread.Comment) {
+				duplicate = true
+			}
+			if isReviewLevelComment(thread.Comment) && !isReviewLevelComment(other.Comment) &&
+				commentDescriptionsOverlap(thread.Comment, other.Comment) {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			result = append(result, thread)
+		}
+	}
+	return result
+}
+
+// isReviewLevelComment reports whether the given comment is on the review as a
+// whole, rather than on a file or a line.
+func isReviewLevelComment(c comment.Comment) bool {
+	return c.Location == nil || c.Location.Path == ""
+}
+
+// buildCommentThread wraps a converted GitHub comment in a comment thread.
+//
+// GitHub comments can be edited in place, so if the comment was updated after it
+// was created, the thread's Original is set to the comment as of its creation
+// time, and the comment itself is timestamped with the time of the edit. The
+// creation time never changes, which is what allows WriteNewComments to match
+// the edit to the comment that was previously mirrored.
+func buildCommentThread(c *comment.Comment, createdAt, updatedAt *time.Time) (*review.CommentThread, error) {
+	thread := review.CommentThread{}
+	if createdAt != nil && updatedAt != nil && updatedAt.After(*createdAt) {
+		original := *c
+		original.Timestamp = ConvertTime(*createdAt)
+		c.Timestamp = ConvertTime(*updatedAt)
+		thread.Original = &original
+		thread.Edited = true
+	}
+	hash, err := c.Hash()
+	if err != nil {
+		return nil, err
+	}
+	thread.Hash = hash
+	thread.Comment = *c
+	return &thread, nil
+}
+
 // commentStartLine takes a PullRequestComment and returns the comment's start line.
 func commentStartLine(diffComment *github.PullRequestComment) (uint32, error) {
 	// This takes some contortions to figure out. The diffComment has a "position"
@@ -294,18 +885,55 @@ func commentStartLine(diffComment *github.PullRequestComment) (uint32, error) {
 }
 
 // computeReviewStartingCommit computes the first commit in the review.
-func computeReviewStartingCommit(pr *github.PullRequest, repo repository.Repo) (string, error) {
+//
+// Only the base and head commits are used, as either repository of the pull
+// request may be missing if it has since been deleted.
+func computeReviewStartingCommit(pr *github.PullRequest, repo CommitRangeResolver) (string, error) {
 	if pr.Base == nil || pr.Base.SHA == nil ||
 		pr.Head == nil || pr.Head.SHA == nil {
 		return "", ErrInsufficientInfo
 	}
 
+	if err := repo.VerifyCommit(*pr.Head.SHA); err != nil {
+		// The head commit of a pull request from a fork is only reachable
+		// through the pull request's ref in the upstream repository.
+		return "", fmt.Errorf("head commit %s is missing from the local clone; make sure %q has been fetched: %v",
+			*pr.Head.SHA, fmt.Sprintf("refs/pull/%d/head", prNumber(pr)), err)
+	}
+	if err := repo.VerifyCommit(*pr.Base.SHA); err != nil {
+		// The base commit can be missing from the local clone even if every
+		// branch was fetched; e.g. if the target branch has since been
+		// force-pushed. In that case we can't tell where the pull request's
+		// commits begin, so we fall back to anchoring the review at the head.
+		return *pr.Head.SHA, nil
+	}
 	prCommits, err := repo.ListCommitsBetween(*pr.Base.SHA, *pr.Head.SHA)
 	if err != nil {
-		return "", err
+		// This can happen if the base and head have unrelated histories,
+		// e.g. after the target branch was rewritten. As when the base is
+		// missing, we anchor the review at the head rather than skip it.
+		log.Printf("Warning: can't list the commits of pull request #%d between %.12s and %.12s; using its head instead: %v",
+			prNumber(pr), *pr.Base.SHA, *pr.Head.SHA, err)
+		return *pr.Head.SHA, nil
 	}
 	if len(prCommits) == 0 {
 		return *pr.Head.SHA, nil
 	}
 	return prCommits[0], nil
 }
+
+// isForkPullRequest reports whether the given pull request was opened from a
+// repository other than the one it targets.
+//
+// This is false if either repository is unknown, e.g. if the fork was deleted.
+func isForkPullRequest(pr *github.PullRequest) bool {
+	if pr.Head == nil || pr.Head.Repo == nil || pr.Base == nil || pr.Base.Repo == nil {
+		return false
+	}
+	return repoFullName(pr.Head.Repo) != repoFullName(pr.Base.Repo)
+}
+
+// repoFullName returns the "owner/name" form of the given repository's name.
+func repoFullName(repo *github.Repository) string {
+	return repo.GetOwner().GetLogin() + "/" + repo.GetName()
+}
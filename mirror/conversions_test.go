@@ -16,7 +16,9 @@ limitations under the License.
 package mirror
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -25,6 +27,7 @@ import (
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
 	github "github.com/google/go-github/github"
 )
 
@@ -46,7 +49,7 @@ func TestConvertStatus(t *testing.T) {
 		Context:   &context,
 		CreatedAt: &createdAt,
 	}
-	result, err := ConvertStatus(&input)
+	result, err := ConvertStatus(&input, Options{})
 	if err != nil || result == nil {
 		t.Fatal(err)
 	}
@@ -69,6 +72,74 @@ func TestConvertStatus(t *testing.T) {
 	}
 }
 
+func TestConvertStatusContextAliases(t *testing.T) {
+	aliases, err := ParseContextAliases(`(ci|continuous-integration)/build=build,lint/.*=lint`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{ContextAliases: aliases}
+
+	state := "success"
+	createdAt := time.Now()
+	agents := make(map[string]bool)
+	for _, context := range []string{"ci/build", "continuous-integration/build"} {
+		context := context
+		report, err := ConvertStatus(&github.RepoStatus{State: &state, Context: &context, CreatedAt: &createdAt}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agents[report.Agent] = true
+	}
+	if len(agents) != 1 || !agents["build"] {
+		t.Errorf("Expected both contexts to be mirrored as the same agent; got %v", agents)
+	}
+
+	for context, expected := range map[string]string{
+		"lint/go":        "lint",
+		"ci/build/extra": "ci/build/extra",
+		"deploy":         "deploy",
+	} {
+		context := context
+		report, err := ConvertStatus(&github.RepoStatus{State: &state, Context: &context, CreatedAt: &createdAt}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Agent != expected {
+			t.Errorf("Unexpected agent %q for context %q; expected %q", report.Agent, context, expected)
+		}
+	}
+
+	for _, spec := range []string{"", "ci/build", "=build", "ci/build=", "(ci=build"} {
+		if _, err := ParseContextAliases(spec); err == nil {
+			t.Errorf("Expected the context aliases %q to be rejected", spec)
+		}
+	}
+}
+
+func TestParseContextAliasesWithCommas(t *testing.T) {
+	aliases, err := ParseContextAliases(`ci-[0-9]{1,3}=ci,(build|lint)\,go=go,[,x]=comma,deploy=deploy`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{ContextAliases: aliases}
+	if len(aliases) != 4 {
+		t.Fatalf("Expected 4 context aliases; got %v", aliases)
+	}
+	for context, expected := range map[string]string{
+		"ci-12":     "ci",
+		"ci-1234":   "ci-1234",
+		"build,go":  "go",
+		",":         "comma",
+		"x":         "comma",
+		"deploy":    "deploy",
+		"lint,rust": "lint,rust",
+	} {
+		if agent := opts.normalizeContext(context); agent != expected {
+			t.Errorf("Unexpected agent %q for context %q; expected %q", agent, context, expected)
+		}
+	}
+}
+
 func buildTestPullRequest(testRepo repository.Repo, reqNum int) *github.PullRequest {
 	reqTime := time.Now().Add(-3 * time.Hour)
 	reqTitle := "Bug fixes."
@@ -114,7 +185,7 @@ func TestConvertPullRequest(t *testing.T) {
 	reqNum := 4
 	pullRef := fmt.Sprintf("refs/pull/%d/head", reqNum)
 	pr := buildTestPullRequest(testRepo, reqNum)
-	r, err := ConvertPullRequest(pr)
+	r, err := ConvertPullRequest(pr, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,12 +253,14 @@ func TestConvertPullRequestToReview(t *testing.T) {
 	diffComment2 := "Reply to comment on line 14"
 	diffTime2 := now.Add(-2 * time.Hour)
 	diffCommit := repository.TestCommitG
+	diffPosition := 6
 	diffComments := []*github.PullRequestComment{
 		&github.PullRequestComment{
 			Body:             &diffComment1,
 			Path:             &filePath,
 			OriginalCommitID: &diffCommit,
 			DiffHunk:         &diffHunk,
+			Position:         &diffPosition,
 			User: &github.User{
 				Login: &repoOwner,
 			},
@@ -198,6 +271,7 @@ func TestConvertPullRequestToReview(t *testing.T) {
 			Path:             &filePath,
 			OriginalCommitID: &diffCommit,
 			DiffHunk:         &diffHunk,
+			Position:         &diffPosition,
 			User: &github.User{
 				Login: &contributorLogin,
 			},
@@ -205,7 +279,7 @@ func TestConvertPullRequestToReview(t *testing.T) {
 		},
 	}
 
-	r, err := ConvertPullRequestToReview(pr, issueComments, diffComments, testRepo)
+	r, err := ConvertPullRequestToReview(pr, issueComments, diffComments, nil, testRepo, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -232,3 +306,866 @@ func TestConvertPullRequestToReview(t *testing.T) {
 		t.Errorf("Missing expected line comments: %s", reviewJSON)
 	}
 }
+
+func TestConvertPullRequestToReviewDeduplicatesComments(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	body := "Should this be configurable?"
+	filePath := "example.go"
+	diffHunk := "@@ -4,6 +10,10 @@ func changedMethod() {\n \t// This is an existing line\n \t// This is another existing line\n-\t//This is a removed line\n+\t//This is a new line\n+\t//This is a second new line, with a comment\")"
+	diffCommit := repository.TestCommitG
+	diffPosition := 6
+	createdAt := time.Now().Add(-time.Hour)
+	laterAt := time.Now()
+
+	// GitHub returned the same comment as both an issue comment and a diff
+	// comment, and the author later repeated it.
+	issueComments := []*github.IssueComment{
+		{Body: &body, User: &github.User{Login: &repoOwner}, CreatedAt: &createdAt},
+		{Body: &body, User: &github.User{Login: &repoOwner}, CreatedAt: &laterAt},
+	}
+	diffComments := []*github.PullRequestComment{{
+		Body:             &body,
+		Path:             &filePath,
+		OriginalCommitID: &diffCommit,
+		DiffHunk:         &diffHunk,
+		Position:         &diffPosition,
+		User:             &github.User{Login: &repoOwner},
+		CreatedAt:        &createdAt,
+	}}
+
+	r, err := ConvertPullRequestToReview(pr, issueComments, diffComments, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Comments) != 2 {
+		t.Fatalf("Expected the duplicated comment to be mirrored once, along with its repetition; got %+v", r.Comments)
+	}
+	if c := r.Comments[0].Comment; c.Location != nil || c.Timestamp != ConvertTime(laterAt) {
+		t.Errorf("Expected the repeated issue comment to be kept: %+v", c)
+	}
+	if c := r.Comments[1].Comment; c.Location == nil || c.Location.Range == nil || c.Location.Range.StartLine != 14 {
+		t.Errorf("Expected the line comment to be kept over the duplicate issue comment: %+v", c)
+	}
+}
+
+func TestConvertPullRequestToReviewWithReviews(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	now := time.Now()
+	commit := repository.TestCommitG
+
+	buildReview := func(id int64, login, state, body string, submitted time.Time) *github.PullRequestReview {
+		return &github.PullRequestReview{
+			ID:          &id,
+			User:        &github.User{Login: &login},
+			State:       &state,
+			Body:        &body,
+			SubmittedAt: &submitted,
+			CommitID:    &commit,
+		}
+	}
+	prReviews := []*github.PullRequestReview{
+		buildReview(1, repoOwner, "CHANGES_REQUESTED", "A few nits", now.Add(-2*time.Hour)),
+		buildReview(2, contributorLogin, "COMMENTED", "", now.Add(-1*time.Hour)),
+		buildReview(3, repoOwner, "APPROVED", "LGTM", now.Add(-30*time.Minute)),
+	}
+
+	filePath := "example.go"
+	buildDiffComment := func(id, reviewID int64, inReplyTo *int64, login, body string, created time.Time) *github.PullRequestComment {
+		position := 1
+		return &github.PullRequestComment{
+			ID:                  &id,
+			PullRequestReviewID: &reviewID,
+			InReplyTo:           inReplyTo,
+			Body:                &body,
+			Path:                &filePath,
+			Position:            &position,
+			OriginalCommitID:    &commit,
+			User:                &github.User{Login: &login},
+			CreatedAt:           &created,
+		}
+	}
+	firstNit := int64(10)
+	diffComments := []*github.PullRequestComment{
+		buildDiffComment(firstNit, 1, nil, repoOwner, "Nit: typo", now.Add(-2*time.Hour)),
+		buildDiffComment(11, 1, nil, repoOwner, "Nit: spacing", now.Add(-2*time.Hour)),
+		buildDiffComment(12, 2, &firstNit, contributorLogin, "Fixed", now.Add(-1*time.Hour)),
+		buildDiffComment(13, 3, nil, repoOwner, "Consider a follow-up", now.Add(-30*time.Minute)),
+	}
+
+	r, err := ConvertPullRequestToReview(pr, nil, diffComments, prReviews, testRepo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The review without a body or a verdict is not mirrored.
+	if len(r.Comments) != 6 {
+		t.Fatalf("Expected 2 review summaries and 4 diff comments, got %+v", r.Comments)
+	}
+	hashes := make(map[string]string)
+	for _, thread := range r.Comments {
+		hashes[thread.Comment.Description] = thread.Hash
+	}
+	changesRequested, approved := r.Comments[0].Comment, r.Comments[1].Comment
+	if changesRequested.Description != "A few nits" || changesRequested.Resolved == nil || *changesRequested.Resolved {
+		t.Errorf("Unexpected summary for the review requesting changes: %+v", changesRequested)
+	}
+	if approved.Description != "LGTM" || approved.Resolved == nil || !*approved.Resolved {
+		t.Errorf("Unexpected summary for the approving review: %+v", approved)
+	}
+
+	expectedParents := map[string]string{
+		"Nit: typo":            hashes["A few nits"],
+		"Nit: spacing":         hashes["A few nits"],
+		"Fixed":                hashes["Nit: typo"],
+		"Consider a follow-up": hashes["LGTM"],
+	}
+	for _, thread := range r.Comments[2:] {
+		c := thread.Comment
+		if expected := expectedParents[c.Description]; c.Parent != expected || expected == "" {
+			t.Errorf("Unexpected parent %q for comment %q; expected %q", c.Parent, c.Description, expected)
+		}
+	}
+}
+
+func TestComputeReviewStartingCommitMissingBase(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	missingBase := "0123456789abcdef0123456789abcdef01234567"
+	pr.Base.SHA = &missingBase
+
+	revision, err := computeReviewStartingCommit(pr, testRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != *pr.Head.SHA {
+		t.Errorf("Expected fallback to the head commit %q, got %q", *pr.Head.SHA, revision)
+	}
+}
+
+func TestConvertForkPullRequest(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	forkOwner := "forking_contributor"
+	forkRef := "bug-fixes"
+	pr.Head.Ref = &forkRef
+	pr.Head.Repo.Owner = &github.User{
+		Login: &forkOwner,
+	}
+
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSource := fmt.Sprintf("From fork: %s/%s:%s", forkOwner, repoName, forkRef)
+	if !strings.Contains(r.Request.Description, expectedSource) {
+		t.Errorf("Expected the description to name the fork; got %q", r.Request.Description)
+	}
+	if r.Request.ReviewRef != "refs/pull/4/head" || r.Revision != repository.TestCommitG {
+		t.Errorf("Unexpected review %+v", r.Summary)
+	}
+
+	// Pull requests from the same repository do not mention a fork.
+	sameRepo, err := ConvertPullRequest(buildTestPullRequest(testRepo, 5), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sameRepo.Description, "From fork") {
+		t.Errorf("Unexpected fork in description %q", sameRepo.Description)
+	}
+}
+
+func TestConvertDeletedForkPullRequest(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	pr.Head.Repo = nil
+
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatalf("Expected a pull request from a deleted fork to be converted, got %v", err)
+	}
+	if r.Request.ReviewRef != "refs/pull/4/head" || r.Revision != repository.TestCommitG {
+		t.Errorf("Unexpected review %+v", r.Summary)
+	}
+	if strings.Contains(r.Request.Description, "From fork") {
+		t.Errorf("Unexpected fork in description %q", r.Request.Description)
+	}
+
+	// Old pull requests may be missing their base repository too.
+	pr.Base.Repo = nil
+	if _, err := ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{}); err != nil {
+		t.Fatalf("Expected a pull request without repositories to be converted, got %v", err)
+	}
+
+	// Missing the head commit or the author is not enough to mirror it, but
+	// that is reported rather than panicking.
+	noHead := buildTestPullRequest(testRepo, 4)
+	noHead.Head = nil
+	if _, err := ConvertPullRequestToReview(noHead, nil, nil, nil, testRepo, Options{}); !errors.Is(err, ErrInsufficientInfo) {
+		t.Errorf("Expected ErrInsufficientInfo for a pull request without a head, got %v", err)
+	}
+	noUser := buildTestPullRequest(testRepo, 4)
+	noUser.User = nil
+	if _, err := ConvertPullRequest(noUser, Options{}); err != ErrInsufficientInfo {
+		t.Errorf("Expected ErrInsufficientInfo for a pull request without an author, got %v", err)
+	}
+}
+
+func TestConvertPullRequestReviewers(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	alice, bob := "alice", "bob"
+	pr.RequestedReviewers = []*github.User{{Login: &alice}, {}, {Login: &bob}}
+
+	r, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Reviewers, []string{alice, bob}) {
+		t.Errorf("Unexpected reviewers %v", r.Reviewers)
+	}
+}
+
+func TestConvertPullRequestTrailer(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	url := "https://github.com/user/repo/pull/4"
+	pr.HTMLURL = &url
+
+	r, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(r.Description, "\n\nPR: #4\nURL: "+url) {
+		t.Errorf("Unexpected trailer in description %q", r.Description)
+	}
+	again, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Description != r.Description {
+		t.Errorf("Expected a stable description; got %q and %q", r.Description, again.Description)
+	}
+
+	// Requests mirrored without the trailer are not replaced.
+	withoutTrailer := *r
+	withoutTrailer.Description = strings.TrimSuffix(r.Description, "\n\nPR: #4\nURL: "+url)
+	if !RequestsOverlap(withoutTrailer, *r) {
+		t.Error("Expected the trailer to be ignored when comparing requests")
+	}
+}
+
+func TestConvertPullRequestLabels(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	url := "https://github.com/user/repo/pull/4"
+	pr.HTMLURL = &url
+	unlabeled, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(unlabeled.Description, "Labels:") || requestLabels(*unlabeled) != "" {
+		t.Errorf("Expected no labels in the trailer of an unlabeled PR; got %q", unlabeled.Description)
+	}
+
+	pr.Labels = []*github.Label{{Name: github.String("needs-review")}, {Name: github.String("bug")}}
+	labeled, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(labeled.Description, "\n\nPR: #4\nURL: "+url+"\nLabels: bug, needs-review") {
+		t.Errorf("Expected the sorted labels at the end of the trailer; got %q", labeled.Description)
+	}
+	if labels := requestLabels(*labeled); labels != "bug, needs-review" {
+		t.Errorf("Unexpected labels %q read back from the trailer", labels)
+	}
+	if stripped := stripPullRequestTrailer(labeled.Description); strings.Contains(stripped, "Labels:") || strings.Contains(stripped, "PR: #4") {
+		t.Errorf("Expected the whole trailer to be stripped; got %q", stripped)
+	}
+	if !RequestsOverlap(*unlabeled, *labeled) {
+		t.Error("Expected requests that only differ in their labels to overlap")
+	}
+}
+
+func TestConvertPullRequestNonDefaultTarget(t *testing.T) {
+	opts := Options{MarkNonDefaultTargets: true}
+
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	url := "https://github.com/user/repo/pull/4"
+	pr.HTMLURL = &url
+	defaultBranch := strings.TrimPrefix(*pr.Base.Ref, "refs/heads/")
+	pr.Base.Repo.DefaultBranch = &defaultBranch
+
+	r, err := ConvertPullRequest(pr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(r.Description, "\n\nPR: #4\nURL: "+url) {
+		t.Errorf("Expected no target in the trailer of a PR to the default branch; got %q", r.Description)
+	}
+
+	releaseBranch := "release-2.3"
+	pr.Base.Ref = &releaseBranch
+	r, err = ConvertPullRequest(pr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(r.Description, "\n\nPR: #4\nURL: "+url+"\nTarget: release-2.3 (non-default)") {
+		t.Errorf("Expected the target in the trailer of a PR to a release branch; got %q", r.Description)
+	}
+	if stripped := stripPullRequestTrailer(r.Description); strings.Contains(stripped, "Target:") || strings.Contains(stripped, "PR: #4") {
+		t.Errorf("Expected the whole trailer to be stripped; got %q", stripped)
+	}
+
+	r, err = ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(r.Description, "Target:") {
+		t.Errorf("Expected no target in the trailer unless it is enabled; got %q", r.Description)
+	}
+}
+
+func TestConvertMergeable(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	url := "https://github.com/user/repo/pull/4"
+	pr.HTMLURL = &url
+	at := time.Unix(1500000000, 0)
+
+	if _, err := ConvertMergeable(pr, at); err != ErrInsufficientInfo {
+		t.Errorf("Expected an error while it is unknown whether the PR can be merged, got %v", err)
+	}
+
+	pr.Mergeable = github.Bool(true)
+	report, err := ConvertMergeable(pr, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ci.Report{Timestamp: "1500000000", URL: url, Status: ci.StatusSuccess, Agent: MergeableAgent}
+	if *report != expected {
+		t.Errorf("Unexpected report for a PR that can be merged: %+v", *report)
+	}
+
+	pr.Mergeable = github.Bool(false)
+	report, err = ConvertMergeable(pr, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != ci.StatusFailure || report.Agent != MergeableAgent {
+		t.Errorf("Unexpected report for a PR with conflicts: %+v", *report)
+	}
+}
+
+func TestConvertDraftPullRequest(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	ready, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ready.Description, "Draft:") {
+		t.Errorf("Expected no draft marker for a ready pull request; got %q", ready.Description)
+	}
+
+	pr.MergeableState = github.String("draft")
+	draft, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(draft.Description, "\n\nDraft: true\n\nPR: #4") {
+		t.Errorf("Expected a draft marker before the trailer; got %q", draft.Description)
+	}
+	if RequestsOverlap(*draft, *ready) {
+		t.Error("Expected a draft to be updated once it is ready for review")
+	}
+}
+
+func TestConvertPullRequestWithDeletedTargetBranch(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	deletedRef := "deleted-branch"
+	pr.Base.Ref = &deletedRef
+
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatalf("Expected a pull request with a deleted target branch to be converted, got %v", err)
+	}
+	if r.Request.TargetRef != "refs/heads/deleted-branch" {
+		t.Errorf("Unexpected target ref %q", r.Request.TargetRef)
+	}
+	expectedBase, err := testRepo.MergeBase(*pr.Base.SHA, r.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedBase == r.Revision {
+		expectedBase = ""
+	}
+	if r.Request.BaseCommit != expectedBase {
+		t.Errorf("Expected the base commit %q to be computed from the pull request's base, got %q", expectedBase, r.Request.BaseCommit)
+	}
+
+	// Without the base commit either, the review is still converted.
+	missingBase := "0123456789abcdef0123456789abcdef01234567"
+	pr.Base.SHA = &missingBase
+	r, err = ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatalf("Expected a pull request with a missing base to be converted, got %v", err)
+	}
+	if r.Request.BaseCommit != "" {
+		t.Errorf("Unexpected base commit %q", r.Request.BaseCommit)
+	}
+}
+
+// unrelatedHistoriesRepo is a mock repo in which commits can't be listed
+// between any two commits, as if they had unrelated histories.
+type unrelatedHistoriesRepo struct {
+	repository.Repo
+}
+
+func (r unrelatedHistoriesRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	return nil, errors.New("fatal: no merge base")
+}
+
+func TestComputeReviewStartingCommitUnrelatedHistories(t *testing.T) {
+	testRepo := unrelatedHistoriesRepo{repository.NewMockRepoForTest()}
+	pr := buildTestPullRequest(testRepo, 4)
+
+	revision, err := computeReviewStartingCommit(pr, testRepo)
+	if err != nil {
+		t.Fatalf("Expected a fallback to the head commit, got %v", err)
+	}
+	if revision != *pr.Head.SHA {
+		t.Errorf("Expected the head commit %q, got %q", *pr.Head.SHA, revision)
+	}
+}
+
+func TestComputeReviewStartingCommitMissingHead(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	missingHead := "0123456789abcdef0123456789abcdef01234567"
+	pr.Head.SHA = &missingHead
+
+	_, err := computeReviewStartingCommit(pr, testRepo)
+	if err == nil || !strings.Contains(err.Error(), "refs/pull/4/head") {
+		t.Errorf("Expected an error naming the pull ref to fetch, got %v", err)
+	}
+}
+
+func TestConvertDiffCommentWithoutUsableHunk(t *testing.T) {
+	body := "Should this be configurable?"
+	filePath := "example.go"
+	commit := repository.TestCommitG
+	position := 2
+	now := time.Now()
+	for _, diffHunk := range []string{"", "@@ stale @@", "@@ -4,6 +10,10 @@"} {
+		hunk := diffHunk
+		diffComment := &github.PullRequestComment{
+			Body:             &body,
+			Path:             &filePath,
+			OriginalCommitID: &commit,
+			DiffHunk:         &hunk,
+			User: &github.User{
+				Login: &repoOwner,
+			},
+			CreatedAt: &now,
+		}
+		c, err := ConvertDiffComment(diffComment, Options{})
+		if err != nil {
+			t.Fatalf("Unexpected error for an outdated comment with the hunk %q: %v", diffHunk, err)
+		}
+		if c.Location.Path != filePath || c.Location.Range != nil {
+			t.Errorf("Expected the outdated comment with the hunk %q to be on the whole file: %+v", diffHunk, c.Location)
+		}
+
+		diffComment.Position = &position
+		c, err = ConvertDiffComment(diffComment, Options{})
+		if diffHunk == "" {
+			if err != nil || c.Location.Path != filePath || c.Location.Range != nil {
+				t.Errorf("Expected a comment without a hunk to be on the whole file: %+v, %v", c, err)
+			}
+		} else if err == nil {
+			t.Errorf("Expected an error for a current comment with the malformed hunk %q", diffHunk)
+		}
+	}
+}
+
+func TestConvertDiffCommentPreservesSuggestions(t *testing.T) {
+	body := "Let's use a constant here.\r\n```suggestion\r\n\tconst limit = 10\r\n\r\n```\r\nAnd another:\n```suggestion\n```"
+	filePath := "example.go"
+	diffHunk := "@@ -4,6 +10,10 @@ func changedMethod() {\n \t// This is an existing line\n+\tlimit := 10"
+	commit := repository.TestCommitG
+	position := 2
+	now := time.Now()
+	diffComment := &github.PullRequestComment{
+		Body:             &body,
+		Path:             &filePath,
+		OriginalCommitID: &commit,
+		DiffHunk:         &diffHunk,
+		Position:         &position,
+		User: &github.User{
+			Login: &repoOwner,
+		},
+		CreatedAt: &now,
+	}
+
+	c, err := ConvertDiffComment(diffComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := comment.Parse(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Description != body {
+		t.Errorf("Suggestion was not preserved: %q", parsed.Description)
+	}
+
+	suggestions := Suggestions(parsed.Description)
+	expected := []string{"\tconst limit = 10\n", ""}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("Unexpected suggestions %q; expected %q", suggestions, expected)
+	}
+	for i := range expected {
+		if suggestions[i] != expected[i] {
+			t.Errorf("Unexpected suggestion %q; expected %q", suggestions[i], expected[i])
+		}
+	}
+}
+
+func TestConvertOutdatedDiffComment(t *testing.T) {
+	body := "Should this be configurable?"
+	filePath := "example.go"
+	diffHunk := "@@ -4,6 +10,10 @@ func changedMethod() {\n \t// This is an existing line\n+\tlimit := 10"
+	commit := repository.TestCommitG
+	position := 2
+	now := time.Now()
+	diffComment := &github.PullRequestComment{
+		Body:             &body,
+		Path:             &filePath,
+		OriginalCommitID: &commit,
+		DiffHunk:         &diffHunk,
+		Position:         &position,
+		User: &github.User{
+			Login: &repoOwner,
+		},
+		CreatedAt: &now,
+	}
+	current, err := ConvertDiffComment(diffComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Description != body {
+		t.Errorf("Unexpected description for a current comment: %q", current.Description)
+	}
+
+	diffComment.Position = nil
+	outdated, err := ConvertDiffComment(diffComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outdated.Description != OutdatedMarker+body {
+		t.Errorf("Expected the comment to be marked as outdated: %q", outdated.Description)
+	}
+	if outdated.Location.Commit != commit || outdated.Location.Range == nil || outdated.Location.Range.StartLine != current.Location.Range.StartLine {
+		t.Errorf("Expected the outdated comment to stay on its original line: %+v", outdated.Location)
+	}
+	if !CommentsOverlap(*current, *outdated) {
+		t.Error("A comment that became outdated should not be mirrored again")
+	}
+}
+
+func TestConvertCommentReactions(t *testing.T) {
+	body := "LGTM"
+	now := time.Now()
+	plusOne, minusOne, heart := 3, 1, 2
+	issueComment := &github.IssueComment{
+		Body: &body,
+		User: &github.User{
+			Login: &repoOwner,
+		},
+		CreatedAt: &now,
+		Reactions: &github.Reactions{
+			PlusOne:  &plusOne,
+			MinusOne: &minusOne,
+			Heart:    &heart,
+		},
+	}
+
+	plain, err := ConvertIssueComment(issueComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Description != body {
+		t.Errorf("Expected the reactions to be left out by default: %q", plain.Description)
+	}
+
+	opts := Options{MirrorReactions: true}
+	withReactions, err := ConvertIssueComment(issueComment, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := body + "\n\nReactions: +3/-1"; withReactions.Description != expected {
+		t.Errorf("Unexpected description %q; expected %q", withReactions.Description, expected)
+	}
+
+	plusOne++
+	moreReactions, err := ConvertIssueComment(issueComment, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CommentsOverlap(*plain, *withReactions) || !CommentsOverlap(*withReactions, *moreReactions) {
+		t.Error("A comment that was reacted to should not be mirrored again")
+	}
+}
+
+func TestConvertCommentTimestamps(t *testing.T) {
+	body := "Fixed."
+	commit := repository.TestCommitG
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	updatedAt := createdAt.Add(time.Minute)
+	issueComment := &github.IssueComment{
+		Body:      &body,
+		User:      &github.User{Login: &repoOwner},
+		CreatedAt: &createdAt,
+		UpdatedAt: &updatedAt,
+	}
+	diffComment := &github.PullRequestComment{
+		Body:             &body,
+		User:             &github.User{Login: &repoOwner},
+		OriginalCommitID: &commit,
+		CreatedAt:        &createdAt,
+		UpdatedAt:        &updatedAt,
+	}
+
+	converted, err := ConvertIssueComment(issueComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.Timestamp != ConvertTime(updatedAt) {
+		t.Errorf("Expected the issue comment to have its updated time %q; got %q", ConvertTime(updatedAt), converted.Timestamp)
+	}
+	converted, err = ConvertDiffComment(diffComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.Timestamp != ConvertTime(updatedAt) {
+		t.Errorf("Expected the diff comment to have its updated time %q; got %q", ConvertTime(updatedAt), converted.Timestamp)
+	}
+
+	issueComment.UpdatedAt = nil
+	converted, err = ConvertIssueComment(issueComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.Timestamp != ConvertTime(createdAt) {
+		t.Errorf("Expected the issue comment to fall back to its creation time %q; got %q", ConvertTime(createdAt), converted.Timestamp)
+	}
+}
+
+func TestConvertCommitComment(t *testing.T) {
+	body := "Nice cleanup."
+	filePath := "example.go"
+	commit := repository.TestCommitG
+	now := time.Now()
+	commitComment := &github.RepositoryComment{
+		Body:      &body,
+		CommitID:  &commit,
+		User:      &github.User{Login: &repoOwner},
+		CreatedAt: &now,
+	}
+
+	c, err := ConvertCommitComment(commitComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author != repoOwner || c.Description != body || c.Timestamp != ConvertTime(now) {
+		t.Errorf("Unexpected comment: %+v", c)
+	}
+	if c.Location == nil || c.Location.Commit != commit || c.Location.Path != "" || c.Location.Range != nil {
+		t.Errorf("Expected a comment on the whole commit: %+v", c.Location)
+	}
+
+	commitComment.Path = &filePath
+	c, err = ConvertCommitComment(commitComment, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Location == nil || c.Location.Commit != commit || c.Location.Path != filePath || c.Location.Range != nil {
+		t.Errorf("Expected a comment on the whole file: %+v", c.Location)
+	}
+
+	commitComment.CommitID = nil
+	if _, err := ConvertCommitComment(commitComment, Options{}); err != ErrInsufficientInfo {
+		t.Errorf("Expected a comment without a commit to be rejected, got %v", err)
+	}
+}
+
+func TestConvertMergedPullRequest(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Comments) != 0 {
+		t.Errorf("Expected no comments on an unmerged pull request; got %+v", r.Comments)
+	}
+
+	merger := "merger"
+	mergedAt := pr.CreatedAt.Add(2 * time.Hour)
+	pr.MergedBy = &github.User{Login: &merger}
+	pr.MergedAt = &mergedAt
+	r, err = ConvertPullRequestToReview(pr, nil, nil, nil, testRepo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Comments) != 1 {
+		t.Fatalf("Expected a comment recording the merge; got %+v", r.Comments)
+	}
+	c := r.Comments[0].Comment
+	if c.Author != merger || c.Description != "Merged by merger" || c.Timestamp != ConvertTime(mergedAt) || c.Location != nil {
+		t.Errorf("Unexpected merge comment: %+v", c)
+	}
+}
+
+func TestPullRequestCloseComment(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	closer, labeler := "closer", "labeler"
+	closedAt := pr.CreatedAt.Add(2 * time.Hour)
+	events := []*github.IssueEvent{
+		{Event: github.String("closed"), Actor: &github.User{Login: &labeler}, CreatedAt: pr.CreatedAt},
+		{Event: github.String("reopened"), Actor: &github.User{Login: &labeler}, CreatedAt: pr.CreatedAt},
+		{Event: github.String("closed"), Actor: &github.User{Login: &closer}, CreatedAt: &closedAt},
+		{Event: github.String("labeled"), Actor: &github.User{Login: &labeler}, CreatedAt: &closedAt},
+	}
+	if c := pullRequestCloseComment(pr, events, Options{}); c != nil {
+		t.Errorf("Expected no comment on an open pull request; got %+v", c)
+	}
+
+	pr.State = github.String("closed")
+	c := pullRequestCloseComment(pr, events, Options{})
+	if c == nil || c.Author != closer || c.Description != "Closed by closer" || c.Timestamp != ConvertTime(closedAt) {
+		t.Errorf("Unexpected close comment: %+v", c)
+	}
+	if c := pullRequestCloseComment(pr, events[3:], Options{}); c != nil {
+		t.Errorf("Expected no comment without an event closing the pull request; got %+v", c)
+	}
+	events[2].Actor = nil
+	if c := pullRequestCloseComment(pr, events, Options{}); c == nil || c.Author != DefaultGhostAuthor {
+		t.Errorf("Expected a pull request closed by a deleted account to be attributed to %q; got %+v", DefaultGhostAuthor, c)
+	}
+
+	mergedAt := closedAt
+	pr.MergedAt = &mergedAt
+	if c := pullRequestCloseComment(pr, events, Options{}); c != nil {
+		t.Errorf("Expected no close comment on a merged pull request; got %+v", c)
+	}
+}
+
+func TestConvertGhostComments(t *testing.T) {
+	body := "Thanks!"
+	ghost := "ghost"
+	commit := repository.TestCommitG
+	now := time.Now()
+	for _, user := range []*github.User{nil, {}, {Login: &ghost}} {
+		issueComment, err := ConvertIssueComment(&github.IssueComment{
+			Body:      &body,
+			User:      user,
+			CreatedAt: &now,
+		}, Options{})
+		if err != nil {
+			t.Fatalf("Failed to convert an issue comment by %+v: %v", user, err)
+		}
+		diffComment, err := ConvertDiffComment(&github.PullRequestComment{
+			Body:             &body,
+			User:             user,
+			OriginalCommitID: &commit,
+			CreatedAt:        &now,
+		}, Options{})
+		if err != nil {
+			t.Fatalf("Failed to convert a diff comment by %+v: %v", user, err)
+		}
+		for _, c := range []*comment.Comment{issueComment, diffComment} {
+			if c.Author != DefaultGhostAuthor || !strings.HasSuffix(c.Description, body) || c.Timestamp != ConvertTime(now) {
+				t.Errorf("Unexpected comment by a deleted account: %+v", c)
+			}
+		}
+	}
+
+	opts := Options{GhostAuthor: "deleted-user"}
+	c, err := ConvertIssueComment(&github.IssueComment{
+		Body:      &body,
+		User:      &github.User{Login: &ghost},
+		CreatedAt: &now,
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author != opts.GhostAuthor {
+		t.Errorf("Expected the comment to be attributed to %q; got %q", opts.GhostAuthor, c.Author)
+	}
+}
+
+func TestExpandReferences(t *testing.T) {
+	for body, expected := range map[string]string{
+		"Fixes #12.":           "Fixes #12 (https://github.com/owner/repo/issues/12).",
+		"#3, and (#4)":         "#3 (https://github.com/owner/repo/issues/3), and (#4 (https://github.com/owner/repo/issues/4))",
+		"See other/project#56": "See other/project#56 (https://github.com/other/project/issues/56)",
+		"Thanks @user!":        "Thanks @user!",
+		"Not #12abc, x#1, &#123; or https://example.com/page#7": "Not #12abc, x#1, &#123; or https://example.com/page#7",
+	} {
+		if actual := expandReferences(body, "owner", "repo"); actual != expected {
+			t.Errorf("Unexpected expansion of %q: got %q, expected %q", body, actual, expected)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	for body, expected := range map[string][]string{
+		"Thanks @user!":                      {"@user"},
+		"@first and @second-user, cc @first": {"@first", "@second-user"},
+		"Ping @org/team-name.":               {"@org/team-name"},
+		"Mail user@example.com, not @-x":     nil,
+		"No mentions here":                   nil,
+	} {
+		if actual := mentions(body); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Unexpected mentions in %q: got %q, expected %q", body, actual, expected)
+		}
+	}
+}
+
+func TestConvertPullRequestExpandReferences(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	pr := buildTestPullRequest(testRepo, 4)
+	body := "Fixes #3, thanks to @user"
+	pr.Body = &body
+	pr.Base.Repo = &github.Repository{
+		Name:  &repoName,
+		Owner: &github.User{Login: &repoOwner},
+	}
+
+	r, err := ConvertPullRequest(pr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(r.Description, "\n\n"+body) {
+		t.Errorf("Expected the body to be mirrored as is by default: %q", r.Description)
+	}
+
+	r, err = ConvertPullRequest(pr, Options{ExpandReferences: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("Fixes #3 (https://github.com/%s/%s/issues/3), thanks to @user", repoOwner, repoName)
+	if !strings.Contains(r.Description, "\n\n"+expected+"\n\nMentions: @user\n\n") {
+		t.Errorf("Expected the references in the body to be expanded, and the mentions listed: %q", r.Description)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+
+	github "github.com/google/go-github/github"
+)
+
+// ConversionError is reported when a single item read from GitHub could not
+// be converted into its git-appraise equivalent.
+//
+// Conversion errors only affect the item in question, so callers can safely
+// skip over them and keep the rest of the results.
+type ConversionError struct {
+	// PRNumber is the number of the pull request being converted, or 0
+	// if the item did not belong to a pull request (e.g. a commit status).
+	PRNumber int
+	Cause    error
+}
+
+func (e *ConversionError) Error() string {
+	if e.PRNumber == 0 {
+		return fmt.Sprintf("failure converting item: %v", e.Cause)
+	}
+	return fmt.Sprintf("failure converting pull request #%d: %v", e.PRNumber, e.Cause)
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *ConversionError) Unwrap() error {
+	return e.Cause
+}
+
+// FetchError is reported when data could not be read from GitHub.
+//
+// When returned directly by one of the GetAll* methods, it means nothing
+// could be read for the repository; when passed through an error channel,
+// it only affects the named resource.
+type FetchError struct {
+	// Resource describes what was being read, e.g. "pull requests".
+	Resource string
+	Cause    error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failure fetching %s: %v", e.Resource, e.Cause)
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *FetchError) Unwrap() error {
+	return e.Cause
+}
+
+// WriteError is returned when some of the items passed to one of the Write*
+// functions could not be written to the repository.
+//
+// Each item is written independently, so the others were still written, and
+// callers can treat the failures like those of individual conversions.
+type WriteError struct {
+	// Failures holds the error for each item that could not be written.
+	Failures []error
+}
+
+func (e *WriteError) Error() string {
+	if len(e.Failures) == 1 {
+		return e.Failures[0].Error()
+	}
+	return fmt.Sprintf("failure writing %d items, the first with: %v", len(e.Failures), e.Failures[0])
+}
+
+// writeErrors combines the given failures to write individual items into a
+// single *WriteError, or returns nil if there are none. Nil errors are ignored,
+// and failures that are themselves a *WriteError are flattened.
+func writeErrors(failures []error) error {
+	var flattened []error
+	for _, err := range failures {
+		var writeErr *WriteError
+		if err == nil {
+			continue
+		} else if errors.As(err, &writeErr) {
+			flattened = append(flattened, writeErr.Failures...)
+		} else {
+			flattened = append(flattened, err)
+		}
+	}
+	if len(flattened) == 0 {
+		return nil
+	}
+	return &WriteError{Failures: flattened}
+}
+
+// prNumber returns the number of the given pull request, or 0 if it has none.
+func prNumber(pr *github.PullRequest) int {
+	if pr == nil || pr.Number == nil {
+		return 0
+	}
+	return *pr.Number
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// LogFormat selects how the items written to a repository are described in the
+// messages sent on the log channels of the Write functions.
+type LogFormat int
+
+const (
+	// TextLogFormat describes each item in prose, for people to read.
+	TextLogFormat LogFormat = iota
+	// JSONLogFormat describes each item as a single line of JSON, for
+	// log-based analytics and dashboards.
+	JSONLogFormat
+)
+
+// ParseLogFormat parses the name of a log format, either "text" or "json".
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch name {
+	case "text":
+		return TextLogFormat, nil
+	case "json":
+		return JSONLogFormat, nil
+	}
+	return TextLogFormat, fmt.Errorf("unknown log format %q; must be either \"text\" or \"json\"", name)
+}
+
+// ItemEvent is the structured description of an item written to a repository,
+// as logged in the JSON log format.
+type ItemEvent struct {
+	// Type is one of "report", "review", or "comment".
+	Type      string `json:"type"`
+	Commit    string `json:"commit"`
+	Author    string `json:"author,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	ReviewRef string `json:"reviewRef,omitempty"`
+}
+
+// describeItem returns the message to log for a written item: either the given
+// prose description, or the JSON encoding of the event, according to LogFormat.
+func (o Options) describeItem(event ItemEvent, text string) string {
+	if o.LogFormat != JSONLogFormat {
+		return text
+	}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return text
+	}
+	return string(bytes)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/review"
+	github "github.com/google/go-github/github"
+)
+
+func TestJSONItemLogFormat(t *testing.T) {
+	opts := Options{LogFormat: JSONLogFormat}
+
+	repo := newNotesRepo()
+	pr := buildTestPullRequest(repo, 4)
+	commentTime := pr.CreatedAt.Add(time.Hour)
+	commentBody := "LGTM"
+	issueComments := []*github.IssueComment{{
+		Body:      &commentBody,
+		User:      &github.User{Login: &repoOwner},
+		CreatedAt: &commentTime,
+	}}
+	r, err := ConvertPullRequestToReview(pr, issueComments, nil, nil, repo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logChan := make(chan string, 10)
+	if err := WriteNewReviews([]review.Review{*r}, repo, logChan, opts); err != nil {
+		t.Fatal(err)
+	}
+	close(logChan)
+
+	var events []ItemEvent
+	for msg := range logChan {
+		var event ItemEvent
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			t.Fatalf("Expected a JSON log line, got %q: %v", msg, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected one event for the review and one for its comment, got %+v", events)
+	}
+	if events[0].Type != "review" || events[0].Author != pr.User.GetLogin() || events[0].ReviewRef != "refs/pull/4/head" {
+		t.Errorf("Unexpected review event %+v", events[0])
+	}
+	if events[1].Type != "comment" || events[1].Author != repoOwner || events[1].Commit != r.Revision {
+		t.Errorf("Unexpected comment event %+v", events[1])
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	if format, err := ParseLogFormat("json"); err != nil || format != JSONLogFormat {
+		t.Errorf("Unexpected result for \"json\": %v, %v", format, err)
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
+)
+
+// Bundle holds everything that has been mirrored into a repository, in a form
+// that can be marshalled to JSON and read without git-appraise.
+type Bundle struct {
+	// Reviews holds each review, with its comments, and the CI reports of
+	// its head commit, as review.Review.GetJSON would output it.
+	Reviews []review.Review `json:"reviews"`
+	// Reports holds the CI reports of every commit that has any, keyed by the
+	// commit's hash, including the commits that aren't the head of a review.
+	Reports map[string][]ci.Report `json:"reports"`
+}
+
+// Export reads all of the reviews and CI reports in the given repository.
+func Export(repo repository.Repo) (*Bundle, error) {
+	bundle := &Bundle{
+		Reviews: []review.Review{},
+		Reports: make(map[string][]ci.Report),
+	}
+	for _, summary := range review.ListAll(repo) {
+		summary := summary
+		r, err := summary.Details()
+		if err != nil {
+			return nil, fmt.Errorf("error reading review %s: %v", summary.Revision, err)
+		}
+		bundle.Reviews = append(bundle.Reviews, *r)
+	}
+
+	notes, err := repo.GetAllNotes(ci.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CI reports: %v", err)
+	}
+	for commit, commitNotes := range notes {
+		if reports := ci.ParseAllValid(commitNotes); len(reports) > 0 {
+			bundle.Reports[commit] = reports
+		}
+	}
+	return bundle, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
+)
+
+func TestExport(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	r, err := ConvertPullRequestToReview(buildTestPullRequest(repo, 4), nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	reports := map[string][]ci.Report{
+		repository.TestCommitE: {{Timestamp: "1", Agent: "ci", Status: ci.StatusFailure, URL: "https://ci.example.com/1"}},
+	}
+	if err := WriteNewReports(reports, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := Export(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Reviews []struct {
+			Revision string `json:"revision"`
+			Request  struct {
+				ReviewRef string `json:"reviewRef"`
+			} `json:"request"`
+		} `json:"reviews"`
+		Reports map[string][]ci.Report `json:"reports"`
+	}
+	if err := json.Unmarshal(bytes, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Reviews) != 1 || exported.Reviews[0].Request.ReviewRef != "refs/pull/4/head" {
+		t.Errorf("Unexpected exported reviews: %s", bytes)
+	}
+	if len(exported.Reports) != 1 || len(exported.Reports[repository.TestCommitE]) != 1 {
+		t.Errorf("Unexpected exported reports: %s", bytes)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	github "github.com/google/go-github/github"
+
+	"github.com/google/git-pull-request-mirror/internal/testutil"
+)
+
+func TestMirrorFromFakeGitHub(t *testing.T) {
+	fake := testutil.NewFakeGitHub("user", "repo")
+	defer fake.Close()
+	// Small pages make every list below span several of them.
+	fake.PageSize = 2
+
+	testRepo := repository.NewMockRepoForTest()
+	open, closed := "open", "closed"
+	for number, state := range []*string{&open, &closed, &open} {
+		pr := buildTestPullRequest(testRepo, number+1)
+		pr.State = state
+		fake.AddPullRequest(pr)
+	}
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("Comment %d", i)
+		createdAt := now.Add(time.Duration(i) * time.Minute)
+		fake.AddIssueComment(1, &github.IssueComment{
+			Body:      &body,
+			User:      &github.User{Login: &repoOwner},
+			CreatedAt: &createdAt,
+		})
+	}
+	diffBody, diffCommit, diffPath := "Nit.", repository.TestCommitG, "foo.go"
+	fake.AddDiffComment(2, &github.PullRequestComment{
+		Body:             &diffBody,
+		User:             &github.User{Login: &repoOwner},
+		OriginalCommitID: &diffCommit,
+		Path:             &diffPath,
+		CreatedAt:        &now,
+	})
+	fake.AddRef("refs/heads/master", repository.TestCommitG)
+	for i := 0; i < 3; i++ {
+		targetURL := fmt.Sprintf(statusTargetURLFormat, i)
+		agent := fmt.Sprintf("ci/%d", i)
+		fake.AddStatus(repository.TestCommitG, &github.RepoStatus{
+			CreatedAt: &now,
+			State:     &stateSuccess,
+			TargetURL: &targetURL,
+			Context:   &agent,
+		})
+	}
+	fake.Throttle(1)
+
+	client := fake.Client()
+	errOutput := make(chan error, 1000)
+	statuses, err := GetAllStatuses(context.Background(), "user", "repo", client.Git, client.Repositories, client.PullRequests, nil, errOutput, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reviews, err := GetAllPullRequests(context.Background(), testRepo, "user", "repo", AllPullRequests, time.Time{}, 0, client.PullRequests, client.Issues, errOutput, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(errOutput)
+	for err := range errOutput {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	requests := fake.Requests()
+	if len(requests) < 2 || requests[0] != requests[1] {
+		t.Errorf("Expected the throttled request to be retried; got %v", requests)
+	}
+	paginated := false
+	for _, request := range requests {
+		paginated = paginated || strings.Contains(request, "page=2")
+	}
+	if !paginated {
+		t.Errorf("Expected the results to be read across several pages; got %v", requests)
+	}
+	if len(statuses[repository.TestCommitG]) != 3 {
+		t.Errorf("Expected all of the statuses to be read across pages; got %+v", statuses)
+	}
+	if len(reviews) != 3 {
+		t.Fatalf("Expected all of the pull requests to be read across pages; got %d", len(reviews))
+	}
+	comments := make(map[string]int)
+	for _, r := range reviews {
+		comments[r.Request.ReviewRef] = len(r.Comments)
+	}
+	if comments["refs/pull/1/head"] != 3 || comments["refs/pull/2/head"] != 1 || comments["refs/pull/3/head"] != 0 {
+		t.Errorf("Unexpected number of comments read for each pull request: %v", comments)
+	}
+
+	local := newNotesRepo()
+	if err := WriteNewReports(statuses, local, discardLogs(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews(reviews, local, discardLogs(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for notesRef, expected := range map[string]int{
+		"refs/notes/devtools/ci":      3,
+		"refs/notes/devtools/reviews": 3,
+		"refs/notes/devtools/discuss": 4,
+	} {
+		if notes := local.GetNotes(notesRef, repository.TestCommitG); len(notes) != expected {
+			t.Errorf("Expected %d notes in %s; got %d: %s", expected, notesRef, len(notes), strings.Join(noteStrings(notes), "\n"))
+		}
+	}
+}
+
+func TestPullRequestsServiceReportsDrafts(t *testing.T) {
+	fake := testutil.NewFakeGitHub("user", "repo")
+	defer fake.Close()
+	fake.PageSize = 1
+
+	testRepo := repository.NewMockRepoForTest()
+	open := "open"
+	for number := 1; number <= 2; number++ {
+		pr := buildTestPullRequest(testRepo, number)
+		pr.State = &open
+		fake.AddPullRequest(pr)
+	}
+	fake.MarkDraft(2)
+
+	prs := NewPullRequestsService(fake.Client())
+	listed, err := ListPullRequests(context.Background(), "user", "repo", prs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drafts := make(map[int]bool)
+	for _, pr := range listed {
+		drafts[pr.GetNumber()] = IsDraft(pr)
+	}
+	if len(drafts) != 2 || drafts[1] || !drafts[2] {
+		t.Errorf("Expected only the listed pull request #2 to be a draft, got %v", drafts)
+	}
+	pr, _, err := prs.Get(context.Background(), "user", "repo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDraft(pr) {
+		t.Error("Expected pull request #2 to be read as a draft")
+	}
+
+	errOutput := make(chan error, 1000)
+	reviews, err := GetAllPullRequests(context.Background(), testRepo, "user", "repo", AllPullRequests, time.Time{}, 0, prs, fake.Client().Issues, errOutput, nil, Options{SkipDrafts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(errOutput)
+	for err := range errOutput {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(reviews) != 1 || reviews[0].Request.ReviewRef != "refs/pull/1/head" {
+		t.Errorf("Expected the draft to be skipped by the full crawl, got %+v", reviews)
+	}
+}
+
+func noteStrings(notes []repository.Note) []string {
+	var result []string
+	for _, note := range notes {
+		result = append(result, string(note))
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"time"
+
+	github "github.com/google/go-github/github"
+)
+
+// DefaultGhostAuthor is the author recorded on comments whose GitHub accounts
+// have been deleted, unless Options.GhostAuthor says otherwise. GitHub
+// attributes those comments to its "ghost" user, or sometimes reports no user
+// at all.
+const DefaultGhostAuthor = "ghost"
+
+// Options control how the data read from GitHub is mirrored.
+//
+// The zero value mirrors everything as it is read, so that each option only has
+// to be set to turn on the behavior it describes. The options are passed to
+// each function that needs them, rather than being set once for the whole
+// process, so that differently configured repositories can be mirrored side by
+// side.
+type Options struct {
+	// GhostAuthor is the author recorded on comments whose GitHub accounts
+	// have been deleted, or DefaultGhostAuthor if it is empty.
+	GhostAuthor string
+
+	// MirrorReactions controls whether a summary of the thumbs up and thumbs
+	// down reactions to each comment, e.g. "Reactions: +3/-1", is appended to
+	// the mirrored comment.
+	//
+	// GitHub includes the reaction counts in the listed comments, so this
+	// doesn't need any additional API requests. However, the counts are not
+	// updated once a comment has been mirrored.
+	MirrorReactions bool
+
+	// ExpandReferences controls whether the issue and pull request references
+	// in the body of a pull request, e.g. "#123", are expanded to include their
+	// URLs, and the users and teams it mentions, e.g. "@user", are listed in a
+	// "Mentions:" line after it, so that the mirrored description still makes
+	// sense away from GitHub.
+	//
+	// This is off by default, so that bodies are mirrored byte-for-byte.
+	ExpandReferences bool
+
+	// ContextAliases are applied to the context of each converted commit
+	// status, in order; the first alias whose pattern matches the whole
+	// context replaces it. By default there are none, so the context is used
+	// as it is.
+	ContextAliases []ContextAlias
+
+	// MirrorMergeable controls whether SyncPullRequest mirrors whether a pull
+	// request can be merged without conflicts, as a CI report on its head
+	// commit.
+	MirrorMergeable bool
+
+	// MirrorClosedBy controls whether the review of each pull request that was
+	// closed without being merged gets a comment recording who closed it, like
+	// the one recording who merged the merged ones.
+	//
+	// GitHub only reports who closed a pull request in its issue events, so
+	// this needs an additional API request for each such pull request.
+	MirrorClosedBy bool
+
+	// SkipDrafts controls whether draft pull requests are left out of the
+	// mirror, rather than mirrored with a "Draft: true" line in their
+	// descriptions.
+	SkipDrafts bool
+
+	// ClosedBefore, if set, leaves the pull requests that were closed (or
+	// merged) before it out of the mirror. This keeps the reviews removed by
+	// PruneResolvedReviews from being mirrored again by every later sync.
+	ClosedBefore time.Time
+
+	// MarkNonDefaultTargets controls whether the trailer of a review request
+	// also names the branch that its pull request targets, e.g.
+	// "Target: release-2.3 (non-default)", if that is not the repository's
+	// default branch.
+	//
+	// GitHub includes the default branch with the base repository of every
+	// pull request, so this doesn't need any additional API requests.
+	MarkNonDefaultTargets bool
+
+	// LogFormat is the format in which written items are described on the
+	// log channels of the Write functions.
+	LogFormat LogFormat
+
+	// Debugf, if set, is called with a message for every item that is
+	// converted, skipped, or could not be converted, for debugging the
+	// conversions.
+	Debugf func(format string, args ...interface{})
+}
+
+// ghostAuthor returns the author to record on the comments of deleted accounts.
+func (o Options) ghostAuthor() string {
+	if o.GhostAuthor == "" {
+		return DefaultGhostAuthor
+	}
+	return o.GhostAuthor
+}
+
+// debugf calls Debugf, if it is set.
+func (o Options) debugf(format string, args ...interface{}) {
+	if o.Debugf != nil {
+		o.Debugf(format, args...)
+	}
+}
+
+// skipReason returns why the given pull request is left out of the mirror, e.g.
+// "draft", or the empty string if it is mirrored.
+func (o Options) skipReason(pr *github.PullRequest) string {
+	if o.SkipDrafts && IsDraft(pr) {
+		return "draft"
+	}
+	if !o.ClosedBefore.IsZero() && pr.GetState() == "closed" && pr.ClosedAt != nil && pr.ClosedAt.Before(o.ClosedBefore) {
+		return "long-closed"
+	}
+	return ""
+}
@@ -19,42 +19,176 @@ package mirror
 import (
 	"encoding/json"
 	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/ci"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
+
+	"github.com/google/git-pull-request-mirror/metrics"
 )
 
+// DefaultNotesRefPattern is the pattern matching all of the git-appraise notes
+// refs, and thus all of the refs that are written by the mirror.
+const DefaultNotesRefPattern = "refs/notes/devtools/*"
+
+// CheckNotesRefPattern verifies that the given pattern, as used for pulling and
+// pushing git-notes, covers all of the notes refs that the mirror writes to.
+//
+// As in a git refspec, the pattern may contain a single "*", which matches any
+// sequence of characters (including "/").
+//
+// The mirror always writes to git-appraise's own refs, e.g.
+// "refs/notes/devtools/reviews", and the notes are pulled and pushed without
+// renaming them, so a pattern under a separate prefix, e.g. for trying the
+// mirror out in "refs/notes/sandbox/*", is not supported. Mirror into a
+// separate repository for that instead.
+func CheckNotesRefPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "refs/notes/") {
+		return fmt.Errorf("notes ref pattern %q is not under refs/notes/", pattern)
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.Index(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+		if strings.Contains(suffix, "*") {
+			return fmt.Errorf("notes ref pattern %q has more than one wildcard", pattern)
+		}
+	}
+	for _, ref := range []string{request.Ref, comment.Ref, ci.Ref} {
+		matched := ref == pattern ||
+			(prefix != pattern && strings.HasPrefix(ref, prefix) && strings.HasSuffix(ref[len(prefix):], suffix))
+		if !matched {
+			return fmt.Errorf("notes ref pattern %q does not match %q, which the mirror writes to; the notes refs can not be moved under another prefix", pattern, ref)
+		}
+	}
+	return nil
+}
+
+// CheckGitIdentity verifies that the given name and email address can be used
+// as the git author and committer of the notes commits that the mirror makes.
+//
+// The email address must be a bare address, e.g. "mirror@example.com", rather
+// than one with a display name or angle brackets.
+func CheckGitIdentity(name, email string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "<>\n") {
+		return fmt.Errorf("invalid git user name %q", name)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return fmt.Errorf("invalid git user email address %q", email)
+	}
+	return nil
+}
+
+// noteBatch accumulates new notes so that all of the notes for a given revision
+// can be written using a single call to AppendNote.
+//
+// Every call to AppendNote creates a new commit on the notes ref, so writing
+// the notes one at a time would produce a separate commit for every single
+// comment or status, which makes the resulting push needlessly large.
+type noteBatch map[string]map[string][]string
+
+// add queues a note to be appended to the given revision under the given ref.
+func (b noteBatch) add(notesRef, revision string, note repository.Note) {
+	if b[notesRef] == nil {
+		b[notesRef] = make(map[string][]string)
+	}
+	b[notesRef][revision] = append(b[notesRef][revision], string(note))
+}
+
+// notes returns the notes already in the repo for the given ref and revision,
+// followed by those queued to be appended to them.
+func (b noteBatch) notes(repo repository.Repo, notesRef, revision string) []repository.Note {
+	notes := repo.GetNotes(notesRef, revision)
+	for _, note := range b[notesRef][revision] {
+		notes = append(notes, repository.Note(note))
+	}
+	return notes
+}
+
+// write appends all of the queued notes to the repo, with a single commit per
+// ref and revision. A failure to write the notes of one revision doesn't stop
+// the others from being written; all of the failures are returned together as a
+// *WriteError.
+func (b noteBatch) write(repo repository.Repo) error {
+	var failures []error
+	var refs []string
+	for notesRef := range b {
+		refs = append(refs, notesRef)
+	}
+	sort.Strings(refs)
+	for _, notesRef := range refs {
+		var revisions []string
+		for revision := range b[notesRef] {
+			revisions = append(revisions, revision)
+		}
+		sort.Strings(revisions)
+		for _, revision := range revisions {
+			// Each line of a note is parsed separately, so the queued notes
+			// can be combined by joining them with newlines.
+			note := repository.Note(strings.Join(b[notesRef][revision], "\n"))
+			if err := repo.AppendNote(notesRef, revision, note); err != nil {
+				failures = append(failures, fmt.Errorf("failure writing the notes in %s for %.12s: %w", notesRef, revision, err))
+				continue
+			}
+			metrics.NotesWritten(len(b[notesRef][revision]))
+		}
+	}
+	return writeErrors(failures)
+}
+
 // WriteNewReports takes a list of CI reports read from GitHub, and writes to the repo any that are new.
 //
 // The passed in logChan variable is used as our intermediary for logging, and allows us to
 // use the same logic for logging messages in either our CLI or our App Engine apps, even though
 // the two have different logging frameworks.
-func WriteNewReports(reportsMap map[string][]ci.Report, repo repository.Repo, logChan chan<- string) error {
+//
+// A failure to write one report doesn't stop the others from being written; all
+// of the failures are returned together as a *WriteError.
+func WriteNewReports(reportsMap map[string][]ci.Report, repo repository.Repo, logChan chan<- string, opts Options) error {
+	batch := make(noteBatch)
+	var failures []error
 	for commit, commitReports := range reportsMap {
 		existingReports := ci.ParseAllValid(repo.GetNotes(ci.Ref, commit))
 		for _, report := range commitReports {
 			bytes, err := json.Marshal(report)
-			note := repository.Note(bytes)
 			if err != nil {
-				return err
+				failures = append(failures, fmt.Errorf("failure encoding a report for %.12s: %w", commit, err))
+				continue
 			}
+			note := repository.Note(bytes)
 			missing := true
 			for _, existing := range existingReports {
-				if existing == report {
+				if ReportsOverlap(existing, report) {
 					missing = false
 				}
 			}
 			if missing {
-				logChan <- fmt.Sprintf("Found a new report for %.12s: %q", commit, string(bytes))
-				if err := repo.AppendNote(ci.Ref, commit, note); err != nil {
-					return err
-				}
+				logChan <- opts.describeItem(
+					ItemEvent{Type: "report", Commit: commit, Author: report.Agent, Timestamp: report.Timestamp},
+					fmt.Sprintf("Found a new report for %.12s: %q", commit, string(bytes)))
+				batch.add(ci.Ref, commit, note)
+				existingReports = append(existingReports, report)
 			}
 		}
 	}
-	return nil
+	return writeErrors(append(failures, batch.write(repo)))
+}
+
+// ReportsOverlap determines if two CI reports are sufficiently similar that one is a good-enough replacement for the other.
+//
+// GitHub bumps the timestamp of a commit status every time the corresponding build is re-run,
+// even if nothing else about it changed, so we only compare the agent, URL, and status. A
+// report whose status changed is still treated as new, and since git-appraise uses the report
+// with the latest timestamp for each agent, that newer report supersedes the older one.
+func ReportsOverlap(a, b ci.Report) bool {
+	return a.Agent == b.Agent &&
+		a.URL == b.URL &&
+		a.Status == b.Status
 }
 
 // WriteNewComments takes a list of review comments read from GitHub, and writes to the repo any that are new.
@@ -62,27 +196,87 @@ func WriteNewReports(reportsMap map[string][]ci.Report, repo repository.Repo, lo
 // The passed in logChan variable is used as our intermediary for logging, and allows us to
 // use the same logic for logging messages in either our CLI or our App Engine apps, even though
 // the two have different logging frameworks.
-func WriteNewComments(r review.Review, repo repository.Repo, logChan chan<- string) error {
-	existingComments := comment.ParseAllValid(repo.GetNotes(comment.Ref, r.Revision))
+//
+// A failure to write one comment doesn't stop the others from being written; all
+// of the failures are returned together as a *WriteError.
+func WriteNewComments(r review.Review, repo repository.Repo, logChan chan<- string, opts Options) error {
+	batch := make(noteBatch)
+	failures := addNewComments(r, repo, batch, logChan, opts)
+	return writeErrors(append(failures, batch.write(repo)))
+}
+
+// addNewComments queues those of the review's comments that are new to be
+// written in the given batch, and returns the failures to encode the others.
+func addNewComments(r review.Review, repo repository.Repo, batch noteBatch, logChan chan<- string, opts Options) []error {
+	var failures []error
+	existingComments := comment.ParseAllValid(batch.notes(repo, comment.Ref, r.Revision))
 	for _, commentThread := range r.Comments {
-		commentNote, err := commentThread.Comment.Write()
-		if err != nil {
-			return err
-		}
 		missing := true
 		for _, existing := range existingComments {
 			if CommentsOverlap(existing, commentThread.Comment) {
 				missing = false
 			}
 		}
-		if missing {
-			logChan <- fmt.Sprintf("Found a new comment: %q", string(commentNote))
-			if err := repo.AppendNote(comment.Ref, r.Revision, commentNote); err != nil {
-				return err
+		if !missing {
+			continue
+		}
+		c := commentThread.Comment
+		if commentThread.Original != nil {
+			// The comment was edited on GitHub. If the version we previously
+			// mirrored is found, then record the new one as an edit of it, so
+			// that git-appraise shows the latest text. Otherwise, we write it
+			// as of its creation time so that later edits can be matched.
+			if originalHash := findEditedComment(*commentThread.Original, existingComments); originalHash != "" {
+				c.Original = originalHash
+			} else {
+				c = *commentThread.Original
 			}
 		}
+		commentNote, err := c.Write()
+		if err != nil {
+			failures = append(failures, fmt.Errorf("failure encoding a comment on %s: %w", r.Request.ReviewRef, err))
+			continue
+		}
+		logChan <- opts.describeItem(
+			ItemEvent{Type: "comment", Commit: r.Revision, Author: c.Author, Timestamp: c.Timestamp, ReviewRef: r.Request.ReviewRef},
+			fmt.Sprintf("Found a new comment: %q", string(commentNote)))
+		batch.add(comment.Ref, r.Revision, commentNote)
 	}
-	return nil
+	return failures
+}
+
+// WriteNewCommitComment writes a comment on a commit, made outside of any pull
+// request, to the repo as a comment on that commit, unless it was already
+// mirrored.
+func WriteNewCommitComment(c comment.Comment, repo repository.Repo, logChan chan<- string, opts Options) error {
+	if c.Location == nil || c.Location.Commit == "" {
+		return ErrInsufficientInfo
+	}
+	r := review.Review{
+		Summary: &review.Summary{
+			Revision: c.Location.Commit,
+			Comments: []review.CommentThread{{Comment: c}},
+		},
+	}
+	return WriteNewComments(r, repo, logChan, opts)
+}
+
+// findEditedComment returns the hash of the existing comment that the given
+// original comment corresponds to, or the empty string if there is none.
+//
+// Since the creation time of a GitHub comment is not affected by edits, the
+// comments are matched on their author, location, and timestamp, rather than
+// on their descriptions.
+func findEditedComment(original comment.Comment, existingComments map[string]comment.Comment) string {
+	for hash, existing := range existingComments {
+		if existing.Original == "" &&
+			existing.Author == original.Author &&
+			existing.Timestamp == original.Timestamp &&
+			commentLocationsOverlap(existing, original) {
+			return hash
+		}
+	}
+	return ""
 }
 
 func quoteComment(c comment.Comment) string {
@@ -94,6 +288,10 @@ func commentDescriptionsMatch(a, b comment.Comment) bool {
 }
 
 func commentDescriptionsOverlap(a, b comment.Comment) bool {
+	// A comment that has since become outdated, or been reacted to, is still
+	// the same comment.
+	a.Description = stripReactionsTrailer(strings.TrimPrefix(a.Description, OutdatedMarker))
+	b.Description = stripReactionsTrailer(strings.TrimPrefix(b.Description, OutdatedMarker))
 	return commentDescriptionsMatch(a, b) ||
 		a.Description == quoteComment(b) ||
 		quoteComment(a) == b.Description
@@ -147,39 +345,69 @@ func CommentsOverlap(a, b comment.Comment) bool {
 // WriteNewReviews takes a list of reviews read from GitHub, and writes to the repo any review
 // data that has not already been written to it.
 //
+// If the request for a review has changed since it was last written (e.g. because the pull
+// request's title or description was edited), then the updated request is appended, and
+// becomes the current request for that review.
+//
+// Reviews are matched to the pull requests they mirror by their review ref, so if a pull
+// request is force-pushed, its review stays at the original revision, and the updated
+// request records the new starting commit in its Alias field. Comments continue to be
+// written to the original revision.
+//
+// The notes of all of the reviews are written together, with a single commit per
+// notes ref and revision. A failure to write one of them doesn't stop the others
+// from being written; all of the failures are returned together as a *WriteError.
+//
 // The passed in logChan variable is used as our intermediary for logging, and allows us to
 // use the same logic for logging messages in either our CLI or our App Engine apps, even though
 // the two have different logging frameworks.
-func WriteNewReviews(reviews []review.Review, repo repository.Repo, logChan chan<- string) error {
+func WriteNewReviews(reviews []review.Review, repo repository.Repo, logChan chan<- string, opts Options) error {
 	existingReviews := review.ListAll(repo)
+	batch := make(noteBatch)
+	var failures []error
 	for _, r := range reviews {
+		failures = append(failures, addNewReview(r, existingReviews, repo, batch, logChan, opts)...)
+	}
+	return writeErrors(append(failures, batch.write(repo)))
+}
+
+// addNewReview queues the notes of the given review that have not already been
+// written in the given batch, as WriteNewReviews does, and returns the failures
+// to encode them.
+func addNewReview(r review.Review, existingReviews []review.Summary, repo repository.Repo, batch noteBatch, logChan chan<- string, opts Options) []error {
+	alreadyPresent := false
+	if existing := findMatchingExistingReview(r, existingReviews); existing != nil {
+		if r.Revision != existing.Revision {
+			// The pull request was force-pushed, so its commits now start
+			// somewhere else. Keep the review anchored at its original
+			// revision, and record the new one as the review's alias,
+			// which is how git-appraise itself tracks rebased reviews.
+			r.Request.Alias = r.Revision
+		}
+		alreadyPresent = sameRequest(existing.Request, r.Request)
+		r.Revision = existing.Revision
+		if !alreadyPresent && r.Request.Timestamp < existing.Request.Timestamp {
+			// git-appraise treats the request with the latest timestamp as the
+			// current one, so an updated request (e.g. from the pull request's
+			// description being edited) must not sort before the one it replaces.
+			r.Request.Timestamp = existing.Request.Timestamp
+		}
+	}
+	if !alreadyPresent {
 		requestNote, err := r.Request.Write()
 		if err != nil {
-			return err
+			return []error{fmt.Errorf("failure encoding the review for %s: %w", r.Request.ReviewRef, err)}
 		}
+		requestJSON, err := r.GetJSON()
 		if err != nil {
-			return err
-		}
-		alreadyPresent := false
-		if existing := findMatchingExistingReview(r, existingReviews); existing != nil {
-			alreadyPresent = RequestsOverlap(existing.Request, r.Request)
-			r.Revision = existing.Revision
-		}
-		if !alreadyPresent {
-			requestJSON, err := r.GetJSON()
-			if err != nil {
-				return err
-			}
-			logChan <- fmt.Sprintf("Found a new review for %.12s:\n%s\n", r.Revision, requestJSON)
-			if err := repo.AppendNote(request.Ref, r.Revision, requestNote); err != nil {
-				return err
-			}
-		}
-		if err := WriteNewComments(r, repo, logChan); err != nil {
-			return err
+			return []error{fmt.Errorf("failure encoding the review for %s: %w", r.Request.ReviewRef, err)}
 		}
+		logChan <- opts.describeItem(
+			ItemEvent{Type: "review", Commit: r.Revision, Author: r.Request.Requester, Timestamp: r.Request.Timestamp, ReviewRef: r.Request.ReviewRef},
+			fmt.Sprintf("Found a new review for %.12s:\n%s\n", r.Revision, requestJSON))
+		batch.add(request.Ref, r.Revision, requestNote)
 	}
-	return nil
+	return addNewComments(r, repo, batch, logChan, opts)
 }
 
 // findMatchingExistingReview determines if the given list of existing reviews includes
@@ -199,15 +427,46 @@ func findMatchingExistingReview(r review.Review, existingReviews []review.Summar
 	return nil
 }
 
+// sameReviewers reports whether two lists of reviewers contain the same users,
+// regardless of their order.
+func sameReviewers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, reviewer := range a {
+		counts[reviewer]++
+	}
+	for _, reviewer := range b {
+		if counts[reviewer] == 0 {
+			return false
+		}
+		counts[reviewer]--
+	}
+	return true
+}
+
 // RequestsOverlap determines if two review requests are sufficiently similar that one is a good-enough replacement for the other.
 //
 // The purpose of this method is to account for the semantic differences between a GitHub pull request and a
 // git-appraise request. More specifically, a GitHub pull request can only have a single "assignee", but a
 // git-appraise review can have multiple reviewers. As such, when we compare two requests to see if they are
-// "close enough", we ignore the reviewers field.
+// "close enough", we ignore the reviewers field. We also ignore the trailer recording the pull request's
+// number and URL, so that requests mirrored before it was added aren't rewritten.
 func RequestsOverlap(a, b request.Request) bool {
 	return a.ReviewRef == b.ReviewRef &&
 		a.TargetRef == b.TargetRef &&
-		a.Description == b.Description &&
+		stripPullRequestTrailer(a.Description) == stripPullRequestTrailer(b.Description) &&
+		a.Alias == b.Alias &&
 		(a.BaseCommit == b.BaseCommit || a.BaseCommit == "" || b.BaseCommit == "")
 }
+
+// sameRequest reports whether the review request b records nothing new over a,
+// so that it needn't be written: whether they overlap, as for RequestsOverlap,
+// and also have the same reviewers and labels, which RequestsOverlap ignores
+// but which are still mirrored as they change.
+func sameRequest(a, b request.Request) bool {
+	return RequestsOverlap(a, b) &&
+		sameReviewers(a.Reviewers, b.Reviewers) &&
+		requestLabels(a) == requestLabels(b)
+}
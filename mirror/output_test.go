@@ -17,10 +17,18 @@ limitations under the License.
 package mirror
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
+	github "github.com/google/go-github/github"
 )
 
 func TestCommentsOverlap(t *testing.T) {
@@ -116,3 +124,443 @@ func TestRequestsOverlap(t *testing.T) {
 		t.Fatal("Requests with different targets should not overlap")
 	}
 }
+
+// notesRepo wraps a mock repo with an in-memory store of notes that, unlike the
+// mock repo's own, supports writing to arbitrary notes refs.
+type notesRepo struct {
+	repository.Repo
+	notes   map[string]map[string][]repository.Note
+	appends int
+}
+
+func newNotesRepo() *notesRepo {
+	return &notesRepo{
+		Repo:  repository.NewMockRepoForTest(),
+		notes: make(map[string]map[string][]repository.Note),
+	}
+}
+
+func (r *notesRepo) GetNotes(notesRef, revision string) []repository.Note {
+	return r.notes[notesRef][revision]
+}
+
+func (r *notesRepo) AppendNote(notesRef, revision string, note repository.Note) error {
+	if r.notes[notesRef] == nil {
+		r.notes[notesRef] = make(map[string][]repository.Note)
+	}
+	// Like git, treat every line of the note as a separate entry.
+	for _, line := range strings.Split(string(note), "\n") {
+		r.notes[notesRef][revision] = append(r.notes[notesRef][revision], repository.Note(line))
+	}
+	r.appends++
+	return nil
+}
+
+func (r *notesRepo) GetAllNotes(notesRef string) (map[string][]repository.Note, error) {
+	return r.notes[notesRef], nil
+}
+
+// failingNotesRepo is a notesRepo that fails to append any note containing the
+// given text, e.g. as it would if the notes ref were locked.
+type failingNotesRepo struct {
+	*notesRepo
+	failOn string
+}
+
+func (r *failingNotesRepo) AppendNote(notesRef, revision string, note repository.Note) error {
+	if strings.Contains(string(note), r.failOn) {
+		return errors.New("unable to lock the notes ref")
+	}
+	return r.notesRepo.AppendNote(notesRef, revision, note)
+}
+
+func discardLogs() chan<- string {
+	logChan := make(chan string)
+	go func() {
+		for range logChan {
+		}
+	}()
+	return logChan
+}
+
+func TestWriteNewReportsIgnoresTimestampChanges(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	report := ci.Report{
+		Timestamp: "0000000001",
+		URL:       "https://ci.example.com/build/1",
+		Status:    ci.StatusSuccess,
+		Agent:     "ci/example",
+	}
+	if err := WriteNewReports(map[string][]ci.Report{repository.TestCommitG: {report}}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	rerun := report
+	rerun.Timestamp = "0000000002"
+	if err := WriteNewReports(map[string][]ci.Report{repository.TestCommitG: {rerun}}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if notes := repo.GetNotes(ci.Ref, repository.TestCommitG); len(notes) != 1 {
+		t.Errorf("Expected a single CI note, got %v", notes)
+	}
+
+	updated := rerun
+	updated.Timestamp = "0000000003"
+	updated.Status = ci.StatusFailure
+	if err := WriteNewReports(map[string][]ci.Report{repository.TestCommitG: {updated}}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	reports := ci.ParseAllValid(repo.GetNotes(ci.Ref, repository.TestCommitG))
+	latest, err := ci.GetLatestCIReport(reports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || latest.Status != ci.StatusFailure {
+		t.Errorf("Expected the updated status to supersede the original; got %v", reports)
+	}
+}
+
+func TestReportsOverlap(t *testing.T) {
+	report := ci.Report{
+		Timestamp: "0000000001",
+		URL:       "https://ci.example.com/build/1",
+		Status:    ci.StatusSuccess,
+		Agent:     "ci/example",
+	}
+	rerun := report
+	rerun.Timestamp = "0000000002"
+	if !ReportsOverlap(report, rerun) {
+		t.Fatal("Timestamps should not be used for determining overlap")
+	}
+	otherBuild := report
+	otherBuild.URL = "https://ci.example.com/build/2"
+	if ReportsOverlap(report, otherBuild) {
+		t.Fatal("Reports for different builds should not overlap")
+	}
+}
+
+func TestWriteNewCommentsUsesOneCommitPerRevision(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	var threads []review.CommentThread
+	for _, description := range []string{"First", "Second", "Third"} {
+		threads = append(threads, review.CommentThread{
+			Comment: comment.Comment{
+				Timestamp:   "0000000001",
+				Author:      "user@example.com",
+				Description: description,
+			},
+		})
+	}
+	r := review.Review{
+		Summary: &review.Summary{
+			Revision: repository.TestCommitG,
+			Comments: threads,
+		},
+	}
+	if err := WriteNewComments(r, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if repo.appends != 1 {
+		t.Errorf("Expected the comments to be written in a single commit, got %d", repo.appends)
+	}
+	if written := comment.ParseAllValid(repo.GetNotes(comment.Ref, repository.TestCommitG)); len(written) != len(threads) {
+		t.Errorf("Unexpected comments written: %v", written)
+	}
+}
+
+func TestWriteNewReviewsUsesOneCommitPerRevision(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	var reviews []review.Review
+	for number := 1; number <= 3; number++ {
+		r, err := ConvertPullRequestToReview(buildTestPullRequest(testRepo, number), nil, nil, nil, testRepo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Comments = []review.CommentThread{{
+			Comment: comment.Comment{
+				Timestamp:   "0000000001",
+				Author:      "user@example.com",
+				Description: fmt.Sprintf("Comment on #%d", number),
+			},
+		}}
+		reviews = append(reviews, *r)
+	}
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	if err := WriteNewReviews(reviews, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// The reviews all start at the same commit, so there is one commit for
+	// their requests and one for their comments.
+	if repo.appends != 2 {
+		t.Errorf("Expected the reviews to be written in two commits, got %d", repo.appends)
+	}
+	if written := request.ParseAllValid(repo.GetNotes(request.Ref, repository.TestCommitG)); len(written) != len(reviews) {
+		t.Errorf("Unexpected reviews written: %v", written)
+	}
+	if written := comment.ParseAllValid(repo.GetNotes(comment.Ref, repository.TestCommitG)); len(written) != len(reviews) {
+		t.Errorf("Unexpected comments written: %v", written)
+	}
+}
+
+func TestWriteNewReviewsPicksUpEditedDescription(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 4)
+	original, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*original}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	editedBody := "Fix some bugs, and add tests."
+	editedAt := pr.CreatedAt.Add(time.Hour)
+	pr.Body = &editedBody
+	pr.UpdatedAt = &editedAt
+	edited, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*edited}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// Syncing again without further edits should not write anything.
+	if err := WriteNewReviews([]review.Review{*edited}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries := review.ListAll(repo)
+	if len(summaries) != 1 {
+		t.Fatalf("Expected a single review, got %v", summaries)
+	}
+	if len(summaries[0].AllRequests) != 2 {
+		t.Errorf("Expected both the original and edited requests, got %v", summaries[0].AllRequests)
+	}
+	if !strings.Contains(summaries[0].Request.Description, editedBody) {
+		t.Errorf("The edited description was not the current one: %q", summaries[0].Request.Description)
+	}
+}
+
+func TestWriteNewReviewsHandlesForcePush(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 4)
+	original, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*original}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	forcePushedHead := repository.TestCommitJ
+	pr.Head.SHA = &forcePushedHead
+	forcePushed, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forcePushed.Revision == original.Revision {
+		t.Fatalf("Expected the force-push to move the review's starting commit")
+	}
+	newRevision := forcePushed.Revision
+	for i := 0; i < 2; i++ {
+		if err := WriteNewReviews([]review.Review{*forcePushed}, repo, logChan, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summaries := review.ListAll(repo)
+	if len(summaries) != 1 {
+		t.Fatalf("Expected the force-pushed pull request to remain a single review, got %v", summaries)
+	}
+	if summaries[0].Revision != original.Revision {
+		t.Errorf("Review moved from %q to %q", original.Revision, summaries[0].Revision)
+	}
+	if summaries[0].Request.Alias != newRevision {
+		t.Errorf("Expected the review to be aliased to %q, got %q", newRevision, summaries[0].Request.Alias)
+	}
+	if len(summaries[0].AllRequests) != 2 {
+		t.Errorf("Unexpected requests: %v", summaries[0].AllRequests)
+	}
+}
+
+func TestWriteNewReviewsReplacesEditedComments(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 4)
+	commentTime := pr.CreatedAt.Add(time.Hour)
+	commentBody := "LGTM"
+	issueComment := &github.IssueComment{
+		Body:      &commentBody,
+		User:      &github.User{Login: &repoOwner},
+		CreatedAt: &commentTime,
+		UpdatedAt: &commentTime,
+	}
+	sync := func() {
+		r, err := ConvertPullRequestToReview(pr, []*github.IssueComment{issueComment}, nil, nil, repo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync()
+
+	for i, editedBody := range []string{"LGTM, with a nit", "LGTM, with two nits"} {
+		editedBody := editedBody
+		editedAt := commentTime.Add(time.Duration(i+1) * time.Minute)
+		issueComment.Body = &editedBody
+		issueComment.UpdatedAt = &editedAt
+		sync()
+		sync()
+
+		summaries := review.ListAll(repo)
+		if len(summaries) != 1 {
+			t.Fatalf("Expected a single review, got %v", summaries)
+		}
+		threads := summaries[0].Comments
+		if len(threads) != 1 {
+			t.Fatalf("Expected the edited comment to replace the original, got %v", threads)
+		}
+		if threads[0].Comment.Description != editedBody || len(threads[0].Edits) != i+1 {
+			t.Errorf("Expected the latest edit %q to be shown, got %+v", editedBody, threads[0])
+		}
+	}
+}
+
+func TestWriteNewReviewsRecordsReviewerChanges(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 4)
+	alice, bob := "alice", "bob"
+	sync := func(reviewers ...*github.User) {
+		pr.RequestedReviewers = reviewers
+		r, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requestNotes := func() int {
+		return len(repo.GetNotes(request.Ref, repository.TestCommitG))
+	}
+
+	sync(&github.User{Login: &alice})
+	sync(&github.User{Login: &alice})
+	if n := requestNotes(); n != 1 {
+		t.Fatalf("Expected a single request note, got %d", n)
+	}
+
+	sync(&github.User{Login: &bob}, &github.User{Login: &alice})
+	if n := requestNotes(); n != 2 {
+		t.Fatalf("Expected a follow-up request note for the new reviewer, got %d notes", n)
+	}
+	summaries := review.ListAll(repo)
+	if len(summaries) != 1 || len(summaries[0].Request.Reviewers) != 2 {
+		t.Errorf("Expected the latest reviewers to be shown, got %v", summaries)
+	}
+
+	// Reordering the reviewers is not a change.
+	sync(&github.User{Login: &alice}, &github.User{Login: &bob})
+	if n := requestNotes(); n != 2 {
+		t.Errorf("Unexpected request note for reordered reviewers; got %d notes", n)
+	}
+}
+
+func TestCheckNotesRefPattern(t *testing.T) {
+	for _, pattern := range []string{DefaultNotesRefPattern, "refs/notes/*", "refs/notes/dev*"} {
+		if err := CheckNotesRefPattern(pattern); err != nil {
+			t.Errorf("Unexpected error for %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"refs/notes/devtools/reviews", "refs/notes/sandbox/*", "refs/heads/*", "refs/notes/*/*"} {
+		if err := CheckNotesRefPattern(pattern); err == nil {
+			t.Errorf("Expected an error for %q", pattern)
+		}
+	}
+}
+
+func TestCheckGitIdentity(t *testing.T) {
+	if err := CheckGitIdentity("Github Mirror", "mirror@example.com"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, identity := range [][2]string{
+		{"", "mirror@example.com"},
+		{"Github <Mirror>", "mirror@example.com"},
+		{"Github Mirror", ""},
+		{"Github Mirror", "mirror"},
+		{"Github Mirror", "Mirror <mirror@example.com>"},
+		{"Github Mirror", "mirror@example.com, other@example.com"},
+	} {
+		if err := CheckGitIdentity(identity[0], identity[1]); err == nil {
+			t.Errorf("Expected an error for %q <%s>", identity[0], identity[1])
+		}
+	}
+}
+
+func TestWriteNewReviewsContinuesAfterFailure(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	var reviews []review.Review
+	for number := 1; number <= 3; number++ {
+		r, err := ConvertPullRequestToReview(buildTestPullRequest(testRepo, number), nil, nil, nil, testRepo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reviews = append(reviews, *r)
+	}
+	// The requests of the reviews at the same commit share a note, so move the
+	// second review to a commit of its own.
+	reviews[1].Revision = repository.TestCommitE
+	repo := &failingNotesRepo{notesRepo: newNotesRepo(), failOn: "refs/pull/2/head"}
+	logChan := discardLogs()
+	defer close(logChan)
+
+	err := WriteNewReviews(reviews, repo, logChan, Options{})
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) || len(writeErr.Failures) != 1 || !strings.Contains(err.Error(), "for "+repository.TestCommitE+":") {
+		t.Fatalf("Expected a single failure for the second review, got %v", err)
+	}
+	written := noteStrings(repo.GetNotes(request.Ref, repository.TestCommitG))
+	if len(written) != 2 || !strings.Contains(written[0], "refs/pull/1/head") || !strings.Contains(written[1], "refs/pull/3/head") {
+		t.Errorf("Expected the other reviews to be written, got %v", written)
+	}
+}
+
+func TestWriteNewReportsContinuesAfterFailure(t *testing.T) {
+	repo := &failingNotesRepo{notesRepo: newNotesRepo(), failOn: "ci.example.com/broken"}
+	logChan := discardLogs()
+	defer close(logChan)
+
+	reports := map[string][]ci.Report{
+		repository.TestCommitE: {{Timestamp: "1", URL: "ci.example.com/broken", Status: ci.StatusFailure, Agent: "ci"}},
+		repository.TestCommitG: {{Timestamp: "1", URL: "ci.example.com/ok", Status: ci.StatusSuccess, Agent: "ci"}},
+	}
+	err := WriteNewReports(reports, repo, logChan, Options{})
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) || len(writeErr.Failures) != 1 {
+		t.Fatalf("Expected a single failure, got %v", err)
+	}
+	if len(repo.GetNotes(ci.Ref, repository.TestCommitG)) != 1 || len(repo.GetNotes(ci.Ref, repository.TestCommitE)) != 0 {
+		t.Errorf("Expected only the other commit's report to be written, got %v", repo.notes)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	github "github.com/google/go-github/github"
+)
+
+// Utilities for pruning the reviews of long-closed pull requests.
+
+// NotesRemover removes all of the notes attached to a revision under the given
+// notes ref.
+//
+// The repository.Repo interface only supports appending notes, so the means of
+// removing them has to be supplied separately.
+type NotesRemover func(notesRef, revision string) error
+
+// PruneResolvedReviews removes the review requests and comments for pull requests
+// that were closed (or merged) more than olderThan ago, and returns the revisions
+// of the pruned reviews.
+//
+// Only the requests whose review ref is that of one of the given pull requests
+// are pruned, so reviews that were not created by the mirror, or whose pull
+// request can't be found, are always left alone, even if they share a revision
+// with a pruned one. The notes of each such revision are rewritten without the
+// pruned lines, the same way as by RepairNotes. Comments don't record which
+// review they belong to, so those of a revision are only pruned along with the
+// last request on it, and even then the ones that may be comments on the
+// commit itself, rather than on a review, are kept; see keptComments. CI
+// reports are attached to commits rather than reviews, so they are not pruned.
+//
+// Note that the reviews of closed pull requests will be mirrored again by any
+// subsequent sync that reads them, unless it leaves them out by setting the
+// ClosedBefore option to the same cutoff.
+func PruneResolvedReviews(repo repository.Repo, prs []*github.PullRequest, olderThan time.Duration, remove NotesRemover) ([]string, error) {
+	cutoff := time.Now().Add(-olderThan)
+	prunable := make(map[string]bool)
+	for _, pr := range prs {
+		if pr.GetState() == "closed" && pr.ClosedAt != nil && pr.ClosedAt.Before(cutoff) && pr.Number != nil {
+			prunable[fmt.Sprintf("refs/pull/%d/head", *pr.Number)] = true
+		}
+	}
+
+	for _, notesRef := range []string{request.Ref, comment.Ref} {
+		if err := restoreRepairBackup(repo, notesRef, repairBackupRef(notesRef), remove); err != nil {
+			return nil, err
+		}
+	}
+	allRequests, err := repo.GetAllNotes(request.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the notes in %s: %v", request.Ref, err)
+	}
+	var revisions []string
+	for revision := range allRequests {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+
+	var pruned []string
+	for _, revision := range revisions {
+		var keptRequests []repository.Note
+		var prunedRefs []string
+		for _, note := range allRequests[revision] {
+			if len(note) == 0 {
+				continue
+			}
+			if r, err := request.Parse(note); err == nil && prunable[r.ReviewRef] {
+				prunedRefs = append(prunedRefs, r.ReviewRef)
+				continue
+			}
+			keptRequests = append(keptRequests, note)
+		}
+		if len(prunedRefs) == 0 {
+			continue
+		}
+		// The comments are pruned first, so that if that fails, the
+		// requests are still there for the next prune to find.
+		if len(keptRequests) == 0 {
+			comments := repo.GetNotes(comment.Ref, revision)
+			if kept := keptComments(revision, comments); len(kept) < len(notesStrings(comments)) {
+				if err := rewriteNotes(repo, comment.Ref, revision, notesStrings(kept), remove); err != nil {
+					return pruned, fmt.Errorf("failure pruning the comments of the review for %s: %v", prunedRefs[0], err)
+				}
+			}
+		}
+		if err := rewriteNotes(repo, request.Ref, revision, notesStrings(keptRequests), remove); err != nil {
+			return pruned, fmt.Errorf("failure pruning the review for %s: %v", prunedRefs[0], err)
+		}
+		pruned = append(pruned, revision)
+	}
+	return pruned, nil
+}
+
+// keptComments returns the comments, out of those attached to the given
+// revision, that are kept when all of the reviews on that revision are pruned.
+//
+// Comments on a commit outside of any pull request are mirrored onto that
+// commit, so any comment on the revision itself is kept, as are the comments
+// that a kept one refers to as its parent or original. So are the notes that
+// can't be parsed as comments.
+func keptComments(revision string, notes []repository.Note) []repository.Note {
+	keep := make([]bool, len(notes))
+	hashes := make([]string, len(notes))
+	for i, note := range notes {
+		if len(note) == 0 {
+			continue
+		}
+		c, err := comment.Parse(note)
+		if err != nil || c.Version != comment.FormatVersion {
+			keep[i] = true
+			continue
+		}
+		if hashes[i], err = c.Hash(); err != nil {
+			keep[i] = true
+			continue
+		}
+		keep[i] = c.Location != nil && c.Location.Commit == revision
+	}
+
+	// Keep whatever the kept comments refer to, until there is nothing more.
+	for changed := true; changed; {
+		changed = false
+		referenced := make(map[string]bool)
+		for i, note := range notes {
+			if !keep[i] {
+				continue
+			}
+			if c, err := comment.Parse(note); err == nil {
+				referenced[c.Parent] = true
+				referenced[c.Original] = true
+			}
+		}
+		for i := range notes {
+			if !keep[i] && hashes[i] != "" && referenced[hashes[i]] {
+				keep[i] = true
+				changed = true
+			}
+		}
+	}
+
+	var kept []repository.Note
+	for i, note := range notes {
+		if keep[i] {
+			kept = append(kept, note)
+		}
+	}
+	return kept
+}
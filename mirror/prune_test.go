@@ -0,0 +1,204 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	github "github.com/google/go-github/github"
+)
+
+func TestPruneResolvedReviews(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	closed := "closed"
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	recently := time.Now().Add(-time.Hour)
+
+	oldPR := buildTestPullRequest(repo, 1)
+	oldPR.State = &closed
+	oldPR.ClosedAt = &longAgo
+	recentPR := buildTestPullRequest(repo, 2)
+	recentPR.State = &closed
+	recentPR.ClosedAt = &recently
+	recentHead := repository.TestCommitJ
+	recentPR.Head.SHA = &recentHead
+	openPR := buildTestPullRequest(repo, 3)
+	openHead := repository.TestCommitD
+	openPR.Head.SHA = &openHead
+	openBase := repository.TestCommitA
+	openPR.Base.SHA = &openBase
+	prs := []*github.PullRequest{oldPR, recentPR, openPR}
+
+	var reviews []review.Review
+	for _, pr := range prs {
+		r, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reviews = append(reviews, *r)
+	}
+	if err := WriteNewReviews(reviews, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(review.ListAll(repo)) != 3 {
+		t.Fatalf("Expected three distinct reviews, got %v", review.ListAll(repo))
+	}
+
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+	// Only the pull requests passed in may be pruned.
+	pruned, err := PruneResolvedReviews(repo, prs[1:], 7*24*time.Hour, remove)
+	if err != nil || len(pruned) != 0 {
+		t.Fatalf("Unexpected pruning of unknown pull requests: %v, %v", pruned, err)
+	}
+	pruned, err = PruneResolvedReviews(repo, prs, 7*24*time.Hour, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != reviews[0].Revision {
+		t.Errorf("Expected only the long-closed review to be pruned, got %v", pruned)
+	}
+	if _, ok := repo.notes[request.Ref][reviews[0].Revision]; ok {
+		t.Error("The pruned review request is still present")
+	}
+	if remaining := review.ListAll(repo); len(remaining) != 2 {
+		t.Errorf("Expected the other two reviews to remain, got %v", remaining)
+	}
+}
+
+func TestPruneResolvedReviewsSharingARevision(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	closed := "closed"
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	oldPR := buildTestPullRequest(repo, 1)
+	oldPR.State = &closed
+	oldPR.ClosedAt = &longAgo
+	// The same commits reopened as a new pull request.
+	reopenedPR := buildTestPullRequest(repo, 2)
+	prs := []*github.PullRequest{oldPR, reopenedPR}
+
+	var reviews []review.Review
+	for _, pr := range prs {
+		r, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Comments = []review.CommentThread{{Comment: comment.Comment{
+			Timestamp:   fmt.Sprintf("%010d", *pr.Number),
+			Author:      "user",
+			Description: fmt.Sprintf("Comment on #%d", *pr.Number),
+		}}}
+		reviews = append(reviews, *r)
+	}
+	if reviews[0].Revision != reviews[1].Revision {
+		t.Fatalf("Expected the reviews to share a revision, got %s and %s", reviews[0].Revision, reviews[1].Revision)
+	}
+	if err := WriteNewReviews(reviews, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	revision := reviews[0].Revision
+	comments := repo.notes[comment.Ref][revision]
+
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+	pruned, err := PruneResolvedReviews(repo, prs, 7*24*time.Hour, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != revision {
+		t.Errorf("Expected the long-closed review to be pruned, got %v", pruned)
+	}
+	requests := request.ParseAllValid(repo.notes[request.Ref][revision])
+	if len(requests) != 1 || requests[0].ReviewRef != "refs/pull/2/head" {
+		t.Errorf("Expected only the request of the reopened pull request to remain, got %+v", requests)
+	}
+	// The comments can't be told apart, so they are all kept.
+	if remaining := repo.notes[comment.Ref][revision]; !reflect.DeepEqual(remaining, comments) {
+		t.Errorf("Expected the comments to be left alone, got %q", remaining)
+	}
+}
+
+func TestPruneResolvedReviewsKeepsCommitComments(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	closed := "closed"
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	pr := buildTestPullRequest(repo, 1)
+	pr.State = &closed
+	pr.ClosedAt = &longAgo
+
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Comments = []review.CommentThread{{Comment: comment.Comment{
+		Timestamp:   "0000000001",
+		Author:      "user",
+		Description: "Comment on the pull request",
+	}}}
+	if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	commitComment := comment.Comment{
+		Timestamp:   "0000000002",
+		Author:      "user",
+		Description: "Comment on the commit",
+		Location:    &comment.Location{Commit: r.Revision},
+	}
+	if err := WriteNewCommitComment(commitComment, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+	if _, err := PruneResolvedReviews(repo, []*github.PullRequest{pr}, 7*24*time.Hour, remove); err != nil {
+		t.Fatal(err)
+	}
+	if requests := repo.notes[request.Ref][r.Revision]; len(requests) != 0 {
+		t.Errorf("Expected the review request to be pruned, got %q", requests)
+	}
+	remaining := comment.ParseAllValid(repo.notes[comment.Ref][r.Revision])
+	if len(remaining) != 1 {
+		t.Fatalf("Expected only the commit comment to remain, got %+v", remaining)
+	}
+	for _, c := range remaining {
+		if c.Description != commitComment.Description {
+			t.Errorf("Expected only the commit comment to remain, got %+v", c)
+		}
+	}
+}
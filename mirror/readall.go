@@ -20,20 +20,43 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/ci"
 	github "github.com/google/go-github/github"
+
+	"github.com/google/git-pull-request-mirror/metrics"
 )
 
 const (
 	maxRetryAttempts = 100
+
+	// maxTransientFailures is how many times a request is retried after a
+	// transient failure, such as a 502 response.
+	maxTransientFailures = 4
+
+	// defaultRetryAfter is how long to wait after sending requests too
+	// quickly, if GitHub doesn't say.
+	defaultRetryAfter = time.Minute
 )
 
+// initialTransientBackoff is the longest wait before the first retry of a
+// request that failed transiently.
+var initialTransientBackoff = 2 * time.Second
+
 var (
 	// ErrInvalidRemoteRepo is returned when a given github repo is missing
 	// required information.
@@ -42,120 +65,502 @@ var (
 
 // Utilities for reading all of the pull request data for a specific repository.
 
-// Can be stubbed out in testing; satisfied by github.Client.Repositories
-type repositoriesService interface {
+// The following interfaces cover the subset of the GitHub API that is used to
+// read a repository. Each is satisfied by the corresponding service of a
+// *github.Client (e.g. client.Git, client.Repositories), and can be stubbed out
+// in testing.
+
+// GitService is satisfied by github.Client.Git
+type GitService interface {
+	ListRefs(ctx context.Context, owner, repo string, opt *github.ReferenceListOptions) ([]*github.Reference, *github.Response, error)
+	GetTag(ctx context.Context, owner string, repo string, sha string) (*github.Tag, *github.Response, error)
+}
+
+// RepositoriesService is satisfied by github.Client.Repositories
+type RepositoriesService interface {
 	ListStatuses(ctx context.Context, owner, repo, ref string, opt *github.ListOptions) ([]*github.RepoStatus, *github.Response, error)
 }
 
-type pullRequestsService interface {
+// PullRequestsService is satisfied by github.Client.PullRequests
+type PullRequestsService interface {
+	Get(ctx context.Context, owner string, repo string, number int) (*github.PullRequest, *github.Response, error)
 	List(ctx context.Context, owner string, repo string, opt *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error)
 	ListComments(ctx context.Context, owner string, repo string, number int, opt *github.PullRequestListCommentsOptions) ([]*github.PullRequestComment, *github.Response, error)
+	ListReviews(ctx context.Context, owner, repo string, number int, opt *github.ListOptions) ([]*github.PullRequestReview, *github.Response, error)
+}
+
+// Media types of the API previews that go-github requests pull requests with,
+// and of the one that GitHub required to report whether they are drafts.
+const (
+	labelDescriptionMediaType = "application/vnd.github.symmetra-preview+json"
+	lockReasonMediaType       = "application/vnd.github.sailor-v-preview+json"
+	draftMediaType            = "application/vnd.github.shadow-cat-preview+json"
+)
+
+// NewPullRequestsService returns the given client's pull requests service, but
+// with the drafts among the pull requests that it reads, whether listed or read
+// one at a time, reported as such by IsDraft.
+//
+// The version of go-github in use predates draft pull requests, so it drops the
+// "draft" field of the pull requests it reads. This service decodes that field
+// itself, and sets the mergeable state of the drafts to "draft", as
+// UnmarshalPullRequestEvent does for webhook payloads.
+func NewPullRequestsService(client *github.Client) PullRequestsService {
+	return &draftPullRequestsService{PullRequestsService: client.PullRequests, client: client}
+}
+
+type draftPullRequestsService struct {
+	*github.PullRequestsService
+	client *github.Client
+}
+
+// draftPullRequest is a pull request as read from the API, along with whether
+// it is a draft.
+type draftPullRequest struct {
+	*github.PullRequest
+	Draft bool `json:"draft"`
+}
+
+// marked returns the pull request, with its mergeable state set to "draft" if
+// it is one.
+func (pr draftPullRequest) marked() *github.PullRequest {
+	if pr.PullRequest != nil && pr.Draft {
+		pr.PullRequest.MergeableState = github.String(draftMergeableState)
+	}
+	return pr.PullRequest
+}
+
+func (s *draftPullRequestsService) Get(ctx context.Context, owner string, repo string, number int) (*github.PullRequest, *github.Response, error) {
+	var pr draftPullRequest
+	resp, err := s.read(ctx, fmt.Sprintf("repos/%v/%v/pulls/%d", owner, repo, number), &pr)
+	if err != nil {
+		return nil, resp, err
+	}
+	return pr.marked(), resp, nil
 }
 
-type issuesService interface {
+func (s *draftPullRequestsService) List(ctx context.Context, owner string, repo string, opt *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error) {
+	u := fmt.Sprintf("repos/%v/%v/pulls", owner, repo)
+	if query := pullRequestListQuery(opt); query != "" {
+		u += "?" + query
+	}
+	var prs []draftPullRequest
+	resp, err := s.read(ctx, u, &prs)
+	if err != nil {
+		return nil, resp, err
+	}
+	result := make([]*github.PullRequest, 0, len(prs))
+	for _, pr := range prs {
+		result = append(result, pr.marked())
+	}
+	return result, resp, nil
+}
+
+// read reads the pull request data at the given URL, relative to the client's
+// base URL, into v.
+func (s *draftPullRequestsService) read(ctx context.Context, u string, v interface{}) (*github.Response, error) {
+	req, err := s.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{labelDescriptionMediaType, lockReasonMediaType, draftMediaType}, ", "))
+	return s.client.Do(ctx, req, v)
+}
+
+// pullRequestListQuery returns the query string for listing pull requests with
+// the given options, as go-github would send it.
+func pullRequestListQuery(opt *github.PullRequestListOptions) string {
+	if opt == nil {
+		return ""
+	}
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"state":     opt.State,
+		"head":      opt.Head,
+		"base":      opt.Base,
+		"sort":      opt.Sort,
+		"direction": opt.Direction,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if opt.Page != 0 {
+		values.Set("page", strconv.Itoa(opt.Page))
+	}
+	if opt.PerPage != 0 {
+		values.Set("per_page", strconv.Itoa(opt.PerPage))
+	}
+	return values.Encode()
+}
+
+// IssuesService is satisfied by github.Client.Issues
+type IssuesService interface {
 	ListComments(ctx context.Context, owner string, repo string, number int, opt *github.IssueListCommentsOptions) ([]*github.IssueComment, *github.Response, error)
+	ListIssueEvents(ctx context.Context, owner, repo string, number int, opt *github.ListOptions) ([]*github.IssueEvent, *github.Response, error)
+}
+
+// ProgressFunc is called to report progress while reading data from GitHub.
+//
+// The done argument is the number of items processed so far, and total is the
+// number of items that will be processed in all.
+type ProgressFunc func(done, total int)
+
+// RefFilter reports whether the statuses for the named ref (e.g.
+// "refs/heads/master") should be mirrored.
+type RefFilter func(ref string) bool
+
+// MatchRefs returns a RefFilter that accepts the refs matching any of the given
+// glob patterns, using the syntax of path.Match (so "refs/pull/*/head" matches
+// the head of every pull request).
+func MatchRefs(patterns ...string) (RefFilter, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid ref pattern %q: %v", pattern, err)
+		}
+	}
+	return func(ref string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, ref); matched {
+				return true
+			}
+		}
+		return false
+	}, nil
 }
 
 type retryableRequest func() (*github.Response, error)
 
-func executeRequest(request retryableRequest) error {
+// executeRequest runs the given request, retrying it if it fails because we ran
+// out of API requests, or because of what looks like a transient problem, such
+// as a server error or a dropped connection.
+func executeRequest(ctx context.Context, request retryableRequest) error {
+	transientFailures := 0
 	for i := 0; i < maxRetryAttempts; i++ {
+		metrics.APICall()
 		resp, err := request()
-		if err == nil || resp.StatusCode != http.StatusForbidden || resp.Rate.Remaining != 0 {
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The request was cut short by the caller, rather than
+			// timing out on its own.
+			return ctx.Err()
+		}
+		var waitDuration time.Duration
+		if isTransientFailure(resp, err) {
+			if transientFailures >= maxTransientFailures {
+				return err
+			}
+			waitDuration = transientBackoff(transientFailures)
+			transientFailures++
+			log.Printf("Request to github failed (%v); retrying in %v", err, waitDuration)
+		} else if resp == nil || resp.Response == nil {
+			// The request failed before any response was received, e.g.
+			// because the connection was refused.
+			return err
+		} else if resp.StatusCode == http.StatusForbidden && resp.Rate.Remaining == 0 {
+			waitDuration = resp.Rate.Reset.Sub(time.Now())
+			log.Printf("Ran out of github API requests; sleeping %v (until %v)",
+				waitDuration,
+				resp.Rate.Reset.Time)
+			metrics.RateLimitSleep(waitDuration)
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			waitDuration = retryAfter(resp)
+			log.Printf("Sending requests to github too quickly; sleeping %v", waitDuration)
+			metrics.RateLimitSleep(waitDuration)
+		} else {
 			return err
 		}
-		waitDuration := resp.Rate.Reset.Sub(time.Now())
-		log.Printf("Ran out of github API requests; sleeping %v (until %v)",
-			waitDuration,
-			resp.Rate.Reset.Time)
-		time.Sleep(waitDuration)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitDuration):
+		}
 	}
 	return fmt.Errorf("Exceeded the maximum of %d retry attempts", maxRetryAttempts)
 }
 
+// isTransientFailure reports whether a request failed in a way that may not
+// happen again if it is retried.
+func isTransientFailure(resp *github.Response, err error) bool {
+	if resp != nil && resp.Response != nil && resp.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	// Requests time out on stalled connections, for example.
+	var netErr net.Error
+	return (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// transientBackoff returns how long to wait before retrying a request that has
+// failed transiently the given number of times already. The wait doubles after
+// each failure, and a random jitter keeps concurrent syncs from retrying in step.
+func transientBackoff(failures int) time.Duration {
+	backoff := initialTransientBackoff << uint(failures)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// retryAfter returns how long the given response asks us to wait before
+// sending another request.
+func retryAfter(resp *github.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRetryAfter
+}
+
 // A retryableListRequest is a procedure that executes a list request in a way that is safe to retry.
 //
 // The contract for such a procedure is that it performs *exactly* one of the following:
 //  1. Returns an error
 // or
-//  2. Captures the returned results in some internal state and returns a response with the LastPage field set.
-type retryableListRequest func(github.ListOptions) (*github.Response, error)
+//  2. Captures the returned results in some internal state and returns the number of them, along
+//     with the response.
+type retryableListRequest func(github.ListOptions) (int, *github.Response, error)
+
+// listPageSize is the number of results requested per page; the maximum allowed.
+const listPageSize = 100
 
 // executeListRequest takes a retryableListRequest, and runs it for every page of
 // results returned by the GitHub API.
-func executeListRequest(request retryableListRequest) error {
-	for page, maxPage := 1, 1; page <= maxPage; page++ {
+//
+// The pages are followed using the pagination links of each response, rather
+// than the number of pages reported for the first one, as that can change while
+// the results are being read. GitHub omits the links when there is only a single
+// page of results, so a response without them is taken to be the last page only
+// if it isn't full.
+func executeListRequest(ctx context.Context, request retryableListRequest) error {
+	for page := 1; ; page++ {
 		listOpts := github.ListOptions{
 			Page:    page,
-			PerPage: 100, // The maximum number of results per page
+			PerPage: listPageSize,
 		}
-		err := executeRequest(func() (*github.Response, error) {
-			resp, err := request(listOpts)
-			if err == nil {
-				maxPage = resp.LastPage
-			}
+		var count int
+		var resp *github.Response
+		err := executeRequest(ctx, func() (*github.Response, error) {
+			var err error
+			count, resp, err = request(listOpts)
 			return resp, err
 		})
 		if err != nil {
 			return err
 		}
+		if !hasMorePages(page, count, resp) {
+			return nil
+		}
 	}
-	return nil
+}
+
+// hasMorePages reports whether there are any results after the given page, which
+// held count results and was returned with the given response.
+func hasMorePages(page, count int, resp *github.Response) bool {
+	if count == 0 {
+		return false
+	}
+	if resp.NextPage != 0 || page < resp.LastPage {
+		return true
+	}
+	paginated := resp.FirstPage != 0 || resp.PrevPage != 0 || resp.LastPage != 0
+	return !paginated && count >= listPageSize
 }
 
 // GetAllStatuses iterates through all of the head commits in the remote
 // repository, reads their statuses from Github, and returns the git-appraise equivalents.
 //
+// If refFilter is non-nil, only the commits of the refs it accepts are read.
+// The head commits of open pull requests are read too, as long as refFilter
+// accepts their "refs/pull/<number>/head" refs, even if the remote repository
+// has no such ref; e.g. if the branch of a pull request was deleted. Pass a nil
+// prService to only read the commits of refs.
+// If progress is non-nil, it is called after the statuses for each commit are read.
+// Reading stops as soon as ctx is cancelled, including while waiting for the
+// API rate limit to reset.
+//
 // Errors processing individual channels will be passed through the supplied
-// error channel; errors that prevent all processing will be returned directly.
-func GetAllStatuses(remoteUser, remoteRepo string, client *github.Client, errOutput chan<- error) (map[string][]ci.Report, error) {
+// error channel as *ConversionError values; errors that prevent all processing
+// will be returned directly as *FetchError values.
+func GetAllStatuses(ctx context.Context, remoteUser, remoteRepo string, gitService GitService, repoService RepositoriesService, prService PullRequestsService, refFilter RefFilter, errOutput chan<- error, progress ProgressFunc, opts Options) (map[string][]ci.Report, error) {
 	if remoteUser == "" || remoteRepo == "" {
 		return nil, ErrInvalidRemoteRepo
 	}
-	commits, err := iterateRemoteCommits(remoteUser, remoteRepo, client)
+	commits, err := iterateRemoteCommits(ctx, remoteUser, remoteRepo, gitService, refFilter)
 	if err != nil {
-		return nil, err
+		return nil, &FetchError{Resource: "refs", Cause: err}
+	}
+	if prService != nil {
+		heads, err := openPullRequestHeads(ctx, remoteUser, remoteRepo, prService, refFilter)
+		if err != nil {
+			return nil, &FetchError{Resource: "pull requests", Cause: err}
+		}
+		commits = appendMissingCommits(commits, heads)
 	}
 
-	return fetchStatuses(commits, remoteUser, remoteRepo, client.Repositories, errOutput)
+	return fetchStatuses(ctx, commits, remoteUser, remoteRepo, repoService, errOutput, progress, opts)
 }
 
-// iterateRemoteCommits returns a slice of the head commits for every ref in the remote repo.
-func iterateRemoteCommits(remoteUser, remoteRepo string, client *github.Client) ([]string, error) {
-	var remoteCommits []string
-	err := executeListRequest(func(listOpts github.ListOptions) (*github.Response, error) {
+// iterateRemoteCommits returns a slice of the head commits for every ref in the
+// remote repo that is accepted by refFilter, or for every ref if it is nil.
+//
+// The refs of annotated tags are resolved to the commits that the tags point
+// to, so that those commits' statuses are mirrored too.
+func iterateRemoteCommits(ctx context.Context, remoteUser, remoteRepo string, gitService GitService, refFilter RefFilter) ([]string, error) {
+	var remoteCommits, tags []string
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
 		opts := &github.ReferenceListOptions{
 			ListOptions: listOpts,
 		}
-		refs, response, err := client.Git.ListRefs(context.TODO(), remoteUser, remoteRepo, opts)
+		refs, response, err := gitService.ListRefs(ctx, remoteUser, remoteRepo, opts)
 		if err == nil {
 			for _, ref := range refs {
-				remoteCommits = append(remoteCommits, *ref.Object.SHA)
+				if refFilter != nil && (ref.Ref == nil || !refFilter(*ref.Ref)) {
+					continue
+				}
+				if sha := refCommit(ref); sha != "" {
+					remoteCommits = append(remoteCommits, sha)
+				} else if sha := refTag(ref); sha != "" {
+					tags = append(tags, sha)
+				}
+			}
+		}
+		return len(refs), response, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tagged []string
+	for _, tag := range tags {
+		sha, err := peelTag(ctx, remoteUser, remoteRepo, gitService, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading tag %.12s: %w", tag, err)
+		}
+		if sha != "" {
+			tagged = append(tagged, sha)
+		}
+	}
+	return appendMissingCommits(remoteCommits, tagged), nil
+}
+
+// maxTagDepth is how many annotated tags that point at other tags are followed
+// to find the commit that a tag ref points to.
+const maxTagDepth = 10
+
+// peelTag returns the SHA of the commit that the annotated tag with the given
+// SHA points to, following any tags that it points to in turn, or the empty
+// string if it points to something other than a commit, e.g. a tree.
+func peelTag(ctx context.Context, remoteUser, remoteRepo string, gitService GitService, sha string) (string, error) {
+	for i := 0; i < maxTagDepth; i++ {
+		var tag *github.Tag
+		err := executeRequest(ctx, func() (*github.Response, error) {
+			var resp *github.Response
+			var err error
+			tag, resp, err = gitService.GetTag(ctx, remoteUser, remoteRepo, sha)
+			return resp, err
+		})
+		if err != nil {
+			return "", err
+		}
+		object := tag.GetObject()
+		switch object.GetType() {
+		case "commit":
+			return object.GetSHA(), nil
+		case "tag":
+			sha = object.GetSHA()
+		default:
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// openPullRequestHeads returns the head commits of the open pull requests in the
+// remote repo whose "refs/pull/<number>/head" refs are accepted by refFilter,
+// or of every open pull request if it is nil.
+func openPullRequestHeads(ctx context.Context, remoteUser, remoteRepo string, prs PullRequestsService, refFilter RefFilter) ([]string, error) {
+	var heads []string
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
+		opts := &github.PullRequestListOptions{
+			State:       OpenPullRequests,
+			ListOptions: listOpts,
+		}
+		pullRequests, response, err := prs.List(ctx, remoteUser, remoteRepo, opts)
+		if err == nil {
+			for _, pr := range pullRequests {
+				if refFilter != nil && !refFilter(fmt.Sprintf("refs/pull/%d/head", pr.GetNumber())) {
+					continue
+				}
+				if sha := pr.GetHead().GetSHA(); sha != "" {
+					heads = append(heads, sha)
+				}
 			}
 		}
-		return response, err
+		return len(pullRequests), response, err
 	})
 	if err != nil {
 		return nil, err
 	}
-	return remoteCommits, nil
+	return heads, nil
+}
+
+// appendMissingCommits appends to commits each of the others that it doesn't
+// already contain, so that the statuses of no commit are read twice.
+func appendMissingCommits(commits, others []string) []string {
+	seen := make(map[string]bool)
+	for _, commit := range commits {
+		seen[commit] = true
+	}
+	for _, commit := range others {
+		if !seen[commit] {
+			seen[commit] = true
+			commits = append(commits, commit)
+		}
+	}
+	return commits
 }
 
-func fetchReportsForCommit(commitSHA, remoteUser, remoteRepo string, repoService repositoriesService, errOutput chan<- error) ([]ci.Report, error) {
+// refCommit returns the SHA of the commit that the given ref points to.
+//
+// Refs that do not point directly at a commit, such as annotated tags (which
+// point at a tag object), have no statuses of their own, so the empty string
+// is returned for them; see refTag.
+func refCommit(ref *github.Reference) string {
+	if ref == nil || ref.Object == nil || ref.Object.SHA == nil {
+		return ""
+	}
+	if ref.Object.Type != nil && *ref.Object.Type != "commit" {
+		return ""
+	}
+	return *ref.Object.SHA
+}
+
+// refTag returns the SHA of the annotated tag that the given ref points to, or
+// the empty string if it points to anything else.
+func refTag(ref *github.Reference) string {
+	if ref == nil || ref.Object == nil || ref.Object.GetType() != "tag" {
+		return ""
+	}
+	return ref.Object.GetSHA()
+}
+
+func fetchReportsForCommit(ctx context.Context, commitSHA, remoteUser, remoteRepo string, repoService RepositoriesService, errOutput chan<- error, opts Options) ([]ci.Report, error) {
 	var reports []ci.Report
-	err := executeListRequest(func(listOpts github.ListOptions) (*github.Response, error) {
-		statuses, resp, err := repoService.ListStatuses(context.TODO(), remoteUser, remoteRepo, commitSHA, &listOpts)
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
+		statuses, resp, err := repoService.ListStatuses(ctx, remoteUser, remoteRepo, commitSHA, &listOpts)
 		if err == nil {
 			for _, status := range statuses {
-				report, err := ConvertStatus(status)
+				report, err := ConvertStatus(status, opts)
 				if err != nil {
-					errOutput <- err
+					opts.debugf("Skipping a status of commit %.12s by %q: %v", commitSHA, status.GetContext(), err)
+					errOutput <- &ConversionError{Cause: err}
 				} else {
+					opts.debugf("Converted the status of commit %.12s by %q: %s", commitSHA, status.GetContext(), report.Status)
 					reports = append(reports, *report)
 				}
 			}
 		}
-		return resp, err
+		return len(statuses), resp, err
 	})
 	if err != nil {
 		return nil, err
@@ -163,60 +568,355 @@ func fetchReportsForCommit(commitSHA, remoteUser, remoteRepo string, repoService
 	return reports, nil
 }
 
-func fetchStatuses(commits []string, remoteUser, remoteRepo string, repoService repositoriesService, errOutput chan<- error) (map[string][]ci.Report, error) {
+func fetchStatuses(ctx context.Context, commits []string, remoteUser, remoteRepo string, repoService RepositoriesService, errOutput chan<- error, progress ProgressFunc, opts Options) (map[string][]ci.Report, error) {
 	reportsByCommitHash := make(map[string][]ci.Report)
-	for _, commitSHA := range commits {
-		reports, err := fetchReportsForCommit(commitSHA, remoteUser, remoteRepo, repoService, errOutput)
+	for i, commitSHA := range commits {
+		if err := ctx.Err(); err != nil {
+			return nil, &FetchError{Resource: "statuses", Cause: err}
+		}
+		reports, err := fetchReportsForCommit(ctx, commitSHA, remoteUser, remoteRepo, repoService, errOutput, opts)
 		if err != nil {
-			return nil, err
+			return nil, &FetchError{Resource: fmt.Sprintf("statuses for %.12s", commitSHA), Cause: err}
 		}
 		reportsByCommitHash[commitSHA] = reports
+		if progress != nil {
+			progress(i+1, len(commits))
+		}
 	}
 	return reportsByCommitHash, nil
 }
 
 // GetAllPullRequests reads all of the pull requests from the given repository.
 // It returns successful conversions and encountered errors in a channel.
-// Errors processing individual channels will be passed through the supplied
-// error channel; errors that prevent all processing will be returned directly.
-func GetAllPullRequests(local repository.Repo, remoteUser, remoteRepo string, client *github.Client, errOutput chan<- error) ([]review.Review, error) {
+// Errors processing individual pull requests will be passed through the supplied
+// error channel as *ConversionError or *FetchError values, and the affected pull
+// requests skipped; errors that prevent all processing will be returned directly.
+//
+// Only the pull requests in the given state are read: OpenPullRequests,
+// ClosedPullRequests, or AllPullRequests (or "", which is the same). If since is
+// non-zero, only the pull requests last updated at or after it are read. Only the
+// pull requests numbered after startAfter are read, so that an interrupted
+// import can be resumed; pass 0 to read all of them.
+//
+// If progress is non-nil, it is called after each pull request is processed.
+// Reading stops as soon as ctx is cancelled, including while waiting for the
+// API rate limit to reset.
+func GetAllPullRequests(ctx context.Context, local repository.Repo, remoteUser, remoteRepo, state string, since time.Time, startAfter int, prService PullRequestsService, issueService IssuesService, errOutput chan<- error, progress ProgressFunc, opts Options) ([]review.Review, error) {
+	var output []review.Review
+	err := ImportPullRequests(ctx, local, remoteUser, remoteRepo, state, since, startAfter, 0, prService, issueService, errOutput, progress, func(reviews []review.Review, lastPR int) error {
+		output = append(output, reviews...)
+		return nil
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// PullRequestBatchFunc is called by ImportPullRequests with the reviews of each
+// batch of pull requests, and the number of the last pull request in the batch.
+type PullRequestBatchFunc func(reviews []review.Review, lastPR int) error
+
+// ImportPullRequests reads the pull requests in the given state, updated since
+// the given time, and numbered after startAfter from the given repository, in increasing order of their numbers, as GetAllPullRequests
+// does, but hands the reviews to write in batches of batchSize pull requests
+// (or all at once, if batchSize is 0) as soon as each batch has been read.
+//
+// This lets a long import record its progress after each batch, by storing the
+// number passed to write, and later resume from there by passing that number as
+// startAfter. The pull requests skipped because of errors are still counted as
+// part of their batches. An error returned by write stops the import, and is
+// returned as is.
+func ImportPullRequests(ctx context.Context, local repository.Repo, remoteUser, remoteRepo, state string, since time.Time, startAfter, batchSize int, prService PullRequestsService, issueService IssuesService, errOutput chan<- error, progress ProgressFunc, write PullRequestBatchFunc, opts Options) error {
 	if remoteUser == "" || remoteRepo == "" {
-		return nil, ErrInvalidRemoteRepo
+		return ErrInvalidRemoteRepo
+	}
+	if err := CheckPullRequestState(state); err != nil {
+		return err
 	}
 
-	prs, err := fetchPullRequests(remoteUser, remoteRepo, client.PullRequests)
+	prs, err := fetchPullRequests(ctx, remoteUser, remoteRepo, state, since, prService)
 	if err != nil {
-		return nil, err
+		return &FetchError{Resource: "pull requests", Cause: err}
 	}
-	var output []review.Review
+	prs = pullRequestsAfter(prs, startAfter)
+	if batchSize <= 0 {
+		batchSize = len(prs)
+	}
+	for start := 0; start < len(prs); start += batchSize {
+		end := start + batchSize
+		if end > len(prs) {
+			end = len(prs)
+		}
+		reviews := convertPullRequests(ctx, prs[start:end], local, remoteUser, remoteRepo, prService, issueService, errOutput, func(done, total int) {
+			if progress != nil {
+				progress(start+done, len(prs))
+			}
+		}, opts)
+		if err := ctx.Err(); err != nil {
+			return &FetchError{Resource: "pull requests", Cause: err}
+		}
+		if err := write(reviews, prNumber(prs[end-1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullRequestsAfter returns the given pull requests that are numbered after n,
+// sorted by their numbers. If n is 0, then all of them are returned, including
+// any without numbers, so that those are reported as errors.
+func pullRequestsAfter(prs []*github.PullRequest, n int) []*github.PullRequest {
+	var after []*github.PullRequest
 	for _, pr := range prs {
-		issueComments, diffComments, err := fetchComments(pr, remoteUser, remoteRepo, client.PullRequests, client.Issues)
+		if n == 0 || prNumber(pr) > n {
+			after = append(after, pr)
+		}
+	}
+	sort.SliceStable(after, func(i, j int) bool {
+		return prNumber(after[i]) < prNumber(after[j])
+	})
+	return after
+}
+
+// convertPullRequests fetches the comments for each of the given pull requests,
+// and converts them into git-appraise reviews.
+//
+// A failure for one pull request never aborts the run: it is reported through
+// the supplied error channel, that pull request is skipped, and the reviews for
+// all of the others are still returned. If ctx is cancelled, then the remaining
+// pull requests are skipped without reporting an error for each of them.
+func convertPullRequests(ctx context.Context, prs []*github.PullRequest, local repository.Repo, remoteUser, remoteRepo string, prService PullRequestsService, issueService IssuesService, errOutput chan<- error, progress ProgressFunc, opts Options) []review.Review {
+	var output []review.Review
+	for i, pr := range prs {
+		if ctx.Err() != nil {
+			break
+		}
+		if reason := opts.skipReason(pr); reason != "" {
+			opts.debugf("Skipping %s pull request #%d", reason, prNumber(pr))
+			if progress != nil {
+				progress(i+1, len(prs))
+			}
+			continue
+		}
+		review, err := fetchAndConvertPullRequest(ctx, pr, local, remoteUser, remoteRepo, prService, issueService, opts)
 		if err != nil {
+			opts.debugf("Skipping pull request #%d: %v", prNumber(pr), err)
 			errOutput <- err
 		} else {
-			review, err := ConvertPullRequestToReview(pr, issueComments, diffComments, local)
+			opts.debugf("Converted pull request #%d into the review of %.12s with %d comments", prNumber(pr), review.Revision, len(review.Comments))
+			output = append(output, *review)
+		}
+		if progress != nil {
+			progress(i+1, len(prs))
+		}
+	}
+	return output
+}
+
+// fetchAndConvertPullRequest fetches the comments for a single pull request, and
+// converts it into a git-appraise review.
+//
+// Errors are returned as either a *FetchError or a *ConversionError.
+func fetchAndConvertPullRequest(ctx context.Context, pr *github.PullRequest, local repository.Repo, remoteUser, remoteRepo string, prService PullRequestsService, issueService IssuesService, opts Options) (*review.Review, error) {
+	issueComments, diffComments, prReviews, err := fetchComments(ctx, pr, remoteUser, remoteRepo, prService, issueService)
+	if err != nil {
+		return nil, &FetchError{
+			Resource: fmt.Sprintf("comments for pull request #%d", prNumber(pr)),
+			Cause:    err,
+		}
+	}
+	review, err := ConvertPullRequestToReview(pr, issueComments, diffComments, prReviews, local, opts)
+	if err != nil {
+		return nil, &ConversionError{PRNumber: prNumber(pr), Cause: err}
+	}
+	if opts.MirrorClosedBy && closedWithoutMerging(pr) {
+		events, err := fetchIssueEvents(ctx, pr, remoteUser, remoteRepo, issueService)
+		if err != nil {
+			return nil, &FetchError{
+				Resource: fmt.Sprintf("events for pull request #%d", prNumber(pr)),
+				Cause:    err,
+			}
+		}
+		if c := pullRequestCloseComment(pr, events, opts); c != nil {
+			thread, err := buildCommentThread(c, nil, nil)
 			if err != nil {
-				errOutput <- err
-			} else {
-				output = append(output, *review)
+				return nil, &ConversionError{PRNumber: prNumber(pr), Cause: err}
 			}
+			review.Comments = append(review.Comments, *thread)
 		}
 	}
-	return output, nil
+	return review, nil
+}
+
+// SyncSinglePullRequest reads the pull request with the given number, along with
+// its comments, and writes the corresponding review into the local repository.
+//
+// This is intended for re-syncing a single pull request without crawling the
+// entire remote repository.
+func SyncSinglePullRequest(ctx context.Context, number int, local repository.Repo, remoteUser, remoteRepo string, prService PullRequestsService, issueService IssuesService, logChan chan<- string, opts Options) error {
+	if remoteUser == "" || remoteRepo == "" {
+		return ErrInvalidRemoteRepo
+	}
+
+	var pr *github.PullRequest
+	err := executeRequest(ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		pr, resp, err = prService.Get(ctx, remoteUser, remoteRepo, number)
+		return resp, err
+	})
+	if err != nil {
+		return &FetchError{Resource: fmt.Sprintf("pull request #%d", number), Cause: err}
+	}
+	return SyncPullRequest(ctx, pr, local, remoteUser, remoteRepo, prService, issueService, logChan, opts)
 }
 
-func fetchPullRequests(remoteUser, remoteRepo string, prs pullRequestsService) ([]*github.PullRequest, error) {
+// SyncReviewRequest writes the review request for the given pull request into
+// the local repository, without reading its comments, e.g. when only its labels
+// changed. Like SyncPullRequest, it writes nothing for the pull requests that
+// the options leave out of the mirror.
+func SyncReviewRequest(pr *github.PullRequest, local repository.Repo, logChan chan<- string, opts Options) error {
+	if reason := opts.skipReason(pr); reason != "" {
+		opts.debugf("Skipping %s pull request #%d", reason, prNumber(pr))
+		return nil
+	}
+	r, err := ConvertPullRequestToReview(pr, nil, nil, nil, local, opts)
+	if err != nil {
+		return &ConversionError{PRNumber: prNumber(pr), Cause: err}
+	}
+	return WriteNewReviews([]review.Review{*r}, local, logChan, opts)
+}
+
+// SyncPullRequest reads the comments for the given pull request, and writes the
+// corresponding review into the local repository.
+//
+// This is used when the pull request itself is already known, e.g. because it
+// was included in a web hook payload. Nothing is written for drafts if the
+// SkipDrafts option is set, nor for pull requests closed before the
+// ClosedBefore option.
+//
+// If the MirrorMergeable option is set, and the pull request says whether it can be
+// merged, as it does when read by SyncSinglePullRequest, then that is written
+// as a CI report on its head commit.
+func SyncPullRequest(ctx context.Context, pr *github.PullRequest, local repository.Repo, remoteUser, remoteRepo string, prService PullRequestsService, issueService IssuesService, logChan chan<- string, opts Options) error {
+	if reason := opts.skipReason(pr); reason != "" {
+		opts.debugf("Skipping %s pull request #%d", reason, prNumber(pr))
+		return nil
+	}
+	r, err := fetchAndConvertPullRequest(ctx, pr, local, remoteUser, remoteRepo, prService, issueService, opts)
+	if err != nil {
+		return err
+	}
+	opts.debugf("Converted pull request #%d into the review of %.12s with %d comments", prNumber(pr), r.Revision, len(r.Comments))
+	err = WriteNewReviews([]review.Review{*r}, local, logChan, opts)
+	if !opts.MirrorMergeable {
+		return err
+	}
+	report, convErr := ConvertMergeable(pr, time.Now())
+	if convErr != nil {
+		return err
+	}
+	reportErr := WriteNewReports(map[string][]ci.Report{pr.GetHead().GetSHA(): {*report}}, local, logChan, opts)
+	return writeErrors([]error{err, reportErr})
+}
+
+// ListPullRequests reads all of the pull requests, open or closed, from the given
+// repository, without reading any of their comments.
+func ListPullRequests(ctx context.Context, remoteUser, remoteRepo string, prService PullRequestsService) ([]*github.PullRequest, error) {
+	if remoteUser == "" || remoteRepo == "" {
+		return nil, ErrInvalidRemoteRepo
+	}
+	prs, err := fetchPullRequests(ctx, remoteUser, remoteRepo, AllPullRequests, time.Time{}, prService)
+	if err != nil {
+		return nil, &FetchError{Resource: "pull requests", Cause: err}
+	}
+	return prs, nil
+}
+
+// The states of the pull requests that can be read, as used by the GitHub API.
+const (
+	OpenPullRequests   = "open"
+	ClosedPullRequests = "closed"
+	AllPullRequests    = "all"
+)
+
+// CheckPullRequestState verifies that the given state is one that pull requests
+// can be read in, i.e. "open", "closed", "all", or "" (for "all").
+func CheckPullRequestState(state string) error {
+	switch state {
+	case "", OpenPullRequests, ClosedPullRequests, AllPullRequests:
+		return nil
+	}
+	return fmt.Errorf("invalid pull request state %q; must be %q, %q, or %q", state, OpenPullRequests, ClosedPullRequests, AllPullRequests)
+}
+
+// ParseImportWindow parses how far back an import reaches, either as a number
+// of days, e.g. "90d", or as a duration, e.g. "36h". The empty string means no
+// limit, and is parsed as 0.
+func ParseImportWindow(spec string) (time.Duration, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	var window time.Duration
+	if days := strings.TrimSuffix(spec, "d"); days != spec {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid import window %q: %v", spec, err)
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if window, err = time.ParseDuration(spec); err != nil {
+			return 0, fmt.Errorf("invalid import window %q: %v", spec, err)
+		}
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("invalid import window %q; must be positive", spec)
+	}
+	return window, nil
+}
+
+// updatedSince reports whether the given pull request was last updated at or
+// after the given time.
+func updatedSince(pr *github.PullRequest, since time.Time) bool {
+	updated := pr.GetUpdatedAt()
+	if updated.IsZero() {
+		updated = pr.GetCreatedAt()
+	}
+	return !updated.Before(since)
+}
+
+// fetchPullRequests lists the pull requests in the given state, and, if since is
+// non-zero, last updated at or after it.
+func fetchPullRequests(ctx context.Context, remoteUser, remoteRepo, state string, since time.Time, prs PullRequestsService) ([]*github.PullRequest, error) {
+	if state == "" {
+		state = AllPullRequests
+	}
 	var results []*github.PullRequest
-	err := executeListRequest(func(listOpts github.ListOptions) (*github.Response, error) {
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
 		opts := &github.PullRequestListOptions{
-			State:       "all",
+			State:       state,
 			ListOptions: listOpts,
 		}
-		pullRequests, response, err := prs.List(context.TODO(), remoteUser, remoteRepo, opts)
-		if err == nil {
-			results = append(results, pullRequests...)
+		if !since.IsZero() {
+			// The API can't filter by the time of the last update, but it
+			// can list the most recently updated pull requests first, so
+			// that listing can stop at the first one that is too old.
+			opts.Sort = "updated"
+			opts.Direction = "desc"
+		}
+		pullRequests, response, err := prs.List(ctx, remoteUser, remoteRepo, opts)
+		if err != nil {
+			return len(pullRequests), response, err
+		}
+		for _, pr := range pullRequests {
+			if !since.IsZero() && !updatedSince(pr, since) {
+				return 0, response, nil
+			}
+			results = append(results, pr)
 		}
-		return response, err
+		return len(pullRequests), response, nil
 	})
 	if err != nil {
 		return nil, err
@@ -225,34 +925,72 @@ func fetchPullRequests(remoteUser, remoteRepo string, prs pullRequestsService) (
 }
 
 // fetchComments fetches all of the comments for each issue it gets and then converts them.
-func fetchComments(pr *github.PullRequest, remoteUser, remoteRepo string, prs pullRequestsService, is issuesService) ([]*github.IssueComment, []*github.PullRequestComment, error) {
+//
+// The reviews of the pull request are fetched along with its comments, as they
+// hold the summaries of the reviews that the diff comments were submitted with.
+func fetchComments(ctx context.Context, pr *github.PullRequest, remoteUser, remoteRepo string, prs PullRequestsService, is IssuesService) ([]*github.IssueComment, []*github.PullRequestComment, []*github.PullRequestReview, error) {
+	if pr.Number == nil {
+		return nil, nil, nil, ErrInsufficientInfo
+	}
 	var issueComments []*github.IssueComment
-	err := executeListRequest(func(listOpts github.ListOptions) (*github.Response, error) {
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
 		listOptions := &github.IssueListCommentsOptions{
 			ListOptions: listOpts,
 		}
-		cs, resp, err := is.ListComments(context.TODO(), remoteUser, remoteRepo, *pr.Number, listOptions)
+		cs, resp, err := is.ListComments(ctx, remoteUser, remoteRepo, *pr.Number, listOptions)
 		if err == nil {
 			issueComments = append(issueComments, cs...)
 		}
-		return resp, err
+		return len(cs), resp, err
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	var diffComments []*github.PullRequestComment
-	err = executeListRequest(func(listOpts github.ListOptions) (*github.Response, error) {
+	err = executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
 		listOptions := &github.PullRequestListCommentsOptions{
 			ListOptions: listOpts,
 		}
-		cs, resp, err := prs.ListComments(context.TODO(), remoteUser, remoteRepo, *pr.Number, listOptions)
+		cs, resp, err := prs.ListComments(ctx, remoteUser, remoteRepo, *pr.Number, listOptions)
 		if err == nil {
 			diffComments = append(diffComments, cs...)
 		}
-		return resp, err
+		return len(cs), resp, err
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var prReviews []*github.PullRequestReview
+	err = executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
+		rs, resp, err := prs.ListReviews(ctx, remoteUser, remoteRepo, *pr.Number, &listOpts)
+		if err == nil {
+			prReviews = append(prReviews, rs...)
+		}
+		return len(rs), resp, err
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	return issueComments, diffComments, prReviews, nil
+}
+
+// fetchIssueEvents fetches the events of the issue underlying the given pull
+// request, e.g. its being closed, which the pull request itself doesn't say
+// who did.
+func fetchIssueEvents(ctx context.Context, pr *github.PullRequest, remoteUser, remoteRepo string, is IssuesService) ([]*github.IssueEvent, error) {
+	if pr.Number == nil {
+		return nil, ErrInsufficientInfo
+	}
+	var events []*github.IssueEvent
+	err := executeListRequest(ctx, func(listOpts github.ListOptions) (int, *github.Response, error) {
+		es, resp, err := is.ListIssueEvents(ctx, remoteUser, remoteRepo, *pr.Number, &listOpts)
+		if err == nil {
+			events = append(events, es...)
+		}
+		return len(es), resp, err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return issueComments, diffComments, nil
+	return events, nil
 }
@@ -18,12 +18,22 @@ package mirror
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
 	github "github.com/google/go-github/github"
 )
 
@@ -85,7 +95,7 @@ func TestFetchReports(t *testing.T) {
 			TargetURL: &successURL,
 			Context:   &statusContext,
 		}
-		successReport, err := ConvertStatus(successResult)
+		successReport, err := ConvertStatus(successResult, Options{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -96,7 +106,7 @@ func TestFetchReports(t *testing.T) {
 			TargetURL: &failureURL,
 			Context:   &statusContext,
 		}
-		failureReport, err := ConvertStatus(failureResult)
+		failureReport, err := ConvertStatus(failureResult, Options{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -122,7 +132,7 @@ func TestFetchReports(t *testing.T) {
 	}
 
 	errOut := make(chan error, 1000)
-	resultingReports, err := fetchReportsForCommit("ABCDEF", "user", "repo", serviceStub, errOut)
+	resultingReports, err := fetchReportsForCommit(context.Background(), "ABCDEF", "user", "repo", serviceStub, errOut, Options{})
 	if err != nil || len(errOut) > 0 {
 		t.Fatal(err, errOut)
 	}
@@ -135,3 +145,845 @@ func TestFetchReports(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchReportsReportsConversionErrors(t *testing.T) {
+	invalidState := "unknown"
+	now := time.Now()
+	serviceStub := &repoServiceStub{
+		Responses: []repoServiceResponse{
+			repoServiceResponse{
+				Results: []*github.RepoStatus{
+					&github.RepoStatus{
+						CreatedAt: &now,
+						State:     &invalidState,
+						Context:   &statusContext,
+					},
+				},
+				Response: github.Response{
+					Response: &http.Response{
+						StatusCode: http.StatusOK,
+					},
+					LastPage: 1,
+					Rate: github.Rate{
+						Remaining: 1,
+					},
+				},
+			},
+		},
+	}
+
+	errOut := make(chan error, 1000)
+	reports, err := fetchReportsForCommit(context.Background(), "ABCDEF", "user", "repo", serviceStub, errOut, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Errorf("Unexpected reports: %v", reports)
+	}
+	if len(errOut) != 1 {
+		t.Fatalf("Expected exactly one reported error, got %d", len(errOut))
+	}
+	var convErr *ConversionError
+	if reported := <-errOut; !errors.As(reported, &convErr) || convErr.Cause != ErrInvalidState {
+		t.Errorf("Unexpected error reported: %v", reported)
+	}
+}
+
+var emptyListResponse = github.Response{
+	Response: &http.Response{
+		StatusCode: http.StatusOK,
+	},
+	Rate: github.Rate{
+		Remaining: 1,
+	},
+}
+
+type pullRequestsServiceStub struct {
+	// ListedStates records the state requested by each call to List.
+	ListedStates []string
+	PullRequests []*github.PullRequest
+	DiffComments map[int][]*github.PullRequestComment
+	Reviews      map[int][]*github.PullRequestReview
+}
+
+func (s *pullRequestsServiceStub) Get(ctx context.Context, owner string, repo string, number int) (*github.PullRequest, *github.Response, error) {
+	for _, pr := range s.PullRequests {
+		if pr.GetNumber() == number {
+			resp := emptyListResponse
+			return pr, &resp, nil
+		}
+	}
+	resp := github.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusNotFound,
+		},
+	}
+	return nil, &resp, errors.New("not found")
+}
+
+func (s *pullRequestsServiceStub) List(ctx context.Context, owner string, repo string, opt *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error) {
+	s.ListedStates = append(s.ListedStates, opt.State)
+	resp := emptyListResponse
+	if opt.State == "all" || opt.State == "" {
+		return s.PullRequests, &resp, nil
+	}
+	var matching []*github.PullRequest
+	for _, pr := range s.PullRequests {
+		if pr.GetState() == opt.State {
+			matching = append(matching, pr)
+		}
+	}
+	return matching, &resp, nil
+}
+
+func (s *pullRequestsServiceStub) ListComments(ctx context.Context, owner string, repo string, number int, opt *github.PullRequestListCommentsOptions) ([]*github.PullRequestComment, *github.Response, error) {
+	resp := emptyListResponse
+	return s.DiffComments[number], &resp, nil
+}
+
+func (s *pullRequestsServiceStub) ListReviews(ctx context.Context, owner, repo string, number int, opt *github.ListOptions) ([]*github.PullRequestReview, *github.Response, error) {
+	resp := emptyListResponse
+	return s.Reviews[number], &resp, nil
+}
+
+type issuesServiceStub struct {
+	IssueComments map[int][]*github.IssueComment
+	IssueEvents   map[int][]*github.IssueEvent
+}
+
+func (s *issuesServiceStub) ListComments(ctx context.Context, owner string, repo string, number int, opt *github.IssueListCommentsOptions) ([]*github.IssueComment, *github.Response, error) {
+	resp := emptyListResponse
+	return s.IssueComments[number], &resp, nil
+}
+
+func (s *issuesServiceStub) ListIssueEvents(ctx context.Context, owner, repo string, number int, opt *github.ListOptions) ([]*github.IssueEvent, *github.Response, error) {
+	resp := emptyListResponse
+	return s.IssueEvents[number], &resp, nil
+}
+
+func TestConvertPullRequestsSkipsFailures(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	prs := []*github.PullRequest{
+		buildTestPullRequest(testRepo, 1),
+		buildTestPullRequest(testRepo, 2),
+		buildTestPullRequest(testRepo, 3),
+	}
+	// Cross-fork pull requests can be missing the base commit.
+	prs[1].Base.SHA = nil
+
+	errOut := make(chan error, 1000)
+	var progressCalls []int
+	progress := func(done, total int) {
+		if total != len(prs) {
+			t.Errorf("Unexpected progress total %d", total)
+		}
+		progressCalls = append(progressCalls, done)
+	}
+	reviews := convertPullRequests(context.Background(), prs, testRepo, "user", "repo", &pullRequestsServiceStub{}, &issuesServiceStub{}, errOut, progress, Options{})
+	if len(progressCalls) != len(prs) || progressCalls[len(progressCalls)-1] != len(prs) {
+		t.Errorf("Unexpected progress reports: %v", progressCalls)
+	}
+	if len(reviews) != 2 {
+		t.Fatalf("Expected the two valid pull requests to be converted; got %v", reviews)
+	}
+	for i, expectedRef := range []string{"refs/pull/1/head", "refs/pull/3/head"} {
+		if reviews[i].Request.ReviewRef != expectedRef {
+			t.Errorf("Unexpected review ref %q; expected %q", reviews[i].Request.ReviewRef, expectedRef)
+		}
+	}
+	if len(errOut) != 1 {
+		t.Fatalf("Expected exactly one reported error, got %d", len(errOut))
+	}
+	var convErr *ConversionError
+	if reported := <-errOut; !errors.As(reported, &convErr) || convErr.PRNumber != 2 || !errors.Is(reported, ErrInsufficientInfo) {
+		t.Errorf("Unexpected error reported: %v", reported)
+	}
+}
+
+func TestConvertPullRequestsDebugsEachPullRequest(t *testing.T) {
+	var messages []string
+	opts := Options{Debugf: func(format string, args ...interface{}) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}}
+
+	testRepo := repository.NewMockRepoForTest()
+	prs := []*github.PullRequest{
+		buildTestPullRequest(testRepo, 1),
+		buildTestPullRequest(testRepo, 2),
+	}
+	prs[1].Base.SHA = nil
+	errOut := make(chan error, 1000)
+	convertPullRequests(context.Background(), prs, testRepo, "user", "repo", &pullRequestsServiceStub{}, &issuesServiceStub{}, errOut, nil, opts)
+	if len(messages) != 2 ||
+		!strings.HasPrefix(messages[0], "Converted pull request #1 ") ||
+		!strings.HasPrefix(messages[1], "Skipping pull request #2: ") {
+		t.Errorf("Unexpected debug messages: %q", messages)
+	}
+}
+
+func TestImportPullRequestsResumesAfterCheckpoint(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	stub := &pullRequestsServiceStub{}
+	for _, number := range []int{5, 2, 4, 1, 3} {
+		stub.PullRequests = append(stub.PullRequests, buildTestPullRequest(testRepo, number))
+	}
+
+	errOut := make(chan error, 1000)
+	var batches [][]string
+	var checkpoints []int
+	err := ImportPullRequests(context.Background(), testRepo, "user", "repo", AllPullRequests, time.Time{}, 2, 2, stub, &issuesServiceStub{}, errOut, nil, func(reviews []review.Review, lastPR int) error {
+		var refs []string
+		for _, r := range reviews {
+			refs = append(refs, r.Request.ReviewRef)
+		}
+		batches = append(batches, refs)
+		checkpoints = append(checkpoints, lastPR)
+		return nil
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"refs/pull/3/head", "refs/pull/4/head"}, {"refs/pull/5/head"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("Unexpected batches %v; expected %v", batches, expected)
+	}
+	if !reflect.DeepEqual(checkpoints, []int{4, 5}) {
+		t.Errorf("Unexpected checkpoints %v", checkpoints)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ImportPullRequests(context.Background(), testRepo, "user", "repo", AllPullRequests, time.Time{}, 0, 2, stub, &issuesServiceStub{}, errOut, nil, func(reviews []review.Review, lastPR int) error {
+		calls++
+		return stop
+	}, Options{})
+	if err != stop || calls != 1 {
+		t.Errorf("Expected the import to stop at the first failed write; got %v after %d writes", err, calls)
+	}
+}
+
+func TestGetAllPullRequestsState(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	open, closed := "open", "closed"
+	stub := &pullRequestsServiceStub{}
+	for number, state := range []*string{&open, &closed, &open} {
+		pr := buildTestPullRequest(testRepo, number+1)
+		pr.State = state
+		stub.PullRequests = append(stub.PullRequests, pr)
+	}
+
+	for state, expected := range map[string][]string{
+		"":                 {"refs/pull/1/head", "refs/pull/2/head", "refs/pull/3/head"},
+		AllPullRequests:    {"refs/pull/1/head", "refs/pull/2/head", "refs/pull/3/head"},
+		OpenPullRequests:   {"refs/pull/1/head", "refs/pull/3/head"},
+		ClosedPullRequests: {"refs/pull/2/head"},
+	} {
+		stub.ListedStates = nil
+		reviews, err := GetAllPullRequests(context.Background(), testRepo, "user", "repo", state, time.Time{}, 0, stub, &issuesServiceStub{}, make(chan error, 1000), nil, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		requested := state
+		if requested == "" {
+			requested = AllPullRequests
+		}
+		if len(stub.ListedStates) != 1 || stub.ListedStates[0] != requested {
+			t.Errorf("Expected the %q pull requests to be listed; listed %v", requested, stub.ListedStates)
+		}
+		var refs []string
+		for _, r := range reviews {
+			refs = append(refs, r.Request.ReviewRef)
+		}
+		if !reflect.DeepEqual(refs, expected) {
+			t.Errorf("Unexpected reviews for the %q pull requests: %v", state, refs)
+		}
+	}
+
+	if _, err := GetAllPullRequests(context.Background(), testRepo, "user", "repo", "merged", time.Time{}, 0, stub, &issuesServiceStub{}, make(chan error, 1000), nil, Options{}); err == nil {
+		t.Error("Expected an invalid state to be rejected")
+	}
+}
+
+// updatedPullRequestsStub lists its pull requests one per page, most recently
+// updated first, as the API does when asked to sort them by their updates.
+type updatedPullRequestsStub struct {
+	pullRequestsServiceStub
+	// ListedPages records the page requested by each call to List.
+	ListedPages []int
+}
+
+func (s *updatedPullRequestsStub) List(ctx context.Context, owner string, repo string, opt *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error) {
+	s.ListedPages = append(s.ListedPages, opt.Page)
+	if opt.Sort != "updated" || opt.Direction != "desc" {
+		return nil, nil, fmt.Errorf("unexpected sort order %q %q", opt.Sort, opt.Direction)
+	}
+	prs := append([]*github.PullRequest(nil), s.PullRequests...)
+	sort.Slice(prs, func(i, j int) bool {
+		return prs[i].GetUpdatedAt().After(prs[j].GetUpdatedAt())
+	})
+	resp := emptyListResponse
+	if opt.Page < len(prs) {
+		resp.NextPage = opt.Page + 1
+	}
+	if opt.Page < 1 || opt.Page > len(prs) {
+		return nil, &resp, nil
+	}
+	return prs[opt.Page-1 : opt.Page], &resp, nil
+}
+
+func TestGetAllPullRequestsSince(t *testing.T) {
+	testRepo := repository.NewMockRepoForTest()
+	now := time.Now()
+	stub := &updatedPullRequestsStub{}
+	for number, age := range []time.Duration{100 * 24 * time.Hour, time.Hour, 200 * 24 * time.Hour, 24 * time.Hour} {
+		pr := buildTestPullRequest(testRepo, number+1)
+		updatedAt := now.Add(-age)
+		pr.UpdatedAt = &updatedAt
+		stub.PullRequests = append(stub.PullRequests, pr)
+	}
+
+	reviews, err := GetAllPullRequests(context.Background(), testRepo, "user", "repo", AllPullRequests, now.Add(-90*24*time.Hour), 0, stub, &issuesServiceStub{}, make(chan error, 1000), nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, r := range reviews {
+		refs = append(refs, r.Request.ReviewRef)
+	}
+	if expected := []string{"refs/pull/2/head", "refs/pull/4/head"}; !reflect.DeepEqual(refs, expected) {
+		t.Errorf("Expected only the recently updated pull requests %v; got %v", expected, refs)
+	}
+	if len(stub.ListedPages) != 3 {
+		t.Errorf("Expected listing to stop at the first pull request outside the window; listed pages %v", stub.ListedPages)
+	}
+}
+
+func TestParseImportWindow(t *testing.T) {
+	for spec, expected := range map[string]time.Duration{
+		"":    0,
+		"90d": 90 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+	} {
+		if window, err := ParseImportWindow(spec); err != nil || window != expected {
+			t.Errorf("Unexpected import window for %q: %v, %v", spec, window, err)
+		}
+	}
+	for _, spec := range []string{"90", "d", "-3d", "0d", "soon"} {
+		if _, err := ParseImportWindow(spec); err == nil {
+			t.Errorf("Expected the import window %q to be rejected", spec)
+		}
+	}
+}
+
+type gitServiceStub struct {
+	// Pages holds the refs returned for each page of results.
+	Pages [][]*github.Reference
+	// Tags holds the annotated tags, by their SHAs.
+	Tags map[string]*github.Tag
+}
+
+func (s *gitServiceStub) ListRefs(ctx context.Context, owner, repo string, opt *github.ReferenceListOptions) ([]*github.Reference, *github.Response, error) {
+	resp := emptyListResponse
+	resp.LastPage = len(s.Pages)
+	return s.Pages[opt.Page-1], &resp, nil
+}
+
+func (s *gitServiceStub) GetTag(ctx context.Context, owner string, repo string, sha string) (*github.Tag, *github.Response, error) {
+	tag, ok := s.Tags[sha]
+	if !ok {
+		return nil, nil, fmt.Errorf("no tag %s", sha)
+	}
+	return tag, &github.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+}
+
+func buildTestReference(name, sha string) *github.Reference {
+	return &github.Reference{
+		Ref: &name,
+		Object: &github.GitObject{
+			SHA: &sha,
+		},
+	}
+}
+
+func TestIterateRemoteCommits(t *testing.T) {
+	gitStub := &gitServiceStub{
+		Pages: [][]*github.Reference{
+			{
+				buildTestReference("refs/heads/master", "ABCDEF"),
+				buildTestReference("refs/heads/dev", "012345"),
+			},
+			{
+				buildTestReference("refs/pull/1/head", "FEDCBA"),
+			},
+		},
+	}
+	commits, err := iterateRemoteCommits(context.Background(), "user", "repo", gitStub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ABCDEF", "012345", "FEDCBA"}
+	if !reflect.DeepEqual(commits, expected) {
+		t.Errorf("Unexpected commits %v; expected %v", commits, expected)
+	}
+}
+
+func TestIterateRemoteCommitsHandlesNonCommitRefs(t *testing.T) {
+	commitType := "commit"
+	tagType := "tag"
+	treeType := "tree"
+	branch := buildTestReference("refs/heads/master", "ABCDEF")
+	branch.Object.Type = &commitType
+	annotatedTag := buildTestReference("refs/tags/v1.0", "7A6000")
+	annotatedTag.Object.Type = &tagType
+	nestedTag := buildTestReference("refs/tags/v1.0-signed", "7A6001")
+	nestedTag.Object.Type = &tagType
+	releaseTag := buildTestReference("refs/tags/v0.9", "7A6002")
+	releaseTag.Object.Type = &tagType
+	treeTag := buildTestReference("refs/tags/tree", "7A6003")
+	treeTag.Object.Type = &tagType
+	missingObject := buildTestReference("refs/heads/broken", "")
+	missingObject.Object = nil
+	missingSHA := buildTestReference("refs/heads/empty", "")
+	missingSHA.Object.SHA = nil
+
+	tagObject := func(objectType, sha string) *github.Tag {
+		return &github.Tag{Object: &github.GitObject{Type: &objectType, SHA: &sha}}
+	}
+	gitStub := &gitServiceStub{
+		Pages: [][]*github.Reference{
+			{branch, annotatedTag, nestedTag, releaseTag, treeTag, missingObject, missingSHA},
+		},
+		Tags: map[string]*github.Tag{
+			// The branch's commit is only listed once, although it is
+			// also tagged, and the tag of a tree is left out.
+			"7A6000": tagObject(commitType, "ABCDEF"),
+			"7A6001": tagObject(tagType, "7A6000"),
+			"7A6002": tagObject(commitType, "012345"),
+			"7A6003": tagObject(treeType, "FEDCBA"),
+		},
+	}
+	commits, err := iterateRemoteCommits(context.Background(), "user", "repo", gitStub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ABCDEF", "012345"}
+	if !reflect.DeepEqual(commits, expected) {
+		t.Errorf("Unexpected commits %v; expected %v", commits, expected)
+	}
+}
+
+func TestIterateRemoteCommitsFiltersRefs(t *testing.T) {
+	gitStub := &gitServiceStub{
+		Pages: [][]*github.Reference{
+			{
+				buildTestReference("refs/heads/master", "ABCDEF"),
+				buildTestReference("refs/heads/stale-feature", "012345"),
+				buildTestReference("refs/pull/1/head", "FEDCBA"),
+				buildTestReference("refs/pull/1/merge", "543210"),
+			},
+		},
+	}
+	refFilter, err := MatchRefs("refs/pull/*/head", "refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := iterateRemoteCommits(context.Background(), "user", "repo", gitStub, refFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ABCDEF", "FEDCBA"}
+	if !reflect.DeepEqual(commits, expected) {
+		t.Errorf("Unexpected commits %v; expected %v", commits, expected)
+	}
+}
+
+// statusesByCommitStub returns the statuses of each commit, recording the
+// commits that they were requested for.
+type statusesByCommitStub struct {
+	Statuses  map[string][]*github.RepoStatus
+	Requested []string
+}
+
+func (s *statusesByCommitStub) ListStatuses(ctx context.Context, owner, repo, ref string, opt *github.ListOptions) ([]*github.RepoStatus, *github.Response, error) {
+	s.Requested = append(s.Requested, ref)
+	resp := emptyListResponse
+	return s.Statuses[ref], &resp, nil
+}
+
+func TestGetAllStatusesIncludesPullRequestHeads(t *testing.T) {
+	gitStub := &gitServiceStub{
+		Pages: [][]*github.Reference{
+			{
+				buildTestReference("refs/heads/master", "ABCDEF"),
+				buildTestReference("refs/pull/1/head", "FEDCBA"),
+			},
+		},
+	}
+	buildPullRequest := func(number int, state, head string) *github.PullRequest {
+		return &github.PullRequest{
+			Number: &number,
+			State:  &state,
+			Head:   &github.PullRequestBranch{SHA: &head},
+		}
+	}
+	prStub := &pullRequestsServiceStub{
+		PullRequests: []*github.PullRequest{
+			buildPullRequest(1, "open", "FEDCBA"),
+			// The branch of this pull request was deleted, so its head is
+			// not the commit of any ref.
+			buildPullRequest(2, "open", "0B5C0E"),
+			buildPullRequest(3, "closed", "C105ED"),
+		},
+	}
+	now := time.Now()
+	repoStub := &statusesByCommitStub{
+		Statuses: map[string][]*github.RepoStatus{
+			"0B5C0E": {{CreatedAt: &now, State: &stateSuccess, Context: &statusContext}},
+		},
+	}
+
+	errOut := make(chan error, 1000)
+	reports, err := GetAllStatuses(context.Background(), "user", "repo", gitStub, repoStub, prStub, nil, errOut, nil, Options{})
+	if err != nil || len(errOut) > 0 {
+		t.Fatal(err, errOut)
+	}
+	expected := []string{"ABCDEF", "FEDCBA", "0B5C0E"}
+	if !reflect.DeepEqual(repoStub.Requested, expected) {
+		t.Errorf("Unexpected commits %v; expected %v", repoStub.Requested, expected)
+	}
+	if len(reports["0B5C0E"]) != 1 {
+		t.Errorf("Expected the statuses of the branchless pull request head to be read; got %v", reports)
+	}
+
+	// Pull requests whose refs are filtered out are skipped.
+	refFilter, err := MatchRefs("refs/heads/master", "refs/pull/1/head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoStub.Requested = nil
+	if _, err := GetAllStatuses(context.Background(), "user", "repo", gitStub, repoStub, prStub, refFilter, errOut, nil, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"ABCDEF", "FEDCBA"}; !reflect.DeepEqual(repoStub.Requested, expected) {
+		t.Errorf("Unexpected commits %v; expected %v", repoStub.Requested, expected)
+	}
+}
+
+func TestMatchRefsRejectsInvalidPatterns(t *testing.T) {
+	if _, err := MatchRefs("refs/heads/["); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestSyncSinglePullRequest(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	prService := &pullRequestsServiceStub{
+		PullRequests: []*github.PullRequest{
+			buildTestPullRequest(repo, 1),
+			buildTestPullRequest(repo, 2),
+		},
+	}
+	if err := SyncSinglePullRequest(context.Background(), 2, repo, "user", "repo", prService, &issuesServiceStub{}, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	reviews := review.ListAll(repo)
+	if len(reviews) != 1 || reviews[0].Request.ReviewRef != "refs/pull/2/head" {
+		t.Fatalf("Expected only pull request #2 to be written, got %v", reviews)
+	}
+
+	var fetchErr *FetchError
+	err := SyncSinglePullRequest(context.Background(), 3, repo, "user", "repo", prService, &issuesServiceStub{}, logChan, Options{})
+	if !errors.As(err, &fetchErr) {
+		t.Errorf("Expected a fetch error for a missing pull request, got %v", err)
+	}
+}
+
+func TestSyncPullRequestSkipsDrafts(t *testing.T) {
+	opts := Options{SkipDrafts: true}
+
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	draft := buildTestPullRequest(repo, 1)
+	draft.MergeableState = github.String("draft")
+	ready := buildTestPullRequest(repo, 2)
+	prService := &pullRequestsServiceStub{PullRequests: []*github.PullRequest{draft, ready}}
+	for _, pr := range prService.PullRequests {
+		if err := SyncPullRequest(context.Background(), pr, repo, "user", "repo", prService, &issuesServiceStub{}, logChan, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reviews := review.ListAll(repo)
+	if len(reviews) != 1 || reviews[0].Request.ReviewRef != "refs/pull/2/head" {
+		t.Fatalf("Expected only the ready pull request to be written, got %v", reviews)
+	}
+}
+
+func TestSyncPullRequestMirrorsMergeable(t *testing.T) {
+	opts := Options{MirrorMergeable: true}
+
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 1)
+	pr.Mergeable = github.Bool(false)
+	prService := &pullRequestsServiceStub{PullRequests: []*github.PullRequest{pr}}
+	if err := SyncPullRequest(context.Background(), pr, repo, "user", "repo", prService, &issuesServiceStub{}, logChan, opts); err != nil {
+		t.Fatal(err)
+	}
+	reports := ci.ParseAllValid(repo.GetNotes(ci.Ref, *pr.Head.SHA))
+	if len(reports) != 1 || reports[0].Agent != MergeableAgent || reports[0].Status != ci.StatusFailure {
+		t.Errorf("Expected a failed mergeable report on the head commit, got %+v", reports)
+	}
+}
+
+func TestExecuteRequestStopsWaitingWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- executeRequest(ctx, func() (*github.Response, error) {
+			attempts++
+			resp := &github.Response{
+				Response: &http.Response{StatusCode: http.StatusForbidden},
+				Rate: github.Rate{
+					Remaining: 0,
+					Reset:     github.Timestamp{Time: time.Now().Add(time.Hour)},
+				},
+			}
+			return resp, errors.New("rate limited")
+		})
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the request to be cancelled, got %v", err)
+		}
+		if attempts != 1 {
+			t.Errorf("Expected a single attempt, got %d", attempts)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The request kept waiting for the rate limit after being cancelled")
+	}
+}
+
+func TestExecuteRequestWithoutResponse(t *testing.T) {
+	connErr := errors.New("connection refused")
+	attempts := 0
+	err := executeRequest(context.Background(), func() (*github.Response, error) {
+		attempts++
+		return nil, connErr
+	})
+	if err != connErr {
+		t.Errorf("Expected the connection error to be returned, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestExecuteRequestRetriesServerErrors(t *testing.T) {
+	defer func(backoff time.Duration) { initialTransientBackoff = backoff }(initialTransientBackoff)
+	initialTransientBackoff = time.Millisecond
+
+	statusCodes := []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}
+	attempts := 0
+	err := executeRequest(context.Background(), func() (*github.Response, error) {
+		statusCode := statusCodes[attempts]
+		attempts++
+		resp := &github.Response{Response: &http.Response{StatusCode: statusCode}}
+		if statusCode != http.StatusOK {
+			return resp, &github.ErrorResponse{Response: resp.Response}
+		}
+		return resp, nil
+	})
+	if err != nil {
+		t.Errorf("Expected the request to succeed after retrying, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	err = executeRequest(context.Background(), func() (*github.Response, error) {
+		attempts++
+		resp := &github.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+		return resp, &github.ErrorResponse{Response: resp.Response}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected a 404 to fail without retrying; got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestExecuteRequestRetriesTimeouts(t *testing.T) {
+	defer func(backoff time.Duration) { initialTransientBackoff = backoff }(initialTransientBackoff)
+	initialTransientBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		attempts++
+		stall := attempts == 1
+		mu.Unlock()
+		if stall {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`{"login": "user"}`))
+	}))
+	defer server.Close()
+	client := github.NewClient(&http.Client{Timeout: 100 * time.Millisecond})
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	var user *github.User
+	err := executeRequest(context.Background(), func() (resp *github.Response, err error) {
+		user, resp, err = client.Users.Get(context.Background(), "")
+		return resp, err
+	})
+	if err != nil {
+		t.Fatalf("Expected the request to succeed after timing out once, got %v", err)
+	}
+	if user.GetLogin() != "user" || attempts != 2 {
+		t.Errorf("Unexpected user %v after %d attempts", user, attempts)
+	}
+}
+
+// listPage describes a single page of results returned by a stubbed list request.
+type listPage struct {
+	Count    int
+	Response github.Response
+}
+
+// runListRequest runs executeListRequest against the given pages of results, and
+// returns the numbers of the pages that were requested.
+func runListRequest(t *testing.T, pages []listPage) []int {
+	var requested []int
+	err := executeListRequest(context.Background(), func(listOpts github.ListOptions) (int, *github.Response, error) {
+		requested = append(requested, listOpts.Page)
+		if listOpts.Page > len(pages) {
+			resp := emptyListResponse
+			return 0, &resp, nil
+		}
+		page := pages[listOpts.Page-1]
+		resp := page.Response
+		resp.Response = emptyListResponse.Response
+		resp.Rate = emptyListResponse.Rate
+		return page.Count, &resp, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return requested
+}
+
+func TestExecuteListRequestSinglePage(t *testing.T) {
+	// GitHub does not include any pagination links for a single page.
+	requested := runListRequest(t, []listPage{{Count: 3}})
+	if !reflect.DeepEqual(requested, []int{1}) {
+		t.Errorf("Unexpected pages requested: %v", requested)
+	}
+}
+
+func TestExecuteListRequestFullPageWithoutLinks(t *testing.T) {
+	requested := runListRequest(t, []listPage{{Count: listPageSize}})
+	if !reflect.DeepEqual(requested, []int{1, 2}) {
+		t.Errorf("Unexpected pages requested: %v", requested)
+	}
+}
+
+func TestExecuteListRequestShrinkingResults(t *testing.T) {
+	// Results were deleted after the first page was read, so the second page
+	// turned out to be the last one.
+	requested := runListRequest(t, []listPage{
+		{Count: listPageSize, Response: github.Response{NextPage: 2, LastPage: 3}},
+		{Count: 10, Response: github.Response{FirstPage: 1, PrevPage: 1}},
+		{Count: listPageSize, Response: github.Response{FirstPage: 1, PrevPage: 2}},
+	})
+	if !reflect.DeepEqual(requested, []int{1, 2}) {
+		t.Errorf("Unexpected pages requested: %v", requested)
+	}
+}
+
+func TestExecuteListRequestGrowingResults(t *testing.T) {
+	// Results were added after the first page was read, so there is now a
+	// third page.
+	requested := runListRequest(t, []listPage{
+		{Count: listPageSize, Response: github.Response{NextPage: 2, LastPage: 2}},
+		{Count: listPageSize, Response: github.Response{FirstPage: 1, PrevPage: 1, NextPage: 3, LastPage: 3}},
+		{Count: 1, Response: github.Response{FirstPage: 1, PrevPage: 2}},
+	})
+	if !reflect.DeepEqual(requested, []int{1, 2, 3}) {
+		t.Errorf("Unexpected pages requested: %v", requested)
+	}
+}
+
+func TestSyncPullRequestSkipsClosedBefore(t *testing.T) {
+	opts := Options{ClosedBefore: time.Now().Add(-time.Hour)}
+
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	longAgo, now := time.Now().Add(-2*time.Hour), time.Now()
+	longClosed := buildTestPullRequest(repo, 1)
+	longClosed.State = github.String("closed")
+	longClosed.ClosedAt = &longAgo
+	recentlyClosed := buildTestPullRequest(repo, 2)
+	recentlyClosed.State = github.String("closed")
+	recentlyClosed.ClosedAt = &now
+	prService := &pullRequestsServiceStub{PullRequests: []*github.PullRequest{longClosed, recentlyClosed}}
+	for _, pr := range prService.PullRequests {
+		if err := SyncPullRequest(context.Background(), pr, repo, "user", "repo", prService, &issuesServiceStub{}, logChan, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reviews := review.ListAll(repo)
+	if len(reviews) != 1 || reviews[0].Request.ReviewRef != "refs/pull/2/head" {
+		t.Fatalf("Expected only the recently closed pull request to be written, got %v", reviews)
+	}
+
+	errOut := make(chan error, 10)
+	converted := convertPullRequests(context.Background(), prService.PullRequests, repo, "user", "repo", prService, &issuesServiceStub{}, errOut, nil, opts)
+	if len(converted) != 1 || converted[0].Request.ReviewRef != "refs/pull/2/head" {
+		t.Errorf("Expected only the recently closed pull request to be read, got %v", converted)
+	}
+}
+
+func TestSyncPullRequestMirrorsClosedBy(t *testing.T) {
+	opts := Options{MirrorClosedBy: true}
+
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	closer := "closer"
+	pr := buildTestPullRequest(repo, 1)
+	pr.State = github.String("closed")
+	closedAt := pr.CreatedAt.Add(time.Hour)
+	issueService := &issuesServiceStub{IssueEvents: map[int][]*github.IssueEvent{
+		1: {{Event: github.String("closed"), Actor: &github.User{Login: &closer}, CreatedAt: &closedAt}},
+	}}
+	prService := &pullRequestsServiceStub{PullRequests: []*github.PullRequest{pr}}
+	if err := SyncPullRequest(context.Background(), pr, repo, "user", "repo", prService, issueService, logChan, opts); err != nil {
+		t.Fatal(err)
+	}
+	comments := comment.ParseAllValid(repo.GetNotes(comment.Ref, repository.TestCommitG))
+	if len(comments) != 1 {
+		t.Fatalf("Expected a comment recording who closed the pull request, got %v", comments)
+	}
+	for _, c := range comments {
+		if c.Author != closer || c.Description != "Closed by closer" {
+			t.Errorf("Unexpected close comment: %+v", c)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-pull-request-mirror/metrics"
+)
+
+// Utilities for compacting notes that hold duplicates of the same items.
+
+// RepairNotes removes the duplicate review requests, comments, and CI reports
+// from the notes of the given repository, e.g. after the notes history was
+// rewritten, or after items were mirrored more than once, and returns the number
+// of notes that were removed. Nothing is read from GitHub.
+//
+// Each revision whose notes hold duplicates has the remaining ones, in their
+// original order, first written under a backup notes ref (see repairBackupRef),
+// then all of its notes removed under the repaired ref, and then the remaining
+// ones appended again. If rewriting them fails, they are still kept under the
+// backup ref, and the next repair restores them before anything else. Notes that
+// can't be parsed are kept as they are. The items are compared with the same
+// functions that keep them from being written twice:
+//
+//   - A request duplicates the one right before it if they overlap, as for
+//     RequestsOverlap, and have the same reviewers and labels, so that the
+//     sequence of changes to the review, and thus its current request, is
+//     kept.
+//   - A report duplicates the one right before it by the same agent if they
+//     overlap, as for ReportsOverlap, so that the latest status of each agent
+//     is kept.
+//   - A comment duplicates an earlier one if they are identical, or if they
+//     overlap, as for CommentsOverlap, and have the same timestamp, unless
+//     another comment refers to it as its parent or original.
+func RepairNotes(repo repository.Repo, remove NotesRemover) (int, error) {
+	removed := 0
+	for _, notesRef := range []string{request.Ref, comment.Ref, ci.Ref} {
+		backupRef := repairBackupRef(notesRef)
+		if err := restoreRepairBackup(repo, notesRef, backupRef, remove); err != nil {
+			return removed, err
+		}
+		allNotes, err := repo.GetAllNotes(notesRef)
+		if err != nil {
+			return removed, fmt.Errorf("failure reading the notes in %s: %v", notesRef, err)
+		}
+		var revisions []string
+		for revision := range allNotes {
+			revisions = append(revisions, revision)
+		}
+		sort.Strings(revisions)
+		for _, revision := range revisions {
+			notes := allNotes[revision]
+			kept := dedupeNotes(notesRef, notes)
+			if len(kept) == len(notes) {
+				continue
+			}
+			if err := rewriteNotes(repo, notesRef, revision, notesStrings(kept), remove); err != nil {
+				return removed, err
+			}
+			removed += len(notes) - len(kept)
+		}
+	}
+	return removed, nil
+}
+
+// rewriteNotes replaces all of the notes of a revision under notesRef with the
+// given lines.
+//
+// The lines are first written under repairBackupRef(notesRef), so that if they
+// can't be written again once the original notes are removed, they are kept
+// there, and restored by restoreRepairBackup. The backup is removed once the
+// notes are rewritten.
+func rewriteNotes(repo repository.Repo, notesRef, revision string, lines []string, remove NotesRemover) error {
+	backupRef := repairBackupRef(notesRef)
+	note := repository.Note(strings.Join(lines, "\n"))
+	if len(lines) > 0 {
+		if err := repo.AppendNote(backupRef, revision, note); err != nil {
+			return fmt.Errorf("failure backing up the rewritten notes in %s for %.12s: %v", notesRef, revision, err)
+		}
+	}
+	if err := remove(notesRef, revision); err != nil {
+		return fmt.Errorf("failure removing the notes in %s for %.12s: %v", notesRef, revision, err)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := repo.AppendNote(notesRef, revision, note); err != nil {
+		return fmt.Errorf("failure rewriting the notes in %s for %.12s, which are kept in %s until the next repair or prune: %v", notesRef, revision, backupRef, err)
+	}
+	metrics.NotesWritten(len(lines))
+	if err := remove(backupRef, revision); err != nil {
+		return fmt.Errorf("failure removing the backup of the notes in %s for %.12s: %v", notesRef, revision, err)
+	}
+	return nil
+}
+
+// repairBackupRef returns the notes ref that RepairNotes, and
+// PruneResolvedReviews, write the rewritten notes under the given ref to,
+// before they remove the original ones.
+//
+// It is kept outside of refs/notes/devtools, so that it isn't pulled or pushed
+// along with the git-appraise notes.
+func repairBackupRef(notesRef string) string {
+	return "refs/notes/repair/" + strings.TrimPrefix(notesRef, "refs/notes/")
+}
+
+// restoreRepairBackup restores the notes under notesRef of each revision that a
+// previous repair removed, but failed to rewrite, from their backup under
+// backupRef, and then removes all of the backups.
+func restoreRepairBackup(repo repository.Repo, notesRef, backupRef string, remove NotesRemover) error {
+	backups, err := repo.GetAllNotes(backupRef)
+	if err != nil {
+		return fmt.Errorf("failure reading the notes in %s: %v", backupRef, err)
+	}
+	var revisions []string
+	for revision := range backups {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	for _, revision := range revisions {
+		lines := notesStrings(backups[revision])
+		if len(lines) > 0 && len(repo.GetNotes(notesRef, revision)) == 0 {
+			if err := repo.AppendNote(notesRef, revision, repository.Note(strings.Join(lines, "\n"))); err != nil {
+				return fmt.Errorf("failure restoring the notes in %s for %.12s from %s: %v", notesRef, revision, backupRef, err)
+			}
+			metrics.NotesWritten(len(lines))
+		}
+		if err := remove(backupRef, revision); err != nil {
+			return fmt.Errorf("failure removing the backup of the notes in %s for %.12s: %v", notesRef, revision, err)
+		}
+	}
+	return nil
+}
+
+// dedupeNotes returns the given notes under the given ref, without the ones
+// that duplicate another, as described for RepairNotes.
+func dedupeNotes(notesRef string, notes []repository.Note) []repository.Note {
+	switch notesRef {
+	case request.Ref:
+		return dedupeRequestNotes(notes)
+	case ci.Ref:
+		return dedupeReportNotes(notes)
+	case comment.Ref:
+		return dedupeCommentNotes(notes)
+	}
+	return notes
+}
+
+func dedupeRequestNotes(notes []repository.Note) []repository.Note {
+	var kept []repository.Note
+	var previous *request.Request
+	for _, note := range notes {
+		r, err := request.Parse(note)
+		if err != nil || r.Version != request.FormatVersion {
+			kept = append(kept, note)
+			continue
+		}
+		if previous != nil && sameRequest(*previous, r) {
+			continue
+		}
+		kept = append(kept, note)
+		previous = &r
+	}
+	return kept
+}
+
+func dedupeReportNotes(notes []repository.Note) []repository.Note {
+	var kept []repository.Note
+	previous := make(map[string]ci.Report)
+	for _, note := range notes {
+		report, err := ci.Parse(note)
+		if err != nil || report.Version != ci.FormatVersion {
+			kept = append(kept, note)
+			continue
+		}
+		if last, ok := previous[report.Agent]; ok && ReportsOverlap(last, report) {
+			continue
+		}
+		kept = append(kept, note)
+		previous[report.Agent] = report
+	}
+	return kept
+}
+
+func dedupeCommentNotes(notes []repository.Note) []repository.Note {
+	referenced := make(map[string]bool)
+	for _, c := range comment.ParseAllValid(notes) {
+		referenced[c.Parent] = true
+		referenced[c.Original] = true
+	}
+
+	var kept []repository.Note
+	keptComments := make(map[string]comment.Comment)
+	for _, note := range notes {
+		c, err := comment.Parse(note)
+		if err != nil || c.Version != comment.FormatVersion {
+			kept = append(kept, note)
+			continue
+		}
+		hash, err := c.Hash()
+		if err != nil {
+			kept = append(kept, note)
+			continue
+		}
+		if _, ok := keptComments[hash]; ok {
+			// An identical copy is kept, so references to it still hold.
+			continue
+		}
+		duplicate := false
+		for _, existing := range keptComments {
+			if existing.Timestamp == c.Timestamp && CommentsOverlap(existing, c) {
+				duplicate = true
+			}
+		}
+		if duplicate && !referenced[hash] {
+			continue
+		}
+		kept = append(kept, note)
+		keptComments[hash] = c
+	}
+	return kept
+}
+
+// notesStrings returns the contents of the given notes, leaving out any empty
+// ones.
+func notesStrings(notes []repository.Note) []string {
+	var result []string
+	for _, note := range notes {
+		if len(note) > 0 {
+			result = append(result, string(note))
+		}
+	}
+	return result
+}
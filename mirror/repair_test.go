@@ -0,0 +1,244 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-pull-request-mirror/metrics"
+)
+
+func TestRepairNotes(t *testing.T) {
+	repo := newNotesRepo()
+	revision := repository.TestCommitG
+	commit := repository.TestCommitJ
+	write := func(notesRef, revision string, item interface{}) repository.Note {
+		bytes, err := json.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		note := repository.Note(bytes)
+		if err := repo.AppendNote(notesRef, revision, note); err != nil {
+			t.Fatal(err)
+		}
+		return note
+	}
+
+	// The same request written twice in a row is a duplicate, but changing
+	// the description back and forth, or only the labels, is not.
+	original := request.Request{Timestamp: "0000000001", ReviewRef: "refs/pull/1/head", TargetRef: "refs/heads/master", Description: "Original"}
+	edited := original
+	edited.Timestamp = "0000000003"
+	edited.Description = "Edited"
+	reverted := original
+	reverted.Timestamp = "0000000004"
+	originalAgain := original
+	originalAgain.Timestamp = "0000000002"
+	labeled := reverted
+	labeled.Timestamp = "0000000012"
+	labeled.Description = original.Description + "\n\nPR: #1\nLabels: bug"
+	requests := []repository.Note{
+		write(request.Ref, revision, original),
+		write(request.Ref, revision, originalAgain),
+		write(request.Ref, revision, edited),
+		write(request.Ref, revision, reverted),
+		write(request.Ref, revision, labeled),
+	}
+
+	// A comment is a duplicate of an identical one, or of one that it only
+	// differs from by the reactions to it, but not of the same text repeated
+	// later on.
+	lgtm := comment.Comment{Timestamp: "0000000005", Author: "user", Description: "LGTM"}
+	lgtmHash, err := lgtm.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reacted := lgtm
+	reacted.Description = lgtm.Description + "\n\nReactions: +1/-0"
+	reply := comment.Comment{Timestamp: "0000000006", Author: "other", Description: "Thanks", Parent: lgtmHash}
+	repeated := lgtm
+	repeated.Timestamp = "0000000007"
+	comments := []repository.Note{
+		write(comment.Ref, revision, lgtm),
+		write(comment.Ref, revision, lgtm),
+		write(comment.Ref, revision, reacted),
+		write(comment.Ref, revision, reply),
+		write(comment.Ref, revision, repeated),
+	}
+	if err := repo.AppendNote(comment.Ref, revision, repository.Note("not a comment")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A report is a duplicate of the previous one by the same agent, but a
+	// status that flips back is not.
+	passed := ci.Report{Timestamp: "0000000008", Agent: "build", URL: "https://ci.example.com/1", Status: ci.StatusSuccess}
+	rerun := passed
+	rerun.Timestamp = "0000000009"
+	failed := passed
+	failed.Timestamp = "0000000010"
+	failed.Status = ci.StatusFailure
+	fixed := passed
+	fixed.Timestamp = "0000000011"
+	reports := []repository.Note{
+		write(ci.Ref, commit, passed),
+		write(ci.Ref, commit, rerun),
+		write(ci.Ref, commit, failed),
+		write(ci.Ref, commit, fixed),
+	}
+
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+	removed, err := RepairNotes(repo, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Errorf("Expected 4 duplicate notes to be removed, got %d", removed)
+	}
+	if notes := repo.notes[request.Ref][revision]; !reflect.DeepEqual(notes, []repository.Note{requests[0], requests[2], requests[3], requests[4]}) {
+		t.Errorf("Unexpected requests after the repair: %q", notes)
+	}
+	if notes := repo.notes[comment.Ref][revision]; !reflect.DeepEqual(notes, []repository.Note{comments[0], comments[3], comments[4], repository.Note("not a comment")}) {
+		t.Errorf("Unexpected comments after the repair: %q", notes)
+	}
+	if notes := repo.notes[ci.Ref][commit]; !reflect.DeepEqual(notes, []repository.Note{reports[0], reports[2], reports[3]}) {
+		t.Errorf("Unexpected reports after the repair: %q", notes)
+	}
+
+	// Repairing the notes again finds nothing more to remove.
+	appends := repo.appends
+	if removed, err := RepairNotes(repo, remove); err != nil || removed != 0 || repo.appends != appends {
+		t.Errorf("Expected the repaired notes to be left alone, got %d removed, %v", removed, err)
+	}
+}
+
+// notesCounter is a metrics.Recorder that counts the notes written.
+type notesCounter struct {
+	written int
+}
+
+func (*notesCounter) SyncStarted()                   {}
+func (*notesCounter) SyncError()                     {}
+func (*notesCounter) APICall()                       {}
+func (*notesCounter) RateLimitSleep(d time.Duration) {}
+func (c *notesCounter) NotesWritten(count int)       { c.written += count }
+
+func TestRepairNotesCountsRewrittenNotes(t *testing.T) {
+	counter := &notesCounter{}
+	metrics.SetRecorder(counter)
+	defer metrics.SetRecorder(nil)
+
+	repo := newNotesRepo()
+	revision := repository.TestCommitG
+	lgtm := comment.Comment{Timestamp: "0000000001", Author: "user", Description: "LGTM"}
+	thanks := comment.Comment{Timestamp: "0000000002", Author: "other", Description: "Thanks"}
+	for _, c := range []comment.Comment{lgtm, lgtm, thanks} {
+		note, err := c.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.AppendNote(comment.Ref, revision, note); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+	if removed, err := RepairNotes(repo, remove); err != nil || removed != 1 {
+		t.Fatalf("Expected a single duplicate to be removed, got %d removed, %v", removed, err)
+	}
+	if counter.written != 2 {
+		t.Errorf("Expected the 2 rewritten notes to be counted, got %d", counter.written)
+	}
+}
+
+// refFailingNotesRepo is a notesRepo that fails to append notes under the given
+// ref.
+type refFailingNotesRepo struct {
+	*notesRepo
+	failRef string
+}
+
+func (r *refFailingNotesRepo) AppendNote(notesRef, revision string, note repository.Note) error {
+	if notesRef == r.failRef {
+		return errors.New("unable to lock the notes ref")
+	}
+	return r.notesRepo.AppendNote(notesRef, revision, note)
+}
+
+func TestRepairNotesKeepsNotesWhenAppendFails(t *testing.T) {
+	repo := &refFailingNotesRepo{notesRepo: newNotesRepo()}
+	revision := repository.TestCommitG
+	lgtm := comment.Comment{Timestamp: "0000000001", Author: "user", Description: "LGTM"}
+	thanks := comment.Comment{Timestamp: "0000000002", Author: "other", Description: "Thanks"}
+	var notes []repository.Note
+	for _, c := range []comment.Comment{lgtm, lgtm, thanks} {
+		note, err := c.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.AppendNote(comment.Ref, revision, note); err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, note)
+	}
+	remove := func(notesRef, revision string) error {
+		delete(repo.notes[notesRef], revision)
+		return nil
+	}
+
+	// If the backup can't be written, then the notes are left alone.
+	repo.failRef = repairBackupRef(comment.Ref)
+	if _, err := RepairNotes(repo, remove); err == nil {
+		t.Fatal("Expected the failure to back up the notes to be returned")
+	}
+	if written := repo.notes[comment.Ref][revision]; !reflect.DeepEqual(written, notes) {
+		t.Errorf("Expected the notes to be left alone, got %q", written)
+	}
+
+	// If the notes can't be rewritten after being removed, then they are
+	// kept in the backup, and restored by the next repair.
+	repo.failRef = comment.Ref
+	if _, err := RepairNotes(repo, remove); err == nil {
+		t.Fatal("Expected the failure to rewrite the notes to be returned")
+	}
+	if len(repo.notes[repairBackupRef(comment.Ref)][revision]) == 0 {
+		t.Fatal("Expected the repaired notes to be kept in the backup")
+	}
+	repo.failRef = ""
+	if removed, err := RepairNotes(repo, remove); err != nil || removed != 0 {
+		t.Fatalf("Expected the notes to be restored with nothing more to remove, got %d removed, %v", removed, err)
+	}
+	if written := repo.notes[comment.Ref][revision]; !reflect.DeepEqual(written, []repository.Note{notes[0], notes[2]}) {
+		t.Errorf("Unexpected comments after the restore: %q", written)
+	}
+	if backup := repo.notes[repairBackupRef(comment.Ref)][revision]; len(backup) != 0 {
+		t.Errorf("Expected the backup to be removed, got %q", backup)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+)
+
+// Drift describes how the notes in a repository differ from what mirroring its
+// GitHub repository would write to it.
+type Drift struct {
+	// Missing holds the items on GitHub that have not been mirrored, or whose
+	// mirrored versions are out of date (e.g. a pull request whose
+	// description was edited).
+	Missing []ItemEvent `json:"missing"`
+	// Extra holds the mirrored items that are not on GitHub (any more), such
+	// as comments deleted since they were mirrored.
+	Extra []ItemEvent `json:"extra"`
+}
+
+// Empty reports whether the notes are in sync with GitHub.
+func (d *Drift) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// DiffAgainstRemote reads everything that would be mirrored from the given
+// GitHub repository, as GetAllStatuses and GetAllPullRequests do, and compares
+// it with the notes in the local repository, without writing anything. The
+// options should be the ones that the notes were mirrored with.
+//
+// Errors processing individual items are passed through the supplied error
+// channel, as for GetAllStatuses and GetAllPullRequests, and those items are
+// left out of the comparison.
+func DiffAgainstRemote(ctx context.Context, local repository.Repo, remoteUser, remoteRepo string, gitService GitService, repoService RepositoriesService, prService PullRequestsService, issueService IssuesService, refFilter RefFilter, errOutput chan<- error, opts Options) (*Drift, error) {
+	statuses, err := GetAllStatuses(ctx, remoteUser, remoteRepo, gitService, repoService, prService, refFilter, errOutput, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := GetAllPullRequests(ctx, local, remoteUser, remoteRepo, AllPullRequests, time.Time{}, 0, prService, issueService, errOutput, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return DiffNotes(statuses, reviews, local), nil
+}
+
+// DiffNotes compares the given reports and reviews, as read from GitHub, with
+// the notes in the given repository.
+//
+// Items are matched the same way as when they are written, i.e. by ReportsOverlap,
+// RequestsOverlap, and CommentsOverlap, so anything reported as missing is exactly
+// what WriteNewReports and WriteNewReviews would write.
+//
+// Only the reviews of pull requests, i.e. with "refs/pull/" review refs, can be
+// extra, so reviews that were made with git-appraise itself are left alone.
+func DiffNotes(reportsMap map[string][]ci.Report, reviews []review.Review, repo repository.Repo) *Drift {
+	drift := &Drift{}
+	var commits []string
+	for commit := range reportsMap {
+		commits = append(commits, commit)
+	}
+	sort.Strings(commits)
+	for _, commit := range commits {
+		reports := reportsMap[commit]
+		existingReports := ci.ParseAllValid(repo.GetNotes(ci.Ref, commit))
+		for _, report := range reports {
+			if !containsOverlappingReport(existingReports, report) {
+				drift.Missing = append(drift.Missing, reportEvent(commit, report))
+			}
+		}
+		for _, existing := range existingReports {
+			if !containsOverlappingReport(reports, existing) {
+				drift.Extra = append(drift.Extra, reportEvent(commit, existing))
+			}
+		}
+	}
+
+	existingReviews := review.ListAll(repo)
+	remoteReviewRefs := make(map[string]bool)
+	for _, r := range reviews {
+		remoteReviewRefs[r.Request.ReviewRef] = true
+		existing := findMatchingExistingReview(r, existingReviews)
+		if existing == nil {
+			drift.Missing = append(drift.Missing, reviewEvent(r.Revision, r.Summary))
+			for _, thread := range r.Comments {
+				drift.Missing = append(drift.Missing, commentEvent(r.Revision, r.Request.ReviewRef, thread.Comment))
+			}
+			continue
+		}
+		if r.Revision != existing.Revision {
+			// As in WriteNewReviews, a force-pushed pull request is
+			// recorded as an alias of the original review.
+			r.Request.Alias = r.Revision
+		}
+		if !sameRequest(existing.Request, r.Request) {
+			drift.Missing = append(drift.Missing, reviewEvent(existing.Revision, r.Summary))
+		}
+		diffComments(drift, existing.Revision, r, repo)
+	}
+	for _, existing := range existingReviews {
+		if strings.HasPrefix(existing.Request.ReviewRef, "refs/pull/") && !remoteReviewRefs[existing.Request.ReviewRef] {
+			drift.Extra = append(drift.Extra, reviewEvent(existing.Revision, &existing))
+		}
+	}
+	return drift
+}
+
+// diffComments adds the differences between the comments of the given review,
+// as read from GitHub, and the ones on the given revision to drift.
+func diffComments(drift *Drift, revision string, r review.Review, repo repository.Repo) {
+	existingComments := comment.ParseAllValid(repo.GetNotes(comment.Ref, revision))
+	for _, thread := range r.Comments {
+		missing := true
+		for _, existing := range existingComments {
+			if CommentsOverlap(existing, thread.Comment) {
+				missing = false
+			}
+		}
+		if missing {
+			drift.Missing = append(drift.Missing, commentEvent(revision, r.Request.ReviewRef, thread.Comment))
+		}
+	}
+	var hashes []string
+	matched := make(map[string]bool)
+	for hash, existing := range existingComments {
+		hashes = append(hashes, hash)
+		for _, thread := range r.Comments {
+			// The original version of an edited comment is mirrored too.
+			if CommentsOverlap(existing, thread.Comment) ||
+				(thread.Original != nil && CommentsOverlap(existing, *thread.Original)) {
+				matched[hash] = true
+			}
+		}
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		existing := existingComments[hash]
+		// Earlier edits of a comment that is still on GitHub are kept as
+		// its history, rather than being extra.
+		if !matched[hash] && !(existing.Original != "" && matched[existing.Original]) {
+			drift.Extra = append(drift.Extra, commentEvent(revision, r.Request.ReviewRef, existing))
+		}
+	}
+}
+
+// containsOverlappingReport reports whether any of the given reports overlaps
+// with the given one.
+func containsOverlappingReport(reports []ci.Report, report ci.Report) bool {
+	for _, r := range reports {
+		if ReportsOverlap(r, report) {
+			return true
+		}
+	}
+	return false
+}
+
+func reportEvent(commit string, report ci.Report) ItemEvent {
+	return ItemEvent{Type: "report", Commit: commit, Author: report.Agent, Timestamp: report.Timestamp}
+}
+
+func reviewEvent(revision string, summary *review.Summary) ItemEvent {
+	return ItemEvent{Type: "review", Commit: revision, Author: summary.Request.Requester, Timestamp: summary.Request.Timestamp, ReviewRef: summary.Request.ReviewRef}
+}
+
+func commentEvent(revision, reviewRef string, c comment.Comment) ItemEvent {
+	return ItemEvent{Type: "comment", Commit: revision, Author: c.Author, Timestamp: c.Timestamp, ReviewRef: reviewRef}
+}
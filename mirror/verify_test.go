@@ -0,0 +1,102 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/ci"
+	github "github.com/google/go-github/github"
+)
+
+func TestDiffNotes(t *testing.T) {
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	pr := buildTestPullRequest(repo, 4)
+	body := "LGTM"
+	createdAt := time.Now().Add(-time.Hour)
+	issueComments := []*github.IssueComment{{
+		Body:      &body,
+		User:      &github.User{Login: &repoOwner},
+		CreatedAt: &createdAt,
+	}}
+	r, err := ConvertPullRequestToReview(pr, issueComments, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := map[string][]ci.Report{
+		repository.TestCommitG: {{Timestamp: "1", Agent: "ci", Status: ci.StatusSuccess, URL: "https://ci.example.com/1"}},
+	}
+
+	// Nothing has been mirrored yet.
+	drift := DiffNotes(reports, []review.Review{*r}, repo)
+	if len(drift.Missing) != 3 || len(drift.Extra) != 0 {
+		t.Fatalf("Expected the report, review, and comment to be missing; got %+v", drift)
+	}
+
+	if err := WriteNewReports(reports, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if drift := DiffNotes(reports, []review.Review{*r}, repo); !drift.Empty() {
+		t.Fatalf("Expected no drift once everything was mirrored; got %+v", drift)
+	}
+
+	// A label added on GitHub is missing from the mirrored request.
+	pr.Labels = []*github.Label{{Name: github.String("bug")}}
+	labeled, err := ConvertPullRequestToReview(pr, issueComments, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift = DiffNotes(reports, []review.Review{*labeled}, repo)
+	if len(drift.Missing) != 1 || drift.Missing[0].Type != "review" || len(drift.Extra) != 0 {
+		t.Errorf("Expected the labeled review to be missing; got %+v", drift)
+	}
+	pr.Labels = nil
+
+	// A new comment on GitHub is missing, and a deleted one is extra.
+	newBody := "Thanks!"
+	issueComments[0].Body = &newBody
+	r, err = ConvertPullRequestToReview(pr, issueComments, nil, nil, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift = DiffNotes(reports, []review.Review{*r}, repo)
+	if len(drift.Missing) != 1 || drift.Missing[0].Type != "comment" ||
+		len(drift.Extra) != 1 || drift.Extra[0].Type != "comment" {
+		t.Errorf("Expected a missing and an extra comment; got %+v", drift)
+	}
+
+	// A pull request that is no longer on GitHub is extra, along with the
+	// statuses of its commit.
+	drift = DiffNotes(map[string][]ci.Report{repository.TestCommitG: nil}, nil, repo)
+	if len(drift.Missing) != 0 || len(drift.Extra) != 2 {
+		t.Errorf("Expected an extra review and report; got %+v", drift)
+	}
+	for _, item := range drift.Extra {
+		if item.Type == "review" && item.ReviewRef != "refs/pull/4/head" {
+			t.Errorf("Unexpected extra review %+v", item)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	github "github.com/google/go-github/github"
+)
+
+// ErrNotPullRequest is returned when a webhook payload is about an issue,
+// rather than a pull request, and so has nothing to be mirrored.
+var ErrNotPullRequest = errors.New("webhook payload is not about a pull request")
+
+// ConvertPullRequestEvent converts the payload of a "pull_request" webhook
+// event into a review, without reading anything from the GitHub API.
+//
+// The payload includes none of the pull request's comments, so the review
+// has none either. The review's commits are found in the given repository,
+// as for ConvertPullRequestToReview.
+func ConvertPullRequestEvent(payload []byte, repo repository.Repo, opts Options) (*review.Review, error) {
+	event, err := UnmarshalPullRequestEvent(payload)
+	if err != nil {
+		return nil, err
+	}
+	if event.PullRequest == nil {
+		return nil, ErrInsufficientInfo
+	}
+	return ConvertPullRequestToReview(event.PullRequest, nil, nil, nil, repo, opts)
+}
+
+// UnmarshalPullRequestEvent parses the payload of a "pull_request" webhook
+// event. If the pull request is a draft, then its mergeable state is set to
+// "draft", so that IsDraft reports it as such.
+func UnmarshalPullRequestEvent(payload []byte) (*github.PullRequestEvent, error) {
+	var event github.PullRequestEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	var draft struct {
+		PullRequest struct {
+			Draft bool `json:"draft"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(payload, &draft); err != nil {
+		return nil, err
+	}
+	if event.PullRequest != nil && draft.PullRequest.Draft {
+		event.PullRequest.MergeableState = github.String(draftMergeableState)
+	}
+	return &event, nil
+}
+
+// ConvertIssueCommentEvent converts the payload of an "issue_comment" webhook
+// event into a review comment. It returns ErrNotPullRequest if the comment is
+// on an issue rather than a pull request.
+func ConvertIssueCommentEvent(payload []byte, opts Options) (*comment.Comment, error) {
+	var event github.IssueCommentEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.Issue == nil || event.Comment == nil {
+		return nil, ErrInsufficientInfo
+	}
+	if !event.Issue.IsPullRequest() {
+		return nil, ErrNotPullRequest
+	}
+	return ConvertIssueComment(event.Comment, opts)
+}
+
+// ConvertPullRequestReviewCommentEvent converts the payload of a
+// "pull_request_review_comment" webhook event into a review comment.
+func ConvertPullRequestReviewCommentEvent(payload []byte, opts Options) (*comment.Comment, error) {
+	var event github.PullRequestReviewCommentEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.Comment == nil {
+		return nil, ErrInsufficientInfo
+	}
+	return ConvertDiffComment(event.Comment, opts)
+}
+
+// ConvertCommitCommentEvent converts the payload of a "commit_comment" webhook
+// event into a review comment on the commented commit. Unlike the API, the
+// payload includes the line that the comment is on, if any, so the comment is
+// placed on it.
+func ConvertCommitCommentEvent(payload []byte, opts Options) (*comment.Comment, error) {
+	var event github.CommitCommentEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.Comment == nil {
+		return nil, ErrInsufficientInfo
+	}
+	c, err := ConvertCommitComment(event.Comment, opts)
+	if err != nil {
+		return nil, err
+	}
+	var line struct {
+		Comment struct {
+			Line *uint32 `json:"line"`
+		} `json:"comment"`
+	}
+	if err := json.Unmarshal(payload, &line); err != nil {
+		return nil, err
+	}
+	if c.Location.Path != "" && line.Comment.Line != nil && *line.Comment.Line > 0 {
+		c.Location.Range = &comment.Range{
+			StartLine: *line.Comment.Line,
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/request"
+)
+
+// The commits of the pull request in the webhook payload fixtures.
+const (
+	fixtureBaseSHA = "f95f852bd8fca8fcc58a9a2d6c842781e32a215e"
+	fixtureHeadSHA = "ec26c3e57ca3a959ca5aad62de7213c562f8c821"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestConvertPullRequestEvent(t *testing.T) {
+	// The fixture's commits are replaced with ones that exist in the mock repo.
+	payload := readFixture(t, "pull_request_event.json")
+	payload = bytes.Replace(payload, []byte(fixtureBaseSHA), []byte(repository.TestCommitE), -1)
+	payload = bytes.Replace(payload, []byte(fixtureHeadSHA), []byte(repository.TestCommitG), -1)
+
+	r, err := ConvertPullRequestEvent(payload, repository.NewMockRepoForTest(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Request.ReviewRef != "refs/pull/2/head" || r.Request.TargetRef != "refs/heads/master" {
+		t.Errorf("Unexpected refs in review request: %+v", r.Request)
+	}
+	if r.Request.Requester != "Codertocat" || r.Request.Timestamp != "1557933633" {
+		t.Errorf("Unexpected requester or timestamp in review request: %+v", r.Request)
+	}
+	if !strings.HasPrefix(r.Request.Description, "Update the README with new information.\n\nThis is a pretty simple change") {
+		t.Errorf("Unexpected review description: %q", r.Request.Description)
+	}
+	if r.Revision != repository.TestCommitG || len(r.Comments) != 0 {
+		t.Errorf("Unexpected review revision %q or comments %+v", r.Revision, r.Comments)
+	}
+
+	if _, err := ConvertPullRequestEvent([]byte(`{"action": "opened"}`), repository.NewMockRepoForTest(), Options{}); err != ErrInsufficientInfo {
+		t.Errorf("Expected a payload without a pull request to be rejected, got %v", err)
+	}
+}
+
+func TestPullRequestEventLabels(t *testing.T) {
+	payload := readFixture(t, "pull_request_event.json")
+	payload = bytes.Replace(payload, []byte(fixtureBaseSHA), []byte(repository.TestCommitE), -1)
+	payload = bytes.Replace(payload, []byte(fixtureHeadSHA), []byte(repository.TestCommitG), -1)
+	repo := newNotesRepo()
+	logChan := discardLogs()
+	defer close(logChan)
+
+	r, err := ConvertPullRequestEvent(payload, repo, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNewReviews([]review.Review{*r}, repo, logChan, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	labeled := bytes.Replace(payload, []byte(`"action": "opened"`), []byte(`"action": "labeled"`), 1)
+	labeled = bytes.Replace(labeled, []byte(`"labels": []`), []byte(`"labels": [{"name": "needs-review"}, {"name": "bug"}]`), 1)
+	event, err := UnmarshalPullRequestEvent(labeled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := SyncReviewRequest(event.PullRequest, repo, logChan, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requests := request.ParseAllValid(repo.GetNotes(request.Ref, repository.TestCommitG))
+	if len(requests) != 2 {
+		t.Fatalf("Expected the labels to be recorded in a single updated request, got %+v", requests)
+	}
+	if !strings.HasSuffix(requests[1].Description, "\nLabels: bug, needs-review") {
+		t.Errorf("Expected the updated request to record the labels, got %q", requests[1].Description)
+	}
+}
+
+func TestUnmarshalPullRequestEventDraft(t *testing.T) {
+	payload := readFixture(t, "pull_request_event.json")
+	event, err := UnmarshalPullRequestEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsDraft(event.PullRequest) {
+		t.Error("Expected the fixture's pull request not to be a draft")
+	}
+
+	payload = bytes.Replace(payload, []byte(`"draft": false`), []byte(`"draft": true`), 1)
+	event, err = UnmarshalPullRequestEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDraft(event.PullRequest) {
+		t.Errorf("Expected a draft pull request, got mergeable state %q", event.PullRequest.GetMergeableState())
+	}
+}
+
+func TestConvertIssueCommentEvent(t *testing.T) {
+	payload := readFixture(t, "issue_comment_event.json")
+	c, err := ConvertIssueCommentEvent(payload, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author != "Codertocat" || c.Timestamp != "1557933621" || c.Description != "You are totally right! I'll get this fixed right away." {
+		t.Errorf("Unexpected comment: %+v", c)
+	}
+
+	// The same comment on a plain issue is not mirrored.
+	issuePayload := bytes.Replace(payload, []byte(`"pull_request"`), []byte(`"not_a_pull_request"`), 1)
+	if _, err := ConvertIssueCommentEvent(issuePayload, Options{}); err != ErrNotPullRequest {
+		t.Errorf("Expected a comment on an issue to be rejected, got %v", err)
+	}
+}
+
+func TestConvertPullRequestReviewCommentEvent(t *testing.T) {
+	c, err := ConvertPullRequestReviewCommentEvent(readFixture(t, "pull_request_review_comment_event.json"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author != "Codertocat" || c.Timestamp != "1557933638" || c.Description != "Maybe you should use more emojji on this line." {
+		t.Errorf("Unexpected comment: %+v", c)
+	}
+	if c.Location == nil || c.Location.Commit != fixtureHeadSHA || c.Location.Path != "README.md" {
+		t.Errorf("Unexpected comment location: %+v", c.Location)
+	}
+}
+
+func TestConvertCommitCommentEvent(t *testing.T) {
+	payload := readFixture(t, "commit_comment_event.json")
+	c, err := ConvertCommitCommentEvent(payload, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Author != "Codertocat" || c.Timestamp != "1557933639" || c.Description != "This is a really good change! :+1:" {
+		t.Errorf("Unexpected comment: %+v", c)
+	}
+	if c.Location == nil || c.Location.Commit != "6113728f27ae82c7b1a177c8d03f9e96e0adf246" || c.Location.Path != "README.md" ||
+		c.Location.Range == nil || c.Location.Range.StartLine != 1 {
+		t.Errorf("Unexpected comment location: %+v", c.Location)
+	}
+
+	// A comment on the commit as a whole has no path, and so no line.
+	payload = bytes.Replace(payload, []byte(`"path": "README.md"`), []byte(`"path": null`), 1)
+	payload = bytes.Replace(payload, []byte(`"line": 1`), []byte(`"line": null`), 1)
+	c, err = ConvertCommitCommentEvent(payload, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Location == nil || c.Location.Path != "" || c.Location.Range != nil {
+		t.Errorf("Expected a comment on the whole commit: %+v", c.Location)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package oplog formats the log entries of the operations on a mirrored repo,
+// e.g. validating it or importing its pull requests, so that both App Engine
+// services log them the same way.
+//
+// The entries are either text, for people to read, or JSON objects that Cloud
+// Logging reads as structured payloads, whose repo and operation fields can be
+// filtered on and used in log-based metrics.
+package oplog
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StructuredEnv names the environment variable that, if set to "true", makes
+// the entries be logged as JSON objects.
+const StructuredEnv = "MIRROR_STRUCTURED_LOGS"
+
+// Severity is the severity of an entry, as named by Cloud Logging.
+type Severity string
+
+const (
+	Info  Severity = "INFO"
+	Error Severity = "ERROR"
+)
+
+// Entry is a log entry for an operation on a repo.
+type Entry struct {
+	Severity  Severity `json:"severity"`
+	Message   string   `json:"message"`
+	Repo      string   `json:"repo"`
+	Operation string   `json:"operation"`
+	Phase     string   `json:"phase,omitempty"`
+	// DurationSeconds is the time since the operation started; it is only
+	// set once the operation is done.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Format returns the line to log for the given entry: either its JSON
+// encoding, or the error or message prefixed by the repo.
+func Format(e Entry, structured bool) string {
+	if structured {
+		if bytes, err := json.Marshal(e); err == nil {
+			return string(bytes)
+		}
+	}
+	if e.Error != "" {
+		return fmt.Sprintf("%s: %s", e.Repo, e.Error)
+	}
+	return fmt.Sprintf("%s: %s", e.Repo, e.Message)
+}
+
+// Logger logs the entries of a single operation on a repo.
+type Logger struct {
+	repo       string
+	operation  string
+	start      time.Time
+	structured bool
+	output     func(severity Severity, line string)
+}
+
+// New returns the logger for the given operation on a repo, which passes each
+// formatted line to output, e.g. log.Infof or log.Errorf according to its
+// severity.
+func New(user, repo, operation string, structured bool, output func(severity Severity, line string)) *Logger {
+	return &Logger{
+		repo:       user + "/" + repo,
+		operation:  operation,
+		start:      time.Now(),
+		structured: structured,
+		output:     output,
+	}
+}
+
+// Infof logs a message about the given phase of the operation.
+func (l *Logger) Infof(phase, format string, params ...interface{}) {
+	l.log(Entry{Severity: Info, Message: fmt.Sprintf(format, params...), Phase: phase})
+}
+
+// Errorf logs an error that the operation failed with.
+func (l *Logger) Errorf(format string, params ...interface{}) {
+	l.log(Entry{
+		Severity: Error,
+		Message:  l.operation + " failed",
+		Phase:    "failed",
+		Error:    fmt.Sprintf(format, params...),
+	})
+}
+
+// Done logs that the operation has finished, along with how long it took.
+func (l *Logger) Done() {
+	duration := time.Since(l.start)
+	l.log(Entry{
+		Severity:        Info,
+		Message:         fmt.Sprintf("%s done in %v", l.operation, duration.Round(time.Millisecond)),
+		Phase:           "done",
+		DurationSeconds: duration.Seconds(),
+	})
+}
+
+func (l *Logger) log(e Entry) {
+	e.Repo = l.repo
+	e.Operation = l.operation
+	l.output(e.Severity, Format(e, l.structured))
+}
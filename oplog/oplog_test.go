@@ -0,0 +1,84 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oplog
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type line struct {
+	severity Severity
+	text     string
+}
+
+func record(lines *[]line) func(Severity, string) {
+	return func(severity Severity, text string) {
+		*lines = append(*lines, line{severity, text})
+	}
+}
+
+func TestTextEntries(t *testing.T) {
+	var lines []line
+	l := New("user", "repo", "validate", false, record(&lines))
+	l.Infof("start", "Validating repo")
+	l.Errorf("Invalid token: %s", "401 Bad credentials")
+	l.Done()
+
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %q", lines)
+	}
+	if lines[0] != (line{Info, "user/repo: Validating repo"}) {
+		t.Errorf("Unexpected info line %q", lines[0])
+	}
+	if lines[1] != (line{Error, "user/repo: Invalid token: 401 Bad credentials"}) {
+		t.Errorf("Unexpected error line %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2].text, "user/repo: validate done in ") {
+		t.Errorf("Unexpected done line %q", lines[2])
+	}
+}
+
+func TestStructuredEntries(t *testing.T) {
+	var lines []line
+	l := New("user", "repo", "initialize", true, record(&lines))
+	l.Infof("clone", "Cloning")
+	l.Errorf("Can't clone repo: %s", "timeout")
+	l.Done()
+
+	var entries []Entry
+	for _, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line.text), &e); err != nil {
+			t.Fatalf("Expected a line of JSON, got %q: %v", line.text, err)
+		}
+		if e.Severity != line.severity || e.Repo != "user/repo" || e.Operation != "initialize" {
+			t.Errorf("Unexpected labels for %q", line.text)
+		}
+		entries = append(entries, e)
+	}
+	if entries[0].Phase != "clone" || entries[0].Message != "Cloning" || entries[0].Error != "" {
+		t.Errorf("Unexpected info entry %+v", entries[0])
+	}
+	if entries[1].Phase != "failed" || entries[1].Error != "Can't clone repo: timeout" {
+		t.Errorf("Unexpected error entry %+v", entries[1])
+	}
+	if entries[2].Phase != "done" || entries[2].DurationSeconds <= 0 {
+		t.Errorf("Unexpected done entry %+v", entries[2])
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package store provides access to the persistent metadata of the repositories
+// tracked by the GitHub mirror App Engine services, outside of those services.
+//
+// It uses the Cloud Datastore client library, and the same entities as the
+// services themselves.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Repo is the persistent metadata of a single tracked repository.
+type Repo struct {
+	User       string
+	Repo       string
+	Token      string // TODO(jhgilles): add another layer of encryption here?
+	HookID     int64
+	HookSecret string
+	Status     string
+	ErrorCause string
+
+	// SizeKB is the size of the repository on GitHub, in kilobytes, as of
+	// when it was last validated, or 0 if it isn't known.
+	SizeKB int
+
+	// LastSyncedAt is when data was last successfully mirrored, and the
+	// counts are the number of items read by the last full sync.
+	LastSyncedAt    time.Time
+	LastPRCount     int
+	LastStatusCount int
+
+	// LastCompletedPR is the number of the last pull request whose review
+	// has been pushed by an initial import that is still in progress, so that
+	// an interrupted import can resume after it. It is 0 once the import is
+	// done.
+	LastCompletedPR int
+
+	// InitializeHeartbeat is when the hooks service last started, or recorded
+	// the progress of, an import of the repo; see InitializationStale.
+	InitializeHeartbeat time.Time
+
+	// RateRemaining and RateReset record the GitHub API quota left for the
+	// repo's token at the end of the last full sync.
+	RateRemaining int
+	RateReset     time.Time
+
+	// HookHealthy records whether the web hook still existed on GitHub when
+	// it was last checked, at HookCheckedAt.
+	HookHealthy   bool
+	HookCheckedAt time.Time
+
+	// HookPingRequestedAt is when a "ping" delivery of the web hook was last
+	// requested, and HookVerified is when the hooks service last received
+	// one; see HookUnverified.
+	HookPingRequestedAt time.Time
+	HookVerified        time.Time
+
+	// PreviousHookSecret is the secret of the web hook before it was last
+	// rotated, at HookSecretRotatedAt; see RotateHookSecret.
+	PreviousHookSecret  string
+	HookSecretRotatedAt time.Time
+
+	// ErrorTimes and ErrorCauses hold the history of the repo's most recent
+	// errors, oldest first. They are kept in step by RecordError, and read
+	// through ErrorHistory.
+	ErrorTimes  []time.Time `datastore:",noindex"`
+	ErrorCauses []string    `datastore:",noindex"`
+
+	// PullRequestState is the state of the pull requests that are mirrored
+	// when the repo is (re)initialized: "open", "closed", or "all" (or "",
+	// the default, which is the same as "all").
+	PullRequestState string
+
+	// ImportWindowDays, if positive, limits the pull requests that are
+	// mirrored when the repo is (re)initialized to those updated within that
+	// many days; later ones are still mirrored as their web hooks arrive.
+	ImportWindowDays int
+
+	// HookEvents are the GitHub events that the repo's web hook delivers,
+	// besides "ping"; see SubscribedEvents.
+	HookEvents []string `datastore:",noindex"`
+}
+
+// DefaultHookEvents are the events that the web hook of a repo delivers unless
+// it is configured otherwise, i.e. all of the events that are mirrored.
+var DefaultHookEvents = []string{
+	"status",
+	"pull_request",
+	"pull_request_review_comment",
+	"issue_comment",
+	"commit_comment",
+}
+
+// CheckHookEvents makes sure that the given events can be configured for the
+// web hook of a repo, i.e. that there is at least one of them, and that each is
+// one of DefaultHookEvents.
+func CheckHookEvents(events []string) error {
+	if len(events) == 0 {
+		return fmt.Errorf("at least one web hook event is required")
+	}
+	for _, event := range events {
+		known := false
+		for _, defaultEvent := range DefaultHookEvents {
+			known = known || event == defaultEvent
+		}
+		if !known {
+			return fmt.Errorf("unsupported web hook event %q", event)
+		}
+	}
+	return nil
+}
+
+// SubscribedEvents returns the events that the repo's web hook should deliver:
+// "ping", which the hooks service needs to finish setting the repo up, and
+// then either the repo's HookEvents or, if it has none, DefaultHookEvents.
+func (r *Repo) SubscribedEvents() []string {
+	events := r.HookEvents
+	if len(events) == 0 {
+		events = DefaultHookEvents
+	}
+	return append([]string{"ping"}, events...)
+}
+
+// HookSecretGracePeriod is how long the previous secret of a web hook is still
+// accepted for after the secret is rotated.
+const HookSecretGracePeriod = 10 * time.Minute
+
+// RotateHookSecret replaces the secret of the repo's web hook with the given
+// one.
+//
+// The new secret has to be stored before it is set on GitHub, so that no
+// deliveries signed with it are rejected. The current secret is kept for
+// HookSecretGracePeriod, so that deliveries which were signed with it before the
+// change took effect on GitHub aren't rejected either.
+func (r *Repo) RotateHookSecret(secret string, now time.Time) {
+	r.PreviousHookSecret = r.HookSecret
+	r.HookSecret = secret
+	r.HookSecretRotatedAt = now
+}
+
+// RevertHookSecret undoes RotateHookSecret, for when the new secret couldn't be
+// set on GitHub.
+func (r *Repo) RevertHookSecret() {
+	r.HookSecret = r.PreviousHookSecret
+	r.PreviousHookSecret = ""
+	r.HookSecretRotatedAt = time.Time{}
+}
+
+// HookSecrets returns the secrets that a delivery of the repo's web hook may be
+// signed with at the given time, the current one first.
+func (r *Repo) HookSecrets(now time.Time) []string {
+	secrets := []string{r.HookSecret}
+	if r.PreviousHookSecret != "" && now.Sub(r.HookSecretRotatedAt) < HookSecretGracePeriod {
+		secrets = append(secrets, r.PreviousHookSecret)
+	}
+	return secrets
+}
+
+// HookVerifyTimeout is how long a requested "ping" of a repo's web hook may take
+// to be delivered before the hook is reported as unverified.
+const HookVerifyTimeout = 10 * time.Minute
+
+// HookUnverified reports whether a "ping" of the repo's web hook was requested
+// at least HookVerifyTimeout before the given time, and none has been received
+// since, which usually means that GitHub can't reach the hooks service.
+func (r *Repo) HookUnverified(now time.Time) bool {
+	if r.HookPingRequestedAt.IsZero() || r.HookVerified.After(r.HookPingRequestedAt) {
+		return false
+	}
+	return now.Sub(r.HookPingRequestedAt) >= HookVerifyTimeout
+}
+
+// InitializationStaleTimeout is how long a repo may be initializing without any
+// sign of life from the hooks service before its initialization is considered
+// abandoned. It is longer than a sync may take between two checkpoints.
+const InitializationStaleTimeout = 2 * time.Hour
+
+// InitializationStale reports whether neither an import of the repo has
+// started or recorded its progress, nor a "ping" of the repo's web hook (which
+// starts one) has been requested, in the InitializationStaleTimeout before the
+// given time. An initializing repo for which that is the case can safely be
+// restarted, without running a second import beside a live one.
+func (r *Repo) InitializationStale(now time.Time) bool {
+	latest := r.InitializeHeartbeat
+	if r.HookPingRequestedAt.After(latest) {
+		latest = r.HookPingRequestedAt
+	}
+	return now.Sub(latest) >= InitializationStaleTimeout
+}
+
+// UpdateToken replaces the repo's token, and moves it back to StatusValidating
+// so that the new token is checked before the repo's web hook is updated.
+//
+// The token can only be updated while no operation is running on the repo,
+// i.e. when it is either ready or in error; otherwise, nothing is changed and
+// false is returned. Any error cause is cleared, but kept in the history.
+func (r *Repo) UpdateToken(token string) bool {
+	if r.Status != StatusReady && r.Status != StatusError {
+		return false
+	}
+	r.Token = token
+	r.Status = StatusValidating
+	r.ErrorCause = ""
+	return true
+}
+
+// OrgDefaults are the defaults for the new repos of a GitHub organization (or
+// user), so that the same token doesn't have to be entered for each of them.
+type OrgDefaults struct {
+	Org string
+	// Token is stored the same way as the tokens of repos.
+	Token string
+}
+
+// ErrNoToken is returned by ResolveToken when there is no token to use.
+var ErrNoToken = errors.New("no token was given, and the organization has no default token")
+
+// ResolveToken returns the token for a new repo: the given token if it isn't
+// empty, or else the default token of the repo's organization, if defaults is
+// not nil and has one.
+func ResolveToken(token string, defaults *OrgDefaults) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	if defaults == nil || defaults.Token == "" {
+		return "", ErrNoToken
+	}
+	return defaults.Token, nil
+}
+
+// MaxErrorHistory is the number of errors kept in the history of each repo,
+// which bounds the size of its entity.
+const MaxErrorHistory = 20
+
+// RepoError is an error that was hit while mirroring a repo.
+type RepoError struct {
+	Time  time.Time
+	Cause string
+}
+
+// RecordError puts the repo into the error status with the given cause, and
+// adds the error to its history, dropping the oldest errors from the history
+// once there are more than MaxErrorHistory of them.
+func (r *Repo) RecordError(t time.Time, cause string) {
+	r.Status = StatusError
+	r.ErrorCause = cause
+
+	count := r.errorCount()
+	r.ErrorTimes = append(r.ErrorTimes[:count], t)
+	r.ErrorCauses = append(r.ErrorCauses[:count], cause)
+	if extra := len(r.ErrorTimes) - MaxErrorHistory; extra > 0 {
+		r.ErrorTimes = r.ErrorTimes[extra:]
+		r.ErrorCauses = r.ErrorCauses[extra:]
+	}
+}
+
+// ErrorHistory returns the repo's most recent errors, newest first.
+func (r *Repo) ErrorHistory() []RepoError {
+	count := r.errorCount()
+	history := make([]RepoError, 0, count)
+	for i := count - 1; i >= 0; i-- {
+		history = append(history, RepoError{Time: r.ErrorTimes[i], Cause: r.ErrorCauses[i]})
+	}
+	return history
+}
+
+// errorCount returns the number of errors in the repo's history.
+func (r *Repo) errorCount() int {
+	if len(r.ErrorCauses) < len(r.ErrorTimes) {
+		return len(r.ErrorCauses)
+	}
+	return len(r.ErrorTimes)
+}
+
+const (
+	// RepoKind is the datastore kind of the Repo entities.
+	RepoKind = "repo"
+	// OrgDefaultsKind is the datastore kind of the defaults of organizations,
+	// which are children of the root entity of all the repos.
+	OrgDefaultsKind = "orgDefaults"
+	// EmptyKind is the datastore kind of the root entity of all the repos.
+	EmptyKind = "empty"
+
+	// ReposPath is the name of the root entity of all the repos.
+	ReposPath = "repos"
+)
+
+// The statuses of a repository, in the order in which it goes through them.
+const (
+	StatusValidating        = "Validating"         // Verifying repo w/ github
+	StatusHooksInitializing = "Hooks Initializing" // Setting up hooks
+	StatusInitializing      = "Initializing"       // Performing initial pull-all
+	StatusReady             = "Ready"              // Ready and waiting for hooks
+	StatusError             = "Error"              // Hit an unrecoverable error
+	StatusPaused            = "Paused"             // Not mirroring until resumed
+)
+
+// ReposRootKey returns the key of the root entity of all the repos.
+func ReposRootKey() *datastore.Key {
+	return datastore.NameKey(
+		EmptyKind,
+		ReposPath,
+		nil,
+	)
+}
+
+// RepoKey returns the key of the entity for the given repo.
+func RepoKey(user, repo string) *datastore.Key {
+	return datastore.NameKey(
+		RepoKind,
+		fmt.Sprintf("%s/%s", user, repo),
+		ReposRootKey(),
+	)
+}
+
+// OrgDefaultsKey returns the key of the entity for the defaults of the given
+// organization.
+func OrgDefaultsKey(org string) *datastore.Key {
+	return datastore.NameKey(OrgDefaultsKind, org, ReposRootKey())
+}
+
+// GetRepo returns the data for a single repo.
+func GetRepo(ctx context.Context, c *datastore.Client, user, repo string) (result Repo, err error) {
+	err = c.Get(ctx, RepoKey(user, repo), &result)
+	return result, err
+}
+
+// ModifyRepo transactionally applies the function f to the data for a repo.
+func ModifyRepo(ctx context.Context, c *datastore.Client, user, repo string, f func(*Repo)) error {
+	_, err := c.RunInTransaction(ctx, func(txn *datastore.Transaction) error {
+		key := RepoKey(user, repo)
+
+		var item Repo
+		if err := txn.Get(key, &item); err != nil {
+			return err
+		}
+
+		f(&item)
+		if _, err := txn.Put(key, &item); err != nil {
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
+// ListRepos returns the data for all of the tracked repos.
+func ListRepos(ctx context.Context, c *datastore.Client) ([]Repo, error) {
+	q := datastore.NewQuery(RepoKind).Ancestor(ReposRootKey())
+	result := []Repo{}
+	if _, err := c.GetAll(ctx, q, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRepoKey(t *testing.T) {
+	key := RepoKey("user", "repo")
+	if key.Kind != RepoKind || key.Name != "user/repo" {
+		t.Errorf("Unexpected repo key %v", key)
+	}
+	if key.Parent == nil || !key.Parent.Equal(ReposRootKey()) {
+		t.Errorf("Expected the repo key to be under the root key, got parent %v", key.Parent)
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	defaults := &OrgDefaults{Org: "org", Token: "org token"}
+	for _, test := range []struct {
+		token    string
+		defaults *OrgDefaults
+		expected string
+		err      error
+	}{
+		{"repo token", defaults, "repo token", nil},
+		{"repo token", nil, "repo token", nil},
+		{"", defaults, "org token", nil},
+		{"", &OrgDefaults{Org: "org"}, "", ErrNoToken},
+		{"", nil, "", ErrNoToken},
+	} {
+		token, err := ResolveToken(test.token, test.defaults)
+		if token != test.expected || err != test.err {
+			t.Errorf("ResolveToken(%q, %+v) = %q, %v; expected %q, %v", test.token, test.defaults, token, err, test.expected, test.err)
+		}
+	}
+}
+
+func TestRecordErrorCapsHistory(t *testing.T) {
+	var repo Repo
+	start := time.Now()
+	for i := 0; i < MaxErrorHistory+5; i++ {
+		repo.RecordError(start.Add(time.Duration(i)*time.Minute), fmt.Sprintf("error %d", i))
+	}
+	if repo.Status != StatusError || repo.ErrorCause != fmt.Sprintf("error %d", MaxErrorHistory+4) {
+		t.Errorf("Unexpected status %q with cause %q", repo.Status, repo.ErrorCause)
+	}
+
+	history := repo.ErrorHistory()
+	if len(history) != MaxErrorHistory {
+		t.Fatalf("Expected the history to be capped at %d errors, got %d", MaxErrorHistory, len(history))
+	}
+	for i, e := range history {
+		expected := MaxErrorHistory + 4 - i
+		if e.Cause != fmt.Sprintf("error %d", expected) || !e.Time.Equal(start.Add(time.Duration(expected)*time.Minute)) {
+			t.Errorf("Unexpected error %d in history: %+v", i, e)
+		}
+	}
+}
+
+func TestRotateHookSecret(t *testing.T) {
+	repo := Repo{HookSecret: "old"}
+	rotatedAt := time.Now()
+	repo.RotateHookSecret("new", rotatedAt)
+	if repo.HookSecret != "new" {
+		t.Errorf("Expected the new secret to be current, got %q", repo.HookSecret)
+	}
+
+	secrets := repo.HookSecrets(rotatedAt.Add(time.Minute))
+	if len(secrets) != 2 || secrets[0] != "new" || secrets[1] != "old" {
+		t.Errorf("Expected both secrets to be accepted during the grace period, got %v", secrets)
+	}
+	secrets = repo.HookSecrets(rotatedAt.Add(HookSecretGracePeriod))
+	if len(secrets) != 1 || secrets[0] != "new" {
+		t.Errorf("Expected only the new secret to be accepted after the grace period, got %v", secrets)
+	}
+
+	repo.RevertHookSecret()
+	secrets = repo.HookSecrets(rotatedAt.Add(time.Minute))
+	if len(secrets) != 1 || secrets[0] != "old" {
+		t.Errorf("Expected only the old secret to be accepted after reverting, got %v", secrets)
+	}
+}
+
+func TestHookUnverified(t *testing.T) {
+	repo := Repo{}
+	now := time.Now()
+	if repo.HookUnverified(now) {
+		t.Error("Expected a repo whose hook was never pinged not to be flagged")
+	}
+
+	repo.HookPingRequestedAt = now
+	if repo.HookUnverified(now.Add(time.Minute)) {
+		t.Error("Expected a recently requested ping not to be flagged yet")
+	}
+	if !repo.HookUnverified(now.Add(HookVerifyTimeout)) {
+		t.Error("Expected a ping that was never delivered to be flagged")
+	}
+
+	repo.HookVerified = now.Add(time.Second)
+	if repo.HookUnverified(now.Add(HookVerifyTimeout)) {
+		t.Error("Expected a delivered ping not to be flagged")
+	}
+
+	// A ping that was received before the latest request doesn't count.
+	repo.HookPingRequestedAt = now.Add(time.Hour)
+	if !repo.HookUnverified(now.Add(time.Hour + HookVerifyTimeout)) {
+		t.Error("Expected a later ping that was never delivered to be flagged")
+	}
+}
+
+func TestInitializationStale(t *testing.T) {
+	now := time.Now()
+	repo := Repo{}
+	if !repo.InitializationStale(now) {
+		t.Error("Expected a repo that was never initialized to be stale")
+	}
+
+	repo.InitializeHeartbeat = now.Add(-time.Hour)
+	if repo.InitializationStale(now) {
+		t.Error("Expected a recent heartbeat to keep the initialization live")
+	}
+	if !repo.InitializationStale(now.Add(InitializationStaleTimeout)) {
+		t.Error("Expected an old heartbeat to make the initialization stale")
+	}
+
+	// A requested ping starts a new initialization.
+	repo.HookPingRequestedAt = now
+	if repo.InitializationStale(now.Add(InitializationStaleTimeout - time.Minute)) {
+		t.Error("Expected a recently requested ping to keep the initialization live")
+	}
+}
+
+func TestUpdateToken(t *testing.T) {
+	repo := Repo{Token: "old", Status: StatusError, HookID: 42}
+	repo.RecordError(time.Now(), "Bad credentials")
+	if !repo.UpdateToken("new") {
+		t.Fatal("Expected the token of a repo in error to be updated")
+	}
+	if repo.Token != "new" || repo.Status != StatusValidating || repo.ErrorCause != "" || repo.HookID != 42 {
+		t.Errorf("Unexpected repo after updating its token: %+v", repo)
+	}
+	if len(repo.ErrorHistory()) != 1 {
+		t.Errorf("Expected the error history to be kept, got %v", repo.ErrorHistory())
+	}
+
+	// The repo is now being validated, so the token can't be changed again
+	// until that is done.
+	if repo.UpdateToken("newer") || repo.Token != "new" {
+		t.Errorf("Expected the token of a repo being validated to be left alone, got %q", repo.Token)
+	}
+}
+
+func TestSubscribedEvents(t *testing.T) {
+	r := &Repo{}
+	if events := r.SubscribedEvents(); len(events) != len(DefaultHookEvents)+1 || events[0] != "ping" {
+		t.Errorf("Expected the default events; got %v", events)
+	}
+
+	r.HookEvents = []string{"status"}
+	if events := r.SubscribedEvents(); len(events) != 2 || events[0] != "ping" || events[1] != "status" {
+		t.Errorf("Expected only the status events besides pings; got %v", events)
+	}
+}
+
+func TestCheckHookEvents(t *testing.T) {
+	if err := CheckHookEvents([]string{"status", "issue_comment"}); err != nil {
+		t.Error(err)
+	}
+	for _, events := range [][]string{nil, {"status", "push"}, {"ping"}} {
+		if err := CheckHookEvents(events); err == nil {
+			t.Errorf("Expected the events %v to be rejected", events)
+		}
+	}
+}
+
+// TestModifyRepoConcurrently checks that concurrent modifications of a repo
+// don't overwrite each other. It needs the datastore emulator, e.g. as started
+// by `gcloud beta emulators datastore start`, with DATASTORE_EMULATOR_HOST set.
+func TestModifyRepoConcurrently(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	c, err := datastore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	user, repo := "user", fmt.Sprintf("repo-%d", time.Now().UnixNano())
+	if _, err := c.Put(ctx, RepoKey(user, repo), &Repo{User: user, Repo: repo}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(ctx, RepoKey(user, repo))
+
+	const writers = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ModifyRepo(ctx, c, user, repo, func(item *Repo) {
+				item.LastPRCount++
+			})
+			if err == datastore.ErrConcurrentTransaction {
+				// Too much contention; the modification wasn't applied.
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	result, err := GetRepo(ctx, c, user, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if succeeded == 0 || result.LastPRCount != succeeded {
+		t.Errorf("Expected %d modifications to be applied, got %d", succeeded, result.LastPRCount)
+	}
+}